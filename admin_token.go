@@ -0,0 +1,28 @@
+package ocrworker
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdminTokenHeader carries the token which permits the /admin end points
+const AdminTokenHeader = "X-Admin-Token"
+
+var errAdminNotPermitted = errors.New("the admin end points are not permitted, set the " + AdminTokenHeader + " header")
+
+// hasAdminToken checks the admin token of the request, the admin end points are disabled if no token is configured
+func hasAdminToken(req *http.Request, rabbitConfig *RabbitConfig) bool {
+	return matchesToken(req.Header.Get(AdminTokenHeader), rabbitConfig.AdminToken)
+}
+
+// checkAdminToken answers with 403 and returns false if the request does not carry the admin token
+func checkAdminToken(w http.ResponseWriter, req *http.Request, rabbitConfig *RabbitConfig) bool {
+	if hasAdminToken(req, rabbitConfig) {
+		return true
+	}
+	log.Warn().Str("component", "OCR_HTTP").Str("path", req.URL.Path).Msg("admin request rejected")
+	writeProblem(w, newForbiddenProblem(errAdminNotPermitted, req.URL.Path))
+	return false
+}
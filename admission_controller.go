@@ -0,0 +1,258 @@
+package ocrworker
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// names of the admission controllers which can be chosen with the -admission flag
+const (
+	AdmissionManagementAPI  = "management_api"
+	AdmissionPassiveDeclare = "passive_declare"
+	AdmissionHeartbeat      = "heartbeat"
+	AdmissionStatic         = "static"
+)
+
+// AdmissionController decides if the http daemon has resources to accept new ocr requests
+type AdmissionController interface {
+	Name() string
+	// Admit is called periodically, accepting is the previous decision which allows for hysteresis
+	Admit(accepting bool) AdmissionState
+}
+
+// AdmissionLoad is a sample of the outstanding jobs and the capacity to process them
+type AdmissionLoad struct {
+	Jobs    uint `json:"jobs"`
+	Workers uint `json:"workers"`
+	// MemUsed and MemLimit are the memory of the message broker in bytes, MemLimit is 0 if unknown
+	MemUsed  uint64 `json:"mem_used,omitempty"`
+	MemLimit uint64 `json:"mem_limit,omitempty"`
+}
+
+// AdmissionState is the last decision of the admission controller, it is served at /readyz
+type AdmissionState struct {
+	Controller     string         `json:"controller"`
+	Accepting      bool           `json:"accepting"`
+	TechnicalError bool           `json:"technical_error"`
+	Reason         string         `json:"reason"`
+	Load           *AdmissionLoad `json:"load,omitempty"`
+	Since          time.Time      `json:"since"`
+	CheckedAt      time.Time      `json:"checked_at"`
+}
+
+var (
+	admissionMu    sync.Mutex
+	admissionState = AdmissionState{Reason: "admission has not been checked yet"}
+	// awaitingResults is the number of jobs of this http daemon which are waiting for a worker reply
+	awaitingResults int64
+)
+
+// CurrentAdmissionState returns the last decision of the admission controller
+func CurrentAdmissionState() AdmissionState {
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	return admissionState
+}
+
+// addAwaitingResult counts the jobs which are waiting for a worker reply
+func addAwaitingResult(delta int64) {
+	jobsAwaitingResult.Add(float64(delta))
+	atomic.AddInt64(&awaitingResults, delta)
+}
+
+// NewAdmissionController creates the admission controller configured by rabbitConfig.Admission
+func NewAdmissionController(rabbitConfig *RabbitConfig) (AdmissionController, error) {
+	thresholds := admissionThresholdsFor(rabbitConfig)
+	switch rabbitConfig.Admission {
+	case AdmissionManagementAPI, "":
+		return &thresholdAdmission{name: AdmissionManagementAPI, thresholds: thresholds, sampler: &managementAPISampler{
+			urlQueue: rabbitConfig.AmqpAPIURI + rabbitConfig.APIPathQueue + rabbitConfig.APIQueueName,
+			urlStat:  rabbitConfig.AmqpAPIURI + rabbitConfig.APIPathStats,
+		}}, nil
+	case AdmissionPassiveDeclare:
+		return &thresholdAdmission{name: AdmissionPassiveDeclare, thresholds: thresholds, sampler: &passiveDeclareSampler{
+			amqpURI:   rabbitConfig.AmqpURI,
+			queueName: rabbitConfig.RoutingKey,
+		}}, nil
+	case AdmissionHeartbeat:
+		return &thresholdAdmission{name: AdmissionHeartbeat, thresholds: thresholds, sampler: heartbeatSampler{}}, nil
+	case AdmissionStatic:
+		return staticAdmission{}, nil
+	}
+	return nil, fmt.Errorf("unknown admission controller %q, use one of %s, %s, %s or %s", rabbitConfig.Admission,
+		AdmissionManagementAPI, AdmissionPassiveDeclare, AdmissionHeartbeat, AdmissionStatic)
+}
+
+// admissionThresholds rejects requests as soon as the outstanding jobs reach factor jobs per worker
+// or the broker memory reaches memoryPercent of its limit. Once rejecting, requests are accepted again
+// only after the load has dropped below resumePercent of these limits.
+type admissionThresholds struct {
+	factor        uint
+	memoryPercent uint64
+	resumePercent uint64
+}
+
+func admissionThresholdsFor(rabbitConfig *RabbitConfig) admissionThresholds {
+	return admissionThresholds{
+		factor:        rabbitConfig.FactorForMessageAccept,
+		memoryPercent: uint64(rabbitConfig.MemoryThreshold),
+		resumePercent: uint64(rabbitConfig.AdmissionResume),
+	}
+}
+
+func (t admissionThresholds) decide(accepting bool, load AdmissionLoad) AdmissionState {
+	state := AdmissionState{Load: &load}
+	if load.Workers == 0 {
+		state.TechnicalError = true
+		state.Reason = "no workers are connected"
+		return state
+	}
+
+	jobLimit := load.Workers * t.factor
+	memLimit := load.MemLimit * t.memoryPercent / 100
+	if !accepting {
+		jobLimit = resumeJobLimit(jobLimit, t.resumePercent)
+		memLimit = memLimit * t.resumePercent / 100
+	}
+	switch {
+	case load.Jobs >= jobLimit:
+		state.Reason = fmt.Sprintf("%d outstanding jobs for %d workers, accepting below %d", load.Jobs, load.Workers, jobLimit)
+	case load.MemLimit > 0 && load.MemUsed >= memLimit:
+		state.Reason = fmt.Sprintf("message broker uses %d of %d bytes memory, accepting below %d",
+			load.MemUsed, load.MemLimit, memLimit)
+	default:
+		state.Accepting = true
+		state.Reason = fmt.Sprintf("%d outstanding jobs for %d workers, rejecting from %d",
+			load.Jobs, load.Workers, load.Workers*t.factor)
+	}
+	return state
+}
+
+// resumeJobLimit is resumePercent of the job limit rounded up, at least 1, otherwise a small limit
+// would be truncated to 0 and no load could ever drop below it
+func resumeJobLimit(jobLimit uint, resumePercent uint64) uint {
+	resumeLimit := (uint64(jobLimit)*resumePercent + 99) / 100
+	if resumeLimit < 1 {
+		return 1
+	}
+	return uint(resumeLimit)
+}
+
+// loadSampler measures the load an admissionThresholds decision is based on
+type loadSampler interface {
+	sampleLoad() (AdmissionLoad, error)
+}
+
+// thresholdAdmission decides by thresholds on the load measured by its sampler
+type thresholdAdmission struct {
+	name       string
+	thresholds admissionThresholds
+	sampler    loadSampler
+}
+
+func (a *thresholdAdmission) Name() string {
+	return a.name
+}
+
+func (a *thresholdAdmission) Admit(accepting bool) AdmissionState {
+	load, err := a.sampler.sampleLoad()
+	if err != nil {
+		return AdmissionState{TechnicalError: true, Reason: "unable to measure the load: " + err.Error()}
+	}
+	return a.thresholds.decide(accepting, load)
+}
+
+// passiveDeclareSampler counts the messages and consumers of the ocr queue with a passive queue declare,
+// it only needs AMQP. The declare only counts the ready messages, the unacknowledged ones the workers are
+// processing are taken from their heartbeats.
+type passiveDeclareSampler struct {
+	amqpURI   string
+	queueName string
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+}
+
+func (s *passiveDeclareSampler) sampleLoad() (AdmissionLoad, error) {
+	if s.channel == nil {
+		conn, err := amqp.Dial(s.amqpURI)
+		if err != nil {
+			return AdmissionLoad{}, err
+		}
+		channel, err := conn.Channel()
+		if err != nil {
+			_ = conn.Close()
+			return AdmissionLoad{}, err
+		}
+		s.conn, s.channel = conn, channel
+	}
+
+	queue, err := s.channel.QueueInspect(s.queueName)
+	if err != nil {
+		// the broker closes the channel after a failed declare, reconnect with the next sample
+		_ = s.conn.Close()
+		s.conn, s.channel = nil, nil
+		return AdmissionLoad{}, err
+	}
+	jobsQueued.Set(float64(queue.Messages))
+	queueConsumers.Set(float64(queue.Consumers))
+	return AdmissionLoad{Jobs: uint(queue.Messages + workersRunningJobs()), Workers: uint(queue.Consumers)}, nil
+}
+
+// heartbeatSampler counts the workers by their announcements and the jobs all http daemons are waiting
+// for by their announcements, it needs neither the management API nor a queue declare
+type heartbeatSampler struct{}
+
+func (heartbeatSampler) sampleLoad() (AdmissionLoad, error) {
+	jobs := atomic.LoadInt64(&awaitingResults) + otherReplicasAwaitingResults()
+	if jobs < 0 {
+		jobs = 0
+	}
+	return AdmissionLoad{
+		Jobs:    uint(jobs),
+		Workers: uint(len(liveWorkerAnnouncements())),
+	}, nil
+}
+
+// staticAdmission accepts every request, the load is left to the queue
+type staticAdmission struct{}
+
+func (staticAdmission) Name() string {
+	return AdmissionStatic
+}
+
+func (staticAdmission) Admit(bool) AdmissionState {
+	return AdmissionState{Accepting: true, Reason: "every request is accepted"}
+}
+
+// checkAdmission asks the controller for a new decision and publishes it
+func checkAdmission(controller AdmissionController) AdmissionState {
+	previous := CurrentAdmissionState()
+	state := controller.Admit(previous.Accepting)
+	state.Controller = controller.Name()
+	state.CheckedAt = time.Now()
+	state.Since = previous.Since
+	if state.Accepting != previous.Accepting || previous.Since.IsZero() {
+		state.Since = state.CheckedAt
+		logger := log.Info().Str("component", "OCR_RESMAN").Str("controller", state.Controller).
+			Interface("load", state.Load).Str("reason", state.Reason)
+		if state.Accepting {
+			logger.Msg("open-ocr is operational with free resources, we are ready to serve")
+		} else {
+			logger.Msg("open-ocr is alive but won't serve any requests; workers are busy or not connected")
+		}
+	}
+
+	admissionMu.Lock()
+	admissionState = state
+	admissionMu.Unlock()
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = state.Accepting
+	TechnicalErrorResManager = state.TechnicalError
+	ServiceCanAcceptMu.Unlock()
+	return state
+}
@@ -0,0 +1,132 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestAdmissionThresholdsHysteresis(t *testing.T) {
+	thresholds := admissionThresholds{factor: 10, memoryPercent: 95, resumePercent: 80}
+
+	assert.True(t, thresholds.decide(true, AdmissionLoad{Jobs: 19, Workers: 2}).Accepting)
+	// jobs published by other http daemons count as well
+	state := thresholds.decide(true, AdmissionLoad{Jobs: 20, Workers: 2})
+	assert.False(t, state.Accepting)
+	assert.False(t, state.TechnicalError)
+
+	// once rejecting, the load has to drop below 80% of the limit
+	assert.False(t, thresholds.decide(false, AdmissionLoad{Jobs: 16, Workers: 2}).Accepting)
+	assert.True(t, thresholds.decide(false, AdmissionLoad{Jobs: 15, Workers: 2}).Accepting)
+
+	assert.False(t, thresholds.decide(true, AdmissionLoad{Workers: 2, MemUsed: 95, MemLimit: 100}).Accepting)
+	assert.False(t, thresholds.decide(false, AdmissionLoad{Workers: 2, MemUsed: 80, MemLimit: 100}).Accepting)
+	assert.True(t, thresholds.decide(false, AdmissionLoad{Workers: 2, MemUsed: 75, MemLimit: 100}).Accepting)
+
+	state = thresholds.decide(true, AdmissionLoad{})
+	assert.False(t, state.Accepting)
+	assert.True(t, state.TechnicalError)
+}
+
+func TestAdmissionThresholdsSmallLimits(t *testing.T) {
+	tests := []struct {
+		factor        uint
+		workers       uint
+		resumePercent uint64
+		jobs          uint
+		accepting     bool
+	}{
+		// the resume limit of a single job is rounded up to 1
+		{factor: 1, workers: 1, resumePercent: 80, jobs: 1, accepting: false},
+		{factor: 1, workers: 1, resumePercent: 80, jobs: 0, accepting: true},
+		{factor: 1, workers: 1, resumePercent: 0, jobs: 0, accepting: true},
+		// 80% of 3 jobs is 2.4, rounded up to 3
+		{factor: 3, workers: 1, resumePercent: 80, jobs: 3, accepting: false},
+		{factor: 3, workers: 1, resumePercent: 80, jobs: 2, accepting: true},
+		{factor: 1, workers: 2, resumePercent: 50, jobs: 1, accepting: false},
+		{factor: 1, workers: 2, resumePercent: 50, jobs: 0, accepting: true},
+	}
+	for _, test := range tests {
+		thresholds := admissionThresholds{factor: test.factor, memoryPercent: 95, resumePercent: test.resumePercent}
+		state := thresholds.decide(false, AdmissionLoad{Jobs: test.jobs, Workers: test.workers})
+		assert.Equals(t, state.Accepting, test.accepting)
+	}
+}
+
+func TestNewAdmissionController(t *testing.T) {
+	rabbitConfig := rabbitConfigForTests()
+	for _, name := range []string{AdmissionManagementAPI, AdmissionPassiveDeclare, AdmissionHeartbeat, AdmissionStatic} {
+		rabbitConfig.Admission = name
+		controller, err := NewAdmissionController(&rabbitConfig)
+		assert.True(t, err == nil)
+		assert.Equals(t, controller.Name(), name)
+	}
+
+	rabbitConfig.Admission = "unknown"
+	_, err := NewAdmissionController(&rabbitConfig)
+	assert.True(t, err != nil)
+}
+
+func TestHeartbeatSamplerReplicas(t *testing.T) {
+	resetWorkerRegistry()
+	defer resetWorkerRegistry()
+	registerWorkerAnnouncement(WorkerAnnouncement{Tag: "worker-a", RequestIDs: []string{"req1", "req2"}})
+	registerWorkerAnnouncement(WorkerAnnouncement{Tag: "worker-b", RequestIDs: []string{"req3"}})
+	// the own heartbeat is replaced by the live counter, the one of a replica which is gone is dropped
+	registerReplicaAnnouncement(ReplicaAnnouncement{Tag: tag, AwaitingResults: 5})
+	registerReplicaAnnouncement(ReplicaAnnouncement{Tag: "replica-b", AwaitingResults: 4})
+	registerReplicaAnnouncement(ReplicaAnnouncement{Tag: "replica-c", AwaitingResults: 3})
+	workerRegistryMu.Lock()
+	gone := replicaRegistry["replica-c"]
+	gone.Time = time.Now().Add(-4 * announceInterval)
+	replicaRegistry["replica-c"] = gone
+	workerRegistryMu.Unlock()
+
+	addAwaitingResult(2)
+	defer addAwaitingResult(-2)
+	load, err := heartbeatSampler{}.sampleLoad()
+	assert.True(t, err == nil)
+	assert.Equals(t, load.Jobs, uint(2+4))
+	assert.Equals(t, load.Workers, uint(2))
+	assert.Equals(t, workersRunningJobs(), 3)
+
+	// with a worker factor of 3 the replicas together are at the limit, each one alone would not be
+	state := admissionThresholds{factor: 3, resumePercent: 50}.decide(true, load)
+	assert.False(t, state.Accepting)
+}
+
+func TestOcrHttpReadyHandler(t *testing.T) {
+	defer func(state AdmissionState) {
+		admissionMu.Lock()
+		admissionState = state
+		admissionMu.Unlock()
+	}(CurrentAdmissionState())
+
+	resetWorkerRegistry()
+	rabbitConfig := rabbitConfigForTests()
+	rabbitConfig.Admission = AdmissionHeartbeat
+	controller, err := NewAdmissionController(&rabbitConfig)
+	assert.True(t, err == nil)
+	checkAdmission(controller)
+
+	recorder := httptest.NewRecorder()
+	NewOcrHttpReadyHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equals(t, recorder.Code, http.StatusServiceUnavailable)
+	state := AdmissionState{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &state) == nil)
+	assert.Equals(t, state.Controller, AdmissionHeartbeat)
+	assert.Equals(t, state.Reason, "no workers are connected")
+
+	checkAdmission(staticAdmission{})
+	recorder = httptest.NewRecorder()
+	NewOcrHttpReadyHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = true
+	ServiceCanAcceptMu.Unlock()
+}
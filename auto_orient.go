@@ -0,0 +1,132 @@
+package ocrworker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// autoOrientMinConfidence is the minimal orientation confidence reported by tesseract
+// for the page to be rotated; below it the page stays as it is
+var autoOrientMinConfidence = 2.0
+
+// PageOrientation is the result of the orientation and script detection for a single page
+type PageOrientation struct {
+	Page int `json:"page"`
+	OsdResult
+	// Applied is set if the page was rotated before recognition
+	Applied bool `json:"applied"`
+}
+
+func newPageOrientation(page int, osd OsdResult) PageOrientation {
+	return PageOrientation{
+		Page:      page,
+		OsdResult: osd,
+		Applied:   osd.Rotate%360 != 0 && osd.OrientationConfidence >= autoOrientMinConfidence,
+	}
+}
+
+// autoOrientImage detects the orientation of an image and writes a rotated copy if needed.
+// It returns the file which should be used for the recognition.
+func autoOrientImage(ctx context.Context, inputFilename string) (string, PageOrientation, error) {
+	osd, err := detectOrientationAndScript(ctx, inputFilename)
+	if err != nil {
+		return inputFilename, PageOrientation{}, err
+	}
+	orientation := newPageOrientation(1, osd)
+	if !orientation.Applied {
+		return inputFilename, orientation, nil
+	}
+
+	rotatedFilename := inputFilename + "_rot" + filepath.Ext(inputFilename)
+	output, err := runCommand(ctx, exec.Command("convert", inputFilename, "-rotate", strconv.Itoa(osd.Rotate), rotatedFilename))
+	if err != nil {
+		return inputFilename, orientation, fmt.Errorf("rotating image failed: %v: %s", err, string(output))
+	}
+	log.Info().Str("component", "OCR_AUTOORIENT").Int("rotate", osd.Rotate).
+		Float64("confidence", osd.OrientationConfidence).Msg("image was rotated")
+	return rotatedFilename, orientation, nil
+}
+
+// pdftkRotation maps the clockwise rotation in degrees to the relative rotation keywords of pdftk
+var pdftkRotation = map[int]string{90: "right", 180: "down", 270: "left"}
+
+// autoOrientPdf rasterizes every page of the pdf, detects its orientation and rotates
+// the pages which need it with pdftk. It returns the file which should be used for the recognition.
+func autoOrientPdf(ctx context.Context, inputFilename string) (string, []PageOrientation, error) {
+	pageImages, cleanup, err := rasterizePdfPages(ctx, inputFilename)
+	defer cleanup()
+	if err != nil {
+		return inputFilename, nil, err
+	}
+
+	orientations := make([]PageOrientation, 0, len(pageImages))
+	catArgs := []string{inputFilename, "cat"}
+	rotationNeeded := false
+	for i, pageImage := range pageImages {
+		osd, err := detectOrientationAndScript(ctx, pageImage)
+		if err != nil {
+			// pages without enough text (e.g. blank pages) can not be detected, keep them as they are
+			log.Info().Str("component", "OCR_AUTOORIENT").Int("page", i+1).Err(err).
+				Msg("orientation of page could not be detected")
+			osd = OsdResult{}
+		}
+		orientation := newPageOrientation(i+1, osd)
+		orientations = append(orientations, orientation)
+		pageSpec := strconv.Itoa(i + 1)
+		if orientation.Applied {
+			pageSpec += pdftkRotation[osd.Rotate%360]
+			rotationNeeded = true
+		}
+		catArgs = append(catArgs, pageSpec)
+	}
+	if !rotationNeeded {
+		return inputFilename, orientations, nil
+	}
+
+	rotatedFilename := strings.TrimSuffix(inputFilename, filepath.Ext(inputFilename)) + "_rot.pdf"
+	catArgs = append(catArgs, "output", rotatedFilename)
+	output, err := runCommand(ctx, exec.Command("pdftk", catArgs...))
+	if err != nil {
+		return inputFilename, orientations, fmt.Errorf("rotating pdf pages failed: %v: %s", err, string(output))
+	}
+	log.Info().Str("component", "OCR_AUTOORIENT").Interface("pdftk_args", catArgs).Msg("pdf pages were rotated")
+	return rotatedFilename, orientations, nil
+}
+
+// rasterizePdfPages renders every page of a pdf into a png file next to it, the returned cleanup function removes them
+func rasterizePdfPages(ctx context.Context, inputFilename string) ([]string, func(), error) {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(inputFilename), "osd")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+
+	output, err := runCommand(ctx, exec.Command("gs",
+		"-dQUIET",
+		"-dNOPAUSE",
+		"-dBATCH",
+		"-sDEVICE=pnggray",
+		"-r150",
+		"-sOutputFile="+filepath.Join(tmpDir, "page_%05d.png"),
+		inputFilename,
+	))
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("rasterizing pdf failed: %v: %s", err, string(output))
+	}
+
+	pageImages, err := filepath.Glob(filepath.Join(tmpDir, "page_*.png"))
+	if err != nil {
+		return nil, cleanup, err
+	}
+	sort.Strings(pageImages)
+	return pageImages, cleanup, nil
+}
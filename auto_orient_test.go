@@ -0,0 +1,47 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestNewPageOrientation(t *testing.T) {
+
+	orientation := newPageOrientation(2, OsdResult{Orientation: 270, Rotate: 90, OrientationConfidence: 21.27, Script: "Latin"})
+	assert.True(t, orientation.Applied)
+	assert.Equals(t, pdftkRotation[orientation.Rotate], "right")
+
+	orientation = newPageOrientation(1, OsdResult{Rotate: 180, OrientationConfidence: 0.5})
+	assert.False(t, orientation.Applied)
+
+	orientation = newPageOrientation(1, OsdResult{Rotate: 0, OrientationConfidence: 30})
+	assert.False(t, orientation.Applied)
+
+	js, err := json.Marshal(OcrResult{Status: "done", Orientation: []PageOrientation{orientation}})
+	assert.True(t, err == nil)
+	result := map[string]interface{}{}
+	assert.True(t, json.Unmarshal(js, &result) == nil)
+	pages := result["orientation"].([]interface{})
+	assert.Equals(t, pages[0].(map[string]interface{})["orientation_confidence"], 30.0)
+
+}
+
+func TestValidateAutoOrient(t *testing.T) {
+
+	rabbitConfig := rabbitConfigForTests()
+	ocrRequest := OcrRequest{
+		ImgUrl:     "http://localhost/img",
+		EngineType: EngineTesseract,
+		EngineArgs: map[string]interface{}{"auto_orient": true},
+	}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	ocrRequest.EngineArgs["auto_orient"] = "yes"
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) != nil)
+
+	ocrRequest.EngineType = EngineSandwichTesseract
+	ocrRequest.EngineArgs = map[string]interface{}{"ocr_type": "txt", "auto_orient": true}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+
+}
@@ -0,0 +1,381 @@
+package ocrworker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BlobStore keeps documents and intermediates out of band, the messages only carry a BlobRef to them
+type BlobStore interface {
+	// Put stores data under key and returns the uri of the blob
+	Put(ctx context.Context, key string, data []byte) (string, error)
+	// PutFile stores the content of the file at path under key without reading it into memory
+	PutFile(ctx context.Context, key, path string) (string, error)
+	Get(ctx context.Context, uri string) ([]byte, error)
+	Delete(ctx context.Context, uri string) error
+}
+
+// BlobRef points to a document in the blob store, Size and SHA256 are checked after the download
+type BlobRef struct {
+	URI    string `json:"uri"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+var errNoBlobStore = errors.New("the request references a blob but no blob store is configured")
+
+// blobHTTPClient is used for all requests to S3 compatible blob stores
+var blobHTTPClient = &http.Client{Timeout: 5 * time.Minute}
+
+// NewBlobStore creates the blob store of storeURI, it is nil if storeURI is empty.
+// Supported are file:///shared/volume and s3://access:secret@host:port/bucket?region=us-east-1,
+// s3+http:// talks plain http to the S3 endpoint.
+func NewBlobStore(storeURI string) (BlobStore, error) {
+	if storeURI == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(storeURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob store: %w", err)
+	}
+	switch parsed.Scheme {
+	case "file":
+		if parsed.Path == "" {
+			return nil, fmt.Errorf("the file blob store needs an absolute path, e.g. file:///var/lib/open-ocr")
+		}
+		return &fileBlobStore{root: filepath.Clean(filepath.FromSlash(parsed.Path))}, nil
+	case "s3", "s3+http":
+		return newS3BlobStore(parsed)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q, use file:// or s3://", parsed.Scheme)
+	}
+}
+
+// offloadImage moves the document into the blob store if it is bigger than threshold bytes.
+// If the upload fails the document stays in the message.
+func (ocrRequest *OcrRequest) offloadImage(ctx context.Context, store BlobStore, threshold int64, key string) {
+	if store == nil || int64(len(ocrRequest.ImgBytes)) <= threshold {
+		return
+	}
+	checksum := sha256.Sum256(ocrRequest.ImgBytes)
+	uri, err := store.Put(ctx, key, ocrRequest.ImgBytes)
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_BLOB").Str("RequestID", ocrRequest.RequestID).
+			Msg("could not upload the document, sending it inline")
+		return
+	}
+	ocrRequest.ImgBlob = &BlobRef{URI: uri, SHA256: hex.EncodeToString(checksum[:]), Size: len(ocrRequest.ImgBytes)}
+	ocrRequest.ImgBytes = nil
+}
+
+// offloadUpload moves an uploaded document from its file into the blob store if it is bigger than threshold
+// bytes, otherwise or if the upload fails the file is read into the message
+func (ocrRequest *OcrRequest) offloadUpload(ctx context.Context, store BlobStore, threshold int64, key string) error {
+	upload := ocrRequest.upload
+	if store != nil && upload.size > threshold {
+		uri, err := store.PutFile(ctx, key, upload.path)
+		if err == nil {
+			ocrRequest.ImgBlob = &BlobRef{URI: uri, SHA256: upload.sha256, Size: int(upload.size)}
+			return nil
+		}
+		log.Warn().Err(err).Str("component", "OCR_BLOB").Str("RequestID", ocrRequest.RequestID).
+			Msg("could not upload the document, sending it inline")
+	}
+	return ocrRequest.readUpload()
+}
+
+// fetchImage downloads the document referenced by ImgBlob into ImgBytes and returns the reference,
+// the caller deletes the blob once the request was handed over. It is nil if the document was inline.
+func (ocrRequest *OcrRequest) fetchImage(ctx context.Context, store BlobStore) (*BlobRef, error) {
+	blob := ocrRequest.ImgBlob
+	if blob == nil {
+		return nil, nil
+	}
+	if store == nil {
+		return nil, errNoBlobStore
+	}
+	data, err := store.Get(ctx, blob.URI)
+	if err != nil {
+		return nil, fmt.Errorf("could not download %s: %w", blob.URI, err)
+	}
+	checksum := sha256.Sum256(data)
+	if len(data) != blob.Size || hex.EncodeToString(checksum[:]) != blob.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch of %s", blob.URI)
+	}
+	ocrRequest.ImgBytes = data
+	ocrRequest.ImgBlob = nil
+	return blob, nil
+}
+
+// deleteBlob removes a blob which is not needed anymore, failures are only logged
+func deleteBlob(ctx context.Context, store BlobStore, blob *BlobRef, component string) {
+	if store == nil || blob == nil {
+		return
+	}
+	if err := store.Delete(ctx, blob.URI); err != nil {
+		log.Warn().Err(err).Str("component", component).Str("uri", blob.URI).Msg("could not delete blob")
+	}
+}
+
+// fileBlobStore keeps the blobs on a volume which is mounted at the same path on every host
+type fileBlobStore struct {
+	root string
+}
+
+func (s *fileBlobStore) Put(_ context.Context, key string, data []byte) (string, error) {
+	return s.write(key, bytes.NewReader(data))
+}
+
+func (s *fileBlobStore) PutFile(_ context.Context, key, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return s.write(key, file)
+}
+
+// write copies the blob to a temporary file first, readers never see a partially written blob
+func (s *fileBlobStore) write(key string, data io.Reader) (string, error) {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, s.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+// path returns the file of uri, blobs outside of the root are rejected
+func (s *fileBlobStore) path(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Clean(filepath.FromSlash(parsed.Path))
+	if parsed.Scheme != "file" || !strings.HasPrefix(path, s.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not part of the blob store", uri)
+	}
+	return path, nil
+}
+
+func (s *fileBlobStore) Get(_ context.Context, uri string) ([]byte, error) {
+	path, err := s.path(uri)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (s *fileBlobStore) Delete(_ context.Context, uri string) error {
+	path, err := s.path(uri)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the directory of the request is removed with its last blob
+	_ = os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// s3BlobStore keeps the blobs in a bucket of an S3 compatible store like MinIO, requests are path style
+type s3BlobStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func newS3BlobStore(storeURL *url.URL) (*s3BlobStore, error) {
+	store := &s3BlobStore{
+		endpoint:  "https://" + storeURL.Host,
+		bucket:    strings.Trim(storeURL.Path, "/"),
+		region:    storeURL.Query().Get("region"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if storeURL.Scheme == "s3+http" {
+		store.endpoint = "http://" + storeURL.Host
+	}
+	if storeURL.User != nil {
+		store.accessKey = storeURL.User.Username()
+		store.secretKey, _ = storeURL.User.Password()
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if storeURL.Host == "" || store.bucket == "" || strings.Contains(store.bucket, "/") {
+		return nil, fmt.Errorf("the s3 blob store needs a host and a bucket, e.g. s3://minio:9000/open-ocr")
+	}
+	return store, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, data []byte) (string, error) {
+	if _, err := s.do(ctx, http.MethodPut, key, data); err != nil {
+		return "", err
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+// PutFile hashes the file first, the signature covers the payload which is then streamed from the file
+func (s *s3BlobStore) PutFile(ctx context.Context, key, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.send(ctx, http.MethodPut, key, file, size, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return "", err
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+// key returns the object key of uri, blobs of other buckets are rejected
+func (s *s3BlobStore) key(uri string) (string, error) {
+	key := strings.TrimPrefix(uri, "s3://"+s.bucket+"/")
+	if key == uri || key == "" {
+		return "", fmt.Errorf("%s is not part of the blob store", uri)
+	}
+	return key, nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, uri string) ([]byte, error) {
+	key, err := s.key(uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(ctx, http.MethodGet, key, nil)
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, uri string) error {
+	key, err := s.key(uri)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, http.MethodDelete, key, nil)
+	return err
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	payloadHash := sha256.Sum256(body)
+	return s.send(ctx, method, key, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]))
+}
+
+// send sends a request with a body of size bytes whose sha256 is payloadHash
+func (s *s3BlobStore) send(ctx context.Context, method, key string, body io.Reader, size int64, payloadHash string) ([]byte, error) {
+	objectPath := "/" + s.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+(&url.URL{Path: objectPath}).EscapedPath(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	s.sign(req, payloadHash, time.Now().UTC())
+	resp, err := blobHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, objectPath, resp.Status)
+	}
+	return data, nil
+}
+
+// sign adds an AWS signature version 4 to the request
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.accessKey == "" {
+		return
+	}
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": req.Header.Get("x-amz-content-sha256"),
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -16,6 +18,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/ublast/open-ocr"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // This assumes that there is a worker running
@@ -39,9 +42,10 @@ func handleIndex(writer http.ResponseWriter, _ *http.Request) {
 	writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 	ocrworker.ServiceCanAcceptMu.Lock()
 	appStopLocal = ocrworker.AppStop
+	technicalError := ocrworker.TechnicalErrorResManager
 	ocrworker.ServiceCanAcceptMu.Unlock()
-	text := ocrworker.GenerateLandingPage(appStopLocal, ocrworker.TechnicalErrorResManager)
-	_, _ = fmt.Fprintf(writer, text)
+	text := ocrworker.GenerateLandingPage(appStopLocal, technicalError, ocrworker.LiveWorkers())
+	_, _ = fmt.Fprint(writer, text)
 }
 
 func makeServerFromMux(mux *http.ServeMux) *http.Server {
@@ -50,7 +54,10 @@ func makeServerFromMux(mux *http.ServeMux) *http.Server {
 		ReadHeaderTimeout: 60 * time.Second,
 		WriteTimeout:      60 * time.Second,
 		IdleTimeout:       120 * time.Second,
-		Handler:           mux,
+		// the event streams of /v2/jobs/{id}/events lift the WriteTimeout for their connection
+		ConnContext: ocrworker.WithConn,
+		// every request gets a server span which continues the trace context sent by the client
+		Handler: otelhttp.NewHandler(mux, "open-ocr-httpd"),
 	}
 }
 
@@ -59,8 +66,22 @@ func makeHTTPServer(rabbitConfig *ocrworker.RabbitConfig, ocrChain http.Handler)
 	mux.HandleFunc("/", handleIndex)
 	mux.Handle("/ocr", ocrChain)
 	mux.Handle("/ocr-file-upload", ocrworker.NewOcrHttpMultipartHandler(rabbitConfig))
+	// api end points for submitting batches, getting their progress and downloading the results
+	ocrBatchHandler := ocrworker.NewOcrHttpBatchHandler(rabbitConfig)
+	mux.Handle("/ocr-batch", ocrBatchHandler)
+	mux.Handle("/ocr-batch/", ocrBatchHandler)
 	// api end point for getting orc request status
 	mux.Handle("/ocr-status", ocrworker.NewOcrHttpStatusHandler())
+	// api end point for getting the languages installed on the live workers
+	mux.Handle("/languages", ocrworker.NewOcrHttpLanguagesHandler())
+	// api end point listing the live workers and what they are processing
+	mux.Handle("/admin/workers", ocrworker.NewOcrHttpWorkersHandler(rabbitConfig))
+	// api end point for reloading the configuration, like SIGHUP
+	mux.Handle("/admin/reload", ocrworker.NewOcrHttpReloadHandler(rabbitConfig))
+	// api end points for downloading the debug bundle of a job and following the progress of a deferred job
+	mux.Handle("/v2/jobs/", ocrworker.NewOcrHttpJobsHandler(rabbitConfig))
+	// api end point explaining whether new requests are accepted
+	mux.Handle("/readyz", ocrworker.NewOcrHttpReadyHandler())
 	// expose metrics for prometheus
 	mux.Handle("/metrics", promhttp.Handler())
 
@@ -83,6 +104,16 @@ func main() {
 		log.Fatal()
 	}*/
 
+	// reload the configuration on SIGHUP, running requests keep the settings they started with
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			log.Info().Str("component", "OCR_HTTP").Msg("Caught SIGHUP, reloading the configuration")
+			_, _ = ocrworker.ReloadConfig()
+		}
+	}()
+
 	go func() {
 		select {
 		case sig := <-signals:
@@ -105,6 +136,7 @@ func main() {
 	}()
 
 	var httpPort uint
+	var grpcPort uint
 	var debug bool
 	var flgVersion bool
 	var useHttps bool
@@ -117,6 +149,12 @@ func main() {
 			8080,
 			"The http port to listen on, eg, 8081",
 		)
+		flag.UintVar(
+			&grpcPort,
+			"grpc_port",
+			0,
+			"The port of the gRPC api, eg, 9090. 0 disables it",
+		)
 		flag.BoolVar(
 			&debug,
 			"debug",
@@ -164,6 +202,16 @@ func main() {
 	rabbitConfigTemp.AmqpURI = ocrworker.StripPasswordFromUrl(urlTmp)
 	log.Info().Interface("parameters", rabbitConfigTemp).Msg("trying to start with parameters")
 
+	shutdownTracing, err := ocrworker.InitTracing("open-ocr-httpd", rabbitConfig.TraceExporter)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "OCR_HTTP").Msg("could not initialize tracing")
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	if err := ocrworker.SetupResultCache(&rabbitConfig); err != nil {
+		log.Fatal().Err(err).Str("component", "OCR_HTTP").Msg("could not set up the result cache")
+	}
+
 	ocrChain := ocrworker.InstrumentHttpStatusHandler(ocrworker.NewOcrHttpHandler(&rabbitConfig))
 	listenAddr := fmt.Sprintf(":%d", httpPort)
 
@@ -171,8 +219,24 @@ func main() {
 	go func() {
 		ocrworker.SetResManagerState(&rabbitConfig)
 	}()
+	// collect the capabilities the workers are announcing
+	go ocrworker.RunWorkerRegistry(&rabbitConfig)
 	log.Info().Str("component", "OCR_HTTP").Str("listenAddr", listenAddr).Msg("Starting listener...")
 
+	if grpcPort != 0 {
+		grpcAddr := fmt.Sprintf(":%d", grpcPort)
+		grpcListener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "OCR_GRPC").Msg("could not listen on the gRPC port")
+		}
+		log.Info().Str("component", "OCR_GRPC").Str("listenAddr", grpcAddr).Msg("Starting gRPC listener...")
+		go func() {
+			if err := ocrworker.NewOcrGrpcServer(&rabbitConfig).Serve(grpcListener); err != nil {
+				log.Fatal().Err(err).Str("component", "OCR_GRPC").Msg("the gRPC server has failed")
+			}
+		}()
+	}
+
 	if useHttps {
 		if certFile == "" || keyFile == "" {
 			log.Fatal().Msg("usehttp flag only makes sense if both the private key and a certificate are available")
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"time"
 
 	"github.com/ublast/open-ocr"
 )
@@ -19,6 +24,11 @@ func init() {
 func main() {
 
 	var preprocessor string
+	var httpPort uint
+	var shutdownGrace uint
+	var workDir string
+	var workDirMaxAge uint
+	var workDirQuotaMB uint
 	flagFunc := func() {
 		flag.StringVar(
 			&preprocessor,
@@ -26,18 +36,63 @@ func main() {
 			"identity",
 			"The preprocessor to use, eg, stroke-width-transform",
 		)
+		flag.UintVar(
+			&httpPort,
+			"http_port",
+			8090,
+			"port of the http listener serving /metrics, /healthz and /readyz, 0 disables the listener",
+		)
+		flag.UintVar(
+			&shutdownGrace,
+			"shutdown_grace",
+			25,
+			"seconds the running job may take to finish after SIGTERM, afterwards it is aborted and requeued",
+		)
+		flag.StringVar(
+			&workDir,
+			"work_dir",
+			"",
+			"root of the per job working directories, defaults to open-ocr in the temp directory",
+		)
+		flag.UintVar(
+			&workDirMaxAge,
+			"work_dir_max_age",
+			86400,
+			"seconds after which left over job directories are purged, 0 keeps them",
+		)
+		flag.UintVar(
+			&workDirQuotaMB,
+			"work_dir_quota_mb",
+			0,
+			"megabytes the left over job directories may use, the oldest are purged first. 0 means no limit",
+		)
 
 	}
 
 	rabbitConfig := ocrworker.DefaultConfigFlagsOverride(flagFunc)
 
+	shutdownTracing, err := ocrworker.InitTracing("open-ocr-preprocessor-"+preprocessor, rabbitConfig.TraceExporter)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("could not initialize tracing")
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	// metrics and health checks
+	go ocrworker.ServeWorkerHttp(httpPort)
+	ocrworker.StartWorkDirJanitor(workDir, time.Duration(workDirMaxAge)*time.Second, int64(workDirQuotaMB)<<20)
+
+	// SIGTERM stops consuming, the running job gets shutdown_grace seconds to finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
 	// inifinite loop, since sometimes worker <-> rabbitmq connection
 	// gets broken.  see https://github.com/tleyden/open-ocr/issues/4
 	for {
 		log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("creating new preprocessor worker")
 		preprocessorWorker, err := ocrworker.NewPreprocessorRpcWorker(
-			rabbitConfig,
+			&rabbitConfig,
 			preprocessor,
+			workDir,
 		)
 		if err != nil {
 			log.Panic().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("could not create rpc worker")
@@ -47,9 +102,21 @@ func main() {
 			log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
 		}
 
-		// this happens when connection is closed
-		err = <-preprocessorWorker.Done
-		log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
+		select {
+		case err = <-preprocessorWorker.Done:
+			// this happens when connection is closed
+			log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
+		case sig := <-signals:
+			log.Info().Str("component", "MAIN_PREPROSSOR").Str("signal", sig.String()).
+				Uint("shutdown_grace", shutdownGrace).
+				Msg("shutting down")
+			err = preprocessorWorker.Shutdown(time.Duration(shutdownGrace) * time.Second)
+			if err != nil {
+				log.Warn().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("shutdown was not clean")
+			}
+			_ = shutdownTracing(context.Background())
+			os.Exit(ocrworker.ShutdownExitCode(err))
+		}
 	}
 
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"net/url"
-	// _ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	// _ "net/http/pprof"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -43,6 +47,21 @@ func main() {
 
 	log.Info().Interface("workerConfig", workerConfigToLog).Msg("worker started with this parameters")
 
+	shutdownTracing, err := ocrworker.InitTracing("open-ocr-worker", workerConfig.TraceExporter)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "OCR_WORKER").Msg("could not initialize tracing")
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	// metrics and health checks
+	go ocrworker.ServeWorkerHttp(workerConfig.HttpPort)
+	ocrworker.StartWorkDirJanitor(workerConfig.WorkDir, time.Duration(workerConfig.WorkDirMaxAge)*time.Second,
+		int64(workerConfig.WorkDirQuotaMB)<<20)
+
+	// SIGTERM stops consuming, the running jobs get shutdown_grace seconds to finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
 	// infinite loop, since sometimes worker <-> rabbitmq connection
 	// gets broken.  see https://github.com/tleyden/open-ocr/issues/4
 	for {
@@ -61,11 +80,23 @@ func main() {
 				Msgf("Error running worker: %v", err)
 		}
 
-		// this happens when connection is closed
-		err = <-ocrWorker.Done
-		log.Error().
-			Str("component", "OCR_WORKER").Err(err).
-			Msg("OCR Worker failed with error")
+		select {
+		case err = <-ocrWorker.Done:
+			// this happens when connection is closed
+			log.Error().
+				Str("component", "OCR_WORKER").Err(err).
+				Msg("OCR Worker failed with error")
+		case sig := <-signals:
+			log.Info().Str("component", "OCR_WORKER").Str("signal", sig.String()).
+				Uint("shutdown_grace", workerConfig.ShutdownGrace).
+				Msg("shutting down")
+			err = ocrWorker.Shutdown(time.Duration(workerConfig.ShutdownGrace) * time.Second)
+			if err != nil {
+				log.Warn().Str("component", "OCR_WORKER").Err(err).Msg("shutdown was not clean")
+			}
+			_ = shutdownTracing(context.Background())
+			os.Exit(ocrworker.ShutdownExitCode(err))
+		}
 	}
 
 }
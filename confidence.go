@@ -0,0 +1,214 @@
+package ocrworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatusNeedsReview is the status of results below the confidence thresholds, if -confidence_review is set
+const StatusNeedsReview = "needs_review"
+
+// PageConfidence is the mean confidence of the words tesseract recognized on a page, from 0 to 100
+type PageConfidence struct {
+	Page       int     `json:"page"`
+	Confidence float64 `json:"confidence"`
+	Words      int     `json:"words"`
+	// LowConfidence is set by the http daemon for pages with words below min_page_confidence
+	LowConfidence bool `json:"low_confidence,omitempty"`
+}
+
+// parseTesseractTSV computes the mean word confidence of every page and of the whole document from the
+// tsv output of tesseract. The document confidence is nil if no words were recognized.
+func parseTesseractTSV(tsv []byte) ([]PageConfidence, *float64, error) {
+	var pages []PageConfidence
+	pageIndex := make(map[int]int)
+	var total float64
+	var words int
+	for i, line := range strings.Split(string(tsv), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "level\t") {
+			continue
+		}
+		// level page_num block_num par_num line_num word_num left top width height conf text
+		fields := strings.Split(line, "\t")
+		if len(fields) < 11 {
+			return nil, nil, fmt.Errorf("malformed tsv line %d", i+1)
+		}
+		level, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed tsv line %d: %w", i+1, err)
+		}
+		pageNum, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed tsv line %d: %w", i+1, err)
+		}
+		index, ok := pageIndex[pageNum]
+		if !ok {
+			index = len(pages)
+			pageIndex[pageNum] = index
+			pages = append(pages, PageConfidence{Page: pageNum})
+		}
+		if level != 5 || len(fields) < 12 || strings.TrimSpace(fields[11]) == "" {
+			continue
+		}
+		conf, err := strconv.ParseFloat(fields[10], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed tsv line %d: %w", i+1, err)
+		}
+		// words without a confidence are -1
+		if conf < 0 {
+			continue
+		}
+		pages[index].Confidence += conf
+		pages[index].Words++
+		total += conf
+		words++
+	}
+	for i := range pages {
+		if pages[i].Words > 0 {
+			pages[i].Confidence = roundConfidence(pages[i].Confidence / float64(pages[i].Words))
+		}
+	}
+	if words == 0 {
+		return pages, nil, nil
+	}
+	confidence := roundConfidence(total / float64(words))
+	return pages, &confidence, nil
+}
+
+func roundConfidence(confidence float64) float64 {
+	return math.Round(confidence*100) / 100
+}
+
+// tsvPageNumber is the last number in the name of a tsv file of pdfsandwich, it numbers the files of the pages
+// like the pages in its messages
+var tsvPageNumber = regexp.MustCompile(`(\d+)\D*$`)
+
+// sandwichTSVFiles finds the tsv files tesseract wrote into the temporary directory of pdfsandwich by page
+func sandwichTSVFiles(dir string) (map[int]string, error) {
+	files := make(map[int]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".tsv" {
+			return err
+		}
+		match := tsvPageNumber.FindStringSubmatch(strings.TrimSuffix(filepath.Base(path), ".tsv"))
+		if match == nil {
+			return nil
+		}
+		page, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil
+		}
+		files[page] = path
+		return nil
+	})
+	return files, err
+}
+
+// sandwichConfidence computes the confidence of a pdfsandwich run from the tsv files its tesseract runs left
+// in dir, one for every page. If only some pages were recognized, ocrPages are their pages in the document.
+func sandwichConfidence(dir string, ocrPages []int) ([]PageConfidence, *float64, error) {
+	files, err := sandwichTSVFiles(dir)
+	if err != nil || len(files) == 0 {
+		return nil, nil, err
+	}
+	var pages []PageConfidence
+	var total float64
+	var words int
+	for page, file := range files {
+		tsv, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		pageConfidence, _, err := parseTesseractTSV(tsv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+		// tesseract recognized the page on its own, it is page 1 of the tsv
+		confidence := PageConfidence{Page: page}
+		if len(pageConfidence) > 0 {
+			confidence.Confidence = pageConfidence[0].Confidence
+			confidence.Words = pageConfidence[0].Words
+		}
+		confidence.Page = documentPage(page, ocrPages)
+		pages = append(pages, confidence)
+		total += confidence.Confidence * float64(confidence.Words)
+		words += confidence.Words
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Page < pages[j].Page })
+	if words == 0 {
+		return pages, nil, nil
+	}
+	confidence := roundConfidence(total / float64(words))
+	return pages, &confidence, nil
+}
+
+// documentPage is the page of the document a page of the pdfsandwich run is, ocrPages are the recognized pages
+// if not all of them were
+func documentPage(page int, ocrPages []int) int {
+	if len(ocrPages) > 0 && page >= 1 && page <= len(ocrPages) {
+		return ocrPages[page-1]
+	}
+	return page
+}
+
+// tsvText puts the words of the tsv output of tesseract together, the lines of a paragraph on lines of
+// their own and the paragraphs separated by an empty line
+func tsvText(tsv []byte) string {
+	var text strings.Builder
+	lastLine, lastParagraph := "", ""
+	for _, line := range strings.Split(string(tsv), "\n") {
+		// level page_num block_num par_num line_num word_num left top width height conf text
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 12 || fields[0] != "5" || strings.TrimSpace(fields[11]) == "" {
+			continue
+		}
+		paragraph := strings.Join(fields[1:4], "/")
+		lineKey := paragraph + "/" + fields[4]
+		switch {
+		case lastLine == "":
+		case paragraph != lastParagraph:
+			text.WriteString("\n\n")
+		case lineKey != lastLine:
+			text.WriteString("\n")
+		default:
+			text.WriteString(" ")
+		}
+		text.WriteString(fields[11])
+		lastLine, lastParagraph = lineKey, paragraph
+	}
+	if text.Len() > 0 {
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+// applyConfidenceThresholds flags the pages below min_page_confidence and, with -confidence_review, sets the
+// status of results with flagged pages or below min_document_confidence to needs_review. It is applied again
+// to cached results, so the thresholds can be reloaded.
+func applyConfidenceThresholds(ocrResult *OcrResult, rabbitConfig *RabbitConfig) {
+	if ocrResult.Confidence == nil || (ocrResult.Status != "done" && ocrResult.Status != StatusNeedsReview) {
+		return
+	}
+	review := *ocrResult.Confidence < float64(rabbitConfig.MinDocumentConfidence)
+	// the pages may be shared with the result cache
+	pages := make([]PageConfidence, len(ocrResult.PageConfidence))
+	copy(pages, ocrResult.PageConfidence)
+	ocrResult.PageConfidence = pages
+	for i := range pages {
+		page := &pages[i]
+		page.LowConfidence = page.Words > 0 && page.Confidence < float64(rabbitConfig.MinPageConfidence)
+		review = review || page.LowConfidence
+	}
+	ocrResult.Status = "done"
+	if review && rabbitConfig.ConfidenceReview {
+		ocrResult.Status = StatusNeedsReview
+	}
+}
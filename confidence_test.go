@@ -0,0 +1,136 @@
+package ocrworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const testConfidenceTSV = "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+	"1\t1\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n" +
+	"5\t1\t1\t1\t1\t1\t100\t100\t200\t40\t96.5\tInvoice\n" +
+	"5\t1\t1\t1\t1\t2\t320\t100\t120\t40\t91\t42\n" +
+	"5\t1\t1\t1\t1\t3\t460\t100\t20\t40\t-1\t \n" +
+	"1\t2\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n" +
+	"1\t3\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n" +
+	"5\t3\t1\t1\t1\t1\t100\t100\t200\t40\t40\tblurred\n"
+
+func TestParseTesseractTSV(t *testing.T) {
+
+	pages, confidence, err := parseTesseractTSV([]byte(testConfidenceTSV))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(pages), 3)
+	assert.Equals(t, pages[0], PageConfidence{Page: 1, Confidence: 93.75, Words: 2})
+	// a blank page has no words and no confidence
+	assert.Equals(t, pages[1], PageConfidence{Page: 2})
+	assert.Equals(t, pages[2], PageConfidence{Page: 3, Confidence: 40, Words: 1})
+	assert.Equals(t, *confidence, 75.83)
+
+	pages, confidence, err = parseTesseractTSV([]byte("1\t1\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n"))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(pages), 1)
+	assert.True(t, confidence == nil)
+
+	_, _, err = parseTesseractTSV([]byte("5\t1\t1\n"))
+	assert.True(t, err != nil)
+
+}
+
+func TestSandwichConfidence(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sandwich-confidence")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	tmpDir := filepath.Join(dir, "pdfsandwich_tmp1234")
+	assert.True(t, os.Mkdir(tmpDir, 0700) == nil)
+
+	header := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n"
+	tsvFiles := map[string]string{
+		"pdfsandwich_inputfile1.tsv": header + "5\t1\t1\t1\t1\t1\t100\t100\t200\t40\t90\tInvoice\n" +
+			"5\t1\t1\t1\t1\t2\t320\t100\t120\t40\t80\t42\n",
+		"pdfsandwich_inputfile2.tsv": header + "1\t1\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n",
+		"pdfsandwich_inputfile3.tsv": header + "5\t1\t1\t1\t1\t1\t100\t100\t200\t40\t30\tblurred\n",
+	}
+	for name, tsv := range tsvFiles {
+		assert.True(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(tsv), 0600) == nil)
+	}
+	pages, confidence, err := sandwichConfidence(dir, nil)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(pages), 3)
+	assert.Equals(t, pages[0], PageConfidence{Page: 1, Confidence: 85, Words: 2})
+	assert.Equals(t, pages[1], PageConfidence{Page: 2})
+	assert.Equals(t, pages[2], PageConfidence{Page: 3, Confidence: 30, Words: 1})
+	assert.Equals(t, *confidence, 66.67)
+
+	// only pages 2, 4 and 5 of the document were recognized
+	pages, _, err = sandwichConfidence(dir, []int{2, 4, 5})
+	assert.True(t, err == nil)
+	assert.Equals(t, pages[0].Page, 2)
+	assert.Equals(t, pages[2].Page, 5)
+
+	// a run without tsv files has no confidence
+	emptyDir := filepath.Join(dir, "empty")
+	assert.True(t, os.Mkdir(emptyDir, 0700) == nil)
+	pages, confidence, err = sandwichConfidence(emptyDir, nil)
+	assert.True(t, err == nil)
+	assert.True(t, pages == nil)
+	assert.True(t, confidence == nil)
+
+}
+
+func TestTsvText(t *testing.T) {
+
+	tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+		"4\t1\t1\t1\t1\t0\t100\t100\t400\t40\t-1\t\n" +
+		"5\t1\t1\t1\t1\t1\t100\t100\t200\t40\t96\tInvoice\n" +
+		"5\t1\t1\t1\t1\t2\t320\t100\t120\t40\t91\t42\n" +
+		"5\t1\t1\t1\t2\t1\t100\t150\t200\t40\t90\tdue\n" +
+		"5\t1\t1\t2\t1\t1\t100\t250\t200\t40\t-1\t \n" +
+		"5\t1\t2\t1\t1\t1\t100\t300\t200\t40\t88\tTotal\n"
+	assert.Equals(t, tsvText([]byte(tsv)), "Invoice 42\ndue\n\nTotal\n")
+	// a blank page has no text
+	assert.Equals(t, tsvText([]byte("1\t1\t0\t0\t0\t0\t0\t0\t2480\t3508\t-1\t\n")), "")
+
+}
+
+func TestApplyConfidenceThresholds(t *testing.T) {
+
+	pages, confidence, err := parseTesseractTSV([]byte(testConfidenceTSV))
+	assert.True(t, err == nil)
+	rabbitConfig := DefaultTestConfig()
+	ocrResult := OcrResult{Status: "done", Confidence: confidence, PageConfidence: pages}
+
+	applyConfidenceThresholds(&ocrResult, &rabbitConfig)
+	assert.Equals(t, ocrResult.Status, "done")
+	assert.False(t, ocrResult.PageConfidence[0].LowConfidence)
+	assert.False(t, ocrResult.PageConfidence[1].LowConfidence)
+	assert.True(t, ocrResult.PageConfidence[2].LowConfidence)
+	// the pages of the cached result are left alone
+	assert.False(t, pages[2].LowConfidence)
+
+	rabbitConfig.ConfidenceReview = true
+	applyConfidenceThresholds(&ocrResult, &rabbitConfig)
+	assert.Equals(t, ocrResult.Status, StatusNeedsReview)
+
+	// applying reloaded thresholds again lifts the review
+	rabbitConfig.MinPageConfidence = 30
+	applyConfidenceThresholds(&ocrResult, &rabbitConfig)
+	assert.Equals(t, ocrResult.Status, "done")
+	assert.False(t, ocrResult.PageConfidence[2].LowConfidence)
+
+	rabbitConfig.MinDocumentConfidence = 80
+	applyConfidenceThresholds(&ocrResult, &rabbitConfig)
+	assert.Equals(t, ocrResult.Status, StatusNeedsReview)
+
+	// results without confidence and failed ones keep their status
+	failed := OcrResult{Status: "error", Confidence: confidence}
+	applyConfidenceThresholds(&failed, &rabbitConfig)
+	assert.Equals(t, failed.Status, "error")
+	plain := OcrResult{Status: "done"}
+	applyConfidenceThresholds(&plain, &rabbitConfig)
+	assert.Equals(t, plain.Status, "done")
+
+}
@@ -0,0 +1,192 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration of every daemon is merged from these sources, each one overrides the previous:
+//  1. the defaults of DefaultTestConfig and DefaultWorkerConfig
+//  2. a YAML or TOML config file given by -config or OPENOCR_CONFIG
+//  3. OPENOCR_* environment variables, the name is the upper case key of the config file, e.g. OPENOCR_ROUTING_KEY
+//  4. the flags which are set explicitly on the command line
+const (
+	configEnvPrefix = "OPENOCR_"
+	configEnvFile   = configEnvPrefix + "CONFIG"
+	// secretTag marks fields which are redacted by -print-config
+	secretTag = "secret"
+)
+
+// configFlags are the flags every daemon understands besides its own ones
+type configFlags struct {
+	configFile  string
+	printConfig bool
+}
+
+func registerConfigFlags() *configFlags {
+	flags := &configFlags{}
+	flag.StringVar(
+		&flags.configFile,
+		"config",
+		"",
+		"path of a YAML (.yaml, .yml) or TOML (.toml) config file, can also be set with "+configEnvFile,
+	)
+	flag.BoolVar(
+		&flags.printConfig,
+		"print-config",
+		false,
+		"print the effective configuration with secrets redacted and exit",
+	)
+	return flags
+}
+
+// explicitFlags returns the names of the flags which are set on the command line
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// load applies the config file and then the environment to config, which must be a pointer to a struct
+func (f *configFlags) load(config interface{}) error {
+	configFile := f.configFile
+	if configFile == "" {
+		configFile = os.Getenv(configEnvFile)
+	}
+	if configFile != "" {
+		if err := loadConfigFile(configFile, config); err != nil {
+			return err
+		}
+	}
+	return loadConfigEnv(config, os.LookupEnv)
+}
+
+// loadConfigFile decodes a YAML or TOML file into config, unknown keys are rejected
+func loadConfigFile(path string, config interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// the strict decoder also rejects keys which are already in the maps of the defaults,
+		// so the unknown keys are checked against an empty config
+		err = yaml.UnmarshalStrict(content, reflect.New(reflect.TypeOf(config).Elem()).Interface())
+		if err == nil {
+			err = yaml.Unmarshal(content, config)
+		}
+	case ".toml":
+		var metaData toml.MetaData
+		metaData, err = toml.Decode(string(content), config)
+		if err == nil && len(metaData.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", metaData.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config file %s must end with .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadConfigEnv sets every field of config whose OPENOCR_* variable is set. Maps are given as JSON.
+func loadConfigEnv(config interface{}, lookupEnv func(string) (string, bool)) error {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		key := configKey(value.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		envName := configEnvPrefix + strings.ToUpper(key)
+		envValue, ok := lookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setConfigField(value.Field(i), envValue); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", envName, err)
+		}
+	}
+	return nil
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+	return nil
+}
+
+// configKey is the key of a field in config files and environment variables, empty if it is not configurable
+func configKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+// printConfig writes config as YAML, which can be used as a config file, with its secrets redacted
+func printConfig(w io.Writer, config interface{}) error {
+	redacted := reflect.New(reflect.TypeOf(config).Elem())
+	redacted.Elem().Set(reflect.ValueOf(config).Elem())
+	for i := 0; i < redacted.Elem().NumField(); i++ {
+		field := redacted.Elem().Field(i)
+		if hasConfigOption(redacted.Elem().Type().Field(i), secretTag) && field.Kind() == reflect.String {
+			field.SetString(redactSecret(field.String()))
+		}
+	}
+	out, err := yaml.Marshal(redacted.Interface())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// redactSecret hides the password of an url or the whole value if it is not an url
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	secretUrl, err := url.Parse(secret)
+	if err != nil || secretUrl.Scheme == "" {
+		return "***"
+	}
+	return StripPasswordFromUrl(secretUrl)
+}
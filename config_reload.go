@@ -0,0 +1,141 @@
+package ocrworker
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadTag marks the fields of RabbitConfig which can be changed without a restart
+const reloadTag = "reload"
+
+// ConfigChange is a setting which differs between the running and the reloaded configuration
+type ConfigChange struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+	// Applied is false for the settings which need a restart, e.g. amqp_uri
+	Applied bool `json:"applied"`
+}
+
+var (
+	reloadMu sync.Mutex
+	// runningConfig is the configuration cli-httpd has been started with plus all reloaded settings
+	runningConfig    RabbitConfig
+	loadRabbitConfig func() (RabbitConfig, error)
+	// reloadedConfig holds a *RabbitConfig after the first reload, it is replaced but never modified
+	reloadedConfig atomic.Value
+)
+
+// setReloadableConfig remembers the running configuration and how to load it again
+func setReloadableConfig(rabbitConfig RabbitConfig, load func() (RabbitConfig, error)) {
+	reloadMu.Lock()
+	runningConfig = rabbitConfig
+	loadRabbitConfig = load
+	reloadMu.Unlock()
+	setLogLevel(rabbitConfig.LogLevel)
+}
+
+func setLogLevel(level string) {
+	if parsedLevel, err := zerolog.ParseLevel(level); err == nil && level != "" {
+		zerolog.SetGlobalLevel(parsedLevel)
+	}
+}
+
+func hasConfigOption(field reflect.StructField, option string) bool {
+	for _, configOption := range strings.Split(field.Tag.Get("config"), ",") {
+		if configOption == option {
+			return true
+		}
+	}
+	return false
+}
+
+// withReloadedSettings returns a copy of rabbitConfig with the settings of the last reload.
+// Every request works on such a copy, so a reload only applies to the requests which start after it.
+func withReloadedSettings(rabbitConfig RabbitConfig) RabbitConfig {
+	reloaded, _ := reloadedConfig.Load().(*RabbitConfig)
+	if reloaded == nil {
+		return rabbitConfig
+	}
+	source := reflect.ValueOf(reloaded).Elem()
+	target := reflect.ValueOf(&rabbitConfig).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if hasConfigOption(source.Type().Field(i), reloadTag) {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+	return rabbitConfig
+}
+
+// diffConfig returns the settings which differ between running and reloaded, secrets are redacted
+func diffConfig(running, reloaded *RabbitConfig) []ConfigChange {
+	changes := make([]ConfigChange, 0)
+	runningValue := reflect.ValueOf(running).Elem()
+	reloadedValue := reflect.ValueOf(reloaded).Elem()
+	for i := 0; i < runningValue.NumField(); i++ {
+		field := runningValue.Type().Field(i)
+		key := configKey(field)
+		if key == "" || reflect.DeepEqual(runningValue.Field(i).Interface(), reloadedValue.Field(i).Interface()) {
+			continue
+		}
+		change := ConfigChange{
+			Key:     key,
+			Old:     runningValue.Field(i).Interface(),
+			New:     reloadedValue.Field(i).Interface(),
+			Applied: hasConfigOption(field, reloadTag),
+		}
+		if hasConfigOption(field, secretTag) {
+			change.Old = redactSecret(runningValue.Field(i).String())
+			change.New = redactSecret(reloadedValue.Field(i).String())
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// ReloadConfig loads the config file and the environment again and applies the settings which can be
+// changed without a restart. Requests which are already running keep the settings they started with.
+func ReloadConfig() ([]ConfigChange, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if loadRabbitConfig == nil {
+		return nil, fmt.Errorf("the configuration can't be reloaded")
+	}
+	loaded, err := loadRabbitConfig()
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_CONFIG").Msg("reloading the configuration failed, keeping the running one")
+		return nil, err
+	}
+
+	changes := diffConfig(&runningConfig, &loaded)
+	loadedValue := reflect.ValueOf(&loaded).Elem()
+	runningValue := reflect.ValueOf(&runningConfig).Elem()
+	for i := 0; i < runningValue.NumField(); i++ {
+		if hasConfigOption(runningValue.Type().Field(i), reloadTag) {
+			runningValue.Field(i).Set(loadedValue.Field(i))
+		}
+	}
+	applied := runningConfig
+	reloadedConfig.Store(&applied)
+
+	for _, change := range changes {
+		if change.Applied {
+			log.Info().Str("component", "OCR_CONFIG").Str("key", change.Key).
+				Interface("old", change.Old).Interface("new", change.New).Msg("setting changed")
+			if change.Key == "log_level" {
+				setLogLevel(applied.LogLevel)
+			}
+		} else {
+			log.Warn().Str("component", "OCR_CONFIG").Str("key", change.Key).
+				Interface("old", change.Old).Interface("new", change.New).Msg("setting changed, it needs a restart to apply")
+		}
+	}
+	log.Info().Str("component", "OCR_CONFIG").Int("changes", len(changes)).Msg("configuration reloaded")
+	return changes, nil
+}
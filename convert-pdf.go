@@ -22,18 +22,18 @@ type ConvertPdf struct {
 
 func (c ConvertPdf) preprocess(ocrRequest *OcrRequest) error {
 
-	tmpFileNameInput, err := createTempFileName("")
-	tmpFileNameInput = fmt.Sprintf("%s.pdf", tmpFileNameInput)
+	tmpFileNameInput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
+	tmpFileNameInput = fmt.Sprintf("%s.pdf", tmpFileNameInput)
 	defer os.Remove(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
-	tmpFileNameOutput = fmt.Sprintf("%s.tif", tmpFileNameOutput)
+	tmpFileNameOutput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
+	tmpFileNameOutput = fmt.Sprintf("%s.tif", tmpFileNameOutput)
 	defer os.Remove(tmpFileNameOutput)
 
 	err = saveBytesToFileName(ocrRequest.ImgBytes, tmpFileNameInput)
@@ -55,7 +55,7 @@ func (c ConvertPdf) preprocess(ocrRequest *OcrRequest) error {
 	)
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Interface("gsArgs", gsArgs)
 
-	out, err := exec.Command("gs", gsArgs...).CombinedOutput()
+	out, err := runCommand(ocrRequest.traceContext(), exec.Command("gs", gsArgs...))
 	if err != nil {
 		log.Error().Err(err).Str("component", "PREPROCESSOR_CONVERTPDF").Msg(string(out))
 	}
@@ -0,0 +1,342 @@
+package ocrworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DebugTokenHeader carries the token which permits debug requests and the download of debug bundles
+const DebugTokenHeader = "X-Debug-Token"
+
+var errDebugNotPermitted = errors.New("debug bundles are not permitted, set the " + DebugTokenHeader + " header")
+
+// CommandRecord is an external command a job has run, it is part of the debug bundle
+type CommandRecord struct {
+	Args     []string  `json:"args"`
+	Output   string    `json:"output"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// DebugArtifact is the input a preprocessor got and the commands it ran,
+// it travels with a debug request to the worker
+type DebugArtifact struct {
+	Preprocessor string          `json:"preprocessor"`
+	Input        []byte          `json:"input"`
+	Commands     []CommandRecord `json:"commands"`
+	// ToolVersions are the versions of the commands on the preprocessor host
+	ToolVersions map[string]string `json:"tool_versions,omitempty"`
+	Started      time.Time         `json:"started"`
+	Duration     float64           `json:"duration_seconds"`
+}
+
+// debugRecorder collects the external commands of a job, runCommand finds it in the context
+type debugRecorder struct {
+	mu       sync.Mutex
+	commands []CommandRecord
+}
+
+type debugRecorderKey struct{}
+
+func withDebugRecorder(ctx context.Context) (context.Context, *debugRecorder) {
+	recorder := &debugRecorder{}
+	return context.WithValue(ctx, debugRecorderKey{}, recorder), recorder
+}
+
+// recordCommand adds the command to the debug recorder of ctx, if there is one
+func recordCommand(ctx context.Context, cmd *exec.Cmd, output []byte, start time.Time, err error) {
+	recorder, ok := ctx.Value(debugRecorderKey{}).(*debugRecorder)
+	if !ok {
+		return
+	}
+	record := CommandRecord{
+		Args:     cmd.Args,
+		Output:   string(output),
+		ExitCode: commandExitCode(err),
+		Started:  start,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	recorder.mu.Lock()
+	recorder.commands = append(recorder.commands, record)
+	recorder.mu.Unlock()
+}
+
+func (r *debugRecorder) recorded() []CommandRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CommandRecord(nil), r.commands...)
+}
+
+// checkDebugPermission returns errDebugNotPermitted if one of the requests asks for a debug bundle
+// but the client did not send the debug token
+func checkDebugPermission(req *http.Request, rabbitConfig *RabbitConfig, ocrRequests ...*OcrRequest) error {
+	for _, ocrRequest := range ocrRequests {
+		if ocrRequest.Debug && !hasDebugToken(req, rabbitConfig) {
+			return errDebugNotPermitted
+		}
+	}
+	return nil
+}
+
+// hasDebugToken checks the debug token of the request, debugging is disabled if no token is configured
+func hasDebugToken(req *http.Request, rabbitConfig *RabbitConfig) bool {
+	return validDebugToken(req.Header.Get(DebugTokenHeader), rabbitConfig)
+}
+
+func validDebugToken(token string, rabbitConfig *RabbitConfig) bool {
+	return matchesToken(token, rabbitConfig.DebugToken)
+}
+
+// matchesToken compares a token in constant time, nothing matches an empty configured token
+func matchesToken(token, configured string) bool {
+	return configured != "" && subtle.ConstantTimeCompare([]byte(token), []byte(configured)) == 1
+}
+
+func newForbiddenProblem(err error, instance string) ProblemDetails {
+	return ProblemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusForbidden),
+		Status:   http.StatusForbidden,
+		Detail:   err.Error(),
+		Instance: instance,
+	}
+}
+
+// debugManifest is manifest.json of the debug bundle
+type debugManifest struct {
+	RequestID     string            `json:"request_id"`
+	Request       OcrRequest        `json:"request"`
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	Worker        string            `json:"worker"`
+	WorkerVersion string            `json:"worker_version"`
+	Started       time.Time         `json:"started"`
+	Duration      float64           `json:"duration_seconds"`
+	Commands      []CommandRecord   `json:"commands"`
+	Preprocessors []DebugArtifact   `json:"preprocessors"`
+	ToolVersions  map[string]string `json:"tool_versions"`
+	Files         []string          `json:"files"`
+	SkippedFiles  []string          `json:"skipped_files,omitempty"`
+}
+
+// buildDebugBundle packs the files of the job directory, the preprocessor inputs, the commands
+// and the tool versions into a tar.gz. Files are skipped once the bundle would exceed maxBytes.
+func buildDebugBundle(ocrRequest *OcrRequest, ocrResult *OcrResult, jobErr error, commands []CommandRecord,
+	workDir string, started time.Time, maxBytes int64) ([]byte, error) {
+
+	hostname, _ := os.Hostname()
+	manifest := debugManifest{
+		RequestID:     ocrRequest.RequestID,
+		Request:       *ocrRequest,
+		Status:        ocrResult.Status,
+		Worker:        hostname,
+		WorkerVersion: version,
+		Started:       started,
+		Duration:      time.Since(started).Seconds(),
+		Commands:      commands,
+		Preprocessors: make([]DebugArtifact, 0, len(ocrRequest.DebugArtifacts)),
+		ToolVersions:  toolVersionsOf(commands),
+		Files:         make([]string, 0),
+	}
+	// the documents are part of the bundle as files, not in the manifest
+	manifest.Request.ImgBase64 = ""
+	manifest.Request.ImgBytes = nil
+	manifest.Request.DebugArtifacts = nil
+	if jobErr != nil {
+		manifest.Error = jobErr.Error()
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	var size int64
+	addFile := func(name string, data []byte) {
+		if maxBytes > 0 && size+int64(len(data)) > maxBytes {
+			manifest.SkippedFiles = append(manifest.SkippedFiles, name)
+			return
+		}
+		size += int64(len(data))
+		manifest.Files = append(manifest.Files, name)
+		_ = writeTarFile(tarWriter, name, data, started)
+	}
+
+	for i, artifact := range ocrRequest.DebugArtifacts {
+		addFile(fmt.Sprintf("preprocessors/%d-%s.input", i+1, sanitizeFileName(artifact.Preprocessor)), artifact.Input)
+		artifact.Input = nil
+		manifest.Preprocessors = append(manifest.Preprocessors, artifact)
+	}
+
+	fileNames := make([]string, 0)
+	_ = filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && info.Name() != activeWorkDirMarker {
+			fileNames = append(fileNames, path)
+		}
+		return nil
+	})
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		relativeName, _ := filepath.Rel(workDir, fileName)
+		name := "workdir/" + filepath.ToSlash(relativeName)
+		if maxBytes > 0 && size >= maxBytes {
+			manifest.SkippedFiles = append(manifest.SkippedFiles, name)
+			continue
+		}
+		data, err := readFileLimited(fileName, maxBytes-size)
+		if err != nil {
+			manifest.SkippedFiles = append(manifest.SkippedFiles, name)
+			continue
+		}
+		addFile(name, data)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tarWriter, "manifest.json", manifestJSON, started); err != nil {
+		return nil, err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tarWriter.Write(data)
+	return err
+}
+
+// readFileLimited reads a file unless it is bigger than limit, limit is not checked if it is 0 or less
+func readFileLimited(fileName string, limit int64) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if limit <= 0 {
+		return ioutil.ReadAll(file)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is too big for the debug bundle", fileName)
+	}
+	return data, nil
+}
+
+var (
+	toolVersionsMu sync.Mutex
+	toolVersions   = make(map[string]string)
+	// toolVersionFlags are the flags printing the version of the tools which don't understand --version
+	toolVersionFlags = map[string]string{
+		"convert":     "-version",
+		"pdfsandwich": "-version",
+		"pdftotext":   "-v",
+		"pdfinfo":     "-v",
+	}
+)
+
+// toolVersionsOf returns the versions of the tools the commands have run
+func toolVersionsOf(commands []CommandRecord) map[string]string {
+	versions := make(map[string]string)
+	for _, command := range commands {
+		versions[command.Args[0]] = toolVersion(command.Args[0])
+	}
+	return versions
+}
+
+// toolVersion returns the first line the tool prints about its version, it is cached for the process lifetime
+func toolVersion(tool string) string {
+	toolVersionsMu.Lock()
+	defer toolVersionsMu.Unlock()
+	if toolVersion, ok := toolVersions[tool]; ok {
+		return toolVersion
+	}
+	versionFlag, ok := toolVersionFlags[tool]
+	if !ok {
+		versionFlag = "--version"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, tool, versionFlag).CombinedOutput()
+	toolVersion := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if toolVersion == "" && err != nil {
+		toolVersion = "unknown: " + err.Error()
+	}
+	toolVersions[tool] = toolVersion
+	return toolVersion
+}
+
+var (
+	debugBundlesMu sync.Mutex
+	// debugBundles holds the debug bundles received by the http daemon by request id
+	debugBundles = make(map[string][]byte)
+)
+
+// storeDebugBundle takes the debug bundle out of the result and keeps it for retention seconds,
+// the result tells the client where to download it
+func storeDebugBundle(requestID string, ocrResult *OcrResult, retention uint) {
+	if len(ocrResult.DebugBundle) == 0 {
+		return
+	}
+	debugBundlesMu.Lock()
+	debugBundles[requestID] = ocrResult.DebugBundle
+	debugBundlesMu.Unlock()
+	time.AfterFunc(time.Duration(retention)*time.Second, func() {
+		debugBundlesMu.Lock()
+		delete(debugBundles, requestID)
+		debugBundlesMu.Unlock()
+	})
+	log.Info().Str("component", "OCR_DEBUG").Str("RequestID", requestID).
+		Int("size", len(ocrResult.DebugBundle)).Uint("retention", retention).Msg("stored debug bundle")
+	ocrResult.DebugBundle = nil
+	ocrResult.DebugURL = debugBundlePath(requestID)
+}
+
+func debugBundlePath(requestID string) string {
+	return "/v2/jobs/" + requestID + "/debug"
+}
+
+func lookupDebugBundle(requestID string) ([]byte, bool) {
+	debugBundlesMu.Lock()
+	defer debugBundlesMu.Unlock()
+	bundle, ok := debugBundles[requestID]
+	return bundle, ok
+}
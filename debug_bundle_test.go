@@ -0,0 +1,125 @@
+package ocrworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func untarBundle(t *testing.T, bundle []byte) map[string][]byte {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(bundle))
+	assert.True(t, err == nil)
+	tarReader := tar.NewReader(gzipReader)
+	files := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.True(t, err == nil)
+		data, err := ioutil.ReadAll(tarReader)
+		assert.True(t, err == nil)
+		files[header.Name] = data
+	}
+	return files
+}
+
+func TestBuildDebugBundle(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo is not installed")
+	}
+	workDir, err := ioutil.TempDir("", "debug-test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(workDir)
+	assert.True(t, ioutil.WriteFile(filepath.Join(workDir, "input.pdf"), []byte("%PDF"), 0600) == nil)
+	assert.True(t, ioutil.WriteFile(filepath.Join(workDir, "big.pdf"), make([]byte, 200), 0600) == nil)
+
+	ctx, recorder := withDebugRecorder(context.Background())
+	_, err = runCommand(ctx, exec.Command("echo", "pdfsandwich"))
+	assert.True(t, err == nil)
+	// commands outside of a debug job are not recorded
+	_, _ = runCommand(context.Background(), exec.Command("echo", "other"))
+
+	ocrRequest := OcrRequest{
+		RequestID: "req1",
+		Debug:     true,
+		ImgBytes:  []byte("document"),
+		DebugArtifacts: []DebugArtifact{
+			{Preprocessor: "convert-pdf", Input: []byte("original")},
+		},
+	}
+	ocrResult := OcrResult{Status: "error"}
+	bundle, err := buildDebugBundle(&ocrRequest, &ocrResult, fmt.Errorf("pdfsandwich failed"), recorder.recorded(),
+		workDir, time.Now(), 100)
+	assert.True(t, err == nil)
+
+	files := untarBundle(t, bundle)
+	assert.Equals(t, string(files["workdir/input.pdf"]), "%PDF")
+	assert.Equals(t, string(files["preprocessors/1-convert-pdf.input"]), "original")
+	_, ok := files["workdir/big.pdf"]
+	assert.False(t, ok)
+
+	manifest := debugManifest{}
+	assert.True(t, json.Unmarshal(files["manifest.json"], &manifest) == nil)
+	assert.Equals(t, manifest.RequestID, "req1")
+	assert.Equals(t, manifest.Error, "pdfsandwich failed")
+	assert.Equals(t, len(manifest.Commands), 1)
+	assert.Equals(t, manifest.Commands[0].Output, "pdfsandwich\n")
+	assert.Equals(t, manifest.Commands[0].ExitCode, 0)
+	assert.Equals(t, len(manifest.Request.ImgBytes), 0)
+	assert.Equals(t, len(manifest.Preprocessors), 1)
+	assert.Equals(t, len(manifest.Preprocessors[0].Input), 0)
+	assert.Equals(t, len(manifest.SkippedFiles), 1)
+	assert.Equals(t, manifest.SkippedFiles[0], "workdir/big.pdf")
+}
+
+func TestOcrHttpDebugHandler(t *testing.T) {
+	rabbitConfig := DefaultTestConfig()
+	rabbitConfig.DebugToken = "secret"
+	handler := NewOcrHttpDebugHandler(&rabbitConfig)
+
+	ocrResult := OcrResult{DebugBundle: []byte("bundle")}
+	storeDebugBundle("req2", &ocrResult, 60)
+	assert.Equals(t, len(ocrResult.DebugBundle), 0)
+	assert.Equals(t, ocrResult.DebugURL, "/v2/jobs/req2/debug")
+
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set(DebugTokenHeader, token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equals(t, serve("/v2/jobs/req2/debug", "").Code, http.StatusForbidden)
+	assert.Equals(t, serve("/v2/jobs/req2/debug", "wrong").Code, http.StatusForbidden)
+	response := serve("/v2/jobs/req2/debug", "secret")
+	assert.Equals(t, response.Code, http.StatusOK)
+	assert.Equals(t, response.Body.String(), "bundle")
+	assert.Equals(t, serve("/v2/jobs/unknown/debug", "secret").Code, http.StatusNotFound)
+	assert.Equals(t, serve("/v2/jobs/req2/other", "secret").Code, http.StatusNotFound)
+
+	// debug requests need the token, without a configured token debugging is disabled
+	req := httptest.NewRequest(http.MethodPost, "/ocr", nil)
+	assert.Equals(t, checkDebugPermission(req, &rabbitConfig, &OcrRequest{}), nil)
+	assert.Equals(t, checkDebugPermission(req, &rabbitConfig, &OcrRequest{Debug: true}), errDebugNotPermitted)
+	req.Header.Set(DebugTokenHeader, "secret")
+	assert.Equals(t, checkDebugPermission(req, &rabbitConfig, &OcrRequest{Debug: true}), nil)
+	rabbitConfig.DebugToken = ""
+	assert.Equals(t, checkDebugPermission(req, &rabbitConfig, &OcrRequest{Debug: true}), errDebugNotPermitted)
+}
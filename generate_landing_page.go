@@ -1,75 +1,26 @@
 package ocrworker
 
 import (
-	"math/rand"
+	"fmt"
 )
 
-func randomMOTD() string {
-
-	names := [...]string{
-		`<p>Nice day to put slinkies on an escalator!</p>
-		<pre>__   ; '.'  :
-|  +. :  ;   :   __
-.-+\   ':  ;   ,,-'  :
-'.  '.  '\ ;  :'   ,'
-,-+'+. '. \.;.:  _,' '-.
-'.__  "-.::||::.:'___-+'
--"  '--..::::::_____.IIHb
-'-:______.:; '::,,...,;:HB\
-.+         \ ::,,...,;:HB \
-'-.______.:+ \'+.,...,;:P'  \
-.-'           \              \
-'-.______.:+   \______________\
-.-::::::::,     BBBBBBBBBBBBBBB
-::,,...,;:HB    BBBBBBBBBBBBBBB
-::,,...,;:HB    BBBBBBBBBBBBBBB
-::,,...,;:HB\   BBBBBBBBBBBBBBB
-::,,...,;:HB \  BBBBBBBBBBBBBBB
-'+.,...,;:P'  \ BBBBBBBBBBBBBBB
-               \BBBBBBBBBBBBBBB</pre>`,
-		"Oh, marmalade!",
-		"There it is, the near-death star.",
-		"Hooray, I'm useful. I'm having a wonderful time.",
-		"Oh, Lord, I'm on the verge of a nervous melt-down.",
-		"The guy who wrote this is gone",
-		"It's running everywhere!",
-		"No comments, no documentation but 24 tickets",
-		"00 0110011 1000011 010011 01000 0110 10011 11 001010 001 0001011 110010",
-		"Robot Nite - Designated device drivers drink free",
-		"When I'm in command, every mission is a suicide-mission.",
-		"Protecting the environment is a crime",
-		"I choose to believe what I was programmed to believe.",
-		"No fair! You changed the outcome by measuring it.",
-		"I can't keep running people over. I'm not famous enough to get away with it",
-		"Creating tomorrow's legacy today!",
-		"Help! A guinea pig tricked me!",
-		"You win again, gravity!",
-		"Good news! There's a report on TV with some very bad news.",
-		"Who was that guy? -Fry Your momma! Now shut up and drag me to work. -Bender",
-		"Oh no! I should do something....but i am already in my pajamas.",
-		"I'd tell you the joke about UDP, but you might not get it.",
-		`<p>Here be dragons!</p>
-		<pre>
-     ,-------,  ,  ,   ,-------,
-      )  ,' /(  |\/|   )\ ',  (
-       )'  /  \ (qp)  /  \  '(
-        ) /___ \_\/(_/ ___\ (
-         '    '-(   )-'    '
-         )w^w(
-         (W_W)
-         ((
-         ))
-         ((
-         ) 
-             </pre>`,
+// fleetSummary renders the number of live workers and their jobs for the landing page, the page is public,
+// the hosts, versions and requests of the workers are only listed at /admin/workers
+func fleetSummary(workers []WorkerAnnouncement) string {
+	if len(workers) == 0 {
+		return `<p>No workers are connected.</p>`
 	}
-	number := rand.Intn(len(names))
-
-	return names[number]
+	running, capacity := 0, uint(0)
+	for _, worker := range workers {
+		running += len(worker.RequestIDs)
+		capacity += worker.NumParallelJobs
+	}
+	return fmt.Sprintf(`<p class="fleet">%d workers are connected, %d of %d jobs are running.</p>`,
+		len(workers), running, capacity)
 }
 
-// GenerateLandingPage will generate a simple landing page
-func GenerateLandingPage(appStop, technicalError bool) string {
+// GenerateLandingPage will generate a simple landing page showing the number of live workers
+func GenerateLandingPage(appStop, technicalError bool, workers []WorkerAnnouncement) string {
 	statusArray := [4]string{}
 
 	if technicalError {
@@ -178,14 +129,17 @@ pre {
     font-family: "Press Start 2P";
 
 }
+.fleet {
+    font-size: 10px;
+}
 </style></head><body><section class="nes-container with-title">	<h2 class="title">Open-ocr  ></h2>
   <div class="nes-balloon from-left">
       <p>` + statusArray[3] + `</p>
     </div>
 <div>`
 	buttons := statusArray[0] + "\n" + statusArray[1] + "\n" + statusArray[2]
-	middle := `</div><div class="nes-container with-title is-centered"> <p class="title">MOTD</p>`
-	MOTD := randomMOTD()
+	middle := `</div><div class="nes-container with-title is-centered"> <p class="title">workers</p>`
+	fleet := fleetSummary(workers)
 	tail := `</div><div class="nes-container with-title">
 <p class="title">info</p>
 <div class="lists">
@@ -197,6 +151,6 @@ pre {
 </div>
 </section></body> </html>`
 
-	return head + buttons + middle + MOTD + tail
+	return head + buttons + middle + fleet + tail
 
 }
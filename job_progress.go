@@ -0,0 +1,215 @@
+package ocrworker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// states of a deferred job as reported by its progress events
+const (
+	JobQueued        = "queued"
+	JobPreprocessing = "preprocessing"
+	JobRecognizing   = "recognizing"
+	JobDone          = "done"
+	JobFailed        = "error"
+)
+
+// progressMessageType marks the messages on the reply queue which report progress instead of carrying the result
+const progressMessageType = "progress"
+
+// jobEventsKeepAlive is the interval in which idle event streams are kept alive for proxies
+var jobEventsKeepAlive = 15 * time.Second
+
+// JobProgress is a progress event of a deferred job, the http daemon numbers the events of a job by Seq
+type JobProgress struct {
+	Seq   int    `json:"seq"`
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// QueuePosition is the position of the job in the queue at the time it was queued, starting at 1
+	QueuePosition int       `json:"queue_position,omitempty"`
+	Preprocessor  string    `json:"preprocessor,omitempty"`
+	PagesDone     int       `json:"pages_done,omitempty"`
+	PagesTotal    int       `json:"pages_total,omitempty"`
+	Time          time.Time `json:"time"`
+
+	// Page is the result of a page as soon as it was recognized, the sandwich engine reports it
+	Page *PageResult `json:"page,omitempty"`
+}
+
+// PageResult is the text and the confidence of a recognized page, Page counts from 1
+type PageResult struct {
+	Page       int     `json:"page"`
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+	Words      int     `json:"words"`
+}
+
+func isFinalJobState(state string) bool {
+	return state == JobDone || state == JobFailed
+}
+
+type progressReporterKey struct{}
+
+// withProgressReporter returns a context through which the engines report the progress of the job
+func withProgressReporter(ctx context.Context, report func(JobProgress)) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, report)
+}
+
+func hasProgressReporter(ctx context.Context) bool {
+	_, ok := ctx.Value(progressReporterKey{}).(func(JobProgress))
+	return ok
+}
+
+// reportProgress passes the progress to the reporter of ctx, if there is one
+func reportProgress(ctx context.Context, progress JobProgress) {
+	if report, ok := ctx.Value(progressReporterKey{}).(func(JobProgress)); ok {
+		report(progress)
+	}
+}
+
+type outputWatcherKey struct{}
+
+// withOutputWatcher returns a context in which runCommand calls watch with every line a command prints
+// while it is running
+func withOutputWatcher(ctx context.Context, watch func(line string)) context.Context {
+	return context.WithValue(ctx, outputWatcherKey{}, watch)
+}
+
+// lineWriter calls watch with every complete line written to it
+type lineWriter struct {
+	watch   func(line string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.watch(string(bytes.TrimRight(w.partial[:i], "\r")))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+// publishProgress sends a progress event of a deferred request to the reply queue of the http daemon,
+// the job goes on if it can not be sent
+func publishProgress(ctx context.Context, channel *amqp.Channel, exchange string, d *amqp.Delivery, progress JobProgress) {
+	body, err := json.Marshal(progress)
+	if err == nil {
+		err = channel.Publish(exchange, d.ReplyTo, false, false, amqp.Publishing{
+			Headers:       withSchemaVersion(traceHeaders(ctx), WireEncodingJSON),
+			ContentType:   contentTypeJSON,
+			Type:          progressMessageType,
+			Body:          body,
+			DeliveryMode:  amqp.Transient,
+			CorrelationId: d.CorrelationId,
+		})
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_PROGRESS").Str("RequestID", d.CorrelationId).
+			Msg("could not publish the progress")
+	}
+}
+
+// jobEventLog holds the progress events of a deferred job in the http daemon
+type jobEventLog struct {
+	events []JobProgress
+	// changed is closed and replaced whenever an event is added
+	changed chan struct{}
+}
+
+var (
+	jobEventsMu sync.Mutex
+	// jobEvents are the event logs of the deferred requests by request id
+	jobEvents = make(map[string]*jobEventLog)
+)
+
+// startJobEvents creates the event log of a deferred request, it is deleted after retention seconds
+func startJobEvents(requestID string, retention int) {
+	jobEventsMu.Lock()
+	jobEvents[requestID] = &jobEventLog{changed: make(chan struct{})}
+	jobEventsMu.Unlock()
+
+	time.AfterFunc(time.Second*time.Duration(retention+10), func() {
+		jobEventsMu.Lock()
+		delete(jobEvents, requestID)
+		jobEventsMu.Unlock()
+	})
+}
+
+// recordJobProgress adds an event to the log of the request, the events of unknown requests are dropped
+func recordJobProgress(requestID string, progress JobProgress) {
+	jobEventsMu.Lock()
+	defer jobEventsMu.Unlock()
+	eventLog, ok := jobEvents[requestID]
+	if !ok {
+		return
+	}
+	progress.Seq = len(eventLog.events) + 1
+	progress.ID = requestID
+	if progress.Time.IsZero() {
+		progress.Time = time.Now()
+	}
+	eventLog.events = append(eventLog.events, progress)
+	close(eventLog.changed)
+	eventLog.changed = make(chan struct{})
+}
+
+// jobEventsSince returns the events of the request after seq and a channel which is closed with the next one,
+// ok is false if the request is unknown or expired
+func jobEventsSince(requestID string, seq int) (events []JobProgress, changed <-chan struct{}, ok bool) {
+	jobEventsMu.Lock()
+	defer jobEventsMu.Unlock()
+	eventLog, ok := jobEvents[requestID]
+	if !ok {
+		return nil, nil, false
+	}
+	if seq < 0 {
+		seq = 0
+	}
+	if seq < len(eventLog.events) {
+		events = append(events, eventLog.events[seq:]...)
+	}
+	return events, eventLog.changed, true
+}
+
+// followJobEvents calls send with every event of the request after seq until the job is finished,
+// the log expires or done is closed. keepAlive is called while nothing happens.
+func followJobEvents(requestID string, seq int, done <-chan struct{}, send func(JobProgress) error,
+	keepAlive func() error) error {
+
+	ticker := time.NewTicker(jobEventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		events, changed, ok := jobEventsSince(requestID, seq)
+		if !ok {
+			return nil
+		}
+		for _, event := range events {
+			if err := send(event); err != nil {
+				return err
+			}
+			seq = event.Seq
+			if isFinalJobState(event.State) {
+				return nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if err := keepAlive(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
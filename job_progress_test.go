@@ -0,0 +1,152 @@
+package ocrworker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestRunCommandOutputWatcher(t *testing.T) {
+	if _, err := exec.LookPath("printf"); err != nil {
+		t.Skip("printf is not installed")
+	}
+	var lines []string
+	ctx := withOutputWatcher(context.Background(), func(line string) {
+		lines = append(lines, line)
+	})
+	output, err := runCommand(ctx, exec.Command("printf", "Processing page 1.\\r\\nProcessing page 2.\\nrest"))
+	assert.True(t, err == nil)
+	assert.Equals(t, string(output), "Processing page 1.\r\nProcessing page 2.\nrest")
+	// the last line is incomplete, it is only part of the output
+	assert.Equals(t, strings.Join(lines, "|"), "Processing page 1.|Processing page 2.")
+}
+
+func TestJobEvents(t *testing.T) {
+	// events of requests without a log are dropped
+	recordJobProgress("unknown", JobProgress{State: JobQueued})
+	_, _, ok := jobEventsSince("unknown", 0)
+	assert.False(t, ok)
+
+	startJobEvents("job1", 60)
+	recordJobProgress("job1", JobProgress{State: JobQueued, QueuePosition: 3})
+	events, changed, ok := jobEventsSince("job1", 0)
+	assert.True(t, ok)
+	assert.Equals(t, len(events), 1)
+	assert.Equals(t, events[0].Seq, 1)
+	assert.Equals(t, events[0].ID, "job1")
+	assert.Equals(t, events[0].QueuePosition, 3)
+
+	recordJobProgress("job1", JobProgress{State: JobRecognizing, PagesDone: 1, PagesTotal: 2})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("the new event was not signalled")
+	}
+	events, _, _ = jobEventsSince("job1", 1)
+	assert.Equals(t, len(events), 1)
+	assert.Equals(t, events[0].PagesDone, 1)
+
+	// following stops with the final event
+	go recordJobProgress("job1", JobProgress{State: JobDone})
+	var states []string
+	err := followJobEvents("job1", 0, nil, func(progress JobProgress) error {
+		states = append(states, progress.State)
+		return nil
+	}, func() error { return nil })
+	assert.True(t, err == nil)
+	assert.Equals(t, strings.Join(states, ","), "queued,recognizing,done")
+}
+
+func TestOcrHttpJobEventsHandler(t *testing.T) {
+	server := httptest.NewServer(NewOcrHttpJobsHandler(&RabbitConfig{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/jobs/unknown/events")
+	assert.True(t, err == nil)
+	resp.Body.Close()
+	assert.Equals(t, resp.StatusCode, http.StatusNotFound)
+
+	startJobEvents("job2", 60)
+	recordJobProgress("job2", JobProgress{State: JobQueued, QueuePosition: 1})
+	recordJobProgress("job2", JobProgress{State: JobPreprocessing, Preprocessor: "convert-pdf"})
+
+	// server-sent events, starting after the event the client got before reconnecting
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/jobs/job2/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	assert.True(t, err == nil)
+	defer resp.Body.Close()
+	assert.Equals(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		recordJobProgress("job2", JobProgress{State: JobDone})
+	}()
+	var ids, states []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+		if strings.HasPrefix(line, "data: ") {
+			progress := JobProgress{}
+			assert.True(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &progress) == nil)
+			states = append(states, progress.State)
+		}
+	}
+	assert.Equals(t, strings.Join(ids, ","), "2,3")
+	assert.Equals(t, strings.Join(states, ","), "preprocessing,done")
+
+	// the same events over a WebSocket
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v2/jobs/job2/events", "", server.URL)
+	assert.True(t, err == nil)
+	defer ws.Close()
+	states = nil
+	for {
+		progress := JobProgress{}
+		if err := websocket.JSON.Receive(ws, &progress); err != nil {
+			break
+		}
+		states = append(states, progress.State)
+	}
+	assert.Equals(t, strings.Join(states, ","), "queued,preprocessing,done")
+}
+
+func TestOcrHttpJobEventsOutliveWriteTimeout(t *testing.T) {
+	defer func(keepAlive time.Duration) { jobEventsKeepAlive = keepAlive }(jobEventsKeepAlive)
+	jobEventsKeepAlive = 50 * time.Millisecond
+
+	server := httptest.NewUnstartedServer(NewOcrHttpJobsHandler(&RabbitConfig{}))
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Config.ConnContext = WithConn
+	server.Start()
+	defer server.Close()
+
+	startJobEvents("job3", 60)
+	recordJobProgress("job3", JobProgress{State: JobQueued, QueuePosition: 1})
+	resp, err := http.Get(server.URL + "/v2/jobs/job3/events")
+	assert.True(t, err == nil)
+	defer resp.Body.Close()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		recordJobProgress("job3", JobProgress{State: JobDone})
+	}()
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	assert.True(t, strings.Contains(strings.Join(lines, "\n"), ": keep-alive"))
+	assert.True(t, strings.Contains(lines[len(lines)-1], `"state":"done"`))
+}
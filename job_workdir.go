@@ -0,0 +1,203 @@
+package ocrworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+// janitorInterval is the time between two purges of the work dir root
+const janitorInterval = time.Minute
+
+// activeWorkDirMarker is a file in every job directory in use, its modification time is refreshed every
+// janitorInterval. The janitors of all processes sharing a root skip the directories with a fresh marker,
+// the marker of a crashed process gets stale after activeMarkerMaxAge.
+const (
+	activeWorkDirMarker = ".active"
+	activeMarkerMaxAge  = 3 * janitorInterval
+)
+
+var (
+	// activeWorkDirs are the job directories in use by this process, the janitor never removes them
+	activeWorkDirsMu sync.Mutex
+	activeWorkDirs   = make(map[string]bool)
+	refreshMarkers   sync.Once
+)
+
+// workDirRoot returns the directory the job directories are created in, os.TempDir()/open-ocr by default
+func workDirRoot(root string) string {
+	if root == "" {
+		return filepath.Join(os.TempDir(), "open-ocr")
+	}
+	return root
+}
+
+// jobWorkDir is the directory holding all the files of a single job
+type jobWorkDir struct {
+	path string
+}
+
+// newJobWorkDir creates a new job directory below root, its name starts with the request id for debugging
+func newJobWorkDir(root, requestID string) (*jobWorkDir, error) {
+	root = workDirRoot(root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	path, err := ioutil.TempDir(root, sanitizeFileName(requestID)+"-")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, activeWorkDirMarker), nil, 0600); err != nil {
+		_ = os.RemoveAll(path)
+		return nil, err
+	}
+	activeWorkDirsMu.Lock()
+	activeWorkDirs[path] = true
+	activeWorkDirsMu.Unlock()
+	refreshMarkers.Do(func() { go refreshActiveMarkers() })
+	return &jobWorkDir{path: path}, nil
+}
+
+// refreshActiveMarkers keeps the markers of the job directories of this process fresh
+func refreshActiveMarkers() {
+	for range time.Tick(janitorInterval) {
+		now := time.Now()
+		activeWorkDirsMu.Lock()
+		for path := range activeWorkDirs {
+			_ = os.Chtimes(filepath.Join(path, activeWorkDirMarker), now, now)
+		}
+		activeWorkDirsMu.Unlock()
+	}
+}
+
+// hasFreshMarker tells if another process may still use the job directory
+func hasFreshMarker(path string, now time.Time) bool {
+	info, err := os.Stat(filepath.Join(path, activeWorkDirMarker))
+	return err == nil && now.Sub(info.ModTime()) < activeMarkerMaxAge
+}
+
+// release removes the job directory unless keep is set, the janitor purges kept directories later on
+func (d *jobWorkDir) release(keep bool) {
+	activeWorkDirsMu.Lock()
+	delete(activeWorkDirs, d.path)
+	activeWorkDirsMu.Unlock()
+	_ = os.Remove(filepath.Join(d.path, activeWorkDirMarker))
+	if keep {
+		log.Info().Str("component", "OCR_WORKDIR").Str("work_dir", d.path).
+			Msg("job directory was not removed for debugging purposes")
+		return
+	}
+	if err := os.RemoveAll(d.path); err != nil {
+		log.Warn().Err(err).Str("component", "OCR_WORKDIR").Str("work_dir", d.path).
+			Msg("could not remove job directory")
+	}
+}
+
+func isActiveWorkDir(path string) bool {
+	activeWorkDirsMu.Lock()
+	defer activeWorkDirsMu.Unlock()
+	return activeWorkDirs[path]
+}
+
+// sanitizeFileName makes a request id usable as (part of) a file name
+func sanitizeFileName(name string) string {
+	if name == "" {
+		return ksuid.New().String()
+	}
+	sanitized := []rune(name)
+	for i, r := range sanitized {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) > 64 {
+		sanitized = sanitized[:64]
+	}
+	return string(sanitized)
+}
+
+// staleWorkDir is a job directory below the work dir root the janitor may purge
+type staleWorkDir struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// purgeWorkDirs removes the job directories below root which are older than maxAge, then the oldest ones
+// until all of them together use less than quota bytes. maxAge and quota are not checked if 0.
+// Directories of running jobs are never removed, neither those of this process nor those with a fresh marker.
+func purgeWorkDirs(root string, maxAge time.Duration, quota int64, now time.Time) (removed int, freed int64) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("component", "OCR_WORKDIR").Str("work_dir", root).Msg("could not list work dir root")
+		}
+		return 0, 0
+	}
+
+	dirs := make([]staleWorkDir, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if !entry.IsDir() || isActiveWorkDir(path) || hasFreshMarker(path, now) {
+			continue
+		}
+		dir := staleWorkDir{path: path, modTime: entry.ModTime(), size: dirSize(path)}
+		total += dir.size
+		dirs = append(dirs, dir)
+	}
+	// oldest first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].modTime.Before(dirs[j].modTime) })
+
+	for _, dir := range dirs {
+		expired := maxAge > 0 && now.Sub(dir.modTime) > maxAge
+		overQuota := quota > 0 && total > quota
+		if !expired && !overQuota {
+			continue
+		}
+		if err := os.RemoveAll(dir.path); err != nil {
+			log.Warn().Err(err).Str("component", "OCR_WORKDIR").Str("work_dir", dir.path).Msg("could not purge job directory")
+			continue
+		}
+		total -= dir.size
+		removed++
+		freed += dir.size
+	}
+	workDirsPurged.Add(float64(removed))
+	workDirBytes.Set(float64(total))
+	return removed, freed
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// StartWorkDirJanitor purges stale job directories below root periodically, see purgeWorkDirs
+func StartWorkDirJanitor(root string, maxAge time.Duration, quota int64) {
+	root = workDirRoot(root)
+	log.Info().Str("component", "OCR_WORKDIR").Str("work_dir", root).Dur("max_age", maxAge).
+		Int64("quota", quota).Msg("starting work dir janitor")
+	go func() {
+		for {
+			removed, freed := purgeWorkDirs(root, maxAge, quota, time.Now())
+			if removed > 0 {
+				log.Info().Str("component", "OCR_WORKDIR").Int("removed", removed).Int64("freed_bytes", freed).
+					Msg("purged stale job directories")
+			}
+			time.Sleep(janitorInterval)
+		}
+	}()
+}
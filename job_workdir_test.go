@@ -0,0 +1,93 @@
+package ocrworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestJobWorkDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "workdir-test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(root)
+
+	workDir, err := newJobWorkDir(root, "../req/1")
+	assert.True(t, err == nil)
+	assert.Equals(t, filepath.Dir(workDir.path), root)
+	assert.True(t, isActiveWorkDir(workDir.path))
+	assert.True(t, hasFreshMarker(workDir.path, time.Now()))
+	fileName, err := createTempFileName(workDir.path, "")
+	assert.True(t, err == nil)
+	assert.True(t, ioutil.WriteFile(fileName, []byte("page"), 0600) == nil)
+
+	workDir.release(true)
+	assert.False(t, isActiveWorkDir(workDir.path))
+	assert.False(t, hasFreshMarker(workDir.path, time.Now()))
+	_, err = os.Stat(fileName)
+	assert.True(t, err == nil)
+
+	workDir, err = newJobWorkDir(root, "")
+	assert.True(t, err == nil)
+	workDir.release(false)
+	_, err = os.Stat(workDir.path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equals(t, sanitizeFileName("../req/1"), "___req_1")
+}
+
+func TestPurgeWorkDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "workdir-test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(root)
+
+	now := time.Now()
+	makeDir := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(root, name)
+		assert.True(t, os.Mkdir(path, 0755) == nil)
+		assert.True(t, ioutil.WriteFile(filepath.Join(path, "file"), make([]byte, size), 0600) == nil)
+		assert.True(t, os.Chtimes(path, now.Add(-age), now.Add(-age)) == nil)
+		return path
+	}
+	expired := makeDir("expired", 10, 2*time.Hour)
+	oldest := makeDir("oldest", 100, 50*time.Minute)
+	newest := makeDir("newest", 100, time.Minute)
+	active := makeDir("active", 1000, 3*time.Hour)
+	activeWorkDirsMu.Lock()
+	activeWorkDirs[active] = true
+	activeWorkDirsMu.Unlock()
+	defer func() {
+		activeWorkDirsMu.Lock()
+		delete(activeWorkDirs, active)
+		activeWorkDirsMu.Unlock()
+	}()
+
+	// the job of another process sharing the root has a fresh marker, the one of a crashed process a stale one
+	markDir := func(path string, age, markerAge time.Duration) {
+		marker := filepath.Join(path, activeWorkDirMarker)
+		assert.True(t, ioutil.WriteFile(marker, nil, 0600) == nil)
+		assert.True(t, os.Chtimes(marker, now.Add(-markerAge), now.Add(-markerAge)) == nil)
+		assert.True(t, os.Chtimes(path, now.Add(-age), now.Add(-age)) == nil)
+	}
+	otherProcess := makeDir("other-process", 1000, 3*time.Hour)
+	markDir(otherProcess, 3*time.Hour, time.Minute)
+	crashed := makeDir("crashed", 10, 3*time.Hour)
+	markDir(crashed, 3*time.Hour, time.Hour)
+
+	// the expired directories go first, then the oldest one until the quota is met
+	removed, freed := purgeWorkDirs(root, time.Hour, 150, now)
+	assert.Equals(t, removed, 3)
+	assert.Equals(t, freed, int64(120))
+	for path, exists := range map[string]bool{expired: false, oldest: false, newest: true, active: true,
+		otherProcess: true, crashed: false} {
+		_, err := os.Stat(path)
+		assert.Equals(t, err == nil, exists)
+	}
+
+	// nothing is purged without limits
+	removed, _ = purgeWorkDirs(root, 0, 0, now.Add(24*time.Hour))
+	assert.Equals(t, removed, 0)
+}
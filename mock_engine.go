@@ -7,5 +7,12 @@ type MockEngine struct {
 
 // ProcessRequest will process incoming OCR request by routing it through the whole process chain
 func (m MockEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
-	return OcrResult{Text: MockEngineResponse}, nil
+	ocrResult := OcrResult{Text: MockEngineResponse, Status: "done"}
+	for _, output := range requestedOutputs(ocrRequest) {
+		if ocrResult.Outputs == nil {
+			ocrResult.Outputs = make(map[string]OcrOutput)
+		}
+		ocrResult.Outputs[output] = newOcrOutput(output, []byte(MockEngineResponse))
+	}
+	return ocrResult, nil
 }
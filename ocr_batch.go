@@ -0,0 +1,447 @@
+package ocrworker
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/segmentio/ksuid"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OcrBatchRequest is the JSON body of a batch submission
+type OcrBatchRequest struct {
+	Requests []OcrRequest `json:"requests"`
+	ReplyTo  string       `json:"reply_to"`
+}
+
+// OcrBatchManifest describes how the files of an uploaded ZIP/TAR archive should be processed.
+// Defaults are used for every file of the archive, Files can override them per file name.
+type OcrBatchManifest struct {
+	Defaults OcrRequest            `json:"defaults"`
+	Files    map[string]OcrRequest `json:"files"`
+	ReplyTo  string                `json:"reply_to"`
+}
+
+// OcrBatchItem holds the state of a single request of a batch
+type OcrBatchItem struct {
+	Index     int        `json:"index"`
+	Name      string     `json:"name,omitempty"`
+	RequestID string     `json:"req_id,omitempty"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Result    *OcrResult `json:"result,omitempty"`
+}
+
+// OcrBatch holds the progress and the results of a batch submission
+type OcrBatch struct {
+	ID      string         `json:"id"`
+	Status  string         `json:"status"`
+	Total   int            `json:"total"`
+	Done    int            `json:"done"`
+	Failed  int            `json:"failed"`
+	Pending int            `json:"pending"`
+	ReplyTo string         `json:"reply_to,omitempty"`
+	Items   []OcrBatchItem `json:"items,omitempty"`
+}
+
+var (
+	batchesMu sync.RWMutex
+	// Batches is for holding and monitoring submitted batches
+	Batches = make(map[string]*OcrBatch)
+)
+
+func newOcrBatch(names []string, replyTo string) *OcrBatch {
+	batch := &OcrBatch{
+		ID:      ksuid.New().String(),
+		Status:  "processing",
+		Total:   len(names),
+		Pending: len(names),
+		ReplyTo: replyTo,
+		Items:   make([]OcrBatchItem, len(names)),
+	}
+	for i, name := range names {
+		batch.Items[i] = OcrBatchItem{Index: i, Name: name, Status: "processing"}
+	}
+	return batch
+}
+
+// GetOcrBatch returns a copy of the batch with the given id
+func GetOcrBatch(batchID string) (OcrBatch, bool) {
+	batchesMu.RLock()
+	defer batchesMu.RUnlock()
+	batch, ok := Batches[batchID]
+	if !ok {
+		return OcrBatch{}, false
+	}
+	return batch.snapshot(), true
+}
+
+// snapshot must be called with batchesMu held
+func (b *OcrBatch) snapshot() OcrBatch {
+	batchCopy := *b
+	batchCopy.Items = make([]OcrBatchItem, len(b.Items))
+	copy(batchCopy.Items, b.Items)
+	return batchCopy
+}
+
+func (b *OcrBatch) setItemResult(index int, ocrResult OcrResult, err error) {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	item := &b.Items[index]
+	item.RequestID = ocrResult.ID
+	switch {
+	case err != nil:
+		item.Status = "error"
+		item.Error = err.Error()
+	case ocrResult.Status == "":
+		item.Status = "done"
+	default:
+		item.Status = ocrResult.Status
+	}
+	if err == nil {
+		item.Result = &ocrResult
+	}
+	if item.Status == "error" {
+		b.Failed++
+	} else {
+		b.Done++
+	}
+	b.Pending--
+	if b.Pending == 0 {
+		b.Status = "done"
+	}
+}
+
+// submitOcrBatch registers a new batch and starts processing it in the background
+func submitOcrBatch(ctx context.Context, requests []OcrRequest, names []string, replyTo string, rabbitConfig *RabbitConfig) (OcrBatch, error) {
+	if len(requests) == 0 {
+		return OcrBatch{}, fmt.Errorf("batch does not contain any requests")
+	}
+	batchValidationErr := &OcrRequestValidationError{}
+	if replyTo != "" {
+		validURL, err := checkURLForReplyTo(replyTo)
+		if err != nil {
+			batchValidationErr.add("reply_to", err.Error())
+		}
+		replyTo = validURL
+	}
+	// the whole batch is rejected if a single item is invalid
+	for i := range requests {
+		var validationErr *OcrRequestValidationError
+		if err := ValidateOcrRequest(&requests[i], rabbitConfig); errors.As(err, &validationErr) {
+			for _, param := range validationErr.InvalidParams {
+				batchValidationErr.add(fmt.Sprintf("requests[%d].%s", i, param.Name), param.Reason)
+			}
+		}
+	}
+	if len(batchValidationErr.InvalidParams) > 0 {
+		return OcrBatch{}, batchValidationErr
+	}
+
+	batch := newOcrBatch(names, replyTo)
+	batchesMu.Lock()
+	Batches[batch.ID] = batch
+	snapshot := batch.snapshot()
+	batchesMu.Unlock()
+
+	go batch.run(detachedTraceContext(ctx), requests, *rabbitConfig)
+
+	return snapshot, nil
+}
+
+// run processes all requests of the batch with a bounded number of parallel requests.
+// All requests share one connection to the message broker.
+func (b *OcrBatch) run(ctx context.Context, requests []OcrRequest, rabbitConfig RabbitConfig) {
+	ctx, span := tracer.Start(ctx, "ocr batch", trace.WithAttributes(
+		attribute.String("ocr.batch_id", b.ID),
+		attribute.Int("ocr.batch_size", len(requests)),
+	))
+	defer span.End()
+
+	logger := zerolog.New(os.Stdout).With().
+		Str("component", "OCR_BATCH").
+		Str("BatchID", b.ID).Timestamp().Logger()
+	defer timeTrack(time.Now(), "processing_time", "batch processing time", b.ID)
+	logger.Info().Int("Total", len(requests)).Msg("starting batch")
+
+	var conn *amqp.Connection
+	if batchNeedsBroker(requests) {
+		var err error
+		conn, err = amqp.Dial(rabbitConfig.AmqpURI)
+		if err != nil {
+			logger.Error().Err(err).Msg("message broker is not reachable")
+			for i := range requests {
+				b.setItemResult(i, OcrResult{}, fmt.Errorf("message broker is not reachable: %v", err))
+			}
+			recordSpanError(span, err)
+			b.finish(ctx, &rabbitConfig, logger)
+			return
+		}
+		defer conn.Close()
+	}
+
+	parallelism := rabbitConfig.BatchParallelism
+	if parallelism == 0 {
+		parallelism = 1
+	}
+	semaphore := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range requests {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(index int, ocrRequest OcrRequest) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			// the batch will be delivered as a whole, single items are always processed synchronously
+			ocrRequest.ReplyTo = ""
+			ocrRequest.Deferred = false
+			ocrRequest.traceCtx = ctx
+			ocrResult, _, err := handleOcrRequestWithConnection(&ocrRequest, &rabbitConfig, conn)
+			if err != nil {
+				logger.Warn().Err(err).Int("Index", index).Msg("batch item failed")
+			}
+			b.setItemResult(index, ocrResult, err)
+		}(i, requests[i])
+	}
+	wg.Wait()
+
+	b.finish(ctx, &rabbitConfig, logger)
+}
+
+// batchNeedsBroker reports if any request of the batch has to be routed through the message broker
+func batchNeedsBroker(requests []OcrRequest) bool {
+	for i := range requests {
+		if !requests[i].InplaceDecode {
+			return true
+		}
+	}
+	return false
+}
+
+// finish delivers the batch summary to ReplyTo if requested and schedules the deletion of the batch
+func (b *OcrBatch) finish(ctx context.Context, rabbitConfig *RabbitConfig, logger zerolog.Logger) {
+	batchesMu.RLock()
+	summary := b.snapshot()
+	batchesMu.RUnlock()
+	logger.Info().Int("Done", summary.Done).Int("Failed", summary.Failed).Msg("batch finished")
+
+	time.AfterFunc(time.Duration(rabbitConfig.ResponseCacheTimeout)*time.Second, func() {
+		batchesMu.Lock()
+		delete(Batches, b.ID)
+		batchesMu.Unlock()
+	})
+
+	if summary.ReplyTo == "" {
+		return
+	}
+	// the callback only carries the progress counts and per-item status, results can be downloaded separately
+	for i := range summary.Items {
+		summary.Items[i].Result = nil
+	}
+	jsonReply, err := json.Marshal(summary)
+	if err != nil {
+		logger.Error().Err(err).Msg("can not marshal batch summary")
+		return
+	}
+	ocrPostClient := newOcrPostClient()
+	for tryCounter := uint(1); tryCounter <= numRetries; tryCounter++ {
+		err = ocrPostClient.postJSON(ctx, jsonReply, b.ID, summary.ReplyTo, tryCounter)
+		if err == nil {
+			logger.Debug().Msg("delivery was successful")
+			return
+		}
+		logger.Error().Err(err).Uint("delivery_attempt", tryCounter).Msg("batch delivery attempt was not successful")
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// parseOcrBatchJSON accepts either a plain array of OcrRequests or an OcrBatchRequest object
+func parseOcrBatchJSON(body []byte) (OcrBatchRequest, error) {
+	batchRequest := OcrBatchRequest{}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &batchRequest.Requests)
+		return batchRequest, err
+	}
+	err := json.Unmarshal(trimmed, &batchRequest)
+	return batchRequest, err
+}
+
+// errBatchTooLarge is returned if a batch has more than max_batch_items requests
+var errBatchTooLarge = errors.New("the batch exceeds the maximal number of items")
+
+// checkBatchItems returns errBatchTooLarge if count exceeds maxItems, 0 means no limit
+func checkBatchItems(count int, maxItems uint) error {
+	if maxItems > 0 && count > int(maxItems) {
+		return errBatchTooLarge
+	}
+	return nil
+}
+
+// readArchiveEntry reads a file of an archive, errUploadTooLarge stops a decompression bomb early
+func readArchiveEntry(reader io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err == nil && int64(len(content)) > maxSize {
+		return nil, errUploadTooLarge
+	}
+	return content, err
+}
+
+// requestsFromArchive builds one OcrRequest per regular file in a ZIP or (gzipped) TAR archive, every file
+// is limited to maxFileSize bytes and the archive to maxItems files, 0 means no limit
+func requestsFromArchive(archive io.ReaderAt, size int64, manifest *OcrBatchManifest, maxFileSize int64,
+	maxItems uint) ([]OcrRequest, []string, error) {
+	header := make([]byte, 4)
+	if _, err := archive.ReadAt(header, 0); err != nil {
+		return nil, nil, fmt.Errorf("can not read archive: %v", err)
+	}
+
+	files := make(map[string][]byte)
+	switch {
+	case bytes.Equal(header, []byte("PK\x03\x04")):
+		zipReader, err := zip.NewReader(archive, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, zipFile := range zipReader.File {
+			if zipFile.FileInfo().IsDir() {
+				continue
+			}
+			if err := checkBatchItems(len(files)+1, maxItems); err != nil {
+				return nil, nil, err
+			}
+			reader, err := zipFile.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			content, err := readArchiveEntry(reader, maxFileSize)
+			reader.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			files[zipFile.Name] = content
+		}
+	default:
+		var reader io.Reader = io.NewSectionReader(archive, 0, size)
+		if header[0] == 0x1f && header[1] == 0x8b {
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+		tarReader := tar.NewReader(reader)
+		for {
+			tarHeader, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("archive is neither zip nor tar: %v", err)
+			}
+			if tarHeader.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := checkBatchItems(len(files)+1, maxItems); err != nil {
+				return nil, nil, err
+			}
+			content, err := readArchiveEntry(tarReader, maxFileSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			files[tarHeader.Name] = content
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	requests := make([]OcrRequest, 0, len(names))
+	for _, name := range names {
+		ocrRequest := manifest.Defaults
+		if override, ok := manifest.Files[name]; ok {
+			ocrRequest = override
+		}
+		ocrRequest.ImgUrl = ""
+		ocrRequest.ImgBase64 = ""
+		ocrRequest.ImgBytes = files[name]
+		requests = append(requests, ocrRequest)
+	}
+	return requests, names, nil
+}
+
+// writeBatchResultsZip writes the summary and one JSON file per item into a ZIP archive
+func writeBatchResultsZip(w io.Writer, batch *OcrBatch) error {
+	zipWriter := zip.NewWriter(w)
+
+	summary := *batch
+	summary.Items = nil
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	entry, err := zipWriter.Create("batch.json")
+	if err != nil {
+		return err
+	}
+	if _, err = entry.Write(summaryJSON); err != nil {
+		return err
+	}
+
+	for _, item := range batch.Items {
+		itemName := item.RequestID
+		if item.Name != "" {
+			itemName = path.Base(item.Name)
+		}
+		entry, err := zipWriter.Create(fmt.Sprintf("results/%05d_%s.json", item.Index, itemName))
+		if err != nil {
+			return err
+		}
+		itemJSON, err := json.MarshalIndent(item, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err = entry.Write(itemJSON); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// writeBatchResultsJSONL writes one JSON object per item and line
+func writeBatchResultsJSONL(w io.Writer, batch *OcrBatch) error {
+	bufWriter := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bufWriter)
+	for _, item := range batch.Items {
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
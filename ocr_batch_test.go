@@ -0,0 +1,209 @@
+package ocrworker
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func waitForBatch(t *testing.T, batchID string) OcrBatch {
+	for i := 0; i < 100; i++ {
+		batch, ok := GetOcrBatch(batchID)
+		assert.True(t, ok)
+		if batch.Status == "done" {
+			return batch
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("batch %s did not finish in time", batchID)
+	return OcrBatch{}
+}
+
+func TestParseOcrBatchJSON(t *testing.T) {
+
+	batchRequest, err := parseOcrBatchJSON([]byte(` [{"img_url":"foo","engine":"mock"},{"img_url":"bar"}]`))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(batchRequest.Requests), 2)
+	assert.Equals(t, batchRequest.Requests[0].EngineType, EngineMock)
+
+	batchRequest, err = parseOcrBatchJSON([]byte(`{"requests":[{"img_url":"foo"}],"reply_to":"http://localhost/cb"}`))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(batchRequest.Requests), 1)
+	assert.Equals(t, batchRequest.ReplyTo, "http://localhost/cb")
+
+}
+
+func TestRequestsFromArchive(t *testing.T) {
+
+	manifest := OcrBatchManifest{
+		Defaults: OcrRequest{EngineType: EngineMock, DocType: "default"},
+		Files:    map[string]OcrRequest{"b.tif": {EngineType: EngineMock, DocType: "special"}},
+	}
+
+	zipBuffer := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(zipBuffer)
+	for _, name := range []string{"b.tif", "a.pdf"} {
+		entry, err := zipWriter.Create(name)
+		assert.True(t, err == nil)
+		_, _ = entry.Write([]byte(name))
+	}
+	assert.True(t, zipWriter.Close() == nil)
+
+	requests, names, err := requestsFromArchive(bytes.NewReader(zipBuffer.Bytes()), int64(zipBuffer.Len()), &manifest, 0, 0)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(requests), 2)
+	assert.Equals(t, names[0], "a.pdf")
+	assert.Equals(t, requests[0].DocType, "default")
+	assert.Equals(t, string(requests[0].ImgBytes), "a.pdf")
+	assert.Equals(t, requests[1].DocType, "special")
+
+	tarBuffer := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(tarBuffer)
+	content := []byte("content")
+	assert.True(t, tarWriter.WriteHeader(&tar.Header{Name: "c.tif", Mode: 0600, Size: int64(len(content))}) == nil)
+	_, _ = tarWriter.Write(content)
+	assert.True(t, tarWriter.Close() == nil)
+
+	requests, names, err = requestsFromArchive(bytes.NewReader(tarBuffer.Bytes()), int64(tarBuffer.Len()), &manifest, 0, 0)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(requests), 1)
+	assert.Equals(t, names[0], "c.tif")
+	assert.Equals(t, string(requests[0].ImgBytes), "content")
+
+	// an entry which unpacks to more than the upload limit and too many entries are rejected
+	_, _, err = requestsFromArchive(bytes.NewReader(tarBuffer.Bytes()), int64(tarBuffer.Len()), &manifest, 4, 0)
+	assert.True(t, errors.Is(err, errUploadTooLarge))
+	_, _, err = requestsFromArchive(bytes.NewReader(zipBuffer.Bytes()), int64(zipBuffer.Len()), &manifest, 0, 1)
+	assert.True(t, errors.Is(err, errBatchTooLarge))
+	assert.Equals(t, batchErrorStatus(err), http.StatusRequestEntityTooLarge)
+
+}
+
+func TestOcrHttpBatchHandlerLimits(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	rabbitConfig.MaxBatchItems = 1
+	handler := NewOcrHttpBatchHandler(&rabbitConfig)
+
+	body := `[{"img_url":"foo","engine":"mock"},{"img_url":"bar","engine":"mock"}]`
+	req := httptest.NewRequest("POST", "/ocr-batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, http.StatusRequestEntityTooLarge)
+
+	rabbitConfig.MaxBatchItems = 0
+	rabbitConfig.MaxUploadSize = 10
+	handler = NewOcrHttpBatchHandler(&rabbitConfig)
+	req = httptest.NewRequest("POST", "/ocr-batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, http.StatusRequestEntityTooLarge)
+
+}
+
+func TestOcrHttpBatchHandlerJSON(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpBatchHandler(&rabbitConfig)
+
+	body := `[{"img_url":"foo","engine":"mock","inplace_decode":true},{"img_url":"bar","engine":"mock","inplace_decode":true}]`
+	req := httptest.NewRequest("POST", "/ocr-batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, 200)
+
+	submitted := OcrBatch{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &submitted) == nil)
+	assert.Equals(t, submitted.Total, 2)
+
+	batch := waitForBatch(t, submitted.ID)
+	assert.Equals(t, batch.Done, 2)
+	assert.Equals(t, batch.Failed, 0)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ocr-batch/"+submitted.ID+"/results?format=jsonl", nil))
+	assert.Equals(t, rec.Code, 200)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	assert.Equals(t, len(lines), 2)
+	item := OcrBatchItem{}
+	assert.True(t, json.Unmarshal([]byte(lines[0]), &item) == nil)
+	assert.Equals(t, item.Result.Text, MockEngineResponse)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ocr-batch/"+submitted.ID+"/results", nil))
+	assert.Equals(t, rec.Code, 200)
+	zipReader, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(zipReader.File), 3)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ocr-batch/unknown", nil))
+	assert.Equals(t, rec.Code, 404)
+
+}
+
+func TestOcrHttpBatchHandlerArchive(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpBatchHandler(&rabbitConfig)
+
+	callbacks := make(chan OcrBatch, 1)
+	replyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summary := OcrBatch{}
+		_ = json.NewDecoder(r.Body).Decode(&summary)
+		callbacks <- summary
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer replyServer.Close()
+
+	zipBuffer := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(zipBuffer)
+	for _, name := range []string{"a.tif", "b.tif", "c.tif"} {
+		entry, _ := zipWriter.Create(name)
+		_, _ = entry.Write([]byte(name))
+	}
+	_ = zipWriter.Close()
+
+	body := &bytes.Buffer{}
+	formWriter := multipart.NewWriter(body)
+	_ = formWriter.WriteField("manifest", `{"defaults":{"engine":"mock","inplace_decode":true},"reply_to":"`+replyServer.URL+`"}`)
+	archivePart, _ := formWriter.CreateFormFile("archive", "batch.zip")
+	_, _ = archivePart.Write(zipBuffer.Bytes())
+	_ = formWriter.Close()
+
+	req := httptest.NewRequest("POST", "/ocr-batch", body)
+	req.Header.Set("Content-Type", formWriter.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, 200)
+
+	submitted := OcrBatch{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &submitted) == nil)
+	assert.Equals(t, submitted.Total, 3)
+	assert.Equals(t, submitted.Items[2].Name, "c.tif")
+
+	select {
+	case summary := <-callbacks:
+		assert.Equals(t, summary.ID, submitted.ID)
+		assert.Equals(t, summary.Done, 3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch callback was not delivered")
+	}
+
+}
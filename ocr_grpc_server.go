@@ -0,0 +1,620 @@
+package ocrworker
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// grpcProtoFile is the name the service is registered under, reflection serves it to the clients
+	grpcProtoFile    = "ocr_grpc.proto"
+	grpcServiceName  = "openocr.v1.Ocr"
+	grpcHealthPeriod = time.Second
+)
+
+// ocrGrpcFile describes the messages and the service of ocr_grpc.proto, it is built here
+// because the repository does not generate code
+var ocrGrpcFile = registerOcrGrpcFile()
+
+func registerOcrGrpcFile() protoreflect.FileDescriptor {
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name), Number: proto.Int32(number), Label: optional, Type: typ.Enum(),
+		}
+	}
+	message := func(name string, number int32, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := field(name, number, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+		f.TypeName = proto.String(".openocr.v1." + typeName)
+		return f
+	}
+	event := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.OneofIndex = proto.Int32(0)
+		return f
+	}
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	preprocessors := field("preprocessors", 5, str)
+	preprocessors.Label = repeated
+	outputs := field("outputs", 13, str)
+	outputs.Label = repeated
+	outputResults := message("outputs", 6, "Output")
+	outputResults.Label = repeated
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(grpcProtoFile),
+		Package: proto.String("openocr.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("RecognizeRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("document", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+				field("img_url", 2, str),
+				field("engine", 3, str),
+				field("engine_args", 4, str),
+				preprocessors,
+				field("preprocessor_args", 6, str),
+				field("doc_type", 7, str),
+				field("page_number", 8, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("time_out", 9, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("reference_id", 10, str),
+				field("cache", 11, str),
+				field("user_agent", 12, str),
+				outputs,
+				field("title", 14, str),
+				field("debug", 15, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+			},
+		}, {
+			Name: proto.String("RecognizeResponse"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, str),
+				field("status", 2, str),
+				field("text", 3, str),
+				field("cached", 4, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+				field("confidence", 5, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				outputResults,
+			},
+		}, {
+			Name: proto.String("Output"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("format", 1, str),
+				field("content_type", 2, str),
+				field("content", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			},
+		}, {
+			Name: proto.String("UploadChunk"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				message("options", 1, "RecognizeRequest"),
+				field("data", 2, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			},
+		}, {
+			Name: proto.String("Progress"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("request_id", 1, str),
+				field("state", 2, str),
+				field("queue_position", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("preprocessor", 4, str),
+				field("pages_done", 5, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("pages_total", 6, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+			},
+		}, {
+			Name: proto.String("PageResult"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("page", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("text", 2, str),
+				field("confidence", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("low_confidence", 4, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+				field("source", 5, str),
+			},
+		}, {
+			Name: proto.String("JobEvent"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				event(message("progress", 1, "Progress")),
+				event(message("page", 2, "PageResult")),
+				event(message("result", 3, "RecognizeResponse")),
+			},
+			OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("event")}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Ocr"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Recognize"),
+				InputType:  proto.String(".openocr.v1.RecognizeRequest"),
+				OutputType: proto.String(".openocr.v1.RecognizeResponse"),
+			}, {
+				Name:            proto.String("Upload"),
+				InputType:       proto.String(".openocr.v1.UploadChunk"),
+				OutputType:      proto.String(".openocr.v1.RecognizeResponse"),
+				ClientStreaming: proto.Bool(true),
+			}, {
+				Name:            proto.String("Watch"),
+				InputType:       proto.String(".openocr.v1.RecognizeRequest"),
+				OutputType:      proto.String(".openocr.v1.JobEvent"),
+				ServerStreaming: proto.Bool(true),
+			}},
+		}},
+	}
+	descriptor, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		panic("invalid descriptor of " + grpcProtoFile + ": " + err.Error())
+	}
+	// the reflection service looks the file up in the global registry
+	if err := protoregistry.GlobalFiles.RegisterFile(descriptor); err != nil {
+		panic("can not register " + grpcProtoFile + ": " + err.Error())
+	}
+	return descriptor
+}
+
+// newGrpcMessage creates an empty message of ocr_grpc.proto
+func newGrpcMessage(name protoreflect.Name) *dynamicpb.Message {
+	return dynamicpb.NewMessage(ocrGrpcFile.Messages().ByName(name))
+}
+
+// ocrGrpcServer is the handler type of the Ocr service
+type ocrGrpcServer interface {
+	recognize(ctx context.Context, ocrRequest OcrRequest) (OcrResult, error)
+}
+
+// ocrGrpcService takes the requests through the same pipeline as the http api
+type ocrGrpcService struct {
+	rabbitConfig RabbitConfig
+	// handle is HandleOcrRequest, the tests replace it
+	handle func(ocrRequest *OcrRequest, rabbitConfig *RabbitConfig) (OcrResult, int, error)
+}
+
+var ocrGrpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*ocrGrpcServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Recognize",
+		Handler:    recognizeHandler,
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Upload",
+		Handler:       uploadHandler,
+		ClientStreams: true,
+	}, {
+		StreamName:    "Watch",
+		Handler:       watchHandler,
+		ServerStreams: true,
+	}},
+	Metadata: grpcProtoFile,
+}
+
+// OcrGrpcServer is the gRPC server of cli-httpd, stopping it stops the updates of the health status as well
+type OcrGrpcServer struct {
+	*grpc.Server
+	stopHealth chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewOcrGrpcServer creates the gRPC server of cli-httpd with the Ocr, health and reflection services.
+// The health status follows checkServiceCanAccept.
+func NewOcrGrpcServer(rabbitConfig *RabbitConfig) *OcrGrpcServer {
+	return newOcrGrpcServer(&ocrGrpcService{rabbitConfig: *rabbitConfig, handle: HandleOcrRequest})
+}
+
+// Stop stops the server like grpc.Server.Stop
+func (s *OcrGrpcServer) Stop() {
+	s.stopOnce.Do(func() { close(s.stopHealth) })
+	s.Server.Stop()
+}
+
+// GracefulStop stops the server like grpc.Server.GracefulStop
+func (s *OcrGrpcServer) GracefulStop() {
+	s.stopOnce.Do(func() { close(s.stopHealth) })
+	s.Server.GracefulStop()
+}
+
+func newOcrGrpcServer(service *ocrGrpcService) *OcrGrpcServer {
+	// documents of the unary calls may be as big as an upload, plus room for the options
+	maxMessageSize := math.MaxInt32
+	if limit := service.rabbitConfig.MaxUploadSize; limit > 0 && limit < math.MaxInt32-1<<20 {
+		maxMessageSize = int(limit) + 1<<20
+	}
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(maxMessageSize))
+	server.RegisterService(&ocrGrpcServiceDesc, service)
+
+	healthServer := health.NewServer()
+	updateGrpcHealth(healthServer)
+	stopHealth := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(grpcHealthPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				updateGrpcHealth(healthServer)
+			case <-stopHealth:
+				return
+			}
+		}
+	}()
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+	return &OcrGrpcServer{Server: server, stopHealth: stopHealth}
+}
+
+func updateGrpcHealth(healthServer *health.Server) {
+	servingStatus := healthpb.HealthCheckResponse_SERVING
+	if checkServiceCanAccept() != nil {
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	healthServer.SetServingStatus("", servingStatus)
+	healthServer.SetServingStatus(grpcServiceName, servingStatus)
+}
+
+func (s *ocrGrpcService) recognize(ctx context.Context, ocrRequest OcrRequest) (OcrResult, error) {
+	if err := checkServiceCanAccept(); err != nil {
+		log.Warn().Str("component", "OCR_GRPC").Err(err).
+			Msg("conditions for accepting new requests are not met")
+		return OcrResult{}, status.Error(codes.Unavailable, err.Error())
+	}
+	ocrRequest.traceCtx = detachedTraceContext(ctx)
+	rabbitConfig := withReloadedSettings(s.rabbitConfig)
+	if ocrRequest.Debug && !validDebugToken(grpcDebugToken(ctx), &rabbitConfig) {
+		return OcrResult{}, status.Error(codes.PermissionDenied, errDebugNotPermitted.Error())
+	}
+	ocrResult, httpStatus, err := s.handle(&ocrRequest, &rabbitConfig)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_GRPC").Msg("Unable to perform OCR decode")
+		return OcrResult{}, grpcError(httpStatus, err)
+	}
+	return ocrResult, nil
+}
+
+// grpcDebugToken returns the debug token of the metadata of a call, it has the name of the http header
+func grpcDebugToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if tokens := md.Get(DebugTokenHeader); len(tokens) > 0 {
+		return tokens[0]
+	}
+	return ""
+}
+
+// grpcError maps the errors of HandleOcrRequest to the status codes of gRPC
+func grpcError(httpStatus int, err error) error {
+	var validationErr *OcrRequestValidationError
+	switch {
+	case errors.As(err, &validationErr) || httpStatus == http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case httpStatus == http.StatusRequestEntityTooLarge:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case httpStatus == http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	case httpStatus == http.StatusRequestTimeout || httpStatus == http.StatusGatewayTimeout:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// ocrRequestFromGrpc maps a RecognizeRequest onto an OcrRequest, the options are parsed like the
+// fields of /ocr-file-upload
+func ocrRequestFromGrpc(m protoreflect.Message) (OcrRequest, error) {
+	ocrRequest := OcrRequest{}
+	fields := m.Descriptor().Fields()
+	formFields := map[protoreflect.Name]string{
+		"img_url":           "img_url",
+		"engine":            "engine",
+		"engine_args":       "engine_args",
+		"preprocessor_args": "preprocessor-args",
+		"doc_type":          "doc_type",
+		"reference_id":      "reference_id",
+		"cache":             "cache",
+		"user_agent":        "user_agent",
+		"title":             "title",
+	}
+	for name, formField := range formFields {
+		if value := m.Get(fields.ByName(name)).String(); value != "" {
+			if err := applyFormField(&ocrRequest, formField, value); err != nil {
+				return ocrRequest, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+	}
+	preprocessors := m.Get(fields.ByName("preprocessors")).List()
+	for i := 0; i < preprocessors.Len(); i++ {
+		ocrRequest.PreprocessorChain = append(ocrRequest.PreprocessorChain, preprocessors.Get(i).String())
+	}
+	outputs := m.Get(fields.ByName("outputs")).List()
+	for i := 0; i < outputs.Len(); i++ {
+		ocrRequest.Outputs = append(ocrRequest.Outputs, outputs.Get(i).String())
+	}
+	pageNumber := m.Get(fields.ByName("page_number")).Uint()
+	if pageNumber > math.MaxUint16 {
+		return ocrRequest, status.Error(codes.InvalidArgument, "page_number is out of range")
+	}
+	ocrRequest.PageNumber = uint16(pageNumber)
+	ocrRequest.TimeOut = uint(m.Get(fields.ByName("time_out")).Uint())
+	ocrRequest.Debug = m.Get(fields.ByName("debug")).Bool()
+	if document := m.Get(fields.ByName("document")).Bytes(); len(document) > 0 {
+		ocrRequest.ImgBytes = document
+	}
+	return ocrRequest, nil
+}
+
+func grpcResponse(ocrResult OcrResult) (*dynamicpb.Message, error) {
+	response := newGrpcMessage("RecognizeResponse")
+	fields := response.Descriptor().Fields()
+	response.Set(fields.ByName("id"), protoreflect.ValueOfString(ocrResult.ID))
+	response.Set(fields.ByName("status"), protoreflect.ValueOfString(ocrResult.Status))
+	response.Set(fields.ByName("text"), protoreflect.ValueOfString(ocrResult.Text))
+	response.Set(fields.ByName("cached"), protoreflect.ValueOfBool(ocrResult.Cached))
+	if ocrResult.Confidence != nil {
+		response.Set(fields.ByName("confidence"), protoreflect.ValueOfFloat64(*ocrResult.Confidence))
+	}
+	// the outputs are sent as raw bytes, sorted by their format
+	formats := make([]string, 0, len(ocrResult.Outputs))
+	for format := range ocrResult.Outputs {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	outputs := response.Mutable(fields.ByName("outputs")).List()
+	for _, format := range formats {
+		content, err := ocrResult.Outputs[format].Bytes()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		output := newGrpcMessage("Output")
+		outputFields := output.Descriptor().Fields()
+		output.Set(outputFields.ByName("format"), protoreflect.ValueOfString(format))
+		output.Set(outputFields.ByName("content_type"), protoreflect.ValueOfString(ocrResult.Outputs[format].ContentType))
+		output.Set(outputFields.ByName("content"), protoreflect.ValueOfBytes(content))
+		outputs.Append(protoreflect.ValueOfMessage(output))
+	}
+	return response, nil
+}
+
+// grpcEvent wraps one of Progress, PageResult and RecognizeResponse into a JobEvent
+func grpcEvent(name protoreflect.Name, value *dynamicpb.Message) *dynamicpb.Message {
+	event := newGrpcMessage("JobEvent")
+	event.Set(event.Descriptor().Fields().ByName(name), protoreflect.ValueOfMessage(value))
+	return event
+}
+
+func grpcProgress(jobProgress JobProgress) *dynamicpb.Message {
+	progress := newGrpcMessage("Progress")
+	fields := progress.Descriptor().Fields()
+	progress.Set(fields.ByName("request_id"), protoreflect.ValueOfString(jobProgress.ID))
+	progress.Set(fields.ByName("state"), protoreflect.ValueOfString(jobProgress.State))
+	progress.Set(fields.ByName("queue_position"), protoreflect.ValueOfUint32(uint32(jobProgress.QueuePosition)))
+	progress.Set(fields.ByName("preprocessor"), protoreflect.ValueOfString(jobProgress.Preprocessor))
+	progress.Set(fields.ByName("pages_done"), protoreflect.ValueOfUint32(uint32(jobProgress.PagesDone)))
+	progress.Set(fields.ByName("pages_total"), protoreflect.ValueOfUint32(uint32(jobProgress.PagesTotal)))
+	return grpcEvent("progress", progress)
+}
+
+// grpcPage is the JobEvent of the result of a page
+func grpcPage(pageNumber int, text string, confidence float64, lowConfidence bool, source string) *dynamicpb.Message {
+	page := newGrpcMessage("PageResult")
+	fields := page.Descriptor().Fields()
+	page.Set(fields.ByName("page"), protoreflect.ValueOfUint32(uint32(pageNumber)))
+	page.Set(fields.ByName("text"), protoreflect.ValueOfString(text))
+	page.Set(fields.ByName("confidence"), protoreflect.ValueOfFloat64(confidence))
+	page.Set(fields.ByName("low_confidence"), protoreflect.ValueOfBool(lowConfidence))
+	page.Set(fields.ByName("source"), protoreflect.ValueOfString(source))
+	return grpcEvent("page", page)
+}
+
+// forwardJobEvents sends the events of a request until it is finished, the last events are sent after finished
+// is closed
+func forwardJobEvents(requestID string, finished <-chan struct{}, send func(JobProgress) error) error {
+	seq := 0
+	forward := func(progress JobProgress) error {
+		seq = progress.Seq
+		return send(progress)
+	}
+	if err := followJobEvents(requestID, seq, finished, forward, func() error { return nil }); err != nil {
+		return err
+	}
+	<-finished
+	events, _, _ := jobEventsSince(requestID, seq)
+	for _, event := range events {
+		if err := forward(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultPages splits the text of a result at the form feeds tesseract and pdftotext write after every page.
+// Results which are PDFs have no pages, unless the txt output was requested next to them.
+func resultPages(ocrRequest *OcrRequest, ocrResult *OcrResult) []string {
+	if ocrResult.Status != "done" && ocrResult.Status != StatusNeedsReview {
+		return nil
+	}
+	text := ocrResult.Text
+	if output, ok := ocrResult.Outputs[OutputTxt]; ok {
+		text = output.Content
+	} else if ocrRequest.EngineType == EngineSandwichTesseract {
+		// the sandwich engine returns its files base64 encoded
+		ocrType, _ := ocrRequest.EngineArgs["ocr_type"].(string)
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || !strings.EqualFold(ocrType, OutputTxt) {
+			return nil
+		}
+		text = string(decoded)
+	}
+	return strings.Split(strings.TrimSuffix(text, "\f"), "\f")
+}
+
+func recognizeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	request := newGrpcMessage("RecognizeRequest")
+	if err := dec(request); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		ocrRequest, err := ocrRequestFromGrpc(req.(*dynamicpb.Message))
+		if err != nil {
+			return nil, err
+		}
+		ocrResult, err := srv.(ocrGrpcServer).recognize(ctx, ocrRequest)
+		if err != nil {
+			return nil, err
+		}
+		return grpcResponse(ocrResult)
+	}
+	if interceptor == nil {
+		return handler(ctx, request)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/Recognize"}
+	return interceptor(ctx, request, info, handler)
+}
+
+// uploadHandler collects the chunks of a document, the options are taken from the first chunk
+func uploadHandler(srv interface{}, stream grpc.ServerStream) error {
+	service := srv.(*ocrGrpcService)
+	maxUploadSize := withReloadedSettings(service.rabbitConfig).MaxUploadSize
+	var ocrRequest OcrRequest
+	var document []byte
+	for first := true; ; first = false {
+		chunk := newGrpcMessage("UploadChunk")
+		err := stream.RecvMsg(chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fields := chunk.Descriptor().Fields()
+		if first {
+			if !chunk.Has(fields.ByName("options")) {
+				return status.Error(codes.InvalidArgument, "the first chunk has to carry the options")
+			}
+			if ocrRequest, err = ocrRequestFromGrpc(chunk.Get(fields.ByName("options")).Message()); err != nil {
+				return err
+			}
+			document = append(document, ocrRequest.ImgBytes...)
+		}
+		document = append(document, chunk.Get(fields.ByName("data")).Bytes()...)
+		if maxUploadSize > 0 && int64(len(document)) > maxUploadSize {
+			return status.Error(codes.ResourceExhausted, errUploadTooLarge.Error())
+		}
+	}
+	if len(document) > 0 {
+		ocrRequest.ImgBytes = document
+	}
+	ocrResult, err := service.recognize(stream.Context(), ocrRequest)
+	if err != nil {
+		return err
+	}
+	response, err := grpcResponse(ocrResult)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(response)
+}
+
+// watchHandler processes a document and streams the progress, the text of every page and the result
+func watchHandler(srv interface{}, stream grpc.ServerStream) error {
+	service := srv.(*ocrGrpcService)
+	request := newGrpcMessage("RecognizeRequest")
+	if err := stream.RecvMsg(request); err != nil {
+		return err
+	}
+	ocrRequest, err := ocrRequestFromGrpc(request)
+	if err != nil {
+		return err
+	}
+	// the progress events of the preprocessors and the worker are forwarded while the request is processed
+	ocrRequest.ReportProgress = true
+	requestIDs := make(chan string, 1)
+	ocrRequest.onRequestID = func(requestID string) {
+		startJobEvents(requestID, int(service.rabbitConfig.ResponseCacheTimeout))
+		requestIDs <- requestID
+	}
+	var ocrResult OcrResult
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ocrResult, err = service.recognize(stream.Context(), ocrRequest)
+	}()
+
+	finalState := false
+	// the pages the worker reported while recognizing are not sent again with the result
+	streamed := make(map[int]bool)
+	send := func(progress JobProgress) error {
+		if page := progress.Page; page != nil {
+			streamed[page.Page] = true
+			lowConfidence := page.Words > 0 && page.Confidence < float64(service.rabbitConfig.MinPageConfidence)
+			return stream.SendMsg(grpcPage(page.Page, page.Text, page.Confidence, lowConfidence, PageSourceOcr))
+		}
+		finalState = isFinalJobState(progress.State)
+		return stream.SendMsg(grpcProgress(progress))
+	}
+	var requestID string
+	select {
+	case requestID = <-requestIDs:
+	case <-finished:
+		select {
+		case requestID = <-requestIDs:
+		default:
+		}
+	}
+	if requestID != "" {
+		if err := forwardJobEvents(requestID, finished, send); err != nil {
+			return err
+		}
+	}
+	<-finished
+	if err != nil {
+		return err
+	}
+	// cached results and those decoded in place have no events
+	if !finalState {
+		if err := send(JobProgress{ID: ocrResult.ID, State: JobDone}); err != nil {
+			return err
+		}
+	}
+	for i, text := range resultPages(&ocrRequest, &ocrResult) {
+		if streamed[i+1] {
+			continue
+		}
+		var confidence float64
+		var lowConfidence bool
+		for _, pageConfidence := range ocrResult.PageConfidence {
+			if pageConfidence.Page == i+1 {
+				confidence, lowConfidence = pageConfidence.Confidence, pageConfidence.LowConfidence
+			}
+		}
+		source := ""
+		for _, pageSource := range ocrResult.PageSources {
+			if pageSource.Page == i+1 {
+				source = pageSource.Source
+			}
+		}
+		if err := stream.SendMsg(grpcPage(i+1, text, confidence, lowConfidence, source)); err != nil {
+			return err
+		}
+	}
+	response, err := grpcResponse(ocrResult)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(grpcEvent("result", response))
+}
@@ -0,0 +1,241 @@
+package ocrworker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// dialTestGrpcServer serves the Ocr service in memory, handle replaces HandleOcrRequest
+func dialTestGrpcServer(t *testing.T, rabbitConfig RabbitConfig,
+	handle func(*OcrRequest, *RabbitConfig) (OcrResult, int, error)) *grpc.ClientConn {
+
+	listener := bufconn.Listen(1 << 20)
+	server := newOcrGrpcServer(&ocrGrpcService{rabbitConfig: rabbitConfig, handle: handle})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(
+		func(context.Context, string) (net.Conn, error) { return listener.Dial() }))
+	assert.True(t, err == nil)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func setGrpcField(m *dynamicpb.Message, name protoreflect.Name, value protoreflect.Value) {
+	m.Set(m.Descriptor().Fields().ByName(name), value)
+}
+
+func getGrpcField(m *dynamicpb.Message, name protoreflect.Name) protoreflect.Value {
+	return m.Get(m.Descriptor().Fields().ByName(name))
+}
+
+func TestOcrGrpcServer(t *testing.T) {
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = true
+	ServiceCanAcceptMu.Unlock()
+
+	rabbitConfig := DefaultTestConfig()
+	rabbitConfig.MaxUploadSize = 10
+	var handled OcrRequest
+	conn := dialTestGrpcServer(t, rabbitConfig, func(ocrRequest *OcrRequest, _ *RabbitConfig) (OcrResult, int, error) {
+		if ocrRequest.ReferenceID == "invalid" {
+			validationErr := &OcrRequestValidationError{}
+			validationErr.add("reference_id", "invalid")
+			return OcrResult{}, 400, validationErr
+		}
+		handled = *ocrRequest
+		if ocrRequest.onRequestID != nil {
+			// the progress the preprocessors and the worker report for Watch
+			ocrRequest.onRequestID("req1")
+			recordJobProgress("req1", JobProgress{State: JobQueued, QueuePosition: 2})
+			recordJobProgress("req1", JobProgress{State: JobRecognizing})
+			recordJobProgress("req1", JobProgress{State: JobRecognizing, PagesDone: 1, PagesTotal: 2})
+			recordJobProgress("req1", JobProgress{State: JobRecognizing,
+				Page: &PageResult{Page: 2, Text: "page two", Confidence: 40, Words: 2}})
+			recordJobProgress("req1", JobProgress{State: JobDone})
+		}
+		confidence := 87.5
+		return OcrResult{ID: "req1", Status: "done", Text: "page one\fpage two\f", Confidence: &confidence,
+			PageSources: []PageSource{{Page: 1, Source: PageSourceTextLayer}, {Page: 2, Source: PageSourceOcr}},
+			Outputs:     map[string]OcrOutput{OutputCombinedPdf: newOcrOutput(OutputCombinedPdf, []byte("%PDF"))}}, 200, nil
+	})
+	ctx := context.Background()
+
+	request := newGrpcMessage("RecognizeRequest")
+	setGrpcField(request, "document", protoreflect.ValueOfBytes([]byte("image")))
+	setGrpcField(request, "engine", protoreflect.ValueOfString("tesseract"))
+	setGrpcField(request, "engine_args", protoreflect.ValueOfString(`{"lang":"deu"}`))
+	setGrpcField(request, "page_number", protoreflect.ValueOfUint32(2))
+	request.Mutable(request.Descriptor().Fields().ByName("outputs")).List().Append(protoreflect.ValueOfString("combinedpdf"))
+	response := newGrpcMessage("RecognizeResponse")
+	err := conn.Invoke(ctx, "/openocr.v1.Ocr/Recognize", request, response)
+	assert.True(t, err == nil)
+	assert.Equals(t, getGrpcField(response, "id").String(), "req1")
+	assert.Equals(t, getGrpcField(response, "status").String(), "done")
+	assert.Equals(t, getGrpcField(response, "confidence").Float(), 87.5)
+	assert.Equals(t, string(handled.ImgBytes), "image")
+	assert.Equals(t, handled.EngineType, EngineTesseract)
+	assert.Equals(t, handled.EngineArgs["lang"], "deu")
+	assert.Equals(t, handled.PageNumber, uint16(2))
+	assert.Equals(t, fmt.Sprint(handled.Outputs), "[combinedpdf]")
+	// the outputs are raw bytes
+	outputs := getGrpcField(response, "outputs").List()
+	assert.Equals(t, outputs.Len(), 1)
+	output := outputs.Get(0).Message()
+	assert.Equals(t, output.Get(output.Descriptor().Fields().ByName("content_type")).String(), "application/pdf")
+	assert.Equals(t, string(output.Get(output.Descriptor().Fields().ByName("content")).Bytes()), "%PDF")
+
+	// debug bundles need the debug token in the metadata
+	setGrpcField(request, "debug", protoreflect.ValueOfBool(true))
+	err = conn.Invoke(ctx, "/openocr.v1.Ocr/Recognize", request, newGrpcMessage("RecognizeResponse"))
+	assert.Equals(t, status.Code(err), codes.PermissionDenied)
+	setGrpcField(request, "debug", protoreflect.ValueOfBool(false))
+
+	setGrpcField(request, "reference_id", protoreflect.ValueOfString("invalid"))
+	err = conn.Invoke(ctx, "/openocr.v1.Ocr/Recognize", request, newGrpcMessage("RecognizeResponse"))
+	assert.Equals(t, status.Code(err), codes.InvalidArgument)
+
+	// the document arrives in chunks after the options
+	upload, err := conn.NewStream(ctx, &ocrGrpcServiceDesc.Streams[0], "/openocr.v1.Ocr/Upload")
+	assert.True(t, err == nil)
+	for i, data := range []string{"doc", "ument"} {
+		chunk := newGrpcMessage("UploadChunk")
+		if i == 0 {
+			options := newGrpcMessage("RecognizeRequest")
+			options.Mutable(options.Descriptor().Fields().ByName("preprocessors")).List().
+				Append(protoreflect.ValueOfString("convert-pdf"))
+			setGrpcField(chunk, "options", protoreflect.ValueOfMessage(options))
+		}
+		setGrpcField(chunk, "data", protoreflect.ValueOfBytes([]byte(data)))
+		assert.True(t, upload.SendMsg(chunk) == nil)
+	}
+	assert.True(t, upload.CloseSend() == nil)
+	response = newGrpcMessage("RecognizeResponse")
+	assert.True(t, upload.RecvMsg(response) == nil)
+	assert.Equals(t, getGrpcField(response, "id").String(), "req1")
+	assert.Equals(t, string(handled.ImgBytes), "document")
+	assert.Equals(t, fmt.Sprint(handled.PreprocessorChain), "[convert-pdf]")
+
+	// uploads are limited to MaxUploadSize
+	upload, err = conn.NewStream(ctx, &ocrGrpcServiceDesc.Streams[0], "/openocr.v1.Ocr/Upload")
+	assert.True(t, err == nil)
+	chunk := newGrpcMessage("UploadChunk")
+	setGrpcField(chunk, "options", protoreflect.ValueOfMessage(newGrpcMessage("RecognizeRequest")))
+	setGrpcField(chunk, "data", protoreflect.ValueOfBytes(make([]byte, 11)))
+	assert.True(t, upload.SendMsg(chunk) == nil)
+	assert.True(t, upload.CloseSend() == nil)
+	err = upload.RecvMsg(newGrpcMessage("RecognizeResponse"))
+	assert.Equals(t, status.Code(err), codes.ResourceExhausted)
+
+	// watch streams the progress, every page and the result
+	watch, err := conn.NewStream(ctx, &ocrGrpcServiceDesc.Streams[1], "/openocr.v1.Ocr/Watch")
+	assert.True(t, err == nil)
+	request = newGrpcMessage("RecognizeRequest")
+	setGrpcField(request, "document", protoreflect.ValueOfBytes([]byte("image")))
+	assert.True(t, watch.SendMsg(request) == nil)
+	assert.True(t, watch.CloseSend() == nil)
+	var events []string
+	for {
+		event := newGrpcMessage("JobEvent")
+		if err := watch.RecvMsg(event); err == io.EOF {
+			break
+		} else {
+			assert.True(t, err == nil)
+		}
+		field := event.WhichOneof(event.Descriptor().Oneofs().ByName("event"))
+		value := event.Get(field).Message()
+		switch field.Name() {
+		case "progress":
+			events = append(events, fmt.Sprintf("progress:%s/%d",
+				value.Get(value.Descriptor().Fields().ByName("state")).String(),
+				value.Get(value.Descriptor().Fields().ByName("pages_done")).Uint()))
+		case "page":
+			events = append(events, fmt.Sprintf("page:%s/%s/%v",
+				value.Get(value.Descriptor().Fields().ByName("text")).String(),
+				value.Get(value.Descriptor().Fields().ByName("source")).String(),
+				value.Get(value.Descriptor().Fields().ByName("low_confidence")).Bool()))
+		case "result":
+			events = append(events, "result:"+value.Get(value.Descriptor().Fields().ByName("id")).String())
+		}
+	}
+	// the page recognized while the job runs is sent right away and not again with the result
+	assert.Equals(t, fmt.Sprint(events), "[progress:queued/0 progress:recognizing/0 progress:recognizing/1 "+
+		"page:page two/ocr/true progress:done/0 page:page one/text_layer/false result:req1]")
+	assert.True(t, handled.ReportProgress)
+
+	health := healthpb.NewHealthClient(conn)
+	healthResponse, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: grpcServiceName})
+	assert.True(t, err == nil)
+	assert.Equals(t, healthResponse.Status, healthpb.HealthCheckResponse_SERVING)
+
+	// reflection serves the file of the service
+	_, err = protoregistry.GlobalFiles.FindFileByPath(grpcProtoFile)
+	assert.True(t, err == nil)
+
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = false
+	ServiceCanAcceptMu.Unlock()
+	err = conn.Invoke(ctx, "/openocr.v1.Ocr/Recognize", request, newGrpcMessage("RecognizeResponse"))
+	assert.Equals(t, status.Code(err), codes.Unavailable)
+}
+
+func TestOcrGrpcServerStop(t *testing.T) {
+	server := newOcrGrpcServer(&ocrGrpcService{rabbitConfig: DefaultTestConfig(), handle: HandleOcrRequest})
+	server.GracefulStop()
+	// the health updates end with the server, stopping twice is fine
+	select {
+	case <-server.stopHealth:
+	default:
+		t.Error("the health updates were not stopped")
+	}
+	server.Stop()
+}
+
+func TestResultPages(t *testing.T) {
+
+	ocrRequest := OcrRequest{EngineType: EngineTesseract}
+	ocrResult := OcrResult{Status: "done", Text: "one\ftwo\f"}
+	assert.Equals(t, fmt.Sprint(resultPages(&ocrRequest, &ocrResult)), "[one two]")
+
+	// the sandwich engine returns the text base64 encoded, pdfs have no pages
+	ocrRequest = OcrRequest{EngineType: EngineSandwichTesseract, EngineArgs: map[string]interface{}{"ocr_type": "TXT"}}
+	ocrResult = OcrResult{Status: StatusNeedsReview, Text: "b25lDHR3bww="}
+	assert.Equals(t, fmt.Sprint(resultPages(&ocrRequest, &ocrResult)), "[one two]")
+	ocrRequest.EngineArgs["ocr_type"] = "combinedpdf"
+	assert.Equals(t, len(resultPages(&ocrRequest, &ocrResult)), 0)
+	ocrResult.Outputs = map[string]OcrOutput{OutputTxt: newOcrOutput(OutputTxt, []byte("three\f"))}
+	assert.Equals(t, fmt.Sprint(resultPages(&ocrRequest, &ocrResult)), "[three]")
+
+}
+
+func TestOcrGrpcFile(t *testing.T) {
+
+	// the descriptor of the service is built by hand, it has to describe the same messages as ocr_grpc.proto
+	parsed, err := parseProtoFile("ocr_grpc.proto")
+	assert.True(t, err == nil)
+	compiled, err := protodesc.NewFile(parsed, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("ocr_grpc.proto: %v", err)
+	}
+	want := protodesc.ToFileDescriptorProto(compiled)
+	got := protodesc.ToFileDescriptorProto(ocrGrpcFile)
+	if !proto.Equal(want, got) {
+		t.Errorf("ocrGrpcFile differs from ocr_grpc.proto\nwant: %s\ngot:  %s", prototext.Format(want), prototext.Format(got))
+	}
+
+}
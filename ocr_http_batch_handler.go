@@ -0,0 +1,231 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxBatchMemory is the part of a multipart batch upload which is held in memory, the rest goes to disk
+const maxBatchMemory = 32 << 20
+
+// OcrHttpBatchHandler is handling submission of batches, their status and the download of the results
+type OcrHttpBatchHandler struct {
+	RabbitConfig RabbitConfig
+}
+
+func NewOcrHttpBatchHandler(r *RabbitConfig) *OcrHttpBatchHandler {
+	return &OcrHttpBatchHandler{
+		RabbitConfig: *r,
+	}
+}
+
+// ServeHTTP handles
+//
+//	POST /ocr-batch                 submit a batch as JSON or as multipart/form-data with "manifest" and "archive"
+//	GET  /ocr-batch/{id}            progress and per-item status
+//	GET  /ocr-batch/{id}/results    all results as zip (default) or jsonl (?format=jsonl)
+func (s *OcrHttpBatchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	log.Info().Str("component", "OCR_BATCH").Str("path", req.URL.Path).Msg("batch handler called")
+
+	batchPath := strings.Trim(strings.TrimPrefix(req.URL.Path, "/ocr-batch"), "/")
+	pathParts := strings.Split(batchPath, "/")
+
+	switch {
+	case batchPath == "" && req.Method == http.MethodPost:
+		s.submit(w, req)
+	case batchPath != "" && len(pathParts) == 1 && req.Method == http.MethodGet:
+		s.status(w, pathParts[0])
+	case len(pathParts) == 2 && pathParts[1] == "results" && req.Method == http.MethodGet:
+		s.results(w, pathParts[0], req.URL.Query().Get("format"))
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *OcrHttpBatchHandler) submit(w http.ResponseWriter, req *http.Request) {
+	if err := checkServiceCanAccept(); err != nil {
+		log.Warn().Str("component", "OCR_BATCH").Err(err).
+			Msg("conditions for accepting new requests are not met")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	// the JSON body or the archive of a batch is a single upload
+	if rabbitConfig.MaxUploadSize > 0 {
+		if req.ContentLength > rabbitConfig.MaxUploadSize {
+			http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = ioutil.NopCloser(&maxUploadReader{reader: req.Body, remaining: rabbitConfig.MaxUploadSize})
+	}
+
+	var (
+		requests []OcrRequest
+		names    []string
+		replyTo  string
+	)
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch contentType {
+	case "multipart/form-data":
+		manifest, err := s.extractManifest(req)
+		if err != nil {
+			log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("invalid batch upload")
+			http.Error(w, err.Error(), batchErrorStatus(err))
+			return
+		}
+		archive, archiveHeader, err := req.FormFile("archive")
+		if err != nil {
+			http.Error(w, "archive part is missing", http.StatusBadRequest)
+			return
+		}
+		defer archive.Close()
+		requests, names, err = requestsFromArchive(archive, archiveHeader.Size, &manifest,
+			rabbitConfig.MaxUploadSize, rabbitConfig.MaxBatchItems)
+		if err != nil {
+			log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("unable to read archive")
+			http.Error(w, fmt.Sprintf("unable to read archive: %v", err), batchErrorStatus(err))
+			return
+		}
+		replyTo = manifest.ReplyTo
+	default:
+		body, err := ioutil.ReadAll(req.Body)
+		if errors.Is(err, errUploadTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "unable to read request body", http.StatusBadRequest)
+			return
+		}
+		batchRequest, err := parseOcrBatchJSON(body)
+		if err != nil {
+			log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("did the client send a valid json?")
+			http.Error(w, "Unable to unmarshal json, malformed request", http.StatusBadRequest)
+			return
+		}
+		requests = batchRequest.Requests
+		if err := checkBatchItems(len(requests), rabbitConfig.MaxBatchItems); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		names = make([]string, len(requests))
+		replyTo = batchRequest.ReplyTo
+	}
+
+	for i := range requests {
+		if err := checkDebugPermission(req, &rabbitConfig, &requests[i]); err != nil {
+			log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("debug request rejected")
+			writeProblem(w, newForbiddenProblem(err, req.URL.Path))
+			return
+		}
+	}
+	batch, err := submitOcrBatch(req.Context(), requests, names, replyTo, &rabbitConfig)
+	var validationErr *OcrRequestValidationError
+	if errors.As(err, &validationErr) {
+		log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("batch validation failed")
+		writeProblem(w, newValidationProblem(validationErr, req.URL.Path))
+		return
+	}
+	if err != nil {
+		log.Warn().Str("component", "OCR_BATCH").Err(err).Msg("batch was not accepted")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeBatchJSON(w, &batch)
+}
+
+// batchErrorStatus is 413 for the uploads which exceed a limit and 400 otherwise
+func batchErrorStatus(err error) int {
+	if errors.Is(err, errUploadTooLarge) || errors.Is(err, errBatchTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func (s *OcrHttpBatchHandler) extractManifest(req *http.Request) (OcrBatchManifest, error) {
+	manifest := OcrBatchManifest{}
+	if err := req.ParseMultipartForm(maxBatchMemory); err != nil {
+		return manifest, fmt.Errorf("unable to parse multipart form: %w", err)
+	}
+	manifestJSON := req.FormValue("manifest")
+	if manifestJSON == "" {
+		if manifestFile, _, err := req.FormFile("manifest"); err == nil {
+			manifestBytes, err := ioutil.ReadAll(manifestFile)
+			manifestFile.Close()
+			if err != nil {
+				return manifest, err
+			}
+			manifestJSON = string(manifestBytes)
+		}
+	}
+	if manifestJSON == "" {
+		return manifest, nil
+	}
+	if err := json.Unmarshal([]byte(manifestJSON), &manifest); err != nil {
+		return manifest, fmt.Errorf("unable to unmarshal manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+func (s *OcrHttpBatchHandler) status(w http.ResponseWriter, batchID string) {
+	batch, ok := GetOcrBatch(batchID)
+	if !ok {
+		http.Error(w, "no such batch. batch time out reached?", http.StatusNotFound)
+		return
+	}
+	// the status only carries per-item state, results are available via the results endpoint
+	for i := range batch.Items {
+		batch.Items[i].Result = nil
+	}
+	writeBatchJSON(w, &batch)
+}
+
+func (s *OcrHttpBatchHandler) results(w http.ResponseWriter, batchID, format string) {
+	batch, ok := GetOcrBatch(batchID)
+	if !ok {
+		http.Error(w, "no such batch. batch time out reached?", http.StatusNotFound)
+		return
+	}
+	if batch.Status != "done" {
+		http.Error(w, "batch is still processing", http.StatusConflict)
+		return
+	}
+
+	var err error
+	switch format {
+	case "", "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", batchID+".zip"))
+		err = writeBatchResultsZip(w, &batch)
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = writeBatchResultsJSONL(w, &batch)
+	default:
+		http.Error(w, "unsupported format, use zip or jsonl", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_BATCH").Str("BatchID", batchID).Msg("writing results failed")
+	}
+}
+
+func writeBatchJSON(w http.ResponseWriter, batch *OcrBatch) {
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(batch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(js)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_BATCH").Msg("http write() failed")
+	}
+}
@@ -0,0 +1,52 @@
+package ocrworker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OcrHttpDebugHandler serves the debug bundles of failed and debug requests at /v2/jobs/{id}/debug
+type OcrHttpDebugHandler struct {
+	RabbitConfig RabbitConfig
+}
+
+func NewOcrHttpDebugHandler(r *RabbitConfig) *OcrHttpDebugHandler {
+	return &OcrHttpDebugHandler{
+		RabbitConfig: *r,
+	}
+}
+
+func (s *OcrHttpDebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "this endpoint only accepts GET requests", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/jobs/"), "/debug")
+	if requestID == "" || strings.Contains(requestID, "/") || debugBundlePath(requestID) != req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	if !hasDebugToken(req, &rabbitConfig) {
+		log.Warn().Str("component", "OCR_DEBUG").Str("RequestID", requestID).Msg("debug bundle download rejected")
+		writeProblem(w, newForbiddenProblem(errDebugNotPermitted, req.URL.Path))
+		return
+	}
+	bundle, ok := lookupDebugBundle(requestID)
+	if !ok {
+		http.Error(w, "no debug bundle for this job, it may have expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", requestID+"-debug.tar.gz"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(bundle)))
+	if _, err := w.Write(bundle); err != nil {
+		log.Error().Err(err).Str("component", "OCR_DEBUG").Msg("http write() failed")
+	}
+}
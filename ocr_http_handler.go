@@ -2,15 +2,20 @@ package ocrworker
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	// "github.com/sasha-s/go-deadlock"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OcrHTTPStatusHandler is for initial handling of ocr request
@@ -37,25 +42,11 @@ func (s *OcrHTTPStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 	defer req.Body.Close()
 	var httpStatus = 200
 
-	ServiceCanAcceptMu.Lock()
-	serviceCanAcceptLocal := ServiceCanAccept
-	appStopLocal := AppStop
-	ServiceCanAcceptMu.Unlock()
-	if !serviceCanAcceptLocal && !appStopLocal {
-		err := "no resources available to process the request"
-		log.Warn().Str("component", "OCR_HTTP").Err(fmt.Errorf(err)).
-			Msg("conditions for accepting new requests are not met")
-		httpStatus = 503
-		http.Error(w, err, httpStatus)
-		return
-	}
-
-	if !serviceCanAcceptLocal && appStopLocal {
-		err := "service is going down"
-		log.Warn().Str("component", "OCR_HTTP").Err(fmt.Errorf(err)).
+	if err := checkServiceCanAccept(); err != nil {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).
 			Msg("conditions for accepting new requests are not met")
 		httpStatus = 503
-		http.Error(w, err, httpStatus)
+		http.Error(w, err.Error(), httpStatus)
 		return
 	}
 
@@ -70,8 +61,21 @@ func (s *OcrHTTPStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &s.RabbitConfig)
+	ocrRequest.traceCtx = detachedTraceContext(req.Context())
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	if err := checkDebugPermission(req, &rabbitConfig, &ocrRequest); err != nil {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).Msg("debug request rejected")
+		writeProblem(w, newForbiddenProblem(err, req.URL.Path))
+		return
+	}
+	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &rabbitConfig)
 
+	var validationErr *OcrRequestValidationError
+	if errors.As(err, &validationErr) {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).Msg("request validation failed")
+		writeProblem(w, newValidationProblem(validationErr, req.URL.Path))
+		return
+	}
 	if err != nil {
 		msg := "Unable to perform OCR decode. Error: %v"
 		errMsg := fmt.Sprintf(msg, err)
@@ -92,19 +96,142 @@ func (s *OcrHTTPStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 	}
 }
 
+// checkServiceCanAccept returns an error if the service is not able to accept new requests,
+// either because there are no free resources or because the service is going down
+func checkServiceCanAccept() error {
+	ServiceCanAcceptMu.Lock()
+	serviceCanAcceptLocal := ServiceCanAccept
+	appStopLocal := AppStop
+	ServiceCanAcceptMu.Unlock()
+	if !serviceCanAcceptLocal && !appStopLocal {
+		return fmt.Errorf("no resources available to process the request")
+	}
+	if !serviceCanAcceptLocal && appStopLocal {
+		return fmt.Errorf("service is going down")
+	}
+	return nil
+}
+
 // HandleOcrRequest will process incoming OCR request by routing it through the whole process chain
 func HandleOcrRequest(ocrRequest *OcrRequest, workerConfig *RabbitConfig) (OcrResult, int, error) {
+	return handleOcrRequestWithConnection(ocrRequest, workerConfig, nil)
+}
+
+// handleOcrRequestWithConnection is the same as HandleOcrRequest but will reuse the given connection
+// to the message broker if it is not nil
+func handleOcrRequestWithConnection(ocrRequest *OcrRequest, workerConfig *RabbitConfig, conn *amqp.Connection) (OcrResult, int, error) {
 	var httpStatus = 200
+	if err := ValidateOcrRequest(ocrRequest, workerConfig); err != nil {
+		return OcrResult{}, 400, err
+	}
+	// only the preprocessors add debug artifacts and only the services reference blobs
+	ocrRequest.DebugArtifacts = nil
+	ocrRequest.ImgBlob = nil
 	var requestIDRaw = ksuid.New()
 	requestID := requestIDRaw.String()
-	ocrResult := newOcrResult(requestID)
 	ocrRequest.RequestID = requestID
+	if ocrRequest.onRequestID != nil {
+		ocrRequest.onRequestID(requestID)
+	}
+	ctx, span := tracer.Start(ocrRequest.traceContext(), "ocr request", trace.WithAttributes(
+		attribute.String("ocr.request_id", requestID),
+		attribute.String("ocr.engine", ocrRequest.EngineType.String()),
+		attribute.Bool("ocr.deferred", ocrRequest.Deferred),
+	))
+	defer span.End()
+	ocrRequest.traceCtx = ctx
 	// set the context for zerolog, RequestID will be printed on each logging event
 	logger := zerolog.New(os.Stdout).With().
 		Str("RequestID", requestID).Timestamp().Logger()
+
+	cache := currentResultCache()
+	if cache == nil || !resultCacheApplies(ocrRequest) {
+		return processOcrRequest(ocrRequest, workerConfig, conn, span, &logger)
+	}
+	// the document is hashed, so it has to be loaded here instead of in DecodeImage
+	if err := ocrRequest.loadImage(); err != nil {
+		logger.Warn().Err(err).Str("component", "OCR_HTTP").Msg("Error loading the document")
+		recordSpanError(span, err)
+		return OcrResult{}, 500, err
+	}
+	cacheKey := resultCacheKey(ocrRequest)
+	cacheTTL := time.Duration(workerConfig.ResultCacheTTL) * time.Second
+	span.SetAttributes(attribute.String("ocr.cache_key", cacheKey))
+	if ocrRequest.Cache == CacheBypass {
+		resultCacheRequests.WithLabelValues("bypass").Inc()
+		return runResultFlight(ocrRequest, newResultFlight(cacheKey, cache, cacheTTL), workerConfig, conn, span, &logger)
+	}
+	if cachedResult, ok := cache.Get(cacheKey); ok {
+		logger.Info().Str("component", "OCR_HTTP").Str("cacheKey", cacheKey).Msg("serving the result from the cache")
+		resultCacheRequests.WithLabelValues("hit").Inc()
+		cachedResult.ID = requestID
+		cachedResult.Cached = true
+		applyConfidenceThresholds(&cachedResult, workerConfig)
+		if isDeferredRequest(ocrRequest) {
+			return answerDeferredRequest(ocrRequest, workerConfig, func() OcrResult { return cachedResult })
+		}
+		return cachedResult, httpStatus, nil
+	}
+
+	flight, leader := joinResultFlight(cacheKey, cache, cacheTTL)
+	if leader {
+		resultCacheRequests.WithLabelValues("miss").Inc()
+		return runResultFlight(ocrRequest, flight, workerConfig, conn, span, &logger)
+	}
+	logger.Info().Str("component", "OCR_HTTP").Str("cacheKey", cacheKey).Msg("waiting for the result of an identical request")
+	resultCacheRequests.WithLabelValues("collapsed").Inc()
+	if isDeferredRequest(ocrRequest) {
+		return answerDeferredRequest(ocrRequest, workerConfig, func() OcrResult {
+			ocrResult, _, err := flight.wait(requestID)
+			if err != nil {
+				return OcrResult{ID: requestID, Status: "error", Text: err.Error()}
+			}
+			return ocrResult
+		})
+	}
+	return flight.wait(requestID)
+}
+
+// isDeferredRequest is true if the result of the request is polled or sent to reply_to
+func isDeferredRequest(ocrRequest *OcrRequest) bool {
+	return !ocrRequest.InplaceDecode && (ocrRequest.Deferred || ocrRequest.ReplyTo != "")
+}
+
+// runResultFlight processes the request which leads the flight. The flight is finished on the completion side
+// when the worker replies, identical requests waiting for it get the result and it is cached.
+func runResultFlight(ocrRequest *OcrRequest, flight *resultFlight, workerConfig *RabbitConfig, conn *amqp.Connection,
+	span trace.Span, logger *zerolog.Logger) (OcrResult, int, error) {
+
+	deferred := isDeferredRequest(ocrRequest)
+	ocrRequest.onResult = func(ocrResult OcrResult) {
+		flight.finish(ocrResult, 200, nil)
+	}
+	ocrResult, httpStatus, err := processOcrRequest(ocrRequest, workerConfig, conn, span, logger)
+	switch {
+	case err != nil || !deferred:
+		flight.finish(ocrResult, httpStatus, err)
+	default:
+		// the identical requests give up like the deferred one if its result never arrives
+		time.AfterFunc(time.Duration(workerConfig.ResponseCacheTimeout)*time.Second, func() {
+			flight.finish(OcrResult{}, 500, fmt.Errorf("timeout waiting for the result of an identical request"))
+		})
+	}
+	return ocrResult, httpStatus, err
+}
+
+// processOcrRequest decodes the request in place or hands it over to the workers
+func processOcrRequest(ocrRequest *OcrRequest, workerConfig *RabbitConfig, conn *amqp.Connection,
+	span trace.Span, logger *zerolog.Logger) (OcrResult, int, error) {
+
+	var httpStatus = 200
 	switch ocrRequest.InplaceDecode {
 	case true:
 		// inplace decode: short circuit rabbitmq, and just call ocr engine directly
+		if err := ocrRequest.readUpload(); err != nil {
+			logger.Error().Err(err).Str("component", "OCR_HTTP").Msg("Error reading the uploaded document")
+			recordSpanError(span, err)
+			return OcrResult{}, 500, err
+		}
 		ocrEngine := NewOcrEngine(ocrRequest.EngineType)
 
 		workingConfig := WorkerConfig{}
@@ -112,23 +239,26 @@ func HandleOcrRequest(ocrRequest *OcrRequest, workerConfig *RabbitConfig) (OcrRe
 
 		if err != nil {
 			logger.Error().Err(err).Str("component", "OCR_HTTP").Msg("Error processing ocr request")
+			recordSpanError(span, err)
 			httpStatus = 500
 			return OcrResult{}, httpStatus, err
 		}
+		applyConfidenceThresholds(&ocrResult, workerConfig)
 
 		return ocrResult, httpStatus, nil
 	default:
 		// add a new job to rabbitMQ and wait for worker to respond w/ result
-		ocrClient, err := NewOcrRpcClient(workerConfig)
+		ocrClient, err := NewOcrRpcClientWithConnection(workerConfig, conn)
 		if err != nil {
 			logger.Error().Err(err).Str("component", "OCR_HTTP")
 			httpStatus = 500
 			return OcrResult{}, httpStatus, err
 		}
 
-		ocrResult, httpStatus, err = ocrClient.DecodeImage(ocrRequest, requestID)
+		ocrResult, httpStatus, err := ocrClient.DecodeImage(ocrRequest, ocrRequest.RequestID)
 		if err != nil {
 			logger.Error().Err(err).Str("component", "OCR_HTTP")
+			recordSpanError(span, err)
 			return OcrResult{}, httpStatus, err
 		}
 
@@ -0,0 +1,150 @@
+package ocrworker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// OcrHttpJobEventsHandler streams the progress events of deferred requests at /v2/jobs/{id}/events,
+// as server-sent events or over a WebSocket
+type OcrHttpJobEventsHandler struct {
+}
+
+func NewOcrHttpJobEventsHandler() *OcrHttpJobEventsHandler {
+	return &OcrHttpJobEventsHandler{}
+}
+
+type connKey struct{}
+
+// WithConn is the ConnContext of the http server of cli-httpd, the event streams clear the write deadline
+// of their connection with it
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// clearWriteDeadline lifts the WriteTimeout of the http server for the connection of req, the server sets
+// it again for the next request on the connection
+func clearWriteDeadline(req *http.Request) {
+	if conn, ok := req.Context().Value(connKey{}).(net.Conn); ok {
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+func jobEventsPath(requestID string) string {
+	return "/v2/jobs/" + requestID + "/events"
+}
+
+func (s *OcrHttpJobEventsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "this endpoint only accepts GET requests", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/jobs/"), "/events")
+	if requestID == "" || strings.Contains(requestID, "/") || jobEventsPath(requestID) != req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+	if _, _, ok := jobEventsSince(requestID, 0); !ok {
+		http.Error(w, "no such deferred request, it may have expired", http.StatusNotFound)
+		return
+	}
+	// reconnecting clients continue after the last event they got
+	seq, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		server := websocket.Server{Handler: func(ws *websocket.Conn) {
+			s.streamWebSocket(ws, requestID, seq)
+		}}
+		server.ServeHTTP(w, req)
+		return
+	}
+	s.streamServerSentEvents(w, req, requestID, seq)
+}
+
+func (s *OcrHttpJobEventsHandler) streamServerSentEvents(w http.ResponseWriter, req *http.Request, requestID string, seq int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// the stream outlives the write timeout of the http server, the keep-alive comments notice a gone client
+	clearWriteDeadline(req)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := followJobEvents(requestID, seq, req.Context().Done(), func(progress JobProgress) error {
+		data, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", progress.Seq, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		flusher.Flush()
+		return err
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_EVENTS").Str("RequestID", requestID).Msg("event stream closed")
+	}
+}
+
+func (s *OcrHttpJobEventsHandler) streamWebSocket(ws *websocket.Conn, requestID string, seq int) {
+	// the connection outlives the write timeout of the http server
+	_ = ws.SetDeadline(time.Time{})
+	// the client only sends close frames, reading them notices when it is gone
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard string
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	err := followJobEvents(requestID, seq, closed, func(progress JobProgress) error {
+		return websocket.JSON.Send(ws, progress)
+	}, func() error {
+		ws.PayloadType = websocket.PingFrame
+		_, err := ws.Write(nil)
+		return err
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_EVENTS").Str("RequestID", requestID).Msg("event stream closed")
+	}
+	_ = ws.Close()
+}
+
+// OcrHttpJobsHandler routes the requests below /v2/jobs/ to the handlers of the debug bundles and the events
+type OcrHttpJobsHandler struct {
+	debug  *OcrHttpDebugHandler
+	events *OcrHttpJobEventsHandler
+}
+
+func NewOcrHttpJobsHandler(r *RabbitConfig) *OcrHttpJobsHandler {
+	return &OcrHttpJobsHandler{
+		debug:  NewOcrHttpDebugHandler(r),
+		events: NewOcrHttpJobEventsHandler(),
+	}
+}
+
+func (s *OcrHttpJobsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/events") {
+		s.events.ServeHTTP(w, req)
+		return
+	}
+	s.debug.ServeHTTP(w, req)
+}
@@ -0,0 +1,40 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OcrHttpLanguagesHandler returns the languages and scripts which are installed on the live workers
+type OcrHttpLanguagesHandler struct {
+}
+
+type languagesResponse struct {
+	Languages []string `json:"languages"`
+	Scripts   []string `json:"scripts"`
+	Workers   int      `json:"workers"`
+}
+
+func NewOcrHttpLanguagesHandler() *OcrHttpLanguagesHandler {
+	return &OcrHttpLanguagesHandler{}
+}
+
+func (s *OcrHttpLanguagesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "this endpoint only accepts GET requests", http.StatusMethodNotAllowed)
+		return
+	}
+
+	languages, scripts, numWorkers := AvailableLanguages()
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(languagesResponse{Languages: languages, Scripts: scripts, Workers: numWorkers})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
+}
@@ -1,18 +1,31 @@
 package ocrworker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
+// maxFormFieldSize limits the size of a single non-file form field
+const maxFormFieldSize = 1 << 20
+
+var (
+	errUploadTooLarge       = errors.New("uploaded content exceeds the maximal upload size")
+	errUnsupportedMediaType = errors.New("expected content-type: image/*, application/pdf or application/octet-stream")
+)
+
 type OcrHttpMultipartHandler struct {
 	RabbitConfig RabbitConfig
 }
@@ -23,95 +36,295 @@ func NewOcrHttpMultipartHandler(r *RabbitConfig) *OcrHttpMultipartHandler {
 	}
 }
 
-func (s *OcrHttpMultipartHandler) extractParts(req *http.Request) (OcrRequest, error) {
+// uploadedDocument is a document streamed to a temporary file, its checksum is taken on the way
+type uploadedDocument struct {
+	path   string
+	size   int64
+	sha256 string
+}
 
-	log.Info().Str("component", "OCR_HTTP").Msg("request to ocr-file-upload")
-	ocrReq := OcrRequest{}
-
-	switch req.Method {
-	case "POST":
-		h := req.Header.Get("Content-Type")
-		log.Info().Str("component", "OCR_HTTP").
-			Str("content_type", h).
-			Msg("content type")
-
-		contentType, attrs, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
-		log.Info().Str("component", "OCR_HTTP").
-			Str("content_type", contentType).
-			Msg("content type")
-
-		if !strings.HasPrefix(h, "multipart/related") {
-			return ocrReq, fmt.Errorf("expected multipart related")
-		}
+// maxUploadReader returns errUploadTooLarge as soon as more than the allowed number of bytes were read
+type maxUploadReader struct {
+	reader    io.Reader
+	remaining int64
+}
 
-		reader := multipart.NewReader(req.Body, attrs["boundary"])
+func (m *maxUploadReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.reader.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
 
-		for {
+// isUploadContentType checks if the content type of a part is one of the supported document types
+func isUploadContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") ||
+		contentType == "application/pdf" ||
+		contentType == "application/octet-stream"
+}
 
-			part, err := reader.NextPart()
+// extractParts supports multipart/related (a JSON part followed by the document) as well as
+// multipart/form-data where the form fields are mapped onto the OcrRequest. The uploaded document
+// is streamed to a temporary file which is only read if the document has to travel inside the message,
+// the caller removes it once the request was handed over.
+func (s *OcrHttpMultipartHandler) extractParts(req *http.Request, rabbitConfig *RabbitConfig) (ocrReq OcrRequest, err error) {
 
-			if err == io.EOF {
-				break
-			}
-			contentTypeOuter := part.Header["Content-Type"][0]
-			contentType, attrs, _ := mime.ParseMediaType(contentTypeOuter)
+	log.Info().Str("component", "OCR_HTTP").Msg("request to ocr-file-upload")
 
-			log.Info().Str("component", "OCR_HTTP").Interface("attrs", attrs)
+	if req.Method != "POST" {
+		return ocrReq, fmt.Errorf("this endpoint only accepts POST requests")
+	}
 
-			switch contentType {
-			case "application/json":
-				decoder := json.NewDecoder(part)
-				err := decoder.Decode(&ocrReq)
-				if err != nil {
-					return ocrReq, fmt.Errorf("unable to unmarshal json: %s", err)
-				}
-				part.Close()
-			default:
-				if !strings.HasPrefix(contentType, "image") {
-					return ocrReq, fmt.Errorf("expected content-type: image/*")
-				}
+	contentType, attrs, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	log.Info().Str("component", "OCR_HTTP").
+		Str("content_type", contentType).
+		Msg("content type")
+	if err != nil || (contentType != "multipart/related" && contentType != "multipart/form-data") {
+		return ocrReq, fmt.Errorf("expected multipart/form-data or multipart/related")
+	}
 
-				partContents, err := ioutil.ReadAll(part)
-				if err != nil {
-					return ocrReq, fmt.Errorf("failed to read mime part: %v", err)
-				}
+	if rabbitConfig.MaxUploadSize > 0 {
+		if req.ContentLength > rabbitConfig.MaxUploadSize {
+			return ocrReq, errUploadTooLarge
+		}
+		req.Body = ioutil.NopCloser(&maxUploadReader{reader: req.Body, remaining: rabbitConfig.MaxUploadSize})
+	}
 
-				ocrReq.ImgBytes = partContents
-				return ocrReq, nil
+	reader := multipart.NewReader(req.Body, attrs["boundary"])
+	var upload *uploadedDocument
+	// the values of the form fields so far, a JSON part would silently override them
+	formValues := make(map[string]string)
+	jsonPart := false
+	defer func() {
+		if err != nil && upload != nil {
+			_ = os.Remove(upload.path)
+		}
+	}()
 
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errUploadTooLarge) {
+				return ocrReq, errUploadTooLarge
+			}
+			return ocrReq, fmt.Errorf("failed to read mime part: %v", err)
+		}
+
+		partContentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		formName := part.FormName()
+
+		switch {
+		case partContentType == "application/json" || formName == "request":
+			if jsonPart || len(formValues) > 0 {
+				return ocrReq, errConflictingFormFields
+			}
+			jsonPart = true
+			decoder := json.NewDecoder(part)
+			if err := decoder.Decode(&ocrReq); err != nil {
+				return ocrReq, fmt.Errorf("unable to unmarshal json: %s", err)
 			}
+		case part.FileName() != "" || (partContentType != "" && partContentType != "text/plain"):
+			if !isUploadContentType(partContentType) {
+				return ocrReq, errUnsupportedMediaType
+			}
+			if upload != nil {
+				return ocrReq, fmt.Errorf("only one file per request is supported")
+			}
+			upload, err = s.streamPartToFile(part)
+			if err != nil {
+				return ocrReq, err
+			}
+		case formName != "":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				if errors.Is(err, errUploadTooLarge) {
+					return ocrReq, errUploadTooLarge
+				}
+				return ocrReq, fmt.Errorf("failed to read form field %s: %v", formName, err)
+			}
+			if jsonPart {
+				return ocrReq, errConflictingFormFields
+			}
+			if previous, ok := formValues[formName]; ok && !listFormFields[formName] && previous != string(value) {
+				return ocrReq, fmt.Errorf("form field %s is given twice with different values", formName)
+			}
+			formValues[formName] = string(value)
+			if err := applyFormField(&ocrReq, formName, string(value)); err != nil {
+				return ocrReq, err
+			}
+		}
+		part.Close()
+	}
 
+	if upload == nil {
+		return ocrReq, fmt.Errorf("no file was uploaded")
+	}
+	ocrReq.upload = upload
+	return ocrReq, nil
+}
+
+func (s *OcrHttpMultipartHandler) streamPartToFile(part *multipart.Part) (*uploadedDocument, error) {
+	tmpFileName, err := createTempFileName("", "")
+	if err != nil {
+		return nil, err
+	}
+	outFile, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(outFile, hash), part)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		if errors.Is(err, errUploadTooLarge) {
+			return nil, errUploadTooLarge
 		}
+		return nil, fmt.Errorf("failed to read mime part: %v", err)
+	}
+	return &uploadedDocument{path: tmpFileName, size: size, sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// errConflictingFormFields is returned if a request is given as JSON part and as form fields
+var errConflictingFormFields = errors.New("the JSON part of the request can't be combined with form fields or another JSON part")
 
-		return ocrReq, fmt.Errorf("didn't expect to get this far")
+// listFormFields may be repeated, their values are appended
+var listFormFields = map[string]bool{"preprocessors": true, "outputs": true}
 
+// applyFormField maps a single multipart/form-data field onto the corresponding OcrRequest field.
+// Field names are the same as the json keys of the OcrRequest.
+func applyFormField(ocrReq *OcrRequest, name, value string) error {
+	var err error
+	switch name {
+	case "img_url":
+		ocrReq.ImgUrl = value
+	case "engine":
+		if engineTypeInt, convErr := strconv.Atoi(value); convErr == nil {
+			ocrReq.EngineType = OcrEngineType(engineTypeInt)
+		} else {
+			err = ocrReq.EngineType.UnmarshalJSON([]byte(strconv.Quote(value)))
+		}
+	case "engine_args":
+		err = json.Unmarshal([]byte(value), &ocrReq.EngineArgs)
+	case "preprocessors":
+		for _, preprocessor := range strings.Split(value, ",") {
+			if preprocessor = strings.TrimSpace(preprocessor); preprocessor != "" {
+				ocrReq.PreprocessorChain = append(ocrReq.PreprocessorChain, preprocessor)
+			}
+		}
+	case "outputs":
+		for _, output := range strings.Split(value, ",") {
+			if output = strings.TrimSpace(output); output != "" {
+				ocrReq.Outputs = append(ocrReq.Outputs, output)
+			}
+		}
+	case "preprocessor-args":
+		err = json.Unmarshal([]byte(value), &ocrReq.PreprocessorArgs)
+	case "deferred":
+		ocrReq.Deferred, err = strconv.ParseBool(value)
+	case "debug":
+		ocrReq.Debug, err = strconv.ParseBool(value)
+	case "inplace_decode":
+		ocrReq.InplaceDecode, err = strconv.ParseBool(value)
+	case "reply_to":
+		ocrReq.ReplyTo = value
+	case "doc_type":
+		ocrReq.DocType = value
+	case "user_agent":
+		ocrReq.UserAgent = value
+	case "reference_id":
+		ocrReq.ReferenceID = value
+	case "title":
+		ocrReq.Title = value
+	case "cache":
+		ocrReq.Cache = value
+	case "page_number":
+		var pageNumber uint64
+		pageNumber, err = strconv.ParseUint(value, 10, 16)
+		ocrReq.PageNumber = uint16(pageNumber)
+	case "time_out":
+		var timeOut uint64
+		timeOut, err = strconv.ParseUint(value, 10, 32)
+		ocrReq.TimeOut = uint(timeOut)
 	default:
-		return ocrReq, fmt.Errorf("this endpoint only accepts POST requests")
+		log.Warn().Str("component", "OCR_HTTP").Str("field", name).Msg("ignoring unknown form field")
 	}
-
+	if err != nil {
+		return fmt.Errorf("invalid value for form field %s: %v", name, err)
+	}
+	return nil
 }
 
 func (s *OcrHttpMultipartHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	defer req.Body.Close()
 	var httpStatus = 200
-	ocrRequest, err := s.extractParts(req)
+
+	if err := checkServiceCanAccept(); err != nil {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).
+			Msg("conditions for accepting new requests are not met")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	ocrRequest, err := s.extractParts(req, &rabbitConfig)
 	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_HTTP")
-		errStr := fmt.Sprintf("Error extracting multipart/related parts: %v", err)
-		http.Error(w, errStr, 500)
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("error extracting multipart parts")
+		switch {
+		case errors.Is(err, errUploadTooLarge):
+			httpStatus = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errUnsupportedMediaType):
+			httpStatus = http.StatusUnsupportedMediaType
+		default:
+			httpStatus = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Error extracting multipart parts: %v", err), httpStatus)
 		return
 	}
+	// the document was read or moved to the blob store when the request was published
+	defer os.Remove(ocrRequest.upload.path)
 
-	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &s.RabbitConfig)
+	if err := checkDebugPermission(req, &rabbitConfig, &ocrRequest); err != nil {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).Msg("debug request rejected")
+		writeProblem(w, newForbiddenProblem(err, req.URL.Path))
+		return
+	}
+	ocrRequest.traceCtx = detachedTraceContext(req.Context())
+	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &rabbitConfig)
 
+	var validationErr *OcrRequestValidationError
+	if errors.As(err, &validationErr) {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).Msg("request validation failed")
+		writeProblem(w, newValidationProblem(validationErr, req.URL.Path))
+		return
+	}
 	if err != nil {
-		msg := "Unable to perform OCR decode."
-		log.Error().Err(err).Str("component", "OCR_HTTP").Msg(msg)
-		http.Error(w, msg, httpStatus)
+		msg := "Unable to perform OCR decode. Error: %v"
+		errMsg := fmt.Sprintf(msg, err)
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("Unable to perform OCR decode")
+		http.Error(w, errMsg, httpStatus)
 		return
 	}
 
-	_, _ = fmt.Fprintf(w, ocrResult.Text)
-
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(ocrResult)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(js)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
 }
@@ -0,0 +1,153 @@
+package ocrworker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newFormDataUpload(t *testing.T, fields map[string]string, fileContentType string, fileContent []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	formWriter := multipart.NewWriter(body)
+	for name, value := range fields {
+		assert.True(t, formWriter.WriteField(name, value) == nil)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	header.Set("Content-Type", fileContentType)
+	filePart, err := formWriter.CreatePart(header)
+	assert.True(t, err == nil)
+	_, _ = filePart.Write(fileContent)
+	assert.True(t, formWriter.Close() == nil)
+	return body, formWriter.FormDataContentType()
+}
+
+func TestApplyFormField(t *testing.T) {
+
+	ocrRequest := OcrRequest{}
+	assert.True(t, applyFormField(&ocrRequest, "engine", "sandwich") == nil)
+	assert.True(t, applyFormField(&ocrRequest, "engine_args", `{"lang":"deu"}`) == nil)
+	assert.True(t, applyFormField(&ocrRequest, "preprocessors", "identity, convert-pdf") == nil)
+	assert.True(t, applyFormField(&ocrRequest, "deferred", "true") == nil)
+	assert.True(t, applyFormField(&ocrRequest, "time_out", "30") == nil)
+	assert.True(t, applyFormField(&ocrRequest, "doc_type", "123") == nil)
+	assert.True(t, applyFormField(&ocrRequest, "debug", "true") == nil)
+
+	assert.Equals(t, ocrRequest.EngineType, EngineSandwichTesseract)
+	assert.Equals(t, ocrRequest.EngineArgs["lang"], "deu")
+	assert.Equals(t, len(ocrRequest.PreprocessorChain), 2)
+	assert.True(t, ocrRequest.Deferred)
+	assert.Equals(t, ocrRequest.TimeOut, uint(30))
+	assert.Equals(t, ocrRequest.DocType, "123")
+	assert.True(t, ocrRequest.Debug)
+
+	assert.True(t, applyFormField(&ocrRequest, "time_out", "soon") != nil)
+
+}
+
+func TestOcrHttpMultipartHandlerFormData(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpMultipartHandler(&rabbitConfig)
+
+	fields := map[string]string{"engine": "mock", "inplace_decode": "true"}
+	body, contentType := newFormDataUpload(t, fields, "application/pdf", []byte("%PDF-1.4"))
+	req := httptest.NewRequest("POST", "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equals(t, rec.Code, 200)
+	assert.Equals(t, rec.Header().Get("Content-Type"), "application/json")
+	ocrResult := OcrResult{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &ocrResult) == nil)
+	assert.Equals(t, ocrResult.Text, MockEngineResponse)
+
+}
+
+func TestOcrHttpMultipartHandlerStreamsUpload(t *testing.T) {
+
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpMultipartHandler(&rabbitConfig)
+	body, contentType := newFormDataUpload(t, map[string]string{"engine": "mock"}, "application/pdf", []byte("%PDF-1.4"))
+	req := httptest.NewRequest("POST", "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", contentType)
+	ocrRequest, err := handler.extractParts(req, &rabbitConfig)
+	assert.True(t, err == nil)
+	defer os.Remove(ocrRequest.upload.path)
+
+	// the document stays in its file until the request is published
+	assert.True(t, ocrRequest.ImgBytes == nil)
+	assert.Equals(t, ocrRequest.upload.size, int64(8))
+	checksum := sha256.Sum256([]byte("%PDF-1.4"))
+	assert.Equals(t, ocrRequest.upload.sha256, hex.EncodeToString(checksum[:]))
+	// an upload is cached like the same document sent inline
+	inline := OcrRequest{EngineType: EngineMock, ImgBytes: []byte("%PDF-1.4")}
+	assert.Equals(t, resultCacheKey(&ocrRequest), resultCacheKey(&inline))
+
+}
+
+func TestOcrHttpMultipartHandlerConflicts(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpMultipartHandler(&rabbitConfig)
+	upload := func(fields [][2]string) int {
+		body := &bytes.Buffer{}
+		formWriter := multipart.NewWriter(body)
+		for _, nameValue := range fields {
+			assert.True(t, formWriter.WriteField(nameValue[0], nameValue[1]) == nil)
+		}
+		filePart, err := formWriter.CreateFormFile("file", "upload.pdf")
+		assert.True(t, err == nil)
+		_, _ = filePart.Write([]byte("%PDF-1.4"))
+		assert.True(t, formWriter.Close() == nil)
+		req := httptest.NewRequest("POST", "/ocr-file-upload", body)
+		req.Header.Set("Content-Type", formWriter.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equals(t, upload([][2]string{{"engine", "mock"}, {"inplace_decode", "true"}, {"engine", "mock"}}), 200)
+	assert.Equals(t, upload([][2]string{{"engine", "mock"}, {"inplace_decode", "true"}, {"engine", "tesseract"}}), 400)
+	assert.Equals(t, upload([][2]string{{"engine", "tesseract"}, {"request", `{"engine":"mock","inplace_decode":true}`}}), 400)
+	// debug bundles need the debug token
+	assert.Equals(t, upload([][2]string{{"engine", "mock"}, {"inplace_decode", "true"}, {"debug", "true"}}), 403)
+
+}
+
+func TestOcrHttpMultipartHandlerLimits(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	rabbitConfig.MaxUploadSize = 1024
+	handler := NewOcrHttpMultipartHandler(&rabbitConfig)
+
+	fields := map[string]string{"engine": "mock", "inplace_decode": "true"}
+	body, contentType := newFormDataUpload(t, fields, "image/tiff", make([]byte, 4096))
+	req := httptest.NewRequest("POST", "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", contentType)
+	// pretend the size is unknown so the streaming limit kicks in
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, 413)
+
+	body, contentType = newFormDataUpload(t, fields, "text/html", []byte("<html></html>"))
+	req = httptest.NewRequest("POST", "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, 415)
+
+}
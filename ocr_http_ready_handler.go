@@ -0,0 +1,38 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OcrHttpReadyHandler answers with 200 if the http daemon accepts new requests, otherwise with 503.
+// The body explains the last decision of the admission controller.
+type OcrHttpReadyHandler struct {
+}
+
+func NewOcrHttpReadyHandler() *OcrHttpReadyHandler {
+	return &OcrHttpReadyHandler{}
+}
+
+func (s *OcrHttpReadyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "this endpoint only accepts GET requests", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := CurrentAdmissionState()
+	js, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !state.Accepting {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
+}
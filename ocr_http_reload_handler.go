@@ -0,0 +1,50 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OcrHttpReloadHandler reloads the configuration of cli-httpd, like SIGHUP does,
+// and answers with the settings which have changed, it needs the admin token
+type OcrHttpReloadHandler struct {
+	RabbitConfig RabbitConfig
+}
+
+type reloadResponse struct {
+	Changes []ConfigChange `json:"changes"`
+}
+
+func NewOcrHttpReloadHandler(r *RabbitConfig) *OcrHttpReloadHandler {
+	return &OcrHttpReloadHandler{
+		RabbitConfig: *r,
+	}
+}
+
+func (s *OcrHttpReloadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "this endpoint only accepts POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	if !checkAdminToken(w, req, &rabbitConfig) {
+		return
+	}
+
+	changes, err := ReloadConfig()
+	if err != nil {
+		http.Error(w, "reloading the configuration failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(reloadResponse{Changes: changes})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
+}
@@ -0,0 +1,50 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OcrHttpWorkersHandler returns the last heartbeat of every live worker, it needs the admin token
+type OcrHttpWorkersHandler struct {
+	RabbitConfig RabbitConfig
+}
+
+type workersResponse struct {
+	Workers []WorkerAnnouncement `json:"workers"`
+	// RunningJobs is the number of requests processed by all workers
+	RunningJobs int `json:"running_jobs"`
+}
+
+func NewOcrHttpWorkersHandler(r *RabbitConfig) *OcrHttpWorkersHandler {
+	return &OcrHttpWorkersHandler{
+		RabbitConfig: *r,
+	}
+}
+
+func (s *OcrHttpWorkersHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "this endpoint only accepts GET requests", http.StatusMethodNotAllowed)
+		return
+	}
+	rabbitConfig := withReloadedSettings(s.RabbitConfig)
+	if !checkAdminToken(w, req, &rabbitConfig) {
+		return
+	}
+
+	response := workersResponse{Workers: LiveWorkers()}
+	for _, worker := range response.Workers {
+		response.RunningJobs += len(worker.RequestIDs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
+}
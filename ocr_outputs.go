@@ -0,0 +1,187 @@
+package ocrworker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// the formats which can be requested in the outputs of a request
+const (
+	OutputCombinedPdf  = "combinedpdf"
+	OutputOcrLayerOnly = "ocrlayeronly"
+	OutputTxt          = "txt"
+	OutputHocr         = "hocr"
+)
+
+// engineOutputs are the formats every engine produces from its single recognition pass
+var engineOutputs = map[OcrEngineType][]string{
+	EngineTesseract:         {OutputTxt, OutputHocr, OutputCombinedPdf},
+	EngineSandwichTesseract: {OutputCombinedPdf, OutputOcrLayerOnly, OutputTxt, OutputHocr, OutputPdfa, OutputPdfaSigned},
+	EngineMock:              {OutputTxt},
+}
+
+// OcrOutput is an artifact requested in the outputs of a request
+type OcrOutput struct {
+	ContentType string `json:"content_type"`
+	// Encoding is base64 for the pdf formats and utf-8 for the text formats
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+func newOcrOutput(format string, content []byte) OcrOutput {
+	switch format {
+	case OutputCombinedPdf, OutputOcrLayerOnly, OutputPdfa, OutputPdfaSigned:
+		return OcrOutput{ContentType: "application/pdf", Encoding: "base64", Content: base64.StdEncoding.EncodeToString(content)}
+	case OutputHocr:
+		return OcrOutput{ContentType: "application/xhtml+xml", Encoding: "utf-8", Content: string(content)}
+	default:
+		return OcrOutput{ContentType: "text/plain; charset=utf-8", Encoding: "utf-8", Content: string(content)}
+	}
+}
+
+// Bytes returns the decoded content of the output
+func (o OcrOutput) Bytes() ([]byte, error) {
+	if o.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(o.Content)
+	}
+	return []byte(o.Content), nil
+}
+
+// requestedOutputs returns the lower cased outputs of a request without duplicates
+func requestedOutputs(ocrRequest *OcrRequest) []string {
+	var outputs []string
+	seen := make(map[string]bool)
+	for _, output := range ocrRequest.Outputs {
+		output = strings.ToLower(output)
+		if !seen[output] {
+			seen[output] = true
+			outputs = append(outputs, output)
+		}
+	}
+	return outputs
+}
+
+// validateOutputs checks if the engine can produce the requested outputs
+func validateOutputs(validationErr *OcrRequestValidationError, ocrRequest *OcrRequest) {
+	supported := engineOutputs[ocrRequest.EngineType]
+	for _, output := range requestedOutputs(ocrRequest) {
+		found := false
+		for _, format := range supported {
+			found = found || format == output
+		}
+		if !found {
+			validationErr.add("outputs", fmt.Sprintf("%s is not supported by the engine, use one of %s",
+				output, strings.Join(supported, ", ")))
+		}
+	}
+}
+
+// sortedOutputs returns the outputs in a stable order for the result cache key
+func sortedOutputs(ocrRequest *OcrRequest) []string {
+	outputs := requestedOutputs(ocrRequest)
+	sort.Strings(outputs)
+	return outputs
+}
+
+// the word boxes of pdftotext -bbox-layout, in points
+type bboxLayoutPage struct {
+	Width  float64           `xml:"width,attr"`
+	Height float64           `xml:"height,attr"`
+	Blocks []bboxLayoutBlock `xml:"flow>block"`
+}
+
+type bboxLayoutBlock struct {
+	bboxLayoutBox
+	Lines []bboxLayoutLine `xml:"line"`
+}
+
+type bboxLayoutLine struct {
+	bboxLayoutBox
+	Words []bboxLayoutWord `xml:"word"`
+}
+
+type bboxLayoutWord struct {
+	bboxLayoutBox
+	Text string `xml:",chardata"`
+}
+
+type bboxLayoutBox struct {
+	XMin float64 `xml:"xMin,attr"`
+	YMin float64 `xml:"yMin,attr"`
+	XMax float64 `xml:"xMax,attr"`
+	YMax float64 `xml:"yMax,attr"`
+}
+
+func (b bboxLayoutBox) title() string {
+	return fmt.Sprintf("bbox %d %d %d %d", int(math.Round(b.XMin)), int(math.Round(b.YMin)),
+		int(math.Round(b.XMax)), int(math.Round(b.YMax)))
+}
+
+// bboxLayoutToHocr converts the output of pdftotext -bbox-layout into hOCR, the text layer of pdfsandwich
+// holds the words at the positions tesseract found them. The coordinates are in points, as scan_res tells.
+func bboxLayoutToHocr(bboxLayout []byte) ([]byte, error) {
+	var pages []bboxLayoutPage
+	decoder := xml.NewDecoder(bytes.NewReader(bboxLayout))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the word boxes: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "page" {
+			page := bboxLayoutPage{}
+			if err := decoder.DecodeElement(&page, &start); err != nil {
+				return nil, fmt.Errorf("could not parse the word boxes: %w", err)
+			}
+			pages = append(pages, page)
+		}
+	}
+
+	var hocr bytes.Buffer
+	hocr.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title></title>
+  <meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>
+  <meta name="ocr-system" content="open-ocr"/>
+  <meta name="ocr-capabilities" content="ocr_page ocr_carea ocr_par ocr_line ocrx_word"/>
+ </head>
+ <body>
+`)
+	for p, page := range pages {
+		fmt.Fprintf(&hocr, "  <div class=\"ocr_page\" id=\"page_%d\" title=\"bbox 0 0 %d %d; ppageno %d; scan_res 72 72\">\n",
+			p+1, int(math.Round(page.Width)), int(math.Round(page.Height)), p)
+		words := 0
+		for b, block := range page.Blocks {
+			fmt.Fprintf(&hocr, "   <div class=\"ocr_carea\" id=\"block_%d_%d\" title=\"%s\">\n", p+1, b+1, block.title())
+			fmt.Fprintf(&hocr, "    <p class=\"ocr_par\" id=\"par_%d_%d\" title=\"%s\">\n", p+1, b+1, block.title())
+			for l, line := range block.Lines {
+				fmt.Fprintf(&hocr, "     <span class=\"ocr_line\" id=\"line_%d_%d_%d\" title=\"%s\">", p+1, b+1, l+1, line.title())
+				for _, word := range line.Words {
+					words++
+					fmt.Fprintf(&hocr, "<span class=\"ocrx_word\" id=\"word_%d_%d\" title=\"%s\">", p+1, words, word.title())
+					if err := xml.EscapeText(&hocr, []byte(strings.ToValidUTF8(word.Text, "\uFFFD"))); err != nil {
+						return nil, err
+					}
+					hocr.WriteString("</span> ")
+				}
+				hocr.WriteString("</span>\n")
+			}
+			hocr.WriteString("    </p>\n   </div>\n")
+		}
+		hocr.WriteString("  </div>\n")
+	}
+	hocr.WriteString(" </body>\n</html>\n")
+	return hocr.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package ocrworker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const testBboxLayout = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+<title></title>
+<meta name="Producer" content="Tesseract 4.1.1"/>
+</head>
+<body>
+<doc>
+  <page width="595.000000" height="842.000000">
+    <flow>
+      <block xMin="56.000000" yMin="70.200000" xMax="240.500000" yMax="84.000000">
+        <line xMin="56.000000" yMin="70.200000" xMax="240.500000" yMax="84.000000">
+          <word xMin="56.000000" yMin="70.200000" xMax="110.000000" yMax="84.000000">Invoice</word>
+          <word xMin="115.000000" yMin="70.200000" xMax="240.500000" yMax="84.000000">A&amp;B&lt;1&gt;</word>
+        </line>
+      </block>
+    </flow>
+  </page>
+  <page width="595.000000" height="842.000000">
+  </page>
+</doc>
+</body>
+</html>
+`
+
+func TestBboxLayoutToHocr(t *testing.T) {
+
+	hocr, err := bboxLayoutToHocr([]byte(testBboxLayout))
+	assert.True(t, err == nil)
+	text := string(hocr)
+	assert.True(t, strings.Contains(text, `<div class="ocr_page" id="page_1" title="bbox 0 0 595 842; ppageno 0; scan_res 72 72">`))
+	assert.True(t, strings.Contains(text, `<div class="ocr_page" id="page_2" title="bbox 0 0 595 842; ppageno 1; scan_res 72 72">`))
+	assert.True(t, strings.Contains(text, `<span class="ocr_line" id="line_1_1_1" title="bbox 56 70 241 84">`))
+	assert.True(t, strings.Contains(text, `<span class="ocrx_word" id="word_1_1" title="bbox 56 70 110 84">Invoice</span>`))
+	// the text is escaped again
+	assert.True(t, strings.Contains(text, `>A&amp;B&lt;1&gt;</span>`))
+
+	_, err = bboxLayoutToHocr([]byte(`<doc><page width="a"></page></doc>`))
+	assert.True(t, err != nil)
+
+}
+
+func TestOcrOutputs(t *testing.T) {
+
+	pdf := newOcrOutput(OutputCombinedPdf, []byte("%PDF-1.5"))
+	assert.Equals(t, pdf.ContentType, "application/pdf")
+	assert.Equals(t, pdf.Encoding, "base64")
+	content, err := pdf.Bytes()
+	assert.True(t, err == nil)
+	assert.Equals(t, string(content), "%PDF-1.5")
+	assert.Equals(t, newOcrOutput(OutputTxt, []byte("text")).Content, "text")
+
+	rabbitConfig := rabbitConfigForTests()
+	// the outputs replace the ocr_type of the sandwich engine
+	ocrRequest := OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"lang": "deu"}, Outputs: []string{"CombinedPdf", "txt", "hocr", "txt"}}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	assert.Equals(t, strings.Join(requestedOutputs(&ocrRequest), ","), "combinedpdf,txt,hocr")
+
+	ocrRequest.Outputs = nil
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*OcrRequestValidationError).InvalidParams[0].Name, "engine_args.ocr_type")
+
+	ocrRequest = OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineTesseract, Outputs: []string{"ocrlayeronly"}}
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*OcrRequestValidationError).InvalidParams[0].Name, "outputs")
+
+	// the order of the outputs does not change the cached result
+	ocrRequest = OcrRequest{ImgBytes: []byte("document"), EngineType: EngineMock, Outputs: []string{"txt"}}
+	sameRequest := ocrRequest
+	sameRequest.Outputs = []string{"TXT", "txt"}
+	assert.Equals(t, resultCacheKey(&ocrRequest), resultCacheKey(&sameRequest))
+	sameRequest.Outputs = nil
+	assert.NotEquals(t, resultCacheKey(&ocrRequest), resultCacheKey(&sameRequest))
+
+	ocrResult, err := MockEngine{}.ProcessRequest(&ocrRequest, &WorkerConfig{})
+	assert.True(t, err == nil)
+	assert.Equals(t, ocrResult.Outputs[OutputTxt].Content, MockEngineResponse)
+
+}
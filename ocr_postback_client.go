@@ -2,13 +2,19 @@ package ocrworker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var postTimeout = 50 * time.Second
@@ -20,26 +26,56 @@ func newOcrPostClient() *ocrPostClient {
 	return &ocrPostClient{}
 }
 
-func (c *ocrPostClient) postOcrRequest(ocrResult *OcrResult, replyToAddress string, numTry uint) error {
-	logger := zerolog.New(os.Stdout).With().Str("RequestID", ocrResult.ID).Timestamp().Logger()
-	logger.Info().Str("component", "OCR_HTTP").
-		Uint("attempt", numTry).
-		Str("replyToAddress", replyToAddress).
-		Msg("sending ocr back to requester")
-
+func (c *ocrPostClient) postOcrRequest(ctx context.Context, ocrResult *OcrResult, replyToAddress string, numTry uint) error {
 	jsonReply, err := json.Marshal(ocrResult)
 	if err != nil {
 		ocrResult.Status = "error"
 	}
+	return c.postJSON(ctx, jsonReply, ocrResult.ID, replyToAddress, numTry)
+}
+
+// postOcrResultWithRetries delivers the result to the requester, a failed delivery is retried numRetries times
+func (c *ocrPostClient) postOcrResultWithRetries(ctx context.Context, ocrResult *OcrResult, replyToAddress string,
+	tryCounter uint, logger *zerolog.Logger) {
+	for ok := true; ok; ok = tryCounter <= numRetries {
+		err := c.postOcrRequest(ctx, ocrResult, replyToAddress, tryCounter)
+		if err == nil {
+			logger.Debug().Msg("delivery was successful")
+			return
+		}
+		logger.Info().Uint("delivery_attempt", tryCounter).Msg("delivery attempt " +
+			strconv.FormatUint(uint64(tryCounter), 10) + " was not successful, attempt " + strconv.FormatUint(uint64(tryCounter), 10) +
+			"/" + strconv.FormatUint(uint64(numRetries), 10))
+		tryCounter++
+		logger.Error().Err(err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// postJSON delivers an already marshalled reply to the requester
+func (c *ocrPostClient) postJSON(ctx context.Context, jsonReply []byte, requestID, replyToAddress string, numTry uint) (err error) {
+	ctx, span := tracer.Start(ctx, "webhook delivery", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.url", replyToAddress),
+		attribute.Int("ocr.delivery_attempt", int(numTry)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	logger := zerolog.New(os.Stdout).With().Str("RequestID", requestID).Timestamp().Logger()
+	logger.Info().Str("component", "OCR_HTTP").
+		Uint("attempt", numTry).
+		Str("replyToAddress", replyToAddress).
+		Msg("sending ocr back to requester")
 
 	req, err := http.NewRequest("POST", replyToAddress, bytes.NewBuffer(jsonReply))
 	if err != nil {
 		logger.Error().Str("component", "OCR_HTTP").Err(err).Msg("forming POST reply error")
+		return err
 	}
 	req.Close = true
 	req.Header.Set("User-Agent", "open-ocr/"+version)
 	req.Header.Set("X-Custom-Header", "automated reply")
 	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	client := &http.Client{Timeout: postTimeout}
 	resp, err := client.Do(req)
@@ -59,10 +95,14 @@ func (c *ocrPostClient) postOcrRequest(ocrResult *OcrResult, replyToAddress stri
 			Msg("ocr was probably not delivered, response body is empty")
 		return err
 	}
+	bodyLenToLog := len(body)
+	if bodyLenToLog > 32 {
+		bodyLenToLog = 32
+	}
 	logger.Info().Str("component", "OCR_HTTP").
 		Int("RESPONSE_CODE", header).
 		Str("replyToAddress", replyToAddress).
-		Interface("payload(first 32 bytes)", string(body[0:32])).
+		Interface("payload(first 32 bytes)", string(body[0:bodyLenToLog])).
 		Msg("target responded")
 
 	return err
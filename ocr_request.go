@@ -1,7 +1,16 @@
 package ocrworker
 
-import "fmt"
-import "encoding/base64"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type OcrRequest struct {
 	ImgUrl            string                 `json:"img_url"`
@@ -11,16 +20,50 @@ type OcrRequest struct {
 	PreprocessorChain []string               `json:"preprocessors"`
 	PreprocessorArgs  map[string]interface{} `json:"preprocessor-args"`
 	EngineArgs        map[string]interface{} `json:"engine_args"`
-	Deferred          bool                   `json:"deferred"`
-	ReplyTo           string                 `json:"reply_to"`
-	DocType           string                 `json:"doc_type"`
-	RequestID         string                 `json:"req_id"`
-	PageNumber        uint16                 `json:"page_number"`
-	UserAgent         string                 `json:"user_agent"`
-	TimeOut           uint                   `json:"time_out"`
-	ReferenceID       string                 `json:"reference_id"`
+	// Outputs are the formats produced from the recognition pass next to the text, see engineOutputs
+	Outputs     []string `json:"outputs,omitempty"`
+	Deferred    bool     `json:"deferred"`
+	ReplyTo     string   `json:"reply_to"`
+	DocType     string   `json:"doc_type"`
+	RequestID   string   `json:"req_id"`
+	PageNumber  uint16   `json:"page_number"`
+	UserAgent   string   `json:"user_agent"`
+	TimeOut     uint     `json:"time_out"`
+	ReferenceID string   `json:"reference_id"`
+	// Title is the title in the metadata of the PDF/A outputs
+	Title string `json:"title,omitempty"`
 	// decode ocr in http handler rather than putting in queue
 	InplaceDecode bool `json:"inplace_decode"`
+	// Debug asks the worker for a debug bundle, it needs the debug token
+	Debug bool `json:"debug"`
+	// ReportProgress makes the preprocessors and workers report the progress of a synchronous request
+	// like the one of a deferred request, Watch of the gRPC api follows it
+	ReportProgress bool `json:"report_progress,omitempty"`
+	// ImgBlob replaces ImgBytes if the document was moved to the blob store, clients can't set it
+	ImgBlob *BlobRef `json:"img_blob,omitempty"`
+	// Cache is "bypass" to skip the result cache, the result replaces the cached one
+	Cache string `json:"cache"`
+	// DebugArtifacts are collected by the preprocessors of a debug request, clients can't set them
+	DebugArtifacts []DebugArtifact `json:"debug_artifacts,omitempty"`
+	// upload is the document streamed to a file by the multipart handler, it is only read into memory
+	// if it has to travel inside the message
+	upload *uploadedDocument
+	// onResult is called with the result as soon as it arrives from the worker, the result cache is filled by it
+	onResult func(ocrResult OcrResult)
+	// onRequestID is called with the id of the request before it is queued
+	onRequestID func(requestID string)
+	// traceCtx holds the span the request is processed in, between the services it travels in the amqp headers
+	traceCtx context.Context
+	// workDir is the directory of the job on the worker or preprocessor, all its files are created there
+	workDir string
+}
+
+// traceContext returns the context of the span the request is processed in
+func (ocrRequest *OcrRequest) traceContext() context.Context {
+	if ocrRequest.traceCtx == nil {
+		return context.Background()
+	}
+	return ocrRequest.traceCtx
 }
 
 // figure out the next pre-processor routing key to use (if any).
@@ -58,7 +101,10 @@ func (ocrRequest *OcrRequest) hasBase64() bool {
 
 func (ocrRequest *OcrRequest) downloadImgUrl() error {
 
+	_, span := tracer.Start(ocrRequest.traceContext(), "download image",
+		trace.WithAttributes(attribute.String("http.url", ocrRequest.ImgUrl)))
 	bytes, err := url2bytes(ocrRequest.ImgUrl)
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
@@ -67,6 +113,40 @@ func (ocrRequest *OcrRequest) downloadImgUrl() error {
 	return nil
 }
 
+// loadImage makes sure the document is in ImgBytes or in the uploaded file, it decodes img_base64
+// or downloads img_url
+func (ocrRequest *OcrRequest) loadImage() error {
+	if ocrRequest.ImgBytes != nil || ocrRequest.upload != nil {
+		return nil
+	}
+	if ocrRequest.hasBase64() {
+		return ocrRequest.decodeBase64()
+	}
+	return ocrRequest.downloadImgUrl()
+}
+
+// readUpload reads the uploaded file into ImgBytes
+func (ocrRequest *OcrRequest) readUpload() error {
+	if ocrRequest.upload == nil || ocrRequest.ImgBytes != nil {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(ocrRequest.upload.path)
+	if err != nil {
+		return fmt.Errorf("failed to read uploaded file: %w", err)
+	}
+	ocrRequest.ImgBytes = bytes
+	return nil
+}
+
+// documentSHA256 is the hex encoded sha256 of the document, the one of an upload was taken while it was streamed
+func (ocrRequest *OcrRequest) documentSHA256() string {
+	if ocrRequest.upload != nil {
+		return ocrRequest.upload.sha256
+	}
+	checksum := sha256.Sum256(ocrRequest.ImgBytes)
+	return hex.EncodeToString(checksum[:])
+}
+
 func (ocrRequest *OcrRequest) String() string {
 	return fmt.Sprintf("ImgUrl: %s, EngineType: %s, Preprocessors: %s, Request ID: %s", ocrRequest.ImgUrl, ocrRequest.EngineType, ocrRequest.PreprocessorChain, ocrRequest.RequestID)
 }
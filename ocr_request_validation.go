@@ -0,0 +1,233 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// engineArgsSchemas holds a JSON Schema per engine which is used to validate the engine_args of a request
+// before anything is queued. Args of another engine are ignored, so clients can send the same args to
+// every engine, args no engine knows like a misspelled ocr_typ are rejected.
+var engineArgsSchemas = map[OcrEngineType]string{
+	EngineTesseract: `{
+  "type": "object",
+  "properties": {
+    "config_vars": {"type": "object", "additionalProperties": {"type": "string"}},
+    "psm": {"type": "string", "pattern": "^([0-9]|1[0-3])$"},
+    "lang": {"type": "string", "pattern": "^(script/)?[A-Za-z0-9_]+(\\+(script/)?[A-Za-z0-9_]+)*$"},
+    "auto_orient": {"type": "boolean"}
+  },
+  "additionalProperties": false
+}`,
+	EngineSandwichTesseract: `{
+  "type": "object",
+  "properties": {
+    "config_vars": {"type": "object", "additionalProperties": {"type": "string"}},
+    "lang": {"type": "string", "pattern": "^(script/)?[A-Za-z0-9_]+(\\+(script/)?[A-Za-z0-9_]+)*$"},
+    "ocr_type": {"type": "string", "pattern": "^(?i)(combinedpdf|ocrlayeronly|txt|pdfa|pdfa_signed)$"},
+    "result_optimize": {"type": "boolean"},
+    "psm": {"type": "string", "pattern": "^([0-9]|1[0-3])$"},
+    "disable_unpaper": {"type": "boolean"},
+    "unpo": {"type": "string"},
+    "coo": {"type": "string"},
+    "enable_grayfilter": {"type": "boolean"},
+    "auto_orient": {"type": "boolean"},
+    "pdfa_level": {"type": "string", "enum": ["1b", "2b", "3b"]},
+    "optimize_profile": {"type": "string", "pattern": "^[A-Za-z0-9_-]+$"},
+    "optimize_dpi": {"type": "integer", "minimum": 36, "maximum": 1200},
+    "optimize_jpeg_quality": {"type": "integer", "minimum": 1, "maximum": 100},
+    "optimize_jbig2": {"type": "boolean"},
+    "ocr_mode": {"type": "string", "enum": ["skip_text", "redo_ocr", "force_ocr"]}
+  },
+  "additionalProperties": false
+}`,
+	EngineMock: `{"type": "object", "additionalProperties": false}`,
+}
+
+var compiledEngineArgsSchemas = compileEngineArgsSchemas()
+
+// knownEngineArgs are the engine args of all engines
+var knownEngineArgs = collectEngineArgs()
+
+func compileEngineArgsSchemas() map[OcrEngineType]*gojsonschema.Schema {
+	schemas := make(map[OcrEngineType]*gojsonschema.Schema)
+	for engineType, schemaJSON := range engineArgsSchemas {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schemaJSON))
+		if err != nil {
+			panic(fmt.Sprintf("invalid engine_args schema for %s: %v", engineType, err))
+		}
+		schemas[engineType] = schema
+	}
+	return schemas
+}
+
+func collectEngineArgs() map[string]bool {
+	known := make(map[string]bool)
+	for engineType, schemaJSON := range engineArgsSchemas {
+		schema := struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		}{}
+		if err := json.Unmarshal([]byte(schemaJSON), &schema); err != nil {
+			panic(fmt.Sprintf("invalid engine_args schema for %s: %v", engineType, err))
+		}
+		for name := range schema.Properties {
+			known[name] = true
+		}
+	}
+	return known
+}
+
+// InvalidParam describes a single invalid field of a request
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// OcrRequestValidationError is returned if a request does not pass the validation, it lists every invalid field
+type OcrRequestValidationError struct {
+	InvalidParams []InvalidParam
+}
+
+func (e *OcrRequestValidationError) Error() string {
+	reasons := make([]string, 0, len(e.InvalidParams))
+	for _, param := range e.InvalidParams {
+		reasons = append(reasons, param.Name+": "+param.Reason)
+	}
+	return "invalid request: " + strings.Join(reasons, "; ")
+}
+
+func (e *OcrRequestValidationError) add(name, reason string) {
+	e.InvalidParams = append(e.InvalidParams, InvalidParam{Name: name, Reason: reason})
+}
+
+// ValidateOcrRequest checks a request before it is handed over to the workers.
+// The engine_args are validated by the JSON Schema of the selected engine.
+func ValidateOcrRequest(ocrRequest *OcrRequest, rabbitConfig *RabbitConfig) error {
+	validationErr := &OcrRequestValidationError{}
+
+	schema, ok := compiledEngineArgsSchemas[ocrRequest.EngineType]
+	if !ok {
+		validationErr.add("engine", fmt.Sprintf("engine %d is not supported", ocrRequest.EngineType))
+	} else if ocrRequest.EngineArgs != nil {
+		result, err := schema.Validate(gojsonschema.NewGoLoader(ocrRequest.EngineArgs))
+		if err != nil {
+			validationErr.add("engine_args", err.Error())
+		} else {
+			for _, resultErr := range result.Errors() {
+				name := "engine_args"
+				if field := resultErr.Field(); field != "(root)" {
+					name = name + "." + field
+				}
+				property := fmt.Sprint(resultErr.Details()["property"])
+				if resultErr.Type() == "additional_property_not_allowed" && knownEngineArgs[property] {
+					log.Warn().Str("component", "OCR_HTTP").Str("engine", ocrRequest.EngineType.String()).
+						Str("arg", property).Msg("ignoring an engine arg of another engine")
+					continue
+				}
+				if resultErr.Type() == "required" || resultErr.Type() == "additional_property_not_allowed" {
+					name = name + "." + property
+				}
+				validationErr.add(name, resultErr.Description())
+			}
+		}
+	}
+	// the sandwich engine needs to know what to return, the ocr_type or the outputs
+	if _, ok := ocrRequest.EngineArgs["ocr_type"]; !ok && ocrRequest.EngineType == EngineSandwichTesseract &&
+		len(ocrRequest.Outputs) == 0 {
+		validationErr.add("engine_args.ocr_type", "ocr_type is required")
+	}
+	validateOutputs(validationErr, ocrRequest)
+
+	if lang, ok := ocrRequest.EngineArgs["lang"].(string); ok {
+		validateLanguage(validationErr, ocrRequest.EngineType, lang)
+	}
+
+	if ocrRequest.ImgUrl == "" && ocrRequest.ImgBase64 == "" && len(ocrRequest.ImgBytes) == 0 &&
+		ocrRequest.upload == nil {
+		validationErr.add("img_url", "one of img_url, img_base64 or an uploaded file is required")
+	}
+	if ocrRequest.ReplyTo != "" {
+		if _, err := checkURLForReplyTo(ocrRequest.ReplyTo); err != nil {
+			validationErr.add("reply_to", err.Error())
+		}
+	}
+	if ocrRequest.Cache != "" && ocrRequest.Cache != CacheBypass {
+		validationErr.add("cache", "must be empty or "+CacheBypass)
+	}
+
+	if len(validationErr.InvalidParams) == 0 {
+		return nil
+	}
+	sort.SliceStable(validationErr.InvalidParams, func(i, j int) bool {
+		return validationErr.InvalidParams[i].Name < validationErr.InvalidParams[j].Name
+	})
+	return validationErr
+}
+
+// validateLanguage checks if the requested languages are installed on at least one live worker.
+// If no worker has announced its languages yet, the check is skipped.
+func validateLanguage(validationErr *OcrRequestValidationError, engineType OcrEngineType, lang string) {
+	if lang == "auto" {
+		if engineType != EngineTesseract {
+			validationErr.add("engine_args.lang", "auto detection of the language is only supported by the tesseract engine")
+		}
+		return
+	}
+	languages, scripts, numWorkers := AvailableLanguages()
+	if numWorkers == 0 {
+		return
+	}
+	available := make(map[string]bool)
+	for _, language := range languages {
+		available[language] = true
+	}
+	for _, script := range scripts {
+		available[scriptPrefix+script] = true
+	}
+	for _, language := range strings.Split(lang, "+") {
+		if !available[language] {
+			validationErr.add("engine_args.lang", fmt.Sprintf("language %s is not installed on any worker", language))
+		}
+	}
+}
+
+// ProblemDetails is an RFC 7807 problem+json response body
+type ProblemDetails struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+func newValidationProblem(validationErr *OcrRequestValidationError, instance string) ProblemDetails {
+	return ProblemDetails{
+		Type:          "about:blank",
+		Title:         http.StatusText(http.StatusBadRequest),
+		Status:        http.StatusBadRequest,
+		Detail:        "request validation failed",
+		Instance:      instance,
+		InvalidParams: validationErr.InvalidParams,
+	}
+}
+
+// writeProblem writes an RFC 7807 problem+json response
+func writeProblem(w http.ResponseWriter, problem ProblemDetails) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	js, err := json.Marshal(problem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(problem.Status)
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("http write() failed")
+	}
+}
@@ -0,0 +1,93 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestValidateOcrRequest(t *testing.T) {
+
+	rabbitConfig := rabbitConfigForTests()
+
+	testJSON := `{"img_url":"http://localhost/img", "engine":"sandwich", "engine_args":{"ocr_type":"combinedpdf", "psm":"1", "lang":"deu+eng"}}`
+	ocrRequest := OcrRequest{}
+	assert.True(t, json.Unmarshal([]byte(testJSON), &ocrRequest) == nil)
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+
+	testJSON = `{"img_url":"http://localhost/img", "engine":"sandwich", "engine_args":{"psm":"42", "config_vars":"foo", "result_optimize":"yes"}}`
+	ocrRequest = OcrRequest{}
+	assert.True(t, json.Unmarshal([]byte(testJSON), &ocrRequest) == nil)
+	err := ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	validationErr, ok := err.(*OcrRequestValidationError)
+	assert.True(t, ok)
+
+	names := make([]string, 0)
+	for _, param := range validationErr.InvalidParams {
+		names = append(names, param.Name)
+	}
+	assert.Equals(t, strings.Join(names, ","), "engine_args.config_vars,engine_args.ocr_type,engine_args.psm,engine_args.result_optimize")
+
+	// a time_out above the maximum is lowered by the client, it is no error
+	ocrRequest = OcrRequest{EngineType: EngineGoTesseract, TimeOut: rabbitConfig.MaximalResponseCacheTimeout + 1}
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	validationErr, ok = err.(*OcrRequestValidationError)
+	assert.True(t, ok)
+	assert.Equals(t, len(validationErr.InvalidParams), 2)
+
+	// misspelled engine args are rejected
+	ocrRequest = OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_typ": "txt", "outputs": "txt"}, Outputs: []string{"txt"}}
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	validationErr, ok = err.(*OcrRequestValidationError)
+	assert.True(t, ok)
+	names = names[:0]
+	for _, param := range validationErr.InvalidParams {
+		names = append(names, param.Name)
+	}
+	sort.Strings(names)
+	assert.Equals(t, strings.Join(names, ","), "engine_args.ocr_typ,engine_args.outputs")
+	// the args of another engine are ignored
+	ocrRequest = OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineTesseract,
+		EngineArgs: map[string]interface{}{"lang": "eng", "ocr_type": "txt", "result_optimize": true}}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	ocrRequest.EngineType = EngineMock
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+
+}
+
+func TestOcrHttpHandlerProblemResponse(t *testing.T) {
+
+	ServiceCanAccept = true
+	rabbitConfig := rabbitConfigForTests()
+	handler := NewOcrHttpHandler(&rabbitConfig)
+
+	body := `{"img_url":"http://localhost/img", "engine":"tesseract", "engine_args":{"psm":3}}`
+	req := httptest.NewRequest("POST", "/ocr", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equals(t, rec.Code, 400)
+	assert.Equals(t, rec.Header().Get("Content-Type"), "application/problem+json")
+	problem := ProblemDetails{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &problem) == nil)
+	assert.Equals(t, problem.Status, 400)
+	assert.Equals(t, problem.Instance, "/ocr")
+	assert.Equals(t, len(problem.InvalidParams), 1)
+	assert.Equals(t, problem.InvalidParams[0].Name, "engine_args.psm")
+
+}
+
+func TestNewTesseractEngineArgsInvalidConfigVars(t *testing.T) {
+
+	testJSON := `{"engine":"tesseract", "engine_args":{"config_vars":["tessedit_char_whitelist"]}}`
+	ocrRequest := OcrRequest{}
+	assert.True(t, json.Unmarshal([]byte(testJSON), &ocrRequest) == nil)
+	_, err := NewTesseractEngineArgs(&ocrRequest)
+	assert.True(t, err != nil)
+
+}
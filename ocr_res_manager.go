@@ -2,16 +2,21 @@ package ocrworker
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-// OcrQueueManager is used as a main component of resource manager
+// OcrQueueManager is the queue stats returned by the RabbitMQ management API
 type OcrQueueManager struct {
-	NumMessages  uint `json:"messages"`
-	NumConsumers uint `json:"consumers"`
-	MessageBytes uint `json:"message_bytes"`
+	// NumMessages is the sum of the ready and the unacknowledged messages, i.e. all jobs
+	// which are waiting for or processed by a worker, no matter which http daemon has published them
+	NumMessages        uint `json:"messages"`
+	NumMessagesReady   uint `json:"messages_ready"`
+	NumMessagesUnacked uint `json:"messages_unacknowledged"`
+	NumConsumers       uint `json:"consumers"`
+	MessageBytes       uint `json:"message_bytes"`
 }
 
 type ocrResManager struct {
@@ -19,136 +24,63 @@ type ocrResManager struct {
 	MemUsed  uint64 `json:"mem_used"`
 }
 
-const (
-	memoryThreshold uint64 = 95 // if memory usage of RabbitMQ is over this value, no more requests will be added
-)
-
-func newOcrQueueManager() *OcrQueueManager {
-	return &OcrQueueManager{}
-}
-
-func newOcrResManager() []ocrResManager {
-	resManager := make([]ocrResManager, 0)
-	return resManager
-}
-
 var (
-	queueManager *OcrQueueManager
-	resManager   []ocrResManager
 	// StopChan is used to gracefully stop http daemon
 	StopChan                 = make(chan bool, 1)
-	factorForMessageAccept   uint // formula: NumMessages < NumConsumers * FactorForMessageAccept
 	TechnicalErrorResManager bool
 )
 
-// checks if resources for incoming request are available
-func CheckForAcceptRequest(urlQueue, urlStat string, statusChanged bool) bool {
+// managementAPISampler scrapes the queue and node stats of the RabbitMQ management API
+type managementAPISampler struct {
+	urlQueue string
+	urlStat  string
+}
 
-	isAvailable := false
-	TechnicalErrorResManager = false
-	jsonQueueStat, err := url2bytes(urlQueue)
+func (s *managementAPISampler) sampleLoad() (AdmissionLoad, error) {
+	jsonQueueStat, err := url2bytes(s.urlQueue)
 	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_RESMAN").Msg("can't get Queue stats")
-		TechnicalErrorResManager = true
-		return false
+		return AdmissionLoad{}, fmt.Errorf("can't get queue stats: %w", err)
 	}
-	jsonResStat, err := url2bytes(urlStat)
+	jsonResStat, err := url2bytes(s.urlStat)
 	if err != nil {
-		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").
-			Str("body", string(jsonQueueStat)).
-			Bytes("payload", jsonResStat).
-			Msg("error calling url2bytes for rabbitMQ stats")
-		TechnicalErrorResManager = true
-		return false
+		return AdmissionLoad{}, fmt.Errorf("can't get node stats: %w", err)
 	}
 
-	err = json.Unmarshal(jsonQueueStat, queueManager)
-	if err != nil {
+	queueManager := OcrQueueManager{}
+	if err := json.Unmarshal(jsonQueueStat, &queueManager); err != nil {
 		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").
 			Str("body", string(jsonQueueStat)).
-			Bytes("payload", jsonQueueStat).
 			Msg("error unmarshalling json")
-		TechnicalErrorResManager = true
-		return false
-	}
-
-	err = json.Unmarshal(jsonResStat, &resManager)
-	if err != nil {
-		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").Msg("error unmarshalling json")
-		log.Error().Err(err).Str("component", "OCR_RESMAN").
-			Str("body", string(jsonResStat))
-		TechnicalErrorResManager = true
-		return false
-	}
-
-	if queueManager.NumConsumers == 0 {
-		TechnicalErrorResManager = true
-		return false
-	}
-
-	flagForResources := schedulerByMemoryLoad()
-	flagForQueue := schedulerByWorkerNumber()
-	if flagForQueue && flagForResources {
-		TechnicalErrorResManager = false
-		isAvailable = true
+		return AdmissionLoad{}, fmt.Errorf("invalid queue stats: %w", err)
 	}
-
-	if statusChanged {
-		log.Info().Str("component", "OCR_RESMAN").
-			Uint("MessageBytes", queueManager.MessageBytes).
-			Uint("NumConsumers", queueManager.NumConsumers).
-			Uint("NumMessages", queueManager.NumMessages).
-			Interface("resManager", resManager).
-			Msg("OCR_RESMAN stats")
-
-		if isAvailable {
-			log.Info().Str("component", "OCR_RESMAN").Msg("open-ocr is operational with free resources, we are ready to serve")
-		} else {
-			log.Info().Str("component", "OCR_RESMAN").Msg("open-ocr is alive but won't serve any requests; workers are busy or not connected")
-		}
-
+	resManager := make([]ocrResManager, 0)
+	if err := json.Unmarshal(jsonResStat, &resManager); err != nil {
+		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").
+			Str("body", string(jsonResStat)).
+			Msg("error unmarshalling json")
+		return AdmissionLoad{}, fmt.Errorf("invalid node stats: %w", err)
 	}
 
-	return isAvailable
-}
+	jobsQueued.Set(float64(queueManager.NumMessagesReady))
+	jobsUnacknowledged.Set(float64(queueManager.NumMessagesUnacked))
+	queueConsumers.Set(float64(queueManager.NumConsumers))
 
-// computes the ratio of total available memory and used memory and returns a bool value if a threshold is reached
-func schedulerByMemoryLoad() bool {
-	resFlag := false
-	var memTotalAvailable uint64
-	var memTotalInUse uint64
+	load := AdmissionLoad{Jobs: queueManager.NumMessages, Workers: queueManager.NumConsumers}
 	for k := range resManager {
-		memTotalInUse += resManager[k].MemUsed
-		memTotalAvailable += resManager[k].MemLimit
+		load.MemUsed += resManager[k].MemUsed
+		load.MemLimit += resManager[k].MemLimit
 	}
-
-	if memTotalInUse < ((memTotalAvailable * memoryThreshold) / 100) {
-		resFlag = true
-	}
-	return resFlag
+	return load, nil
 }
 
-// if the number of messages in the queue too high we should not accept the new messages
-func schedulerByWorkerNumber() bool {
-	resFlag := false
-	if getQueueLen() < (queueManager.NumConsumers * factorForMessageAccept) {
-		resFlag = true
+// SetResManagerState runs the configured admission controller until the http daemon is stopped
+// and sets ServiceCanAccept accordingly
+func SetResManagerState(rabbitConfig *RabbitConfig) {
+	controller, err := NewAdmissionController(rabbitConfig)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "OCR_RESMAN").Msg("invalid admission controller")
 	}
-	return resFlag
-}
-
-// SetResManagerState sets boolean value of resource manager; if memory of rabbitMQ and the number
-// messages is not exceeding  the limit
-func SetResManagerState(ampqAPIConfig *RabbitConfig) {
-	var sleepFor time.Duration = 5
-	resManager = newOcrResManager()
-	queueManager = newOcrQueueManager()
-	urlQueue := ampqAPIConfig.AmqpAPIURI + ampqAPIConfig.APIPathQueue + ampqAPIConfig.APIQueueName
-	urlStat := ampqAPIConfig.AmqpAPIURI + ampqAPIConfig.APIPathStats
-	factorForMessageAccept = ampqAPIConfig.FactorForMessageAccept
-
-	var boolCurValue = false
-	var boolOldValue = true
+	log.Info().Str("component", "OCR_RESMAN").Str("controller", controller.Name()).Msg("starting admission control")
 	for {
 		if AppStop == true {
 			break
@@ -159,14 +91,19 @@ func SetResManagerState(ampqAPIConfig *RabbitConfig) {
 			ServiceCanAccept = false
 			AppStop = true
 			ServiceCanAcceptMu.Unlock()
-			break
+			admissionMu.Lock()
+			admissionState.Accepting = false
+			admissionState.Reason = "service is going down"
+			admissionState.Since = time.Now()
+			admissionMu.Unlock()
 		default:
-			// only print the RESMAN output if the state has changed
-			ServiceCanAcceptMu.Lock()
-			boolOldValue, boolCurValue = boolCurValue, CheckForAcceptRequest(urlQueue, urlStat, boolCurValue != boolOldValue)
-			ServiceCanAccept = boolCurValue
-			ServiceCanAcceptMu.Unlock()
-			time.Sleep(sleepFor * time.Second)
+			// the thresholds and the interval may have been reloaded
+			reloaded := withReloadedSettings(*rabbitConfig)
+			if thresholdController, ok := controller.(*thresholdAdmission); ok {
+				thresholdController.thresholds = admissionThresholdsFor(&reloaded)
+			}
+			checkAdmission(controller)
+			time.Sleep(time.Duration(reloaded.AdmissionInterval) * time.Second)
 		}
 	}
 }
@@ -8,85 +8,41 @@ import (
 var (
 	requestsAndTimersMu sync.RWMutex
 	// Requests is for holding and monitoring queued requests
-	Requests           = make(map[string]chan OcrResult)
-	ocrWasSentBackChan = make(chan string)
+	Requests = make(map[string]chan OcrResult)
 )
 
 // CheckOcrStatusByID checks status of an ocr request based on origin of request
 func CheckOcrStatusByID(requestID string) (OcrResult, bool) {
 	requestsAndTimersMu.RLock()
-	if _, ok := Requests[requestID]; !ok {
-		requestsAndTimersMu.RUnlock()
+	defer requestsAndTimersMu.RUnlock()
+	rpcResponseChan, ok := Requests[requestID]
+	if !ok {
 		// log.Info().Str("component", "OCR_CLIENT").Str("requestID", requestID).Msg("no such request found in the queue")
 		return OcrResult{}, false // fmt.Errorf("no such request %s", requestID)
 	}
 
-	// log.Debug().Str("component", "OCR_CLIENT").Msg("getting ocrResult := <-Requests[requestID]")
-	ocrResult := OcrResult{}
 	select {
-	case ocrResult = <-Requests[requestID]:
-		// log.Debug().Str("component", "OCR_CLIENT").Msg("got ocrResult := <-Requests[requestID]")
+	case ocrResult := <-rpcResponseChan:
+		return ocrResult, true
 	default:
-		_, ok := Requests[requestID]
-		if ok {
-			return OcrResult{Status: "processing", ID: requestID}, true
-		}
+		return OcrResult{Status: "processing", ID: requestID}, true
 	}
-	requestsAndTimersMu.RUnlock()
-
-	return ocrResult, true
-}
-
-func getQueueLen() uint {
-	requestsAndTimersMu.RLock()
-	queueLength := uint(len(Requests))
-	requestsAndTimersMu.RUnlock()
-	return queueLength
 }
 
 func deleteRequestFromQueue(requestID string) {
 	requestsAndTimersMu.Lock()
-	inFlightGauge.Dec()
-	/*	println("!!!!!!!!!!before deleting from Requests and requestChannels")
-		for key, element := range Requests {
-			fmt.Println("Key:", key, "=>", "Element:", element)
-		}*/
-	_, ok := Requests[requestID]
-	if ok {
-		delete(Requests, requestID)
-	}
-
+	delete(Requests, requestID)
 	requestsAndTimersMu.Unlock()
-	/*log.Info().Str("component", "OCR_CLIENT").
-	  Int("nOfPendingReqs", len(Requests)).
-	  Int("nOfPendingTimers", len(requestChannels)).
-	  Msg("deleted request from the queue")
-	*/
 }
 
+// addNewOcrResultToQueue stores the channel on which the result of a deferred request will arrive.
+// The request is deleted after storageTime or as soon as the result was sent back to the requester.
 func addNewOcrResultToQueue(storageTime int, requestID string, rpcResponseChan chan OcrResult) {
-
-	inFlightGauge.Inc()
 	requestsAndTimersMu.Lock()
 	Requests[requestID] = rpcResponseChan
 	requestsAndTimersMu.Unlock()
 
-	// this go routine will cancel the request after global timeout or if request was sent back
-	// if the requestID arrives on ocrWasSentBackChan - ocrResult was send back to requester an request deletion is triggered
-	go func() {
-		select {
-		case <-ocrWasSentBackChan:
-			requestsAndTimersMu.RLock()
-			if _, ok := Requests[requestID]; ok {
-				requestsAndTimersMu.RUnlock()
-				deleteRequestFromQueue(requestID)
-			}
-		case <-time.After(time.Second * time.Duration(storageTime+10)):
-			requestsAndTimersMu.RLock()
-			if _, ok := Requests[requestID]; ok {
-				requestsAndTimersMu.RUnlock()
-				deleteRequestFromQueue(requestID)
-			}
-		}
-	}()
+	time.AfterFunc(time.Second*time.Duration(storageTime+10), func() {
+		deleteRequestFromQueue(requestID)
+	})
 }
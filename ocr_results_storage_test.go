@@ -0,0 +1,26 @@
+package ocrworker
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestOcrResultsStorage(t *testing.T) {
+	rpcResponseChan := make(chan OcrResult, 1)
+	addNewOcrResultToQueue(60, "storage-test", rpcResponseChan)
+
+	ocrResult, ok := CheckOcrStatusByID("storage-test")
+	assert.True(t, ok)
+	assert.Equals(t, ocrResult.Status, "processing")
+
+	// the lookup must release its lock, otherwise the next one would block the writers forever
+	rpcResponseChan <- OcrResult{ID: "storage-test", Status: "done", Text: "decoded"}
+	ocrResult, ok = CheckOcrStatusByID("storage-test")
+	assert.True(t, ok)
+	assert.Equals(t, ocrResult.Text, "decoded")
+
+	deleteRequestFromQueue("storage-test")
+	_, ok = CheckOcrStatusByID("storage-test")
+	assert.False(t, ok)
+}
@@ -5,13 +5,13 @@ import (
 	"fmt"
 	"net/url"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // rpcResponseTimeout sets timeout for getting the result from channel
@@ -21,12 +21,41 @@ type OcrRpcClient struct {
 	rabbitConfig RabbitConfig
 	connection   *amqp.Connection
 	channel      *amqp.Channel
+	// blobStore holds the documents which are too big for the messages, nil if they are always inline
+	blobStore BlobStore
+	// sharedConnection is set if the connection is owned by the caller (e.g. a batch)
+	// in this case only the channel will be closed after the response was received
+	sharedConnection bool
+	// onResult is the hook of the request, it is called when the result arrives
+	onResult func(ocrResult OcrResult)
 }
 
 type OcrResult struct {
 	Text   string `json:"text"`
 	Status string `json:"status"`
 	ID     string `json:"id"`
+	// Orientation is set if auto_orient was requested and holds the detection result per page
+	Orientation []PageOrientation `json:"orientation,omitempty"`
+	// Confidence is the mean word confidence of the document, PageConfidence the one of every page
+	Confidence     *float64         `json:"confidence,omitempty"`
+	PageConfidence []PageConfidence `json:"page_confidence,omitempty"`
+	// Outputs holds the outputs of the request by format
+	Outputs map[string]OcrOutput `json:"outputs,omitempty"`
+	// PdfaValidation is the report of the validator if a PDF/A file was produced and validated
+	PdfaValidation *PdfaValidation `json:"pdfa_validation,omitempty"`
+	// PageSources tells for every page if its text was taken from its text layer or recognized
+	PageSources []PageSource `json:"page_sources,omitempty"`
+	// Optimization reports the sizes if the combined pdf was optimised
+	Optimization *OptimizeReport `json:"optimization,omitempty"`
+	// DebugBundle is the tar.gz the worker sends to the http daemon, which serves it at DebugURL
+	DebugBundle []byte `json:"debug_bundle_data,omitempty"`
+	DebugURL    string `json:"debug_url,omitempty"`
+	// Cached is set if the result was served from the result cache of the http daemon
+	Cached bool `json:"cached,omitempty"`
+	// pages is the number of recognized pages, it is only known to the worker and used for its metrics
+	pages int
+	// inputBlob is the document of the request in the blob store, the worker deletes it after replying
+	inputBlob *BlobRef
 }
 
 func newOcrResult(id string) OcrResult {
@@ -41,8 +70,29 @@ var (
 )
 
 func NewOcrRpcClient(rc *RabbitConfig) (*OcrRpcClient, error) {
+	blobStore, err := NewBlobStore(rc.BlobStore)
+	if err != nil {
+		return nil, err
+	}
 	ocrRpcClient := &OcrRpcClient{
 		rabbitConfig: *rc,
+		blobStore:    blobStore,
+	}
+	return ocrRpcClient, nil
+}
+
+// NewOcrRpcClientWithConnection creates a client which reuses an already established connection
+// to the message broker instead of dialing a new one for every request
+func NewOcrRpcClientWithConnection(rc *RabbitConfig, conn *amqp.Connection) (*OcrRpcClient, error) {
+	blobStore, err := NewBlobStore(rc.BlobStore)
+	if err != nil {
+		return nil, err
+	}
+	ocrRpcClient := &OcrRpcClient{
+		rabbitConfig:     *rc,
+		connection:       conn,
+		sharedConnection: conn != nil,
+		blobStore:        blobStore,
 	}
 	return ocrRpcClient, nil
 }
@@ -99,14 +149,16 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 
 	// setting rabbitMQ correlation ID. There is no reason to be different from requestID
 	correlationID := requestID
-	urlToLog, _ := url.Parse(c.rabbitConfig.AmqpURI)
-	logger.Info().Str("DocType", ocrRequest.DocType).
-		Str("AmqpURI", urlToLog.Scheme+"://"+urlToLog.Host+urlToLog.Path).
-		Msg("dialing RabbitMQ")
+	if !c.sharedConnection {
+		urlToLog, _ := url.Parse(c.rabbitConfig.AmqpURI)
+		logger.Info().Str("DocType", ocrRequest.DocType).
+			Str("AmqpURI", urlToLog.Scheme+"://"+urlToLog.Host+urlToLog.Path).
+			Msg("dialing RabbitMQ")
 
-	c.connection, err = amqp.Dial(c.rabbitConfig.AmqpURI)
-	if err != nil {
-		return OcrResult{Text: "Internal Server Error: message broker is not reachable", Status: "error"}, 500, err
+		c.connection, err = amqp.Dial(c.rabbitConfig.AmqpURI)
+		if err != nil {
+			return OcrResult{Text: "Internal Server Error: message broker is not reachable", Status: "error"}, 500, err
+		}
 	}
 	// if we close the connection here, the deferred status wont get the ocr result
 	// and will be always returning "processing"
@@ -130,9 +182,11 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 	}
 
 	rpcResponseChan := make(chan OcrResult, c.rabbitConfig.FactorForMessageAccept)
+	c.onResult = ocrRequest.onResult
 
 	callbackQueue, err := c.subscribeCallbackQueue(correlationID, rpcResponseChan)
 	if err != nil {
+		c.release()
 		return OcrResult{}, 500, err
 	}
 
@@ -140,6 +194,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 	// connection.
 	if c.rabbitConfig.Reliable {
 		if err := c.channel.Confirm(false); err != nil {
+			c.release()
 			return OcrResult{}, 500, err
 		}
 
@@ -149,10 +204,9 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 	}
 
 	// TODO: we only need to download image urlToLog if there are
-	// any preprocessors.  if rabbitmq isn't in same data center
-	// as open-ocr, it will be expensive in terms of bandwidth
-	// to have image binary in messages
-	if ocrRequest.ImgBytes == nil {
+	// any preprocessors.  big documents are moved to the blob store
+	// below, so only small ones travel inside the messages
+	if ocrRequest.ImgBytes == nil && ocrRequest.upload == nil {
 
 		// if we do not have bytes use base 64 file by converting it to bytes
 		if ocrRequest.hasBase64() {
@@ -161,6 +215,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 			err = ocrRequest.decodeBase64()
 			if err != nil {
 				logger.Warn().Err(err).Msg("Error decoding base64")
+				c.release()
 				return OcrResult{}, 500, err
 			}
 		} else {
@@ -168,36 +223,64 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 			err = ocrRequest.downloadImgUrl()
 			if err != nil {
 				logger.Warn().Err(err).Msg("Error downloading img urlToLog")
+				c.release()
 				return OcrResult{}, 500, err
 			}
 		}
 	}
 
+	if ocrRequest.upload != nil {
+		// an uploaded document goes from its file into the blob store without being read into memory
+		err = ocrRequest.offloadUpload(ocrRequest.traceContext(), c.blobStore, c.rabbitConfig.BlobThreshold,
+			sanitizeFileName(requestID)+"/input")
+		if err != nil {
+			logger.Warn().Err(err).Msg("Error reading the uploaded document")
+			c.release()
+			return OcrResult{}, 500, err
+		}
+	} else {
+		ocrRequest.offloadImage(ocrRequest.traceContext(), c.blobStore, c.rabbitConfig.BlobThreshold,
+			sanitizeFileName(requestID)+"/input")
+	}
 	routingKey := ocrRequest.nextPreprocessor(c.rabbitConfig.RoutingKey)
 	logger.Info().Str("routingKey", routingKey).Msg("publishing with routing key")
+	ctx, publishSpan := tracer.Start(ocrRequest.traceContext(), "publish "+routingKey, trace.WithSpanKind(trace.SpanKindProducer))
 
-	ocrRequestJson, err := json.Marshal(ocrRequest)
+	ocrRequestBody, err := encodeOcrRequest(ocrRequest, c.rabbitConfig.WireEncoding)
 	if err != nil {
+		endSpan(publishSpan, err)
+		c.release()
 		return OcrResult{}, 500, err
 	}
-	if err = c.channel.Publish(
+	if ocrRequest.Deferred {
+		// the log has to exist before the first preprocessor or worker reports progress
+		startJobEvents(requestID, int(c.rabbitConfig.ResponseCacheTimeout))
+	}
+	if ocrRequest.Deferred || ocrRequest.ReportProgress {
+		recordJobProgress(requestID, JobProgress{State: JobQueued, QueuePosition: c.queuePosition(routingKey)})
+	}
+	err = c.channel.Publish(
 		c.rabbitConfig.Exchange, // publish to an exchange
 		routingKey,
 		false, // mandatory
 		false, // immediate
 		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "application/json",
+			Headers:         withSchemaVersion(traceHeaders(ctx), c.rabbitConfig.WireEncoding),
+			ContentType:     contentTypeFor(c.rabbitConfig.WireEncoding),
 			ContentEncoding: "",
-			Body:            ocrRequestJson,
+			Body:            ocrRequestBody,
 			DeliveryMode:    amqp.Transient,  // 1=non-persistent, 2=persistent
 			Priority:        messagePriority, // 0-9
 			ReplyTo:         callbackQueue.Name,
 			CorrelationId:   correlationID,
 			// a bunch of application/implementation-specific fields
 		},
-	); err != nil {
-		return OcrResult{ID: requestID}, 500, nil
+	)
+	endSpan(publishSpan, err)
+	if err != nil {
+		deleteBlob(ctx, c.blobStore, ocrRequest.ImgBlob, "OCR_CLIENT")
+		c.release()
+		return OcrResult{ID: requestID}, 500, err
 	}
 
 	if ocrRequest.Deferred {
@@ -216,13 +299,8 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 		// automatic delivery oder POST to the requester
 		// check interval for order to be ready to deliver
 		go func() {
-			// trigger deleting request from internal queue
-			defer func() {
-				select {
-				case ocrWasSentBackChan <- requestID:
-				default:
-				}
-			}()
+			// the result was sent back, there is nothing left to poll for
+			defer deleteRequestFromQueue(requestID)
 			ocrRes := OcrResult{ID: requestID, Status: "error", Text: ""}
 			ocrPostClient := newOcrPostClient()
 			var tryCounter uint = 1
@@ -232,23 +310,10 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 				case ocrResult := <-rpcResponseChan:
 					logger.Info().Msg("request is ready for sending back")
 					ocrRes = ocrResult
-					for ok := true; ok; ok = tryCounter <= numRetries {
-						err = ocrPostClient.postOcrRequest(&ocrRes, ocrRequest.ReplyTo, tryCounter)
-						if err != nil {
-							logger.Info().Uint("delivery_attempt", tryCounter).Msg("delivery attempt " +
-								strconv.FormatUint(uint64(tryCounter), 10) + " was not successful, attempt " + strconv.FormatUint(uint64(tryCounter), 10) +
-								"/" + strconv.FormatUint(uint64(numRetries), 10))
-							tryCounter++
-							logger.Error().Err(err)
-							time.Sleep(2 * time.Second)
-						} else {
-							logger.Debug().Msg("delivery was successful")
-							break T
-						}
-					}
+					ocrPostClient.postOcrResultWithRetries(ocrRequest.traceContext(), &ocrRes, ocrRequest.ReplyTo, tryCounter, &logger)
 					break T
 				case <-time.After(rpcResponseTimeout * time.Second):
-					err = ocrPostClient.postOcrRequest(&ocrRes, ocrRequest.ReplyTo, tryCounter)
+					err = ocrPostClient.postOcrRequest(ocrRequest.traceContext(), &ocrRes, ocrRequest.ReplyTo, tryCounter)
 					if err != nil {
 						tryCounter++
 						logger.Error().Err(err)
@@ -271,6 +336,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest, requestID string) (Oc
 			// logger.Debug().Str("st", ocrResult.Status).Str("text", ocrResult.Text).Str("id", ocrResult.ID)
 			return ocrResult, 200, nil
 		case <-time.After(time.Duration(c.rabbitConfig.ResponseCacheTimeout) * time.Second):
+			c.release()
 			return OcrResult{}, 500, fmt.Errorf("timeout waiting for RPC response")
 		}
 	}
@@ -320,6 +386,8 @@ func (c *OcrRpcClient) subscribeCallbackQueue(correlationID string, rpcResponseC
 		return amqp.Queue{}, err
 	}
 
+	// the job is outstanding until its result arrives or the callback queue is gone
+	addAwaitingResult(1)
 	go c.handleRPCResponse(deliveries, correlationID, rpcResponseChan)
 
 	return callbackQueue, nil
@@ -331,11 +399,21 @@ func (c *OcrRpcClient) handleRPCResponse(deliveries <-chan amqp.Delivery, correl
 	logger := zerolog.New(os.Stdout).With().
 		Str("component", "OCR_CLIENT").Str("RequestID", correlationID).Timestamp().Logger()
 	logger.Info().Msg("looping over deliveries...:")
+	defer addAwaitingResult(-1)
 
 	for d := range deliveries {
+		if d.CorrelationId == correlationID && d.Type == progressMessageType {
+			progress := JobProgress{}
+			if err := json.Unmarshal(d.Body, &progress); err != nil {
+				logger.Warn().Err(err).Msg("Error decoding the progress")
+				continue
+			}
+			recordJobProgress(correlationID, progress)
+			continue
+		}
 		if d.CorrelationId == correlationID {
 			bodyLenToLog := len(d.Body)
-			defer c.connection.Close()
+			defer c.release()
 			if bodyLenToLog > 32 {
 				bodyLenToLog = 32
 			}
@@ -344,14 +422,21 @@ func (c *OcrRpcClient) handleRPCResponse(deliveries <-chan amqp.Delivery, correl
 				Str("ReplyTo", d.ReplyTo).
 				Msg("got delivery")
 
-			ocrResult := OcrResult{}
-			err := json.Unmarshal(d.Body, &ocrResult)
+			ocrResult, err := decodeOcrResult(&d)
 			if err != nil {
-				msg := "Error unmarshalling json: %v.  Error: %v"
-				errMsg := fmt.Sprintf(msg, string(d.Body[0:bodyLenToLog]), err)
-				logger.Error().Err(fmt.Errorf(errMsg))
+				logger.Error().Err(err).Str("ContentType", d.ContentType).Msg("Error decoding the result")
 			}
 			ocrResult.ID = correlationID
+			applyConfidenceThresholds(&ocrResult, &c.rabbitConfig)
+			storeDebugBundle(correlationID, &ocrResult, c.rabbitConfig.DebugRetention)
+			finalState := JobDone
+			if ocrResult.Status == "error" {
+				finalState = JobFailed
+			}
+			recordJobProgress(correlationID, JobProgress{State: finalState})
+			if c.onResult != nil {
+				c.onResult(ocrResult)
+			}
 
 			logger.Info().Msg("send result to rpcResponseChan")
 			rpcResponseChan <- ocrResult
@@ -365,6 +450,32 @@ func (c *OcrRpcClient) handleRPCResponse(deliveries <-chan amqp.Delivery, correl
 	}
 }
 
+// queuePosition is the position a request published now gets in the queue of routingKey, 0 if it is unknown.
+// The queues are named like their routing keys.
+func (c *OcrRpcClient) queuePosition(routingKey string) int {
+	// the broker closes the channel after a failed passive declare, so it gets a channel of its own
+	channel, err := c.connection.Channel()
+	if err != nil {
+		return 0
+	}
+	defer channel.Close()
+	queue, err := channel.QueueInspect(routingKey)
+	if err != nil {
+		return 0
+	}
+	return queue.Messages + 1
+}
+
+// release closes the resources which were allocated for a single request. A shared connection
+// stays open, only the channel of this request is closed
+func (c *OcrRpcClient) release() {
+	if c.sharedConnection {
+		_ = c.channel.Close()
+		return
+	}
+	_ = c.connection.Close()
+}
+
 func confirmDelivery(ack, nack chan uint64) {
 	select {
 	case tag := <-ack:
@@ -1,7 +1,7 @@
 package ocrworker
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,6 +11,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OcrRpcWorker struct {
@@ -19,6 +21,9 @@ type OcrRpcWorker struct {
 	channel      *amqp.Channel
 	tag          string
 	Done         chan error
+	jobs         jobControl
+	// blobStore holds the documents which are too big for the messages, nil if they are always inline
+	blobStore BlobStore
 }
 
 var (
@@ -28,12 +33,17 @@ var (
 
 // NewOcrRpcWorker is needed to establish a connection to a message broker
 func NewOcrRpcWorker(wc *WorkerConfig) (*OcrRpcWorker, error) {
+	blobStore, err := NewBlobStore(wc.BlobStore)
+	if err != nil {
+		return nil, err
+	}
 	ocrRpcWorker := &OcrRpcWorker{
 		workerConfig: *wc,
 		conn:         nil,
 		channel:      nil,
 		tag:          tag,
 		Done:         make(chan error),
+		blobStore:    blobStore,
 	}
 	return ocrRpcWorker, nil
 }
@@ -138,30 +148,56 @@ func (w *OcrRpcWorker) Run() error {
 	}
 
 	go w.handle(deliveries, w.Done)
+	go w.announce()
+	setWorkerReady(nil)
 
 	return nil
 }
 
-func (w *OcrRpcWorker) Shutdown() error {
-	// will close() the deliveries channel
-	if err := w.channel.Cancel(w.tag, true); err != nil {
+// Shutdown stops consuming and waits up to grace for the running jobs. Jobs which are still running
+// after grace are aborted, their messages are requeued and ErrJobsRequeued is returned.
+func (w *OcrRpcWorker) Shutdown(grace time.Duration) error {
+	setWorkerReady(fmt.Errorf("shutting down"))
+	w.jobs.stop()
+	if w.channel == nil {
+		return fmt.Errorf("worker is not running")
+	}
+	// will close() the deliveries channel once the broker confirmed the cancel
+	if err := w.channel.Cancel(w.tag, false); err != nil {
 		return fmt.Errorf("worker with tag %s cancel failed: %s", tag, err)
 	}
 
+	log.Info().Str("component", "OCR_WORKER").
+		Str("tag", tag).
+		Dur("grace", grace).
+		Msg("stopped consuming, waiting for running jobs")
+	// wait for handle() to exit
+	result := w.jobs.awaitJobs(w.Done, grace)
+
 	if err := w.conn.Close(); err != nil {
 		return fmt.Errorf("AMQP connection with worker %s close error: %s", tag, err)
 	}
 
-	defer log.Info().Str("component", "OCR_WORKER").
+	log.Info().Str("component", "OCR_WORKER").
 		Str("tag", tag).
+		AnErr("result", result).
 		Msg("Shutdown OK")
-
-	// wait for handle() to exit
-	return <-w.Done
+	return result
 }
 
 func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error) {
+	handleErr := fmt.Errorf("handle: deliveries channel closed")
 	for d := range deliveries {
+		if w.jobs.isStopping() {
+			// prefetched messages go back to the queue for the other workers
+			requeueDelivery(&d, "OCR_WORKER")
+			continue
+		}
+		if !d.Redelivered && checkSchemaVersion(&d) != nil {
+			// an upgraded worker may understand the message, the second time it is answered with an error
+			requeueDelivery(&d, "OCR_WORKER")
+			continue
+		}
 		log.Info().Str("component", "OCR_WORKER").
 			Str("tag", tag).
 			Int("msg_size", len(d.Body)).
@@ -174,9 +210,21 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 			Str("Exchange", d.Exchange).
 			Str("RoutingKey", d.RoutingKey).
 			Msg("worker got delivery, starting processing")
+		observeQueueWait(&d)
+		ctx, span := startDeliverySpan(&d, "process ocr request")
+		jobCtx, jobDone := w.jobs.startJob(ctx)
 		// reply from engine here
 		// id is not set, Text is set, Status is set
-		ocrResult, err := w.resultForDelivery(&d)
+		ocrResult, err := w.resultForDelivery(jobCtx, &d)
+		aborted := err != nil && jobCtx.Err() != nil
+		jobDone()
+		if aborted {
+			// the job was aborted on shutdown, another worker will process it
+			endSpan(span, ErrJobsRequeued)
+			requeueDelivery(&d, "OCR_WORKER")
+			continue
+		}
+		recordSpanError(span, err)
 		if err != nil {
 			log.Error().Err(err).Str("component", "OCR_WORKER").
 				Str("RequestID", ocrResult.ID).
@@ -184,7 +232,8 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 				Msg("Error generating ocr result")
 		}
 
-		err = w.sendRpcResponse(ocrResult, d.ReplyTo, d.CorrelationId)
+		err = w.sendRpcResponse(ctx, ocrResult, wireEncodingOf(&d), d.ReplyTo, d.CorrelationId)
+		endSpan(span, err)
 		if err != nil {
 			log.Error().Err(err).Str("component", "OCR_WORKER").
 				Str("RequestID", ocrResult.ID).
@@ -192,7 +241,7 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 				Msg("Error generating ocr result")
 
 			// if we can't send our response, let's just abort
-			done <- err
+			handleErr = err
 			break
 		}
 		err = d.Ack(false)
@@ -201,33 +250,94 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 				Str("tag", tag).
 				Msg("Ack() was not successful")
 		}
+		// the document is not needed anymore once the result has been sent
+		deleteBlob(ctx, w.blobStore, ocrResult.inputBlob, "OCR_WORKER")
 
 	}
 	log.Info().Str("component", "OCR_WORKER").
 		Str("tag", tag).
 		Msg("handle: deliveries channel closed")
-	done <- fmt.Errorf("handle: deliveries channel closed")
+	setWorkerReady(fmt.Errorf("not consuming, deliveries channel closed"))
+	done <- handleErr
 }
 
-func (w *OcrRpcWorker) resultForDelivery(d *amqp.Delivery) (OcrResult, error) {
+func (w *OcrRpcWorker) resultForDelivery(ctx context.Context, d *amqp.Delivery) (OcrResult, error) {
 
-	ocrRequest := OcrRequest{}
 	ocrResult := OcrResult{}
-	err := json.Unmarshal(d.Body, &ocrRequest)
+	ocrRequest, err := decodeOcrRequest(d)
 	if err != nil {
-		msg := "Error unmarshalling json: %v.  Error: %v"
+		msg := "Error decoding the request: %v.  Error: %v"
 		errMsg := fmt.Sprintf(msg, d.CorrelationId, err)
 		log.Error().Err(err).Caller().
 			Str("RequestID", d.CorrelationId).
 			Str("tag", tag).
-			Msg("error unmarshalling json delivery")
+			Str("ContentType", d.ContentType).
+			Msg("error decoding delivery")
 		ocrResult.Text = errMsg
 		ocrResult.Status = "error"
 		return ocrResult, err
 	}
 
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("ocr.request_id", ocrRequest.RequestID),
+		attribute.String("ocr.engine", ocrRequest.EngineType.String()),
+	)
+	ocrRequest.traceCtx = ctx
+	workDir, err := newJobWorkDir(w.workerConfig.WorkDir, ocrRequest.RequestID)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_WORKER").
+			Str("RequestID", ocrRequest.RequestID).
+			Msg("could not create job directory")
+		ocrResult.Text = fmt.Sprintf("Error creating job directory: %v", err)
+		ocrResult.Status = "error"
+		return ocrResult, err
+	}
+	ocrRequest.workDir = workDir.path
+	inputBlob, err := ocrRequest.fetchImage(ctx, w.blobStore)
+	if err != nil {
+		workDir.release(false)
+		log.Error().Err(err).Str("component", "OCR_WORKER").
+			Str("RequestID", ocrRequest.RequestID).
+			Msg("could not fetch the document from the blob store")
+		ocrResult.Text = fmt.Sprintf("Error fetching the document: %v", err)
+		ocrResult.Status = "error"
+		return ocrResult, err
+	}
+	workerConfig := w.workerConfig
+	var recorder *debugRecorder
+	if ocrRequest.Debug || w.workerConfig.DebugOnFailure {
+		// the engines keep their files for the debug bundle, they are removed with the job directory
+		workerConfig.SaveFiles = true
+		ocrRequest.traceCtx, recorder = withDebugRecorder(ctx)
+	}
+	if ocrRequest.Deferred || ocrRequest.ReportProgress {
+		// deferred clients follow the job at /v2/jobs/{id}/events, gRPC clients with Watch
+		ocrRequest.traceCtx = withProgressReporter(ocrRequest.traceCtx, func(progress JobProgress) {
+			publishProgress(ctx, w.channel, w.workerConfig.Exchange, d, progress)
+		})
+		reportProgress(ocrRequest.traceCtx, JobProgress{State: JobRecognizing})
+	}
 	ocrEngine := NewOcrEngine(ocrRequest.EngineType)
-	ocrResult, err = ocrEngine.ProcessRequest(&ocrRequest, &w.workerConfig)
+	start := time.Now()
+	jobsRunning.Inc()
+	untrackRequest := trackRunningRequest(ocrRequest.RequestID)
+	ocrResult, err = ocrEngine.ProcessRequest(&ocrRequest, &workerConfig)
+	ocrResult.inputBlob = inputBlob
+	if recorder != nil && (ocrRequest.Debug || err != nil) && ctx.Err() == nil {
+		bundle, bundleErr := buildDebugBundle(&ocrRequest, &ocrResult, err, recorder.recorded(), workDir.path, start,
+			int64(w.workerConfig.DebugBundleMaxMB)<<20)
+		if bundleErr != nil {
+			log.Warn().Err(bundleErr).Str("component", "OCR_WORKER").
+				Str("RequestID", ocrRequest.RequestID).
+				Msg("could not build debug bundle")
+		}
+		ocrResult.DebugBundle = bundle
+	}
+	// with -debug the files of failed jobs are kept, but not those of jobs aborted on shutdown
+	workDir.release(w.workerConfig.SaveFiles || (err != nil && w.workerConfig.Debug && ctx.Err() == nil))
+	untrackRequest()
+	jobsRunning.Dec()
+	observeOcrJob(&ocrRequest, &ocrResult, start, err)
 	if err != nil {
 		msg := "Error processing image url: %v.  Error: %v"
 		errMsg := fmt.Sprintf(msg, ocrRequest.RequestID, err)
@@ -246,7 +356,8 @@ func (w *OcrRpcWorker) resultForDelivery(d *amqp.Delivery) (OcrResult, error) {
 
 }
 
-func (w *OcrRpcWorker) sendRpcResponse(r OcrResult, replyTo, correlationId string) error {
+// sendRpcResponse publishes the result in the encoding the request was received in
+func (w *OcrRpcWorker) sendRpcResponse(ctx context.Context, r OcrResult, encoding, replyTo, correlationId string) error {
 	// RequestID is the same as correlationId
 	logger := zerolog.New(os.Stdout).With().
 		Str("RequestID", correlationId).Timestamp().Logger()
@@ -269,7 +380,7 @@ func (w *OcrRpcWorker) sendRpcResponse(r OcrResult, replyTo, correlationId strin
 		Str("tag", tag).
 		Str("replyTo", replyTo).Msg("sendRpcResponse to")
 	// ocr worker is publishing back the decoded text
-	body, err := json.Marshal(r)
+	body, err := encodeOcrResult(&r, encoding)
 	if err != nil {
 		return err
 	}
@@ -280,8 +391,8 @@ func (w *OcrRpcWorker) sendRpcResponse(r OcrResult, replyTo, correlationId strin
 		false,                   // mandatory
 		false,                   // immediate
 		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "text/plain",
+			Headers:         withSchemaVersion(traceHeaders(ctx), encoding),
+			ContentType:     contentTypeFor(encoding),
 			ContentEncoding: "",
 			Body:            body,
 			// Body:            []byte(r.Text),
@@ -1,6 +1,7 @@
 package ocrworker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -67,10 +69,13 @@ func url2bytes(uri string) ([]byte, error) {
 
 }
 
-// createTempFileName generating a file name within of a temp directory. If function argument ist empty string
-// file name will be generated in ksuid format.
-func createTempFileName(fileName string) (string, error) {
-	tempDir := os.TempDir()
+// createTempFileName generating a file name within dir, usually the directory of the job, or the temp directory
+// if dir is empty. If function argument fileName is empty string file name will be generated in ksuid format.
+func createTempFileName(dir, fileName string) (string, error) {
+	tempDir := dir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
 
 	if fileName == "" {
 		ksuidRaw := ksuid.New()
@@ -119,12 +124,12 @@ func detectFileType(buffer []byte) string {
 
 // if sandwich engine gets a TIFF image instead of PDF file
 // we need to convert the input file to pdf first since pdfsandwich can't handle images
-func convertImageToPdf(inputFilename string) string {
+func convertImageToPdf(ctx context.Context, inputFilename string) string {
 	log.Info().Str("component", "OCR_IMAGECONVERT").Msg("got image file instead of pdf, trying to convert it...")
 
 	tmpFileImgToPdf := fmt.Sprintf("%s%s", inputFilename, ".pdf")
 	cmd := exec.Command("convert", inputFilename, tmpFileImgToPdf)
-	_, err := cmd.CombinedOutput()
+	_, err := runCommand(ctx, cmd)
 	if err != nil {
 		log.Warn().Str("component", "OCR_IMAGECONVERT").Err(err).
 			Msg("error exec convert for transforming TIFF to PDF")
@@ -138,12 +143,12 @@ func convertImageToPdf(inputFilename string) string {
 // if sandwich engine gets a TIFF image instead of PDF file
 // we need to convert the input file to pdf first since pdfsandwich can't handle images
 // in this case tiff2pdf will be used; seems to be more reliable
-func tiff2Pdf(inputFilename string) string {
+func tiff2Pdf(ctx context.Context, inputFilename string) string {
 	log.Info().Str("component", "OCR_IMAGECONVERT").Msg("got image file instead of pdf, trying to tiff2pdf it...")
 
 	tmpFileImgToPdf := fmt.Sprintf("%s%s", inputFilename, ".pdf")
 	cmd := exec.Command("tiff2pdf", inputFilename, "-o", tmpFileImgToPdf)
-	_, err := cmd.CombinedOutput()
+	_, err := runCommand(ctx, cmd)
 	if err != nil {
 		log.Debug().Str("component", "OCR_IMAGECONVERT").Interface("tiff2pdf_args", cmd.Args)
 		log.Warn().Str("component", "OCR_IMAGECONVERT").Err(err).
@@ -154,6 +159,20 @@ func tiff2Pdf(inputFilename string) string {
 	return tmpFileImgToPdf
 }
 
+// countPdfPages returns the number of pages of a pdf file as reported by pdfinfo
+func countPdfPages(ctx context.Context, inputFilename string) (int, error) {
+	output, err := runCommand(ctx, exec.Command("pdfinfo", inputFilename))
+	if err != nil {
+		return 0, fmt.Errorf("pdfinfo failed: %v: %s", err, string(output))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "Pages:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Pages:")))
+		}
+	}
+	return 0, fmt.Errorf("pdfinfo did not report the number of pages")
+}
+
 // checkURLForReplyTo Checks if provided string is a valid URL
 func checkURLForReplyTo(uri string) (string, error) {
 	u, err := url.Parse(uri)
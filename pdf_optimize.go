@@ -0,0 +1,188 @@
+package ocrworker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// OptimizeProfile holds the ghostscript settings the combined pdf is optimised with
+type OptimizeProfile struct {
+	// PdfSettings is a preset of ghostscript: screen, ebook, printer, prepress or default
+	PdfSettings string `yaml:"pdf_settings" toml:"pdf_settings" json:"pdf_settings"`
+	// CompatibilityLevel is the pdf version of the optimised file, 1.7 if empty
+	CompatibilityLevel string `yaml:"compatibility_level" toml:"compatibility_level" json:"compatibility_level"`
+	// Dpi is the resolution the color and gray images are downsampled to, 0 keeps the one of the preset
+	Dpi uint `yaml:"dpi" toml:"dpi" json:"dpi"`
+	// JpegQuality from 1 to 100 recompresses the color and gray images as JPEG, 0 keeps the filter of the preset
+	JpegQuality uint `yaml:"jpeg_quality" toml:"jpeg_quality" json:"jpeg_quality"`
+	// Lossless keeps the resolution of all images and compresses them with Flate
+	Lossless bool `yaml:"lossless" toml:"lossless" json:"lossless"`
+	// Jbig2 recompresses the bitonal images as JBIG2 with the jbig2_command of the worker
+	Jbig2 bool `yaml:"jbig2" toml:"jbig2" json:"jbig2"`
+}
+
+// optimizeProfiles are the built in profiles, the optimize_profiles of the worker config add to them or replace them
+var optimizeProfiles = map[string]OptimizeProfile{
+	"screen":  {PdfSettings: "screen", CompatibilityLevel: "1.5"},
+	"ebook":   {PdfSettings: "ebook", CompatibilityLevel: "1.5"},
+	"printer": {PdfSettings: "printer", CompatibilityLevel: "1.7"},
+	"archive": {PdfSettings: "prepress", CompatibilityLevel: "1.7", Lossless: true},
+}
+
+// the profile of result_optimize, which predates the profiles, and the name of the profiles made up by a request
+const (
+	defaultOptimizeProfile = "screen"
+	customOptimizeProfile  = "custom"
+)
+
+var gsPdfSettings = map[string]bool{"screen": true, "ebook": true, "printer": true, "prepress": true, "default": true}
+
+// lookupOptimizeProfile returns a configured or built in profile
+func lookupOptimizeProfile(name string, configured map[string]OptimizeProfile) (OptimizeProfile, error) {
+	if profile, ok := configured[name]; ok {
+		return profile, nil
+	}
+	if profile, ok := optimizeProfiles[name]; ok {
+		return profile, nil
+	}
+	var names []string
+	for known := range optimizeProfiles {
+		names = append(names, known)
+	}
+	for known := range configured {
+		if _, ok := optimizeProfiles[known]; !ok {
+			names = append(names, known)
+		}
+	}
+	sort.Strings(names)
+	return OptimizeProfile{}, fmt.Errorf("unknown optimize profile %q, use one of %s", name, strings.Join(names, ", "))
+}
+
+// validateOptimizeProfiles checks the optimize_profiles of the worker config
+func validateOptimizeProfiles(profiles map[string]OptimizeProfile, jbig2Command string) error {
+	for name, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("invalid optimize profile %s: %w", name, err)
+		}
+		if profile.Jbig2 && jbig2Command == "" {
+			return fmt.Errorf("invalid optimize profile %s: jbig2 needs the jbig2_command", name)
+		}
+	}
+	return nil
+}
+
+func (p OptimizeProfile) validate() error {
+	if p.PdfSettings != "" && !gsPdfSettings[p.PdfSettings] {
+		return fmt.Errorf("pdf_settings must be one of screen, ebook, printer, prepress or default")
+	}
+	switch p.CompatibilityLevel {
+	case "", "1.4", "1.5", "1.6", "1.7":
+	default:
+		return fmt.Errorf("compatibility_level must be one of 1.4, 1.5, 1.6 or 1.7")
+	}
+	if p.JpegQuality > 100 {
+		return fmt.Errorf("jpeg_quality must be between 1 and 100")
+	}
+	if p.Lossless && (p.Dpi > 0 || p.JpegQuality > 0) {
+		return fmt.Errorf("lossless can't be combined with dpi or jpeg_quality")
+	}
+	return nil
+}
+
+// gsArgs returns the arguments of ghostscript which optimise inputPdf into outputPdf
+func (p OptimizeProfile) gsArgs(inputPdf, outputPdf string) []string {
+	compatibilityLevel := p.CompatibilityLevel
+	if compatibilityLevel == "" {
+		compatibilityLevel = "1.7"
+	}
+	args := []string{"-sDEVICE=pdfwrite", "-dCompatibilityLevel=" + compatibilityLevel}
+	if p.PdfSettings != "" {
+		args = append(args, "-dPDFSETTINGS=/"+p.PdfSettings)
+	}
+	args = append(args, "-dNOPAUSE", "-dBATCH", "-dQUIET", "-sOutputFile="+outputPdf)
+	// the bitonal images are left to the preset, downsampling them would make the text unreadable
+	for _, kind := range []string{"Color", "Gray"} {
+		if p.Dpi > 0 {
+			args = append(args,
+				"-dDownsample"+kind+"Images=true",
+				"-d"+kind+"ImageDownsampleType=/Bicubic",
+				fmt.Sprintf("-d%sImageResolution=%d", kind, p.Dpi))
+		}
+		if p.JpegQuality > 0 {
+			args = append(args, "-dAutoFilter"+kind+"Images=false", "-d"+kind+"ImageFilter=/DCTEncode")
+		}
+	}
+	if p.Lossless {
+		args = append(args,
+			"-dDownsampleColorImages=false", "-dDownsampleGrayImages=false", "-dDownsampleMonoImages=false",
+			"-dAutoFilterColorImages=false", "-dColorImageFilter=/FlateEncode",
+			"-dAutoFilterGrayImages=false", "-dGrayImageFilter=/FlateEncode")
+	}
+	if p.JpegQuality > 0 {
+		// pdfwrite takes the quality as QFactor of the image dictionaries
+		jpegDict := fmt.Sprintf("<< /QFactor %.2f /Blend 1 /HSamples [1 1 1 1] /VSamples [1 1 1 1] >>", jpegQFactor(p.JpegQuality))
+		args = append(args, "-c", fmt.Sprintf("<< /ColorImageDict %s /GrayImageDict %s >> setdistillerparams", jpegDict, jpegDict), "-f")
+	}
+	return append(args, inputPdf)
+}
+
+// jpegQFactor converts the quality of libjpeg into the QFactor of ghostscript, which scales the
+// standard quantization tables like the quality does: quality 50 is QFactor 1
+func jpegQFactor(quality uint) float64 {
+	if quality < 50 {
+		return 50 / float64(quality)
+	}
+	return float64(200-2*quality) / 100
+}
+
+// optimizePdf optimises inputPdf with a profile, the bitonal images are recompressed by the jbig2 command afterwards
+func optimizePdf(ctx context.Context, inputPdf, outputPdf string, profile OptimizeProfile, jbig2Command string) (tmpFiles []string, err error) {
+	gsOutput := outputPdf
+	if profile.Jbig2 {
+		if jbig2Command == "" {
+			return nil, fmt.Errorf("jbig2 is not available on this worker, the jbig2_command is not set")
+		}
+		gsOutput = strings.TrimSuffix(outputPdf, ".pdf") + "_gs.pdf"
+		tmpFiles = append(tmpFiles, gsOutput)
+	}
+	outGs, err := runCommand(ctx, exec.Command("gs", profile.gsArgs(inputPdf, gsOutput)...))
+	if err != nil {
+		return tmpFiles, fmt.Errorf("gs failed: %v: %s", err, string(outGs))
+	}
+	if !profile.Jbig2 {
+		return tmpFiles, nil
+	}
+	command := strings.Fields(jbig2Command)
+	outJbig2, err := runCommand(ctx, exec.Command(command[0], append(command[1:], gsOutput, outputPdf)...))
+	if err != nil {
+		return tmpFiles, fmt.Errorf("%s failed: %v: %s", command[0], err, string(outJbig2))
+	}
+	return tmpFiles, nil
+}
+
+// OptimizeReport tells how much the optimisation shrank the document of the request
+type OptimizeReport struct {
+	Profile string `json:"profile"`
+	// InputSize is the size of the document of the request, OutputSize the one of the optimised pdf, in bytes
+	InputSize  int64 `json:"input_size"`
+	OutputSize int64 `json:"output_size"`
+	// CompressionRatio is InputSize divided by OutputSize
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+func newOptimizeReport(profile string, inputSize int64, outputPdf string) (*OptimizeReport, error) {
+	info, err := os.Stat(outputPdf)
+	if err != nil {
+		return nil, err
+	}
+	report := &OptimizeReport{Profile: profile, InputSize: inputSize, OutputSize: info.Size()}
+	if report.OutputSize > 0 {
+		report.CompressionRatio = math.Round(float64(inputSize)/float64(report.OutputSize)*100) / 100
+	}
+	return report, nil
+}
@@ -0,0 +1,94 @@
+package ocrworker
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestOptimizeProfileArgs(t *testing.T) {
+
+	// result_optimize keeps the arguments it always had
+	profile := optimizeProfiles[defaultOptimizeProfile]
+	assert.Equals(t, strings.Join(profile.gsArgs("in.pdf", "out.pdf"), " "),
+		"-sDEVICE=pdfwrite -dCompatibilityLevel=1.5 -dPDFSETTINGS=/screen -dNOPAUSE -dBATCH -dQUIET -sOutputFile=out.pdf in.pdf")
+
+	profile = OptimizeProfile{PdfSettings: "ebook", Dpi: 200, JpegQuality: 75}
+	args := strings.Join(profile.gsArgs("in.pdf", "out.pdf"), " ")
+	assert.True(t, strings.HasPrefix(args, "-sDEVICE=pdfwrite -dCompatibilityLevel=1.7 -dPDFSETTINGS=/ebook"))
+	assert.True(t, strings.Contains(args, "-dColorImageResolution=200 "))
+	assert.True(t, strings.Contains(args, "-dGrayImageFilter=/DCTEncode "))
+	assert.True(t, strings.Contains(args, "/QFactor 0.50 "))
+	assert.True(t, strings.HasSuffix(args, "setdistillerparams -f in.pdf"))
+	assert.Equals(t, jpegQFactor(25), 2.0)
+	assert.Equals(t, jpegQFactor(90), 0.2)
+
+	archive := strings.Join(optimizeProfiles["archive"].gsArgs("in.pdf", "out.pdf"), " ")
+	assert.True(t, strings.Contains(archive, "-dDownsampleColorImages=false"))
+	assert.True(t, strings.Contains(archive, "-dColorImageFilter=/FlateEncode"))
+
+	assert.True(t, OptimizeProfile{PdfSettings: "best"}.validate() != nil)
+	assert.True(t, OptimizeProfile{CompatibilityLevel: "2.0"}.validate() != nil)
+	assert.True(t, OptimizeProfile{Lossless: true, Dpi: 150}.validate() != nil)
+	assert.True(t, validateOptimizeProfiles(map[string]OptimizeProfile{"bitonal": {Jbig2: true}}, "") != nil)
+	assert.True(t, validateOptimizeProfiles(map[string]OptimizeProfile{"bitonal": {Jbig2: true}}, "jbig2pdf") == nil)
+
+	file, err := ioutil.TempFile("", "optimized")
+	assert.True(t, err == nil)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("%PDF-1.5")
+	assert.True(t, err == nil)
+	file.Close()
+	report, err := newOptimizeReport("screen", 20, file.Name())
+	assert.True(t, err == nil)
+	assert.Equals(t, *report, OptimizeReport{Profile: "screen", InputSize: 20, OutputSize: 8, CompressionRatio: 2.5})
+
+}
+
+func TestOptimizeEngineArgs(t *testing.T) {
+
+	workerConfig := workerConfigForTests()
+	workerConfig.OptimizeProfiles = map[string]OptimizeProfile{"scans": {PdfSettings: "printer", Dpi: 300}}
+	newArgs := func(engineArgs map[string]interface{}) (*SandwichEngineArgs, error) {
+		return NewSandwichEngineArgs(&OcrRequest{EngineType: EngineSandwichTesseract, EngineArgs: engineArgs}, &workerConfig)
+	}
+
+	engineArgs, err := newArgs(map[string]interface{}{"result_optimize": true})
+	assert.True(t, err == nil)
+	name, profile := engineArgs.optimization()
+	assert.Equals(t, name, "screen")
+	assert.Equals(t, profile.PdfSettings, "screen")
+
+	engineArgs, err = newArgs(map[string]interface{}{"optimize_profile": "scans", "optimize_jpeg_quality": 80.0})
+	assert.True(t, err == nil)
+	name, profile = engineArgs.optimization()
+	assert.Equals(t, name, "scans")
+	assert.Equals(t, *profile, OptimizeProfile{PdfSettings: "printer", Dpi: 300, JpegQuality: 80})
+
+	engineArgs, err = newArgs(map[string]interface{}{"optimize_dpi": 150.0})
+	assert.True(t, err == nil)
+	name, profile = engineArgs.optimization()
+	assert.Equals(t, name, customOptimizeProfile)
+	assert.Equals(t, profile.Dpi, uint(150))
+
+	engineArgs, err = newArgs(map[string]interface{}{"lang": "deu"})
+	assert.True(t, err == nil)
+	_, profile = engineArgs.optimization()
+	assert.True(t, profile == nil)
+
+	_, err = newArgs(map[string]interface{}{"optimize_profile": "tiny"})
+	assert.True(t, err != nil)
+	_, err = newArgs(map[string]interface{}{"optimize_profile": "archive", "optimize_dpi": 150.0})
+	assert.True(t, err != nil)
+
+	rabbitConfig := rabbitConfigForTests()
+	ocrRequest := OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_type": "combinedpdf", "optimize_profile": "ebook", "optimize_jpeg_quality": 101}}
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*OcrRequestValidationError).InvalidParams[0].Name, "engine_args.optimize_jpeg_quality")
+
+}
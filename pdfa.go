@@ -0,0 +1,290 @@
+package ocrworker
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// the PDF/A output formats, pdfa_signed is signed with the certificate of the worker
+const (
+	OutputPdfa       = "pdfa"
+	OutputPdfaSigned = "pdfa_signed"
+)
+
+// pdfaParts are the parts of ISO 19005 by the conformance levels of the pdfa_level engine arg
+var pdfaParts = map[string]int{"1b": 1, "2b": 2, "3b": 3}
+
+const defaultPdfaLevel = "2b"
+
+// pdfaIccProfiles are searched for the sRGB profile of the output intent if pdfa_icc_profile is not set
+var pdfaIccProfiles = []string{
+	"/usr/share/ghostscript/*/iccprofiles/srgb.icc",
+	"/usr/share/ghostscript/iccprofiles/srgb.icc",
+	"/usr/share/color/icc/sRGB.icc",
+}
+
+// pdfaMetadata is written into the document info, ghostscript builds the XMP metadata of the PDF/A file from it
+type pdfaMetadata struct {
+	Title       string
+	ReferenceID string
+	// Lang is the tesseract language of the request, e.g. deu+eng
+	Lang string
+}
+
+// PdfaValidation is the report of the validator about the PDF/A file of a request
+type PdfaValidation struct {
+	Level     string `json:"level"`
+	Validator string `json:"validator"`
+	Compliant bool   `json:"compliant"`
+	Statement string `json:"statement,omitempty"`
+	// Failures are the failed rules as clause-test: description
+	Failures []string `json:"failures,omitempty"`
+}
+
+// pdfaSettings are the settings of the worker for the PDF/A outputs
+type pdfaSettings struct {
+	iccProfile  string
+	validator   string
+	signCert    string
+	signKey     string
+	signKeyPass string
+}
+
+func newPdfaSettings(workerConfig *WorkerConfig) pdfaSettings {
+	return pdfaSettings{
+		iccProfile:  workerConfig.PdfaIccProfile,
+		validator:   workerConfig.PdfaValidator,
+		signCert:    workerConfig.SignCert,
+		signKey:     workerConfig.SignKey,
+		signKeyPass: workerConfig.SignKeyPass,
+	}
+}
+
+// pdfaRequested is true if the request asks for a PDF/A file, its metadata is part of the result
+func pdfaRequested(ocrRequest *OcrRequest) bool {
+	formats := requestedOutputs(ocrRequest)
+	if ocrType, ok := ocrRequest.EngineArgs["ocr_type"].(string); ok {
+		formats = append(formats, strings.ToLower(ocrType))
+	}
+	for _, format := range formats {
+		if format == OutputPdfa || format == OutputPdfaSigned {
+			return true
+		}
+	}
+	return false
+}
+
+// findIccProfile returns the configured ICC profile or the sRGB profile of the installed ghostscript
+func findIccProfile(configured string) (string, error) {
+	if configured != "" {
+		return filepath.Abs(configured)
+	}
+	for _, pattern := range pdfaIccProfiles {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) > 0 {
+			// the newest ghostscript version sorts last
+			sort.Strings(matches)
+			return matches[len(matches)-1], nil
+		}
+	}
+	return "", fmt.Errorf("no sRGB ICC profile found for PDF/A, set pdfa_icc_profile")
+}
+
+// convertToPdfa converts a pdf into PDF/A of the given level with ghostscript
+func convertToPdfa(ctx context.Context, inputPdf, outputPdf, level string, metadata pdfaMetadata, iccProfile string) error {
+	part, ok := pdfaParts[level]
+	if !ok {
+		return fmt.Errorf("unknown PDF/A level %q, use one of 1b, 2b or 3b", level)
+	}
+	iccProfile, err := findIccProfile(iccProfile)
+	if err != nil {
+		return err
+	}
+	definitions := strings.TrimSuffix(outputPdf, filepath.Ext(outputPdf)) + "_def.ps"
+	if err := ioutil.WriteFile(definitions, []byte(pdfaDefinitions(part, metadata, iccProfile)), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(definitions)
+
+	output, err := runCommand(ctx, exec.Command("gs",
+		fmt.Sprintf("-dPDFA=%d", part),
+		"-dBATCH",
+		"-dNOPAUSE",
+		"-dQUIET",
+		"-dNOOUTERSAVE",
+		// drop the features PDF/A does not allow instead of writing a plain pdf
+		"-dPDFACompatibilityPolicy=1",
+		"-sColorConversionStrategy=RGB",
+		"-sDEVICE=pdfwrite",
+		"--permit-file-read="+iccProfile,
+		"-sOutputFile="+outputPdf,
+		definitions,
+		inputPdf,
+	))
+	if err != nil {
+		return fmt.Errorf("gs failed to create PDF/A-%s: %v: %s", level, err, string(output))
+	}
+	return nil
+}
+
+// pdfaDefinitions returns the PostScript which ghostscript runs before the document, like lib/PDFA_def.ps
+// of ghostscript it adds the output intent and sets the document info
+func pdfaDefinitions(part int, metadata pdfaMetadata, iccProfile string) string {
+	var ps strings.Builder
+	ps.WriteString("%!\n")
+	fmt.Fprintf(&ps, "/ICCProfile %s def\n", psString(iccProfile))
+	ps.WriteString("[/_objdef {icc_PDFA} /type /stream /OBJ pdfmark\n")
+	ps.WriteString("[{icc_PDFA} << /N 3 >> /PUT pdfmark\n")
+	ps.WriteString("[{icc_PDFA} ICCProfile (r) file /PUT pdfmark\n")
+	ps.WriteString("[/_objdef {OutputIntent_PDFA} /type /dict /OBJ pdfmark\n")
+	ps.WriteString("[{OutputIntent_PDFA} << /Type /OutputIntent /S /GTS_PDFA1 /DestOutputProfile {icc_PDFA} " +
+		"/OutputConditionIdentifier (sRGB) >> /PUT pdfmark\n")
+	ps.WriteString("[{Catalog} << /OutputIntents [ {OutputIntent_PDFA} ] >> /PUT pdfmark\n")
+
+	ps.WriteString("[ /Creator (open-ocr)")
+	if metadata.Title != "" {
+		fmt.Fprintf(&ps, " /Title %s", psString(metadata.Title))
+	}
+	if metadata.ReferenceID != "" {
+		// the keywords end up in pdf:Keywords of the XMP metadata
+		fmt.Fprintf(&ps, " /Keywords %s", psString("reference_id:"+metadata.ReferenceID))
+	}
+	ps.WriteString(" /DOCINFO pdfmark\n")
+	if lang := pdfLanguage(metadata.Lang); lang != "" {
+		fmt.Fprintf(&ps, "[{Catalog} << /Lang %s >> /PUT pdfmark\n", psString(lang))
+	}
+	return ps.String()
+}
+
+// psString encodes s as a PostScript hex string, in UTF-16BE with a byte order mark unless it is ASCII
+func psString(s string) string {
+	ascii := true
+	for _, r := range s {
+		ascii = ascii && r < 0x80
+	}
+	if ascii {
+		return fmt.Sprintf("<%X>", s)
+	}
+	var hex strings.Builder
+	hex.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&hex, "%04X", unit)
+	}
+	hex.WriteString(">")
+	return hex.String()
+}
+
+// pdfLanguages maps the tesseract languages to the two letter codes of BCP 47 where there is one
+var pdfLanguages = map[string]string{
+	"ara": "ar", "bul": "bg", "ces": "cs", "chi": "zh", "dan": "da", "deu": "de", "ell": "el", "eng": "en",
+	"est": "et", "fin": "fi", "fra": "fr", "heb": "he", "hrv": "hr", "hun": "hu", "ita": "it", "jpn": "ja",
+	"kor": "ko", "lav": "lv", "lit": "lt", "nld": "nl", "nor": "no", "pol": "pl", "por": "pt", "ron": "ro",
+	"rus": "ru", "slk": "sk", "slv": "sl", "spa": "es", "srp": "sr", "swe": "sv", "tur": "tr", "ukr": "uk",
+}
+
+// pdfLanguage returns the language of the document for the catalog, the first of the tesseract languages
+func pdfLanguage(lang string) string {
+	first := strings.Split(lang, "+")[0]
+	// chi_sim and deu_frak are variants of the language, scripts and auto detection have none
+	first = strings.Split(first, "_")[0]
+	if first == "" || first == "auto" || first == "osd" || strings.HasPrefix(first, scriptPrefix) {
+		return ""
+	}
+	if code, ok := pdfLanguages[first]; ok {
+		return code
+	}
+	return first
+}
+
+// veraPdfReport is the part of the machine readable report of veraPDF which goes into PdfaValidation
+type veraPdfReport struct {
+	Reports []struct {
+		IsCompliant bool   `xml:"isCompliant,attr"`
+		Statement   string `xml:"statement,attr"`
+		Rules       []struct {
+			Clause      string `xml:"clause,attr"`
+			TestNumber  string `xml:"testNumber,attr"`
+			Status      string `xml:"status,attr"`
+			Description string `xml:"description"`
+		} `xml:"details>rule"`
+	} `xml:"jobs>job>validationReport"`
+}
+
+// validatePdfa checks a PDF/A file with veraPDF, the report tells if it could not be validated
+func validatePdfa(ctx context.Context, pdfFile, level, validator string) *PdfaValidation {
+	validation := &PdfaValidation{Level: level, Validator: validator}
+	// veraPDF exits with 1 if the file is not compliant, the report is written anyway
+	output, err := runCommand(ctx, exec.Command(validator, "--flavour", level, "--format", "mrr", pdfFile))
+	start := bytes.Index(output, []byte("<?xml"))
+	if start < 0 {
+		validation.Statement = fmt.Sprintf("the file could not be validated: %v: %s", err, string(output))
+		return validation
+	}
+	// the log messages on stderr are left out
+	report, err := parseVeraPdfReport(output[start:])
+	if err != nil {
+		validation.Statement = fmt.Sprintf("the report of %s could not be read: %v", validator, err)
+		return validation
+	}
+	validation.Compliant = report.Compliant
+	validation.Statement = report.Statement
+	validation.Failures = report.Failures
+	return validation
+}
+
+func parseVeraPdfReport(output []byte) (*PdfaValidation, error) {
+	report := veraPdfReport{}
+	if err := xml.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	if len(report.Reports) == 0 {
+		return nil, fmt.Errorf("the report has no validation result")
+	}
+	validation := &PdfaValidation{
+		Compliant: report.Reports[0].IsCompliant,
+		Statement: report.Reports[0].Statement,
+	}
+	for _, rule := range report.Reports[0].Rules {
+		if rule.Status == "failed" {
+			validation.Failures = append(validation.Failures,
+				fmt.Sprintf("%s-%s: %s", rule.Clause, rule.TestNumber, strings.TrimSpace(rule.Description)))
+		}
+	}
+	return validation, nil
+}
+
+// signPdf adds a PAdES signature with the certificate of the worker to a pdf, with pyHanko.
+// The signature is an incremental update, a PDF/A file stays PDF/A.
+func signPdf(ctx context.Context, inputPdf, outputPdf string, settings pdfaSettings) error {
+	if settings.signCert == "" || settings.signKey == "" {
+		return fmt.Errorf("signing is not configured on this worker, set sign_cert and sign_key")
+	}
+	args := []string{"sign", "addsig", "--field", "Signature", "--use-pades", "pemder",
+		"--key", settings.signKey, "--cert", settings.signCert}
+	if settings.signKeyPass == "" {
+		args = append(args, "--no-pass")
+	} else {
+		// the passphrase is handed over in a file, it would show up in the process list as an argument
+		passFile := strings.TrimSuffix(outputPdf, filepath.Ext(outputPdf)) + ".pass"
+		if err := ioutil.WriteFile(passFile, []byte(settings.signKeyPass), 0600); err != nil {
+			return err
+		}
+		defer os.Remove(passFile)
+		args = append(args, "--passfile", passFile)
+	}
+	args = append(args, inputPdf, outputPdf)
+	output, err := runCommand(ctx, exec.Command("pyhanko", args...))
+	if err != nil {
+		return fmt.Errorf("pyhanko failed to sign the pdf: %v: %s", err, string(output))
+	}
+	return nil
+}
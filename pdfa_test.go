@@ -0,0 +1,102 @@
+package ocrworker
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const testVeraPdfReport = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<report>
+  <jobs>
+    <job>
+      <item size="1024"><name>/tmp/doc_pdfa.pdf</name></item>
+      <validationReport jobEndStatus="normal" profileName="PDF/A-2B validation profile" statement="PDF file is not compliant with Validation Profile requirements." isCompliant="false">
+        <details passedRules="143" failedRules="1" passedChecks="2000" failedChecks="1">
+          <rule specification="ISO 19005-2:2011" clause="6.2.4.3" testNumber="2" status="failed" failedChecks="1">
+            <description>
+              DeviceRGB shall only be used if a device independent DefaultRGB colour space has been set
+            </description>
+          </rule>
+          <rule specification="ISO 19005-2:2011" clause="6.6.2.1" testNumber="1" status="passed" passedChecks="1"/>
+        </details>
+      </validationReport>
+    </job>
+  </jobs>
+</report>
+`
+
+func TestPdfaDefinitions(t *testing.T) {
+
+	assert.Equals(t, psString("ab"), "<6162>")
+	assert.Equals(t, psString("ä"), "<FEFF00E4>")
+	assert.Equals(t, pdfLanguage("deu+eng"), "de")
+	assert.Equals(t, pdfLanguage("chi_sim"), "zh")
+	assert.Equals(t, pdfLanguage("script/Latin"), "")
+	assert.Equals(t, pdfLanguage(""), "")
+
+	definitions := pdfaDefinitions(2, pdfaMetadata{Title: "Rechnung", ReferenceID: "4711", Lang: "deu"}, "/srgb.icc")
+	assert.True(t, strings.Contains(definitions, "/ICCProfile "+psString("/srgb.icc")+" def"))
+	assert.True(t, strings.Contains(definitions, "/Title "+psString("Rechnung")))
+	assert.True(t, strings.Contains(definitions, "/Keywords "+psString("reference_id:4711")))
+	assert.True(t, strings.Contains(definitions, "<< /Lang "+psString("de")+" >>"))
+	// the metadata of the request is left out if it is not set
+	definitions = pdfaDefinitions(2, pdfaMetadata{}, "/srgb.icc")
+	assert.False(t, strings.Contains(definitions, "/Title"))
+	assert.False(t, strings.Contains(definitions, "/Lang"))
+
+	err := convertToPdfa(context.Background(), "in.pdf", "out.pdf", "4u", pdfaMetadata{}, "")
+	assert.True(t, err != nil)
+
+}
+
+func TestParseVeraPdfReport(t *testing.T) {
+
+	validation, err := parseVeraPdfReport([]byte(testVeraPdfReport))
+	assert.True(t, err == nil)
+	assert.False(t, validation.Compliant)
+	assert.Equals(t, validation.Statement, "PDF file is not compliant with Validation Profile requirements.")
+	assert.Equals(t, len(validation.Failures), 1)
+	assert.Equals(t, validation.Failures[0],
+		"6.2.4.3-2: DeviceRGB shall only be used if a device independent DefaultRGB colour space has been set")
+
+	_, err = parseVeraPdfReport([]byte("<report><jobs></jobs></report>"))
+	assert.True(t, err != nil)
+
+}
+
+func TestPdfaRequests(t *testing.T) {
+
+	// a worker without certificate can't sign
+	err := signPdf(context.Background(), "in.pdf", "out.pdf", pdfaSettings{})
+	assert.True(t, err != nil)
+
+	rabbitConfig := rabbitConfigForTests()
+	ocrRequest := OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_type": "PDFA", "pdfa_level": "1b"}, Title: "Invoice"}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	assert.True(t, pdfaRequested(&ocrRequest))
+
+	engineArgs, err := NewSandwichEngineArgs(&ocrRequest, &WorkerConfig{PdfaValidator: "verapdf"})
+	assert.True(t, err == nil)
+	assert.Equals(t, engineArgs.pdfaLevel, "1b")
+	assert.Equals(t, engineArgs.pdfaMetadata.Title, "Invoice")
+	assert.Equals(t, engineArgs.pdfa.validator, "verapdf")
+
+	ocrRequest.EngineArgs["pdfa_level"] = "4u"
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*OcrRequestValidationError).InvalidParams[0].Name, "engine_args.pdfa_level")
+
+	// the title is part of the cached result of a PDF/A request only
+	ocrRequest = OcrRequest{ImgBytes: []byte("document"), EngineType: EngineSandwichTesseract, Outputs: []string{"pdfa_signed"}}
+	titled := ocrRequest
+	titled.Title = "Invoice"
+	assert.NotEquals(t, resultCacheKey(&ocrRequest), resultCacheKey(&titled))
+	ocrRequest.Outputs = []string{"txt"}
+	titled.Outputs = []string{"txt"}
+	assert.Equals(t, resultCacheKey(&ocrRequest), resultCacheKey(&titled))
+
+}
@@ -1,16 +1,19 @@
 package ocrworker
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
 
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PreprocessorRpcWorker struct {
@@ -21,11 +24,17 @@ type PreprocessorRpcWorker struct {
 	Done            chan error
 	bindingKey      string
 	preprocessorMap map[string]Preprocessor
+	jobs            jobControl
+	// workDir is the root of the job directories
+	workDir string
+	// blobStore holds the documents which are too big for the messages, nil if they are always inline
+	blobStore BlobStore
 }
 
 var preprocessorTag = ksuid.New().String()
 
-func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor string) (*PreprocessorRpcWorker, error) {
+// NewPreprocessorRpcWorker creates a worker for the preprocessor, the files of every job are kept in a directory below workDir
+func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor, workDir string) (*PreprocessorRpcWorker, error) {
 
 	preprocessorMap := make(map[string]Preprocessor)
 	preprocessorMap[PreprocessorStrokeWidthTransform] = StrokeWidthTransformer{}
@@ -36,6 +45,10 @@ func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor string) (*Preproces
 	if !ok {
 		return nil, fmt.Errorf("no preprocessor found for: %q", preprocessor)
 	}
+	blobStore, err := NewBlobStore(rc.BlobStore)
+	if err != nil {
+		return nil, err
+	}
 
 	preprocessorRpcWorker := &PreprocessorRpcWorker{
 		rabbitConfig:    *rc,
@@ -45,6 +58,8 @@ func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor string) (*Preproces
 		Done:            make(chan error),
 		bindingKey:      preprocessor,
 		preprocessorMap: preprocessorMap,
+		workDir:         workDir,
+		blobStore:       blobStore,
 	}
 	return preprocessorRpcWorker, nil
 }
@@ -71,6 +86,10 @@ func (w *PreprocessorRpcWorker) Run() error {
 	if err != nil {
 		return err
 	}
+	// messages are acknowledged after they have been forwarded, so a job aborted on shutdown can be requeued
+	if err := w.channel.Qos(1, 0, false); err != nil {
+		return err
+	}
 
 	if err := w.channel.ExchangeDeclare(
 		w.rabbitConfig.Exchange,     // name of the exchange
@@ -117,7 +136,7 @@ func (w *PreprocessorRpcWorker) Run() error {
 	deliveries, err := w.channel.Consume(
 		queue.Name,      // name
 		preprocessorTag, // consumerTag,
-		true,            // noAck
+		false,           // noAck
 		false,           // exclusive
 		false,           // noLocal
 		false,           // noWait
@@ -128,28 +147,46 @@ func (w *PreprocessorRpcWorker) Run() error {
 	}
 
 	go w.handle(deliveries, w.Done)
+	setWorkerReady(nil)
 
 	return nil
 }
 
-func (w *PreprocessorRpcWorker) Shutdown() error {
-	// will close() the deliveries channel
-	if err := w.channel.Cancel(w.tag, true); err != nil {
+// Shutdown stops consuming and waits up to grace for the running job. A job which is still running
+// after grace is aborted, its message is requeued and ErrJobsRequeued is returned.
+func (w *PreprocessorRpcWorker) Shutdown(grace time.Duration) error {
+	setWorkerReady(fmt.Errorf("shutting down"))
+	w.jobs.stop()
+	if w.channel == nil {
+		return fmt.Errorf("worker is not running")
+	}
+	// will close() the deliveries channel once the broker confirmed the cancel
+	if err := w.channel.Cancel(w.tag, false); err != nil {
 		return fmt.Errorf("worker cancel failed: %s", err)
 	}
 
+	// wait for handle() to exit
+	result := w.jobs.awaitJobs(w.Done, grace)
+
 	if err := w.conn.Close(); err != nil {
 		return fmt.Errorf("AMQP connection close error: %s", err)
 	}
 
-	defer log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("Shutdown OK")
-
-	// wait for handle() to exit
-	return <-w.Done
+	log.Info().Str("component", "PREPROCESSOR_WORKER").AnErr("result", result).Msg("Shutdown OK")
+	return result
 }
 
 func (w *PreprocessorRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error) {
 	for d := range deliveries {
+		if w.jobs.isStopping() {
+			requeueDelivery(&d, "PREPROCESSOR_WORKER")
+			continue
+		}
+		if !d.Redelivered && checkSchemaVersion(&d) != nil {
+			// an upgraded preprocessor may understand the message, the second time it is dropped
+			requeueDelivery(&d, "PREPROCESSOR_WORKER")
+			continue
+		}
 		log.Info().Str("component", "PREPROCESSOR_WORKER").
 			Int("size", len(d.Body)).
 			Uint64("DeliveryTag", d.DeliveryTag).
@@ -157,12 +194,22 @@ func (w *PreprocessorRpcWorker) handle(deliveries <-chan amqp.Delivery, done cha
 			Msg("got delivery")
 
 		err := w.handleDelivery(&d)
+		if errors.Is(err, context.Canceled) {
+			// the job was aborted on shutdown, another preprocessor will process it
+			requeueDelivery(&d, "PREPROCESSOR_WORKER")
+			continue
+		}
 		if err != nil {
 			log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg("Error handling delivery in preprocessor.")
 		}
+		// failed deliveries are dropped as well, they would fail again
+		if err := d.Ack(false); err != nil {
+			log.Warn().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg("Ack() was not successful")
+		}
 
 	}
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("handle: deliveries channel closed")
+	setWorkerReady(fmt.Errorf("not consuming, deliveries channel closed"))
 	done <- fmt.Errorf("handle: deliveries channel closed")
 }
 
@@ -189,13 +236,13 @@ func (w *PreprocessorRpcWorker) strokeWidthTransform(ocrRequest *OcrRequest) err
 
 	// write bytes to a temp file
 
-	tmpFileNameInput, err := createTempFileName("")
+	tmpFileNameInput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
+	tmpFileNameOutput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
@@ -231,14 +278,47 @@ func (w *PreprocessorRpcWorker) strokeWidthTransform(ocrRequest *OcrRequest) err
 
 }
 
-func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
+func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) (err error) {
+
+	observeQueueWait(d)
+	spanCtx, span := startDeliverySpan(d, "preprocess "+w.bindingKey)
+	ctx, jobDone := w.jobs.startJob(spanCtx)
+	start := time.Now()
+	jobsPreprocessing.Inc()
+	// the document the request came with, it is deleted unless the request is requeued
+	var inputBlob *BlobRef
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("preprocessing aborted: %w", ctx.Err())
+		} else {
+			deleteBlob(spanCtx, w.blobStore, inputBlob, "PREPROCESSOR_WORKER")
+		}
+		jobDone()
+		jobsPreprocessing.Dec()
+		observePreprocessorJob(w.bindingKey, start, err)
+		endSpan(span, err)
+	}()
+
+	ocrRequest, err := decodeOcrRequest(d)
+	if err != nil {
+		log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Str("ContentType", d.ContentType).
+			Msg("Error decoding the request")
+		return err
+	}
 
-	ocrRequest := OcrRequest{}
-	err := json.Unmarshal(d.Body, &ocrRequest)
+	span.SetAttributes(attribute.String("ocr.request_id", ocrRequest.RequestID))
+	ocrRequest.traceCtx = ctx
+	if ocrRequest.Deferred || ocrRequest.ReportProgress {
+		publishProgress(ctx, w.channel, w.rabbitConfig.Exchange, d, JobProgress{State: JobPreprocessing, Preprocessor: w.bindingKey})
+	}
+	workDir, err := newJobWorkDir(w.workDir, ocrRequest.RequestID)
+	if err != nil {
+		return err
+	}
+	defer workDir.release(false)
+	ocrRequest.workDir = workDir.path
+	inputBlob, err = ocrRequest.fetchImage(ctx, w.blobStore)
 	if err != nil {
-		msg := "Error unmarshaling json: %v."
-		errMsg := fmt.Sprintf(msg, string(d.Body))
-		log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg(errMsg)
 		return err
 	}
 
@@ -246,6 +326,13 @@ func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Str("routingKey", routingKey).
 		Msg("publishing with routing key")
 
+	// a debug request carries the input and the commands of every preprocessor to the worker
+	var recorder *debugRecorder
+	artifact := DebugArtifact{Preprocessor: w.bindingKey, Input: ocrRequest.ImgBytes, Started: time.Now()}
+	if ocrRequest.Debug {
+		ocrRequest.traceCtx, recorder = withDebugRecorder(ctx)
+	}
+
 	err = w.preprocessImage(&ocrRequest)
 	if err != nil {
 		msg := "Error preprocessing image: %v."
@@ -253,8 +340,24 @@ func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
 		log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg(errMsg)
 		return err
 	}
+	if recorder != nil {
+		artifact.Commands = recorder.recorded()
+		artifact.ToolVersions = toolVersionsOf(artifact.Commands)
+		artifact.Duration = time.Since(artifact.Started).Seconds()
+		ocrRequest.DebugArtifacts = append(ocrRequest.DebugArtifacts, artifact)
+	}
 
-	ocrRequestJson, err := json.Marshal(ocrRequest)
+	// every hop gets a key of its own, the same preprocessor may be in the chain twice
+	ocrRequest.offloadImage(ctx, w.blobStore, w.rabbitConfig.BlobThreshold,
+		fmt.Sprintf("%s/%d-%s", sanitizeFileName(ocrRequest.RequestID), len(ocrRequest.PreprocessorChain), w.bindingKey))
+	defer func() {
+		if err != nil {
+			deleteBlob(spanCtx, w.blobStore, ocrRequest.ImgBlob, "PREPROCESSOR_WORKER")
+		}
+	}()
+	// the next hop gets the request in the encoding it was received in
+	encoding := wireEncodingOf(d)
+	ocrRequestBody, err := encodeOcrRequest(&ocrRequest, encoding)
 	if err != nil {
 		return err
 	}
@@ -268,10 +371,10 @@ func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
 		false,                   // mandatory
 		false,                   // immediate
 		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "text/plain",
+			Headers:         withSchemaVersion(traceHeaders(ctx), encoding),
+			ContentType:     contentTypeFor(encoding),
 			ContentEncoding: "",
-			Body:            ocrRequestJson,
+			Body:            ocrRequestBody,
 			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
 			Priority:        0,              // 0-9
 			ReplyTo:         d.ReplyTo,
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package ocrworker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startInProcessGroup makes cmd the leader of a new process group, the tools it starts like the
+// tesseract of pdfsandwich join the group
+func startInProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills cmd and every process it started, the children would otherwise keep
+// the output pipes open and cmd.Wait would wait for them
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
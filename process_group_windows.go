@@ -0,0 +1,11 @@
+package ocrworker
+
+import "os/exec"
+
+// startInProcessGroup does nothing, windows has no process groups to kill
+func startInProcessGroup(_ *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -1,16 +1,50 @@
 package ocrworker
 
 import (
+	"errors"
 	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/streadway/amqp"
 )
 
 var (
 	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ocr_in_flight_requests",
-		Help: "A gauge of requests currently being served by the wrapped handler.",
+		Help: "A gauge of http requests to /ocr currently being served.",
+	})
+
+	// the lifecycle of a job: awaiting its result in cli-httpd, queued in the broker,
+	// then preprocessing in cli-preprocessor and running in cli-worker
+	jobsAwaitingResult = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_jobs_awaiting_result",
+		Help: "A gauge of jobs published by this http daemon whose result has not arrived yet.",
+	})
+	jobsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_jobs_queued",
+		Help: "A gauge of jobs waiting in the ocr queue of the broker for a worker, across all http daemons.",
+	})
+	jobsUnacknowledged = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_jobs_unacknowledged",
+		Help: "A gauge of jobs delivered to workers but not acknowledged yet, as reported by the broker.",
+	})
+	queueConsumers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_queue_consumers",
+		Help: "A gauge of the workers consuming from the ocr queue, as reported by the broker.",
+	})
+	jobsPreprocessing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_jobs_preprocessing",
+		Help: "A gauge of jobs currently processed by this preprocessor.",
+	})
+	jobsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_jobs_running",
+		Help: "A gauge of jobs currently processed by the engine of this worker.",
 	})
 	counter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -40,14 +74,116 @@ var (
 		},
 		[]string{},
 	)
+
+	// the following metrics are collected by cli-worker and cli-preprocessor
+	workerJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_worker_jobs_total",
+			Help: "A counter for the ocr requests processed by the worker.",
+		},
+		[]string{"engine", "doc_type", "ocr_type", "outcome"},
+	)
+	workerJobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_worker_job_duration_seconds",
+			Help:    "A histogram of the time the engine needed for an ocr request.",
+			Buckets: []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"engine", "doc_type", "ocr_type", "outcome"},
+	)
+	workerPages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_worker_pages_total",
+			Help: "A counter for the pages recognized by the worker.",
+		},
+		[]string{"engine", "doc_type", "ocr_type"},
+	)
+	documentConfidence = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_worker_document_confidence",
+			Help:    "A histogram of the mean word confidence of the recognized documents, from 0 to 100.",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		},
+		[]string{"engine", "doc_type", "ocr_type"},
+	)
+	pageConfidence = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_worker_page_confidence",
+			Help:    "A histogram of the mean word confidence of the recognized pages with words, from 0 to 100.",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		},
+		[]string{"engine", "doc_type", "ocr_type"},
+	)
+	queueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_queue_wait_seconds",
+			Help:    "A histogram of the time messages spent in the queue before they were consumed.",
+			Buckets: []float64{.01, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		},
+		[]string{"queue"},
+	)
+	preprocessorJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_preprocessor_jobs_total",
+			Help: "A counter for the requests processed by the preprocessor.",
+		},
+		[]string{"preprocessor", "outcome"},
+	)
+	preprocessorJobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_preprocessor_job_duration_seconds",
+			Help:    "A histogram of the time the preprocessor needed for a request.",
+			Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"preprocessor", "outcome"},
+	)
+	externalCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_external_command_exits_total",
+			Help: "A counter for the exit codes of external tools, -1 if the tool could not be started or was killed.",
+		},
+		[]string{"command", "exit_code"},
+	)
+	externalCommandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ocr_external_command_duration_seconds",
+			Help:    "A histogram of the run time of external tools.",
+			Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"command"},
+	)
+	workDirsPurged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ocr_workdir_purged_total",
+		Help: "A counter for the stale job directories removed by the janitor.",
+	})
+	workDirBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ocr_workdir_bytes",
+		Help: "A gauge of the bytes used by the finished job directories kept below the work dir root.",
+	})
+	resultCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_result_cache_requests_total",
+			Help: "A counter for the cache lookups of ocr requests: hit, miss, collapsed onto a running request or bypass.",
+		},
+		[]string{"result"},
+	)
+
+	// docTypeLabelPattern limits the values of the doc_type label, which is set by clients
+	docTypeLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
 )
 
+func init() {
+	// Register all of the metrics in the standard registry.
+	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize,
+		jobsAwaitingResult, jobsQueued, jobsUnacknowledged, queueConsumers, jobsPreprocessing, jobsRunning,
+		workerJobs, workerJobDuration, workerPages, documentConfidence, pageConfidence, queueWait,
+		preprocessorJobs, preprocessorJobDuration,
+		externalCommands, externalCommandDuration, workDirsPurged, workDirBytes, resultCacheRequests)
+}
+
 // InstrumentHttpStatusHandler wraps httpHandler to provide prometheus metrics
 func InstrumentHttpStatusHandler(ocrHttpHandler *OcrHTTPStatusHandler) http.Handler {
 
-	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize)
-
 	ocrChain := promhttp.InstrumentHandlerInFlight(inFlightGauge,
 		promhttp.InstrumentHandlerDuration(duration.MustCurryWith(prometheus.Labels{"handler": "ocr"}),
 			promhttp.InstrumentHandlerCounter(counter,
@@ -58,3 +194,79 @@ func InstrumentHttpStatusHandler(ocrHttpHandler *OcrHTTPStatusHandler) http.Hand
 	)
 	return ocrChain
 }
+
+// outcomeLabel is the value of the outcome label for the result of a job
+func outcomeLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// ocrJobLabels returns the engine, doc_type and ocr_type labels of an ocr request
+func ocrJobLabels(ocrRequest *OcrRequest) []string {
+	docType := "none"
+	if ocrRequest.DocType != "" {
+		docType = "other"
+		if docTypeLabelPattern.MatchString(ocrRequest.DocType) {
+			docType = ocrRequest.DocType
+		}
+	}
+	ocrType := "none"
+	if value, ok := ocrRequest.EngineArgs["ocr_type"].(string); ok && value != "" {
+		ocrType = strings.ToLower(value)
+	}
+	return []string{ocrRequest.EngineType.String(), docType, ocrType}
+}
+
+// observeOcrJob records the outcome, duration, recognized pages and confidence of an ocr request processed by a worker
+func observeOcrJob(ocrRequest *OcrRequest, ocrResult *OcrResult, start time.Time, err error) {
+	labels := ocrJobLabels(ocrRequest)
+	if err == nil && ocrResult.pages > 0 {
+		workerPages.WithLabelValues(labels...).Add(float64(ocrResult.pages))
+	}
+	if err == nil && ocrResult.Confidence != nil {
+		documentConfidence.WithLabelValues(labels...).Observe(*ocrResult.Confidence)
+		for _, page := range ocrResult.PageConfidence {
+			if page.Words > 0 {
+				pageConfidence.WithLabelValues(labels...).Observe(page.Confidence)
+			}
+		}
+	}
+	labels = append(labels, outcomeLabel(err))
+	workerJobs.WithLabelValues(labels...).Inc()
+	workerJobDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// observePreprocessorJob records the outcome and duration of a request processed by a preprocessor
+func observePreprocessorJob(preprocessor string, start time.Time, err error) {
+	outcome := outcomeLabel(err)
+	preprocessorJobs.WithLabelValues(preprocessor, outcome).Inc()
+	preprocessorJobDuration.WithLabelValues(preprocessor, outcome).Observe(time.Since(start).Seconds())
+}
+
+// observeQueueWait records the time a delivery spent in its queue, if the publisher has set the publish time
+func observeQueueWait(d *amqp.Delivery) {
+	if publishTime, ok := d.Headers[publishTimeHeader].(int64); ok {
+		queueWait.WithLabelValues(d.RoutingKey).Observe(time.Since(time.Unix(0, publishTime)).Seconds())
+	}
+}
+
+// commandExitCode is the exit code of an external command, -1 if it could not be started or was killed
+func commandExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// observeExternalCommand records the exit code and run time of an external tool
+func observeExternalCommand(cmd *exec.Cmd, start time.Time, err error) {
+	command := cmd.Args[0]
+	externalCommands.WithLabelValues(command, strconv.Itoa(commandExitCode(err))).Inc()
+	externalCommandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,90 @@
+package ocrworker
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrumentHttpStatusHandlerTwice(t *testing.T) {
+
+	rabbitConfig := rabbitConfigForTests()
+	// the metrics are registered once at package initialization, wrapping a handler twice must not panic
+	assert.True(t, InstrumentHttpStatusHandler(NewOcrHttpHandler(&rabbitConfig)) != nil)
+	assert.True(t, InstrumentHttpStatusHandler(NewOcrHttpHandler(&rabbitConfig)) != nil)
+
+}
+
+func TestOcrJobMetrics(t *testing.T) {
+
+	ocrRequest := OcrRequest{
+		EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_type": "TXT"},
+		DocType:    "invoice",
+	}
+	assert.Equals(t, strings.Join(ocrJobLabels(&ocrRequest), ","), "ENGINE_SANDWICH_TESSERACT,invoice,txt")
+	ocrRequest.DocType = "not a valid label value"
+	assert.Equals(t, strings.Join(ocrJobLabels(&ocrRequest), ","), "ENGINE_SANDWICH_TESSERACT,other,txt")
+	ocrRequest = OcrRequest{EngineType: EngineMock}
+	assert.Equals(t, strings.Join(ocrJobLabels(&ocrRequest), ","), "ENGINE_MOCK,none,none")
+
+	jobs := testutil.ToFloat64(workerJobs.WithLabelValues("ENGINE_MOCK", "none", "none", "error"))
+	pages := testutil.ToFloat64(workerPages.WithLabelValues("ENGINE_MOCK", "none", "none"))
+	observeOcrJob(&ocrRequest, &OcrResult{pages: 3}, time.Now(), nil)
+	observeOcrJob(&ocrRequest, &OcrResult{pages: 3}, time.Now(), errors.New("failed"))
+	assert.Equals(t, testutil.ToFloat64(workerJobs.WithLabelValues("ENGINE_MOCK", "none", "none", "error")), jobs+1)
+	assert.Equals(t, testutil.ToFloat64(workerPages.WithLabelValues("ENGINE_MOCK", "none", "none")), pages+3)
+
+	ocrRequest.DocType = "confidence"
+	confidence := 80.0
+	observeOcrJob(&ocrRequest, &OcrResult{Confidence: &confidence, PageConfidence: []PageConfidence{
+		{Page: 1, Confidence: 90, Words: 10}, {Page: 2, Words: 0}, {Page: 3, Confidence: 50, Words: 2},
+	}}, time.Now(), nil)
+	// the page without words is left out
+	metric := &dto.Metric{}
+	assert.True(t, pageConfidence.WithLabelValues("ENGINE_MOCK", "confidence", "none").(prometheus.Histogram).Write(metric) == nil)
+	assert.Equals(t, metric.GetHistogram().GetSampleCount(), uint64(2))
+	assert.Equals(t, metric.GetHistogram().GetSampleSum(), 140.0)
+
+	exits := testutil.ToFloat64(externalCommands.WithLabelValues("false", "1"))
+	_, err := runCommand(context.Background(), exec.Command("false"))
+	assert.True(t, err != nil)
+	assert.Equals(t, testutil.ToFloat64(externalCommands.WithLabelValues("false", "1")), exits+1)
+
+}
+
+func TestWorkerHttpServer(t *testing.T) {
+
+	defer setWorkerReady(errors.New("not connected to the message broker yet"))
+	handler := NewWorkerHttpServer(0).Handler
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equals(t, rec.Code, 200)
+
+	setWorkerReady(errors.New("not consuming"))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equals(t, rec.Code, 503)
+	assert.True(t, strings.Contains(rec.Body.String(), "not consuming"))
+
+	setWorkerReady(nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equals(t, rec.Code, 200)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equals(t, rec.Code, 200)
+	assert.True(t, strings.Contains(rec.Body.String(), "ocr_external_command_exits_total"))
+
+}
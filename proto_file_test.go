@@ -0,0 +1,347 @@
+package ocrworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// protoScalarTypes are the scalar types of the proto3 language
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"double":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"float":    descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"int64":    descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint64":   descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"int32":    descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"fixed64":  descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+	"fixed32":  descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+	"bool":     descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"string":   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":    descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"uint32":   descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"sfixed32": descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+	"sfixed64": descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+	"sint32":   descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+	"sint64":   descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+}
+
+var protoTokens = regexp.MustCompile(`"[^"]*"|[A-Za-z_][A-Za-z0-9_.]*|\d+|[{}()<>;=,\[\]]`)
+
+// protoParser reads the part of the proto3 language the .proto files of the repository use into a
+// descriptor, so the tests can check the code against them without protoc
+type protoParser struct {
+	tokens []string
+	pos    int
+	file   *descriptorpb.FileDescriptorProto
+	enums  map[string]bool
+}
+
+func parseProtoFile(path string) (*descriptorpb.FileDescriptorProto, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(source), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	p := &protoParser{
+		tokens: protoTokens.FindAllString(strings.Join(lines, "\n"), -1),
+		file:   &descriptorpb.FileDescriptorProto{Name: proto.String(path)},
+		enums:  make(map[string]bool),
+	}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p.file, nil
+}
+
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *protoParser) expect(tokens ...string) error {
+	for _, token := range tokens {
+		if got := p.next(); got != token {
+			return fmt.Errorf("expected %q, got %q", token, got)
+		}
+	}
+	return nil
+}
+
+func (p *protoParser) skipStatement() {
+	for token := p.next(); token != ";" && token != ""; token = p.next() {
+	}
+}
+
+func (p *protoParser) parse() error {
+	for p.pos < len(p.tokens) {
+		var err error
+		switch token := p.next(); token {
+		case "syntax":
+			err = p.expect("=")
+			p.file.Syntax = proto.String(strings.Trim(p.next(), `"`))
+			p.skipStatement()
+		case "package":
+			p.file.Package = proto.String(p.next())
+			p.skipStatement()
+		case "import":
+			p.file.Dependency = append(p.file.Dependency, strings.Trim(p.next(), `"`))
+			p.skipStatement()
+		case "option":
+			p.skipStatement()
+		case "message":
+			var message *descriptorpb.DescriptorProto
+			message, err = p.parseMessage(p.next())
+			p.file.MessageType = append(p.file.MessageType, message)
+		case "enum":
+			var enum *descriptorpb.EnumDescriptorProto
+			enum, err = p.parseEnum(p.next())
+			p.file.EnumType = append(p.file.EnumType, enum)
+		case "service":
+			err = p.parseService(p.next())
+		default:
+			err = fmt.Errorf("unexpected %q", token)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, message := range p.file.MessageType {
+		p.resolveTypes(message)
+	}
+	return nil
+}
+
+func (p *protoParser) parseMessage(name string) (*descriptorpb.DescriptorProto, error) {
+	message := &descriptorpb.DescriptorProto{Name: proto.String(name)}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var optionalFields []*descriptorpb.FieldDescriptorProto
+	oneof := int32(-1)
+	for {
+		token := p.next()
+		switch token {
+		case "}":
+			if oneof >= 0 {
+				oneof = -1
+				continue
+			}
+			// proto3 optional fields are in a synthetic oneof of their own, after the real ones
+			for _, field := range optionalFields {
+				field.OneofIndex = proto.Int32(int32(len(message.OneofDecl)))
+				message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{
+					Name: proto.String("_" + field.GetName()),
+				})
+			}
+			return message, nil
+		case "reserved", "option":
+			p.skipStatement()
+			continue
+		case "oneof":
+			oneof = int32(len(message.OneofDecl))
+			message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(p.next())})
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			continue
+		case "":
+			return nil, fmt.Errorf("message %s is not closed", name)
+		}
+		field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+		switch token {
+		case "repeated":
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			token = p.next()
+		case "optional":
+			field.Proto3Optional = proto.Bool(true)
+			optionalFields = append(optionalFields, field)
+			token = p.next()
+		case "map":
+			if err := p.expect("<"); err != nil {
+				return nil, err
+			}
+			keyType := p.next()
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			valueType := p.next()
+			if err := p.expect(">"); err != nil {
+				return nil, err
+			}
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			entry := &descriptorpb.DescriptorProto{
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("key"), Number: proto.Int32(1), Label: field.Label.Enum(), TypeName: proto.String(keyType)},
+					{Name: proto.String("value"), Number: proto.Int32(2), Label: field.Label.Enum(), TypeName: proto.String(valueType)},
+				},
+			}
+			entry.Field[0].Label = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+			entry.Field[1].Label = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+			message.NestedType = append(message.NestedType, entry)
+			token = name + "." + "<entry>"
+		}
+		field.TypeName = proto.String(token)
+		field.Name = proto.String(p.next())
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		number, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %w", name, field.GetName(), err)
+		}
+		field.Number = proto.Int32(int32(number))
+		if oneof >= 0 {
+			field.OneofIndex = proto.Int32(oneof)
+		}
+		if token == name+".<entry>" {
+			entry := message.NestedType[len(message.NestedType)-1]
+			entry.Name = proto.String(protoCamelCase(field.GetName()) + "Entry")
+			field.TypeName = proto.String(name + "." + entry.GetName())
+		}
+		message.Field = append(message.Field, field)
+		p.skipStatement()
+	}
+}
+
+func (p *protoParser) parseEnum(name string) (*descriptorpb.EnumDescriptorProto, error) {
+	enum := &descriptorpb.EnumDescriptorProto{Name: proto.String(name)}
+	p.enums[name] = true
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for token := p.next(); token != "}"; token = p.next() {
+		if token == "" {
+			return nil, fmt.Errorf("enum %s is not closed", name)
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		number, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("enum value %s: %w", token, err)
+		}
+		enum.Value = append(enum.Value, &descriptorpb.EnumValueDescriptorProto{
+			Name: proto.String(token), Number: proto.Int32(int32(number)),
+		})
+		p.skipStatement()
+	}
+	return enum, nil
+}
+
+func (p *protoParser) parseService(name string) error {
+	service := &descriptorpb.ServiceDescriptorProto{Name: proto.String(name)}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for token := p.next(); token != "}"; token = p.next() {
+		if token != "rpc" {
+			return fmt.Errorf("service %s: unexpected %q", name, token)
+		}
+		method := &descriptorpb.MethodDescriptorProto{Name: proto.String(p.next())}
+		for _, types := range []struct {
+			typeName  **string
+			streaming **bool
+		}{{&method.InputType, &method.ClientStreaming}, {&method.OutputType, &method.ServerStreaming}} {
+			if types.typeName == &method.OutputType {
+				if err := p.expect("returns"); err != nil {
+					return err
+				}
+			}
+			if err := p.expect("("); err != nil {
+				return err
+			}
+			typeName := p.next()
+			if typeName == "stream" {
+				*types.streaming = proto.Bool(true)
+				typeName = p.next()
+			}
+			*types.typeName = proto.String(p.qualify(typeName))
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+		}
+		if token := p.next(); token == "{" {
+			if err := p.expect("}"); err != nil {
+				return err
+			}
+		} else if token != ";" {
+			return fmt.Errorf("rpc %s: unexpected %q", method.GetName(), token)
+		}
+		service.Method = append(service.Method, method)
+	}
+	p.file.Service = append(p.file.Service, service)
+	return nil
+}
+
+// qualify is the full name of a message or enum, the names without a dot are the ones of the file
+func (p *protoParser) qualify(name string) string {
+	if strings.Contains(name, ".") && !strings.HasPrefix(name, p.file.GetPackage()+".") {
+		if _, local := p.enums[name]; !local && !p.isLocalMessage(name) {
+			return "." + name
+		}
+	}
+	return "." + p.file.GetPackage() + "." + name
+}
+
+func (p *protoParser) isLocalMessage(name string) bool {
+	topLevel := strings.SplitN(name, ".", 2)[0]
+	for _, message := range p.file.MessageType {
+		if message.GetName() == topLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTypes turns the type names of the fields into their types
+func (p *protoParser) resolveTypes(message *descriptorpb.DescriptorProto) {
+	for _, nested := range message.NestedType {
+		p.resolveTypes(nested)
+	}
+	for _, field := range message.Field {
+		typeName := field.GetTypeName()
+		if scalar, ok := protoScalarTypes[typeName]; ok {
+			field.Type = scalar.Enum()
+			field.TypeName = nil
+			continue
+		}
+		field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		if p.enums[typeName] {
+			field.Type = descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum()
+		}
+		field.TypeName = proto.String(p.qualify(typeName))
+	}
+}
+
+// protoCamelCase is the name protoc gives the entry message of a map field
+func protoCamelCase(name string) string {
+	var camel strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			camel.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		default:
+			camel.WriteRune(r)
+		}
+	}
+	return camel.String()
+}
@@ -4,30 +4,80 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 type RabbitConfig struct {
-	AmqpURI      string
-	Exchange     string
-	ExchangeType string
-	RoutingKey   string
-	Reliable     bool
-	AmqpAPIURI   string
-	APIPathQueue string
-	APIQueueName string
-	APIPathStats string
-	QueuePrio    map[string]uint8
-	QueuePrioArg string
+	AmqpURI      string           `yaml:"amqp_uri" toml:"amqp_uri" config:"secret"`
+	Exchange     string           `yaml:"exchange" toml:"exchange"`
+	ExchangeType string           `yaml:"exchange_type" toml:"exchange_type"`
+	RoutingKey   string           `yaml:"routing_key" toml:"routing_key"`
+	Reliable     bool             `yaml:"reliable" toml:"reliable"`
+	AmqpAPIURI   string           `yaml:"amqpapi_uri" toml:"amqpapi_uri" config:"secret"`
+	APIPathQueue string           `yaml:"api_path_queue" toml:"api_path_queue"`
+	APIQueueName string           `yaml:"api_queue_name" toml:"api_queue_name"`
+	APIPathStats string           `yaml:"api_path_stats" toml:"api_path_stats"`
+	QueuePrio    map[string]uint8 `yaml:"queue_prio" toml:"queue_prio" config:"reload"`
+	QueuePrioArg string           `yaml:"-" toml:"-"`
 	/* ResponseCacheTimeout sets default(!!!) global timeout in seconds for request
 	   engine will be killed after reaching the time limit, user will get timeout error */
-	ResponseCacheTimeout uint
+	ResponseCacheTimeout uint `yaml:"default_timeout" toml:"default_timeout" config:"reload"`
 	// MaximalResponseCacheTimeout client won't be able set the ResponseCacheTimeout higher of it's value
-	MaximalResponseCacheTimeout uint
+	MaximalResponseCacheTimeout uint `yaml:"maximal_timeout" toml:"maximal_timeout" config:"reload"`
 	// check interval for request to be ready
 	// tickerWithPostActionInterval time.Duration
-	FactorForMessageAccept uint
+	FactorForMessageAccept uint `yaml:"worker_factor" toml:"worker_factor" config:"reload"`
+	// Admission is the name of the admission controller, see NewAdmissionController
+	Admission string `yaml:"admission" toml:"admission"`
+	// AdmissionResume is the percentage of the limits the load has to drop below before requests are accepted again
+	AdmissionResume uint `yaml:"admission_resume" toml:"admission_resume" config:"reload"`
+	// MemoryThreshold is the percentage of the broker memory limit from which requests are rejected
+	MemoryThreshold uint `yaml:"memory_threshold" toml:"memory_threshold" config:"reload"`
+	// AdmissionInterval is the number of seconds between two admission checks
+	AdmissionInterval uint `yaml:"admission_interval" toml:"admission_interval" config:"reload"`
+	// BatchParallelism limits the number of requests of a single batch which are processed at the same time
+	BatchParallelism uint `yaml:"batch_parallel" toml:"batch_parallel" config:"reload"`
+	// AnnounceExchange is the fanout exchange on which workers announce their capabilities
+	AnnounceExchange string `yaml:"announce_exchange" toml:"announce_exchange"`
+	// MaxUploadSize limits the size of a single file upload in bytes, 0 means no limit
+	MaxUploadSize int64 `yaml:"max_upload_size" toml:"max_upload_size" config:"reload"`
+	// MaxBatchItems limits the number of requests of a batch, 0 means no limit
+	MaxBatchItems uint `yaml:"max_batch_items" toml:"max_batch_items" config:"reload"`
+	// TraceExporter is empty if tracing is disabled, "stdout" or the url of an OTLP collector
+	TraceExporter string `yaml:"trace_exporter" toml:"trace_exporter"`
+	// LogLevel is the level of zerolog, e.g. debug or info
+	LogLevel string `yaml:"log_level" toml:"log_level" config:"reload"`
+	// DebugToken permits debug requests and the download of debug bundles, debugging is disabled if empty
+	DebugToken string `yaml:"debug_token" toml:"debug_token" config:"secret,reload"`
+	// AdminToken permits the /admin end points, they are disabled if empty
+	AdminToken string `yaml:"admin_token" toml:"admin_token" config:"secret,reload"`
+	// DebugRetention is the number of seconds debug bundles can be downloaded
+	DebugRetention uint `yaml:"debug_retention" toml:"debug_retention" config:"reload"`
+	// ResultCache is the name of the result cache, see NewResultCache
+	ResultCache string `yaml:"result_cache" toml:"result_cache"`
+	// ResultCacheSize is the maximal number of cached results, 0 means no limit
+	ResultCacheSize uint `yaml:"result_cache_size" toml:"result_cache_size"`
+	// ResultCacheDir is the directory of the disk cache, empty for open-ocr-cache in the temp directory
+	ResultCacheDir string `yaml:"result_cache_dir" toml:"result_cache_dir"`
+	// ResultCacheTTL is the number of seconds a result is cached
+	ResultCacheTTL uint `yaml:"result_cache_ttl" toml:"result_cache_ttl" config:"reload"`
+	// BlobStore is the uri of the store for documents bigger than BlobThreshold, see NewBlobStore.
+	// Documents are sent inline in the messages if it is empty.
+	BlobStore string `yaml:"blob_store" toml:"blob_store" config:"secret"`
+	// BlobThreshold is the size in bytes up to which documents are sent inline
+	BlobThreshold int64 `yaml:"blob_threshold" toml:"blob_threshold" config:"reload"`
+	// WireEncoding is the encoding of the requests published by cli-httpd, json or protobuf.
+	// Preprocessors and workers answer in the encoding of the message they received.
+	WireEncoding string `yaml:"wire_encoding" toml:"wire_encoding" config:"reload"`
+	// MinPageConfidence flags the pages with a lower mean word confidence, from 0 to 100
+	MinPageConfidence uint `yaml:"min_page_confidence" toml:"min_page_confidence" config:"reload"`
+	// MinDocumentConfidence is the mean word confidence below which a whole document needs review, 0 disables it
+	MinDocumentConfidence uint `yaml:"min_document_confidence" toml:"min_document_confidence" config:"reload"`
+	// ConfidenceReview sets the status of results with flagged pages or below MinDocumentConfidence to needs_review
+	ConfidenceReview bool `yaml:"confidence_review" toml:"confidence_review" config:"reload"`
 }
 
 func DefaultTestConfig() RabbitConfig {
@@ -51,6 +101,22 @@ func DefaultTestConfig() RabbitConfig {
 		MaximalResponseCacheTimeout: 28800,
 		// tickerWithPostActionInterval: time.Second * 2,
 		FactorForMessageAccept: 2,
+		Admission:              AdmissionManagementAPI,
+		AdmissionResume:        80,
+		MemoryThreshold:        95,
+		AdmissionInterval:      5,
+		BatchParallelism:       4,
+		MaxUploadSize:          50 << 20,
+		MaxBatchItems:          1000,
+		AnnounceExchange:       "open-ocr-workers",
+		LogLevel:               "info",
+		DebugRetention:         3600,
+		ResultCache:            ResultCacheNone,
+		ResultCacheSize:        1000,
+		ResultCacheTTL:         86400,
+		BlobThreshold:          256 << 10,
+		WireEncoding:           WireEncodingJSON,
+		MinPageConfidence:      60,
 	}
 	return rabbitConfig
 
@@ -63,9 +129,8 @@ func NoOpFlagFunction() FlagFunction {
 }
 
 func DefaultConfigFlagsOverride(flagFunction FlagFunction) RabbitConfig {
-	rabbitConfig := DefaultTestConfig()
-
 	flagFunction()
+	configFlags := registerConfigFlags()
 	var (
 		AmqpAPIURI                  string
 		AmqpURI                     string
@@ -73,6 +138,28 @@ func DefaultConfigFlagsOverride(flagFunction FlagFunction) RabbitConfig {
 		ResponseCacheTimeout        uint
 		MaximalResponseCacheTimeout uint
 		FactorForMessageAccept      uint
+		Admission                   string
+		AdmissionResume             uint
+		MemoryThreshold             uint
+		AdmissionInterval           uint
+		BatchParallelism            uint
+		MaxUploadSizeMB             uint
+		MaxBatchItems               uint
+		TraceExporter               string
+		LogLevel                    string
+		DebugToken                  string
+		AdminToken                  string
+		DebugRetention              uint
+		ResultCache                 string
+		ResultCacheSize             uint
+		ResultCacheDir              string
+		ResultCacheTTL              uint
+		BlobStore                   string
+		BlobThresholdKB             uint
+		WireEncoding                string
+		MinPageConfidence           uint
+		MinDocumentConfidence       uint
+		ConfidenceReview            bool
 	)
 	flag.StringVar(
 		&AmqpURI,
@@ -111,34 +198,295 @@ func DefaultConfigFlagsOverride(flagFunction FlagFunction) RabbitConfig {
 		2,
 		"Limits number of accepted request by formula worker_factor * number of running workers.",
 	)
+	flag.StringVar(
+		&Admission,
+		"admission",
+		AdmissionManagementAPI,
+		"How to decide if there are resources for new requests: management_api (queue and memory stats of the "+
+			"RabbitMQ management API), passive_declare (queue stats over AMQP), heartbeat (worker announcements "+
+			"and the jobs of this daemon) or static (accept every request).",
+	)
+	flag.UintVar(
+		&AdmissionResume,
+		"admission_resume",
+		80,
+		"Once requests are rejected, they are accepted again after the load has dropped below this percentage "+
+			"of the limits set by worker_factor and memory_threshold.",
+	)
+	flag.UintVar(
+		&MemoryThreshold,
+		"memory_threshold",
+		95,
+		"Requests are rejected if the memory used by RabbitMQ reaches this percentage of its limit.",
+	)
+	flag.UintVar(
+		&AdmissionInterval,
+		"admission_interval",
+		5,
+		"Interval in seconds in which the admission controller checks the load.",
+	)
+
+	flag.UintVar(
+		&BatchParallelism,
+		"batch_parallel",
+		4,
+		"How many requests of a single batch submitted to /ocr-batch will be processed in parallel.",
+	)
+	flag.UintVar(
+		&MaxUploadSizeMB,
+		"max_upload_mb",
+		50,
+		"Maximal size of a file uploaded to /ocr-file-upload in megabytes, bigger uploads are rejected with 413. "+
+			"Set to 0 to disable the limit.",
+	)
+	flag.UintVar(
+		&MaxBatchItems,
+		"max_batch_items",
+		1000,
+		"Maximal number of requests of a batch submitted to /ocr-batch, bigger batches are rejected with 413. "+
+			"Set to 0 to disable the limit.",
+	)
+	flag.StringVar(
+		&TraceExporter,
+		"trace_exporter",
+		"",
+		"Where to export traces to: the url of an OTLP/HTTP collector, e.g. http://localhost:4318, "+
+			"or stdout. Tracing is disabled if empty.",
+	)
+
+	flag.StringVar(
+		&LogLevel,
+		"log_level",
+		"info",
+		"Log level: debug, info, warn or error.",
+	)
+	flag.StringVar(
+		&DebugToken,
+		"debug_token",
+		"",
+		"Clients sending this token in the X-Debug-Token header may request debug bundles and download them "+
+			"from /v2/jobs/{id}/debug. Debug bundles are disabled if empty.",
+	)
+	flag.StringVar(
+		&AdminToken,
+		"admin_token",
+		"",
+		"Clients sending this token in the X-Admin-Token header may use the /admin end points. "+
+			"They are disabled if empty.",
+	)
+	flag.UintVar(
+		&DebugRetention,
+		"debug_retention",
+		3600,
+		"How many seconds debug bundles can be downloaded.",
+	)
+	flag.StringVar(
+		&ResultCache,
+		"result_cache",
+		ResultCacheNone,
+		"Where the results of synchronous requests are cached by the hash of the document and the options: "+
+			"none, memory or disk. Identical requests running at the same time are processed only once.",
+	)
+	flag.UintVar(
+		&ResultCacheSize,
+		"result_cache_size",
+		1000,
+		"Maximal number of cached results, the least recently used ones are dropped. Set to 0 to disable the limit.",
+	)
+	flag.StringVar(
+		&ResultCacheDir,
+		"result_cache_dir",
+		"",
+		"Directory of the disk result cache, open-ocr-cache in the temp directory if empty.",
+	)
+	flag.UintVar(
+		&ResultCacheTTL,
+		"result_cache_ttl",
+		86400,
+		"How many seconds results are cached.",
+	)
+	flag.StringVar(
+		&BlobStore,
+		"blob_store",
+		"",
+		"Store for big documents, which are not sent inline in the messages: file:///shared/volume or "+
+			"s3://access:secret@host:port/bucket?region=us-east-1, s3+http:// for plain http. Disabled if empty.",
+	)
+	flag.UintVar(
+		&BlobThresholdKB,
+		"blob_threshold_kb",
+		256,
+		"Documents up to this size in kilobytes are sent inline in the messages, bigger ones go to the blob_store.",
+	)
+	flag.StringVar(
+		&WireEncoding,
+		"wire_encoding",
+		WireEncodingJSON,
+		"Encoding of the messages to the preprocessors and workers: json or protobuf, which sends the documents "+
+			"as raw bytes. Switch to protobuf once all preprocessors and workers understand it.",
+	)
+	flag.UintVar(
+		&MinPageConfidence,
+		"min_page_confidence",
+		60,
+		"Pages with a lower mean word confidence (0-100) are flagged as low_confidence in the result.",
+	)
+	flag.UintVar(
+		&MinDocumentConfidence,
+		"min_document_confidence",
+		0,
+		"Documents with a lower mean word confidence (0-100) need review, 0 disables the check.",
+	)
+	flag.BoolVar(
+		&ConfidenceReview,
+		"confidence_review",
+		false,
+		"Return the status needs_review instead of done for results with low confidence pages or below "+
+			"min_document_confidence.",
+	)
 
 	flag.Parse()
-	if len(AmqpURI) > 0 {
-		rabbitConfig.AmqpURI = AmqpURI
-	}
-	if len(AmqpAPIURI) > 0 {
-		rabbitConfig.AmqpAPIURI = AmqpAPIURI
-	}
-	if len(QueuePrioArg) > 0 {
-		err := json.Unmarshal([]byte(QueuePrioArg), &rabbitConfig.QueuePrio)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Message priority argument list is not in a proper JSON format eg. {\"egvp\":9}")
+
+	// the flags are parsed only once, a reload applies them again on top of the config file and the environment
+	loadRabbitConfig := func() (RabbitConfig, error) {
+		rabbitConfig := DefaultTestConfig()
+		if err := configFlags.load(&rabbitConfig); err != nil {
+			return rabbitConfig, err
 		}
-	} else {
-		rabbitConfig.QueuePrioArg = QueuePrioArg
-	}
 
-	if MaximalResponseCacheTimeout < ResponseCacheTimeout {
-		err := fmt.Errorf("maximal_timeout is lower than default_timeout")
-		log.Fatal().Err(err).Msg("setting maximal_timeout lower than default_timeout is not allowed, if in doubt set both to same value")
-	} else {
-		rabbitConfig.MaximalResponseCacheTimeout = MaximalResponseCacheTimeout
-		rabbitConfig.ResponseCacheTimeout = ResponseCacheTimeout
+		// only the flags which are set explicitly override the config file and the environment
+		explicit := explicitFlags()
+		if explicit["amqp_uri"] {
+			rabbitConfig.AmqpURI = AmqpURI
+		}
+		if explicit["amqpapi_uri"] {
+			rabbitConfig.AmqpAPIURI = AmqpAPIURI
+		}
+		if len(QueuePrioArg) > 0 {
+			err := json.Unmarshal([]byte(QueuePrioArg), &rabbitConfig.QueuePrio)
+			if err != nil {
+				return rabbitConfig, fmt.Errorf("message priority argument list is not in a proper JSON format eg. {\"egvp\":9}: %w", err)
+			}
+			rabbitConfig.QueuePrioArg = QueuePrioArg
+		}
+		if explicit["default_timeout"] {
+			rabbitConfig.ResponseCacheTimeout = ResponseCacheTimeout
+		}
+		if explicit["maximal_timeout"] {
+			rabbitConfig.MaximalResponseCacheTimeout = MaximalResponseCacheTimeout
+		}
+		if explicit["worker_factor"] && FactorForMessageAccept > 0 {
+			rabbitConfig.FactorForMessageAccept = FactorForMessageAccept
+		}
+		if explicit["admission"] {
+			rabbitConfig.Admission = Admission
+		}
+		if explicit["admission_resume"] {
+			rabbitConfig.AdmissionResume = AdmissionResume
+		}
+		if explicit["memory_threshold"] {
+			rabbitConfig.MemoryThreshold = MemoryThreshold
+		}
+		if explicit["admission_interval"] && AdmissionInterval > 0 {
+			rabbitConfig.AdmissionInterval = AdmissionInterval
+		}
+		if explicit["batch_parallel"] && BatchParallelism > 0 {
+			rabbitConfig.BatchParallelism = BatchParallelism
+		}
+		if explicit["max_upload_mb"] {
+			rabbitConfig.MaxUploadSize = int64(MaxUploadSizeMB) << 20
+		}
+		if explicit["max_batch_items"] {
+			rabbitConfig.MaxBatchItems = MaxBatchItems
+		}
+		if explicit["trace_exporter"] {
+			rabbitConfig.TraceExporter = TraceExporter
+		}
+		if explicit["log_level"] {
+			rabbitConfig.LogLevel = LogLevel
+		}
+		if explicit["debug_token"] {
+			rabbitConfig.DebugToken = DebugToken
+		}
+		if explicit["admin_token"] {
+			rabbitConfig.AdminToken = AdminToken
+		}
+		if explicit["debug_retention"] {
+			rabbitConfig.DebugRetention = DebugRetention
+		}
+		if explicit["result_cache"] {
+			rabbitConfig.ResultCache = ResultCache
+		}
+		if explicit["result_cache_size"] {
+			rabbitConfig.ResultCacheSize = ResultCacheSize
+		}
+		if explicit["result_cache_dir"] {
+			rabbitConfig.ResultCacheDir = ResultCacheDir
+		}
+		if explicit["result_cache_ttl"] {
+			rabbitConfig.ResultCacheTTL = ResultCacheTTL
+		}
+		if explicit["blob_store"] {
+			rabbitConfig.BlobStore = BlobStore
+		}
+		if explicit["blob_threshold_kb"] {
+			rabbitConfig.BlobThreshold = int64(BlobThresholdKB) << 10
+		}
+		if explicit["wire_encoding"] {
+			rabbitConfig.WireEncoding = WireEncoding
+		}
+		if explicit["min_page_confidence"] {
+			rabbitConfig.MinPageConfidence = MinPageConfidence
+		}
+		if explicit["min_document_confidence"] {
+			rabbitConfig.MinDocumentConfidence = MinDocumentConfidence
+		}
+		if explicit["confidence_review"] {
+			rabbitConfig.ConfidenceReview = ConfidenceReview
+		}
+		return rabbitConfig, validateRabbitConfig(&rabbitConfig)
 	}
 
-	if FactorForMessageAccept > 0 {
-		rabbitConfig.FactorForMessageAccept = FactorForMessageAccept
+	rabbitConfig, err := loadRabbitConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
 	}
+	if configFlags.printConfig {
+		if err := printConfig(os.Stdout, &rabbitConfig); err != nil {
+			log.Fatal().Err(err).Msg("could not print the configuration")
+		}
+		os.Exit(0)
+	}
+	setReloadableConfig(rabbitConfig, loadRabbitConfig)
 
 	return rabbitConfig
 }
+
+// validateRabbitConfig checks the settings which depend on each other
+func validateRabbitConfig(rabbitConfig *RabbitConfig) error {
+	if rabbitConfig.MaximalResponseCacheTimeout < rabbitConfig.ResponseCacheTimeout {
+		return fmt.Errorf("setting maximal_timeout lower than default_timeout is not allowed, if in doubt set both to same value")
+	}
+	if rabbitConfig.AdmissionResume == 0 || rabbitConfig.AdmissionResume > 100 ||
+		rabbitConfig.MemoryThreshold == 0 || rabbitConfig.MemoryThreshold > 100 {
+		return fmt.Errorf("admission_resume and memory_threshold are percentages between 1 and 100")
+	}
+	if _, err := zerolog.ParseLevel(rabbitConfig.LogLevel); err != nil {
+		return fmt.Errorf("invalid log_level: %w", err)
+	}
+	switch rabbitConfig.ResultCache {
+	case ResultCacheNone, ResultCacheMemory, ResultCacheDisk, "":
+	default:
+		return fmt.Errorf("invalid result_cache %q, use none, memory or disk", rabbitConfig.ResultCache)
+	}
+	if _, err := NewBlobStore(rabbitConfig.BlobStore); err != nil {
+		return err
+	}
+	if rabbitConfig.WireEncoding != WireEncodingJSON && rabbitConfig.WireEncoding != WireEncodingProtobuf {
+		return fmt.Errorf("invalid wire_encoding %q, use json or protobuf", rabbitConfig.WireEncoding)
+	}
+	if rabbitConfig.MinPageConfidence > 100 || rabbitConfig.MinDocumentConfidence > 100 {
+		return fmt.Errorf("min_page_confidence and min_document_confidence are percentages between 0 and 100")
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package ocrworker
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// names of the result caches which can be chosen with the -result_cache flag
+const (
+	ResultCacheNone   = "none"
+	ResultCacheMemory = "memory"
+	ResultCacheDisk   = "disk"
+)
+
+// CacheBypass is the cache option of a request which skips the lookup and runs the engine again,
+// its result replaces the cached one
+const CacheBypass = "bypass"
+
+// resultCachePruneInterval is the minimal time between two prunes of the disk cache
+const resultCachePruneInterval = time.Minute
+
+// ResultCache keeps the results of finished ocr requests by the hash of their input and options
+type ResultCache interface {
+	Get(key string) (OcrResult, bool)
+	Put(key string, ocrResult OcrResult, ttl time.Duration)
+}
+
+var (
+	resultCacheMu sync.Mutex
+	// resultCache is nil if caching is disabled
+	resultCache ResultCache
+
+	resultFlightsMu sync.Mutex
+	// resultFlights are the requests running by cache key, identical requests wait for them
+	resultFlights = make(map[string]*resultFlight)
+)
+
+// SetupResultCache creates the result cache configured by rabbitConfig.ResultCache
+func SetupResultCache(rabbitConfig *RabbitConfig) error {
+	cache, err := NewResultCache(rabbitConfig)
+	if err != nil {
+		return err
+	}
+	resultCacheMu.Lock()
+	resultCache = cache
+	resultCacheMu.Unlock()
+	if cache != nil {
+		log.Info().Str("component", "OCR_CACHE").Str("cache", rabbitConfig.ResultCache).
+			Uint("size", rabbitConfig.ResultCacheSize).Msg("result cache enabled")
+	}
+	return nil
+}
+
+// NewResultCache creates the result cache configured by rabbitConfig.ResultCache, it is nil for none
+func NewResultCache(rabbitConfig *RabbitConfig) (ResultCache, error) {
+	switch rabbitConfig.ResultCache {
+	case ResultCacheNone, "":
+		return nil, nil
+	case ResultCacheMemory:
+		return newMemoryResultCache(int(rabbitConfig.ResultCacheSize)), nil
+	case ResultCacheDisk:
+		return newDiskResultCache(rabbitConfig.ResultCacheDir, int(rabbitConfig.ResultCacheSize))
+	default:
+		return nil, fmt.Errorf("unknown result cache %q, use none, memory or disk", rabbitConfig.ResultCache)
+	}
+}
+
+func currentResultCache() ResultCache {
+	resultCacheMu.Lock()
+	defer resultCacheMu.Unlock()
+	return resultCache
+}
+
+// resultCacheApplies is false for debug requests, they always run to collect their bundle
+func resultCacheApplies(ocrRequest *OcrRequest) bool {
+	return !ocrRequest.Debug
+}
+
+// resultCacheKey hashes the document together with every option which changes the result,
+// the document has to be loaded already, an upload is represented by the checksum taken while it was streamed
+func resultCacheKey(ocrRequest *OcrRequest) string {
+	// encoding/json sorts the keys of the maps, equal options always hash the same
+	key := struct {
+		Engine           string                 `json:"engine"`
+		EngineArgs       map[string]interface{} `json:"engine_args"`
+		Preprocessors    []string               `json:"preprocessors"`
+		PreprocessorArgs map[string]interface{} `json:"preprocessor_args"`
+		PageNumber       uint16                 `json:"page_number"`
+		Outputs          []string               `json:"outputs,omitempty"`
+		// the metadata of the request is only part of a PDF/A result
+		Title       string `json:"title,omitempty"`
+		ReferenceID string `json:"reference_id,omitempty"`
+	}{
+		Engine:           ocrRequest.EngineType.String(),
+		EngineArgs:       normalizeEngineArgs(ocrRequest.EngineArgs),
+		Preprocessors:    append([]string{}, ocrRequest.PreprocessorChain...),
+		PreprocessorArgs: normalizeEngineArgs(ocrRequest.PreprocessorArgs),
+		PageNumber:       ocrRequest.PageNumber,
+		Outputs:          sortedOutputs(ocrRequest),
+	}
+	if pdfaRequested(ocrRequest) {
+		key.Title = ocrRequest.Title
+		key.ReferenceID = ocrRequest.ReferenceID
+	}
+	options, _ := json.Marshal(key)
+	hash := sha256.New()
+	hash.Write(options)
+	hash.Write([]byte{0})
+	hash.Write([]byte(ocrRequest.documentSHA256()))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalizeEngineArgs drops the unset arguments and lower cases the ocr_type, which is case insensitive
+func normalizeEngineArgs(args map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		if value == nil {
+			continue
+		}
+		if ocrType, ok := value.(string); ok && name == "ocr_type" {
+			value = strings.ToLower(ocrType)
+		}
+		normalized[name] = value
+	}
+	return normalized
+}
+
+// storeCachedResult caches successful results, everything which belongs to a single request is left out
+func storeCachedResult(cache ResultCache, key string, ocrResult OcrResult, err error, ttl time.Duration) {
+	if err != nil || (ocrResult.Status != "done" && ocrResult.Status != StatusNeedsReview) {
+		return
+	}
+	ocrResult.ID = ""
+	ocrResult.DebugBundle = nil
+	ocrResult.DebugURL = ""
+	cache.Put(key, ocrResult, ttl)
+}
+
+// resultFlight is a job whose result identical requests are waiting for. It is finished on the completion
+// side when the result arrives, for a deferred job this is long after its request was answered.
+type resultFlight struct {
+	key        string
+	cache      ResultCache
+	ttl        time.Duration
+	once       sync.Once
+	done       chan struct{}
+	ocrResult  OcrResult
+	httpStatus int
+	err        error
+}
+
+func newResultFlight(key string, cache ResultCache, ttl time.Duration) *resultFlight {
+	return &resultFlight{key: key, cache: cache, ttl: ttl, done: make(chan struct{})}
+}
+
+// joinResultFlight returns the running job of key, leader is true if there was none and the caller
+// has to run the job and finish the flight
+func joinResultFlight(key string, cache ResultCache, ttl time.Duration) (flight *resultFlight, leader bool) {
+	resultFlightsMu.Lock()
+	defer resultFlightsMu.Unlock()
+	if flight, ok := resultFlights[key]; ok {
+		return flight, false
+	}
+	flight = newResultFlight(key, cache, ttl)
+	resultFlights[key] = flight
+	return flight, true
+}
+
+// finish caches the result and hands it to the waiting requests, only the first call counts
+func (f *resultFlight) finish(ocrResult OcrResult, httpStatus int, err error) {
+	f.once.Do(func() {
+		storeCachedResult(f.cache, f.key, ocrResult, err, f.ttl)
+		resultFlightsMu.Lock()
+		if resultFlights[f.key] == f {
+			delete(resultFlights, f.key)
+		}
+		resultFlightsMu.Unlock()
+		f.ocrResult, f.httpStatus, f.err = ocrResult, httpStatus, err
+		close(f.done)
+	})
+}
+
+// wait returns the result of the flight for the request requestID
+func (f *resultFlight) wait(requestID string) (OcrResult, int, error) {
+	<-f.done
+	ocrResult := f.ocrResult
+	if f.err == nil {
+		ocrResult.ID = requestID
+	}
+	return ocrResult, f.httpStatus, f.err
+}
+
+// answerDeferredRequest answers a deferred or reply_to request whose result comes from the cache or from
+// an identical request. Like the result of a worker it is polled or posted to reply_to once it is there.
+func answerDeferredRequest(ocrRequest *OcrRequest, workerConfig *RabbitConfig, result func() OcrResult) (OcrResult, int, error) {
+	requestID := ocrRequest.RequestID
+	logger := zerolog.New(os.Stdout).With().Str("component", "OCR_HTTP").Str("RequestID", requestID).Timestamp().Logger()
+	replyTo := ""
+	if ocrRequest.ReplyTo != "" {
+		validURL, err := checkURLForReplyTo(ocrRequest.ReplyTo)
+		if err != nil {
+			return OcrResult{ID: requestID}, 400, err
+		}
+		replyTo = validURL
+	}
+	startJobEvents(requestID, int(workerConfig.ResponseCacheTimeout))
+	recordJobProgress(requestID, JobProgress{State: JobQueued})
+	rpcResponseChan := make(chan OcrResult, 1)
+	addNewOcrResultToQueue(int(workerConfig.ResponseCacheTimeout), requestID, rpcResponseChan)
+	go func() {
+		ocrResult := result()
+		finalState := JobDone
+		if ocrResult.Status == "error" {
+			finalState = JobFailed
+		}
+		recordJobProgress(requestID, JobProgress{State: finalState})
+		if replyTo == "" {
+			rpcResponseChan <- ocrResult
+			return
+		}
+		// the result was sent back, there is nothing left to poll for
+		defer deleteRequestFromQueue(requestID)
+		newOcrPostClient().postOcrResultWithRetries(ocrRequest.traceContext(), &ocrResult, replyTo, 1, &logger)
+	}()
+	return OcrResult{ID: requestID, Status: "processing"}, 200, nil
+}
+
+type memoryCacheEntry struct {
+	key       string
+	ocrResult OcrResult
+	expires   time.Time
+}
+
+// memoryResultCache keeps the most recently used results in memory
+type memoryResultCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newMemoryResultCache(size int) *memoryResultCache {
+	return &memoryResultCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *memoryResultCache) Get(key string) (OcrResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return OcrResult{}, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return OcrResult{}, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.ocrResult, true
+}
+
+func (c *memoryResultCache) Put(key string, ocrResult OcrResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &memoryCacheEntry{key: key, ocrResult: ocrResult, expires: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.size > 0 && c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+// diskResultCache keeps the results as json files, the modification time of a file is its expiry.
+// Expired files and the ones exceeding size are pruned at most once per resultCachePruneInterval.
+type diskResultCache struct {
+	mu        sync.Mutex
+	dir       string
+	size      int
+	lastPrune time.Time
+}
+
+func newDiskResultCache(dir string, size int) (*diskResultCache, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "open-ocr-cache")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can not create the result cache directory: %w", err)
+	}
+	return &diskResultCache{dir: dir, size: size}, nil
+}
+
+func (c *diskResultCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *diskResultCache) Get(key string) (OcrResult, bool) {
+	fileName := c.path(key)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return OcrResult{}, false
+	}
+	if time.Now().After(info.ModTime()) {
+		_ = os.Remove(fileName)
+		return OcrResult{}, false
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return OcrResult{}, false
+	}
+	ocrResult := OcrResult{}
+	if err := json.Unmarshal(data, &ocrResult); err != nil {
+		log.Warn().Err(err).Str("component", "OCR_CACHE").Str("file", fileName).Msg("removing corrupt cache entry")
+		_ = os.Remove(fileName)
+		return OcrResult{}, false
+	}
+	return ocrResult, true
+}
+
+func (c *diskResultCache) Put(key string, ocrResult OcrResult, ttl time.Duration) {
+	data, err := json.Marshal(ocrResult)
+	if err == nil {
+		err = c.write(key, data, time.Now().Add(ttl))
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_CACHE").Msg("could not cache the result")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastPrune) >= resultCachePruneInterval {
+		c.lastPrune = time.Now()
+		c.prune(c.lastPrune)
+	}
+}
+
+// write stores the entry in a temporary file first, readers never see a partial entry
+func (c *diskResultCache) write(key string, data []byte, expires time.Time) error {
+	file, err := ioutil.TempFile(c.dir, key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(file.Name(), expires, expires)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// prune removes the expired entries and the ones expiring first while there are more than size
+func (c *diskResultCache) prune(now time.Time) {
+	fileInfos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_CACHE").Msg("could not prune the result cache")
+		return
+	}
+	entries := make([]os.FileInfo, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		if filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		if now.After(info.ModTime()) {
+			_ = os.Remove(filepath.Join(c.dir, info.Name()))
+			continue
+		}
+		entries = append(entries, info)
+	}
+	if c.size <= 0 || len(entries) <= c.size {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, info := range entries[:len(entries)-c.size] {
+		_ = os.Remove(filepath.Join(c.dir, info.Name()))
+	}
+}
@@ -0,0 +1,214 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestResultCacheKey(t *testing.T) {
+	ocrRequest := OcrRequest{
+		ImgBytes:   []byte("document"),
+		EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_type": "TXT", "lang": "deu", "psm": nil},
+	}
+	key := resultCacheKey(&ocrRequest)
+
+	// the order of the arguments, the case of ocr_type and unset arguments don't matter
+	sameRequest := ocrRequest
+	sameRequest.EngineArgs = map[string]interface{}{"lang": "deu", "ocr_type": "txt"}
+	assert.Equals(t, resultCacheKey(&sameRequest), key)
+
+	for _, otherRequest := range []OcrRequest{
+		{ImgBytes: []byte("other document"), EngineType: EngineSandwichTesseract, EngineArgs: sameRequest.EngineArgs},
+		{ImgBytes: []byte("document"), EngineType: EngineTesseract, EngineArgs: sameRequest.EngineArgs},
+		{ImgBytes: []byte("document"), EngineType: EngineSandwichTesseract, EngineArgs: map[string]interface{}{"ocr_type": "txt"}},
+		{ImgBytes: []byte("document"), EngineType: EngineSandwichTesseract, EngineArgs: sameRequest.EngineArgs,
+			PreprocessorChain: []string{"convert-pdf"}},
+	} {
+		assert.NotEquals(t, resultCacheKey(&otherRequest), key)
+	}
+}
+
+func TestMemoryResultCache(t *testing.T) {
+	cache := newMemoryResultCache(2)
+	cache.Put("a", OcrResult{Text: "a"}, time.Hour)
+	cache.Put("b", OcrResult{Text: "b"}, time.Hour)
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	// b is the least recently used one
+	cache.Put("c", OcrResult{Text: "c"}, time.Hour)
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	ocrResult, ok := cache.Get("c")
+	assert.True(t, ok)
+	assert.Equals(t, ocrResult.Text, "c")
+
+	cache.Put("a", OcrResult{Text: "a"}, -time.Second)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+}
+
+func TestDiskResultCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	cache, err := newDiskResultCache(dir, 2)
+	assert.True(t, err == nil)
+	cache.Put("a", OcrResult{Text: "a", Status: "done"}, time.Hour)
+	ocrResult, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equals(t, ocrResult.Text, "a")
+	assert.Equals(t, ocrResult.Status, "done")
+
+	cache.Put("expired", OcrResult{Text: "expired"}, -time.Second)
+	_, ok = cache.Get("expired")
+	assert.False(t, ok)
+
+	// the entries expiring first are pruned while there are more than size
+	cache.Put("b", OcrResult{Text: "b"}, 2*time.Hour)
+	cache.Put("c", OcrResult{Text: "c"}, 3*time.Hour)
+	cache.prune(time.Now())
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(files), 2)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+	_, ok = cache.Get("c")
+	assert.True(t, ok)
+}
+
+func TestResultFlight(t *testing.T) {
+	cache := newMemoryResultCache(10)
+	flight, leader := joinResultFlight("key", cache, time.Hour)
+	assert.True(t, leader)
+
+	var wg sync.WaitGroup
+	for _, requestID := range []string{"b", "c"} {
+		other, leader := joinResultFlight("key", cache, time.Hour)
+		assert.False(t, leader)
+		wg.Add(1)
+		go func(requestID string) {
+			defer wg.Done()
+			ocrResult, httpStatus, err := other.wait(requestID)
+			assert.True(t, err == nil)
+			assert.Equals(t, httpStatus, 200)
+			assert.Equals(t, ocrResult.Text, "text")
+			assert.Equals(t, ocrResult.ID, requestID)
+		}(requestID)
+	}
+	// the result arrives on the completion side, only the first one counts
+	flight.finish(OcrResult{ID: "a", Text: "text", Status: "done"}, 200, nil)
+	flight.finish(OcrResult{}, 500, fmt.Errorf("timeout"))
+	wg.Wait()
+
+	cachedResult, ok := cache.Get("key")
+	assert.True(t, ok)
+	assert.Equals(t, cachedResult.Text, "text")
+	assert.Equals(t, cachedResult.ID, "")
+	_, leader = joinResultFlight("key", cache, time.Hour)
+	assert.True(t, leader)
+	resultFlightsMu.Lock()
+	delete(resultFlights, "key")
+	resultFlightsMu.Unlock()
+}
+
+func TestHandleOcrRequestCached(t *testing.T) {
+	resultCacheMu.Lock()
+	resultCache = newMemoryResultCache(10)
+	resultCacheMu.Unlock()
+	defer func() {
+		resultCacheMu.Lock()
+		resultCache = nil
+		resultCacheMu.Unlock()
+	}()
+
+	rabbitConfig := DefaultTestConfig()
+	newRequest := func(cache string) *OcrRequest {
+		return &OcrRequest{ImgBytes: []byte("document"), EngineType: EngineMock, InplaceDecode: true, Cache: cache}
+	}
+	ocrResult, _, err := HandleOcrRequest(newRequest(""), &rabbitConfig)
+	assert.True(t, err == nil)
+	assert.False(t, ocrResult.Cached)
+
+	ocrResult, httpStatus, err := HandleOcrRequest(newRequest(""), &rabbitConfig)
+	assert.True(t, err == nil)
+	assert.Equals(t, httpStatus, 200)
+	assert.True(t, ocrResult.Cached)
+	assert.Equals(t, ocrResult.Text, MockEngineResponse)
+	assert.True(t, ocrResult.ID != "")
+
+	ocrResult, _, err = HandleOcrRequest(newRequest(CacheBypass), &rabbitConfig)
+	assert.True(t, err == nil)
+	assert.False(t, ocrResult.Cached)
+
+	_, httpStatus, err = HandleOcrRequest(newRequest("always"), &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, httpStatus, 400)
+}
+
+func TestDeferredRequestsFromCache(t *testing.T) {
+	resultCacheMu.Lock()
+	resultCache = newMemoryResultCache(10)
+	resultCacheMu.Unlock()
+	defer func() {
+		resultCacheMu.Lock()
+		resultCache = nil
+		resultCacheMu.Unlock()
+	}()
+
+	rabbitConfig := DefaultTestConfig()
+	ocrRequest := OcrRequest{ImgBytes: []byte("deferred document"), EngineType: EngineMock, InplaceDecode: true}
+	_, _, err := HandleOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err == nil)
+
+	// a polled request gets the cached result without a worker
+	ocrResult, httpStatus, err := HandleOcrRequest(&OcrRequest{ImgBytes: []byte("deferred document"),
+		EngineType: EngineMock, Deferred: true}, &rabbitConfig)
+	assert.True(t, err == nil)
+	assert.Equals(t, httpStatus, 200)
+	assert.Equals(t, ocrResult.Status, "processing")
+	requestID := ocrResult.ID
+	for i := 0; i < 100 && ocrResult.Status == "processing"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ocrResult, _ = CheckOcrStatusByID(requestID)
+	}
+	assert.Equals(t, ocrResult.Text, MockEngineResponse)
+	assert.Equals(t, ocrResult.ID, requestID)
+	assert.True(t, ocrResult.Cached)
+
+	// the cached result is posted to reply_to
+	posted := make(chan OcrResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		postedResult := OcrResult{}
+		assert.True(t, json.NewDecoder(req.Body).Decode(&postedResult) == nil)
+		posted <- postedResult
+	}))
+	defer server.Close()
+	ocrResult, _, err = HandleOcrRequest(&OcrRequest{ImgBytes: []byte("deferred document"),
+		EngineType: EngineMock, ReplyTo: server.URL}, &rabbitConfig)
+	assert.True(t, err == nil)
+	assert.Equals(t, ocrResult.Status, "processing")
+	select {
+	case postedResult := <-posted:
+		assert.Equals(t, postedResult.Text, MockEngineResponse)
+		assert.Equals(t, postedResult.ID, ocrResult.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cached result was not posted")
+	}
+
+	_, httpStatus, err = HandleOcrRequest(&OcrRequest{ImgBytes: []byte("deferred document"),
+		EngineType: EngineMock, ReplyTo: "not a url"}, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, httpStatus, 400)
+}
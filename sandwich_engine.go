@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/url"
 	"os"
 	"os/exec"
@@ -24,17 +25,26 @@ type SandwichEngine struct {
 }
 
 type SandwichEngineArgs struct {
-	configVars   map[string]string `json:"config_vars"`
-	lang         string            `json:"lang"`
-	ocrType      string            `json:"ocr_type"`
-	ocrOptimize  bool              `json:"result_optimize"`
-	psm          string            `json:"psm"`
-	unpaperDis   bool              `json:"disable_unpaper"`
-	unpo         string            `json:"unpo"`
-	coo          string            `json:"coo"`
-	grayfilterEn bool              `json:"enable_grayfilter"`
+	configVars   map[string]string
+	lang         string
+	ocrType      string
+	ocrOptimize  bool
+	psm          string
+	unpaperDis   bool
+	unpo         string
+	coo          string
+	grayfilterEn bool
 	saveFiles    bool
 	t2pConverter string
+	autoOrient   bool
+	outputs      []string
+	pdfaLevel    string
+	pdfaMetadata pdfaMetadata
+	pdfa         pdfaSettings
+	optimize     *OptimizeProfile
+	optimizeName string
+	jbig2Command string
+	ocrMode      string
 	requestID    string
 	component    string
 }
@@ -44,6 +54,12 @@ func NewSandwichEngineArgs(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (
 	engineArgs := &SandwichEngineArgs{}
 	engineArgs.component = "OCR_WORKER"
 	engineArgs.requestID = ocrRequest.RequestID
+	engineArgs.outputs = requestedOutputs(ocrRequest)
+	engineArgs.pdfaLevel = defaultPdfaLevel
+	engineArgs.pdfaMetadata = pdfaMetadata{Title: ocrRequest.Title, ReferenceID: ocrRequest.ReferenceID}
+	engineArgs.pdfa = newPdfaSettings(workerConfig)
+	engineArgs.jbig2Command = workerConfig.Jbig2Command
+	engineArgs.ocrMode = OcrModeSkipText
 
 	logger := zerolog.New(os.Stdout).With().
 		Str("RequestID", engineArgs.requestID).Str("component", engineArgs.component).Timestamp().Logger()
@@ -59,7 +75,10 @@ func NewSandwichEngineArgs(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (
 		logger.Info().Interface("configVarsMap", configVarsMapInterfaceOrig).
 			Msg("got configVarsMap")
 
-		configVarsMapInterface := configVarsMapInterfaceOrig.(map[string]interface{})
+		configVarsMapInterface, ok := configVarsMapInterfaceOrig.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("could not convert config_vars into map: %v", configVarsMapInterfaceOrig)
+		}
 
 		configVarsMap := make(map[string]string)
 		for k, v := range configVarsMapInterface {
@@ -82,6 +101,7 @@ func NewSandwichEngineArgs(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (
 			return nil, fmt.Errorf("could not convert lang into string: %v", lang)
 		}
 		engineArgs.lang = langStr
+		engineArgs.pdfaMetadata.Lang = langStr
 	}
 
 	// select from  pdf, layer 1:pdf + layer 2:ocr_pdf
@@ -159,10 +179,111 @@ func NewSandwichEngineArgs(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (
 		engineArgs.grayfilterEn = grayfilterEnFlag
 	}
 
+	// detect and correct the page orientation before recognition, default: false
+	autoOrient := ocrRequest.EngineArgs["auto_orient"]
+	if autoOrient != nil {
+		autoOrientFlag, ok := autoOrient.(bool)
+		if !(ok) {
+			return nil, fmt.Errorf("could not convert into boolean: %v", autoOrient)
+		}
+		engineArgs.autoOrient = autoOrientFlag
+	}
+
+	// conformance level of the pdfa outputs, default: 2b
+	pdfaLevel := ocrRequest.EngineArgs["pdfa_level"]
+	if pdfaLevel != nil {
+		pdfaLevelStr, ok := pdfaLevel.(string)
+		if !ok {
+			return nil, fmt.Errorf("could not convert pdfa_level into string: %v", pdfaLevel)
+		}
+		engineArgs.pdfaLevel = pdfaLevelStr
+	}
+
+	// what happens to the pages which have a text layer, default: skip_text
+	ocrMode := ocrRequest.EngineArgs["ocr_mode"]
+	if ocrMode != nil {
+		ocrModeStr, ok := ocrMode.(string)
+		if !ok {
+			return nil, fmt.Errorf("could not convert ocr_mode into string: %v", ocrMode)
+		}
+		engineArgs.ocrMode = ocrModeStr
+	}
+
+	// profile the combined pdf is optimised with, the optimize_* args make up a custom one or change the profile
+	if err := engineArgs.parseOptimize(ocrRequest.EngineArgs, workerConfig.OptimizeProfiles); err != nil {
+		return nil, err
+	}
+
 	return engineArgs, nil
 
 }
 
+func (t *SandwichEngineArgs) parseOptimize(args map[string]interface{}, configured map[string]OptimizeProfile) error {
+	profile := OptimizeProfile{}
+	name := ""
+	if optimizeProfile := args["optimize_profile"]; optimizeProfile != nil {
+		profileStr, ok := optimizeProfile.(string)
+		if !ok {
+			return fmt.Errorf("could not convert optimize_profile into string: %v", optimizeProfile)
+		}
+		var err error
+		if profile, err = lookupOptimizeProfile(profileStr, configured); err != nil {
+			return err
+		}
+		name = profileStr
+	}
+	custom := false
+	for _, arg := range []string{"optimize_dpi", "optimize_jpeg_quality"} {
+		value := args[arg]
+		if value == nil {
+			continue
+		}
+		// numbers of the json engine args are float64
+		number, ok := value.(float64)
+		if !ok || number < 0 || number != math.Trunc(number) {
+			return fmt.Errorf("could not convert %s into a positive integer: %v", arg, value)
+		}
+		if arg == "optimize_dpi" {
+			profile.Dpi = uint(number)
+		} else {
+			profile.JpegQuality = uint(number)
+		}
+		custom = true
+	}
+	if jbig2 := args["optimize_jbig2"]; jbig2 != nil {
+		jbig2Flag, ok := jbig2.(bool)
+		if !ok {
+			return fmt.Errorf("could not convert into boolean: %v", jbig2)
+		}
+		profile.Jbig2 = jbig2Flag
+		custom = true
+	}
+	if name == "" && !custom {
+		return nil
+	}
+	if name == "" {
+		name = customOptimizeProfile
+	}
+	if err := profile.validate(); err != nil {
+		return fmt.Errorf("invalid optimize settings: %w", err)
+	}
+	t.optimize = &profile
+	t.optimizeName = name
+	return nil
+}
+
+// optimization returns the profile the combined pdf is optimised with, nil if it is not optimised
+func (t *SandwichEngineArgs) optimization() (string, *OptimizeProfile) {
+	if t.optimize != nil {
+		return t.optimizeName, t.optimize
+	}
+	if t.ocrOptimize {
+		profile := optimizeProfiles[defaultOptimizeProfile]
+		return defaultOptimizeProfile, &profile
+	}
+	return "", nil
+}
+
 // return a slice that can be passed to tesseract binary as command line
 // args, eg, ["-c", "tessedit_char_whitelist=0123456789", "-c", "foo=bar"]
 func (t *SandwichEngineArgs) Export() []string {
@@ -179,8 +300,11 @@ func (t *SandwichEngineArgs) Export() []string {
 	if t.psm != "" {
 		tesso = tesso + "--psm " + t.psm + " "
 	}
-	tesso = tesso + "-c textonly_pdf=1"
+	// tesseract writes the tsv of every page next to its text layer, the confidence is taken from it
+	tesso = tesso + "-c textonly_pdf=1 -c tessedit_create_tsv=1"
 	result = append(result, "-tesso", tesso)
+	// keep the temporary files of pdfsandwich for the tsv files, they are in the directory of the job
+	result = append(result, "-debug")
 
 	if t.unpo != "" {
 		result = append(result, "-unpo", t.unpo)
@@ -241,11 +365,11 @@ func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wor
 	tmpFileName, err := func() (string, error) {
 		switch {
 		case ocrRequest.ImgBase64 != "":
-			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64, ocrRequest.RequestID)
+			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64, ocrRequest.workDir, sanitizeFileName(ocrRequest.RequestID))
 		case ocrRequest.ImgUrl != "":
-			return t.tmpFileFromImageURL(ocrRequest.ImgUrl, ocrRequest.RequestID)
+			return t.tmpFileFromImageURL(ocrRequest.ImgUrl, ocrRequest.workDir, sanitizeFileName(ocrRequest.RequestID))
 		default:
-			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes, ocrRequest.RequestID)
+			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes, ocrRequest.workDir, sanitizeFileName(ocrRequest.RequestID))
 		}
 	}()
 
@@ -281,16 +405,16 @@ func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wor
 	// getting timeout for request
 	configTimeOut := ocrRequest.TimeOut
 
-	ocrResult, err := t.processImageFile(tmpFileName, uplFileType, engineArgs, configTimeOut)
+	ocrResult, err := t.processImageFile(ocrRequest.traceContext(), tmpFileName, uplFileType, engineArgs, configTimeOut)
 
 	return ocrResult, err
 }
 
-func (t SandwichEngine) tmpFileFromImageBytes(imgBytes []byte, tmpFileName string) (string, error) {
+func (t SandwichEngine) tmpFileFromImageBytes(imgBytes []byte, workDir, tmpFileName string) (string, error) {
 
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with bytes image")
 	var err error
-	tmpFileName, err = createTempFileName(tmpFileName)
+	tmpFileName, err = createTempFileName(workDir, tmpFileName)
 	if err != nil {
 		return "", err
 	}
@@ -306,15 +430,12 @@ func (t SandwichEngine) tmpFileFromImageBytes(imgBytes []byte, tmpFileName strin
 
 }
 
-func (t SandwichEngine) tmpFileFromImageBase64(base64Image, tmpFileName string) (string, error) {
+func (t SandwichEngine) tmpFileFromImageBase64(base64Image, workDir, tmpFileName string) (string, error) {
 
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with base 64")
-	var err error
-	if tmpFileName == "" {
-		tmpFileName, err = createTempFileName("")
-		if err != nil {
-			return "", err
-		}
+	tmpFileName, err := createTempFileName(workDir, tmpFileName)
+	if err != nil {
+		return "", err
 	}
 
 	// decoding into bytes the base64 string
@@ -332,15 +453,12 @@ func (t SandwichEngine) tmpFileFromImageBase64(base64Image, tmpFileName string)
 
 }
 
-func (t SandwichEngine) tmpFileFromImageURL(imgURL, tmpFileName string) (string, error) {
+func (t SandwichEngine) tmpFileFromImageURL(imgURL, workDir, tmpFileName string) (string, error) {
 
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with url")
-	var err error
-	if tmpFileName == "" {
-		tmpFileName, err = createTempFileName("")
-		if err != nil {
-			return "", err
-		}
+	tmpFileName, err := createTempFileName(workDir, tmpFileName)
+	if err != nil {
+		return "", err
 	}
 	// we have to write the contents of the image url to a temp
 	// file, because the leptonica lib can't seem to handle byte arrays
@@ -374,8 +492,8 @@ func (t SandwichEngine) buildCmdLineArgs(inputFilename string, engineArgs *Sandw
 
 }
 
-func (t SandwichEngine) runExternalCmd(commandToRun string, cmdArgs []string, defaultTimeOutSeconds time.Duration) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeOutSeconds)
+func (t SandwichEngine) runExternalCmd(ctx context.Context, commandToRun string, cmdArgs []string, tmpDir string, defaultTimeOutSeconds time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeOutSeconds)
 	defer cancel()
 
 	log.Debug().Str("component", "OCR_SANDWICH").
@@ -384,7 +502,10 @@ func (t SandwichEngine) runExternalCmd(commandToRun string, cmdArgs []string, de
 		Msg("running external command")
 
 	cmd := exec.CommandContext(ctx, commandToRun, cmdArgs...)
-	output, err := cmd.CombinedOutput()
+	if tmpDir != "" {
+		cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir)
+	}
+	output, err := runCommand(ctx, cmd)
 	if ctx.Err() == context.DeadlineExceeded {
 		err = fmt.Errorf("command timed out, terminated: %v", err)
 		// on deadline cancellation the output doesnt matter
@@ -394,7 +515,119 @@ func (t SandwichEngine) runExternalCmd(commandToRun string, cmdArgs []string, de
 	return string(output), err
 }
 
-func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engineArgs *SandwichEngineArgs, configTimeOut uint) (OcrResult, error) {
+// withPageProgress counts the pages pdfsandwich reports as processed if the job reports its progress
+func withPageProgress(ctx context.Context, inputFilename string) context.Context {
+	if !hasProgressReporter(ctx) {
+		return ctx
+	}
+	pagesTotal, err := countPdfPages(ctx, inputFilename)
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_SANDWICH").Msg("unable to count pages for the progress")
+	}
+	reportProgress(ctx, JobProgress{State: JobRecognizing, PagesTotal: pagesTotal})
+	pagesDone := 0
+	return withOutputWatcher(ctx, func(line string) {
+		// pdfsandwich prints "Processing page 3." when it starts on a page, the pages run in parallel
+		if strings.HasPrefix(line, "Processing page ") {
+			pagesDone++
+			reportProgress(ctx, JobProgress{State: JobRecognizing, PagesDone: pagesDone, PagesTotal: pagesTotal})
+		}
+	})
+}
+
+// produceOutput creates the file of an output format from the text layer of inputFilename,
+// the temporary files are removed once the outputs are read. The formats based on another one get it from source.
+func (t SandwichEngine) produceOutput(ctx context.Context, logger *zerolog.Logger, format, inputFilename string, layer sandwichLayer,
+	engineArgs *SandwichEngineArgs, source func(format string) (string, error)) (file string, tmpFiles []string, err error) {
+
+	switch format {
+	case OutputCombinedPdf:
+		// a document whose pages all have a text layer is combined already
+		tmpOutCombinedPdf := layer.base
+		if layer.stamp != "" {
+			tmpOutCombinedPdf = fmt.Sprintf("%s%s", inputFilename, "_comb.pdf")
+			tmpFiles = append(tmpFiles, tmpOutCombinedPdf)
+
+			// pdftk FILE_only_TEXT-LAYER.pdf multistamp FILE_ORIGINAL_IMAGE.pdf output FILE_OUTPUT_IMAGE_AND_TEXT_LAYER.pdf
+			combinedArgs := []string{layer.stamp, "multistamp", layer.base, "output", tmpOutCombinedPdf}
+			logger.Info().Interface("combinedArgs", combinedArgs).
+				Msg("Arguments for pdftk to combine pdf files")
+			outPdftk, err := runCommand(ctx, exec.Command("pdftk", combinedArgs...))
+			if err != nil {
+				return "", tmpFiles, fmt.Errorf("pdftk failed: %v: %s", err, string(outPdftk))
+			}
+		}
+		profileName, profile := engineArgs.optimization()
+		if profile == nil {
+			return tmpOutCombinedPdf, tmpFiles, nil
+		}
+
+		logger.Info().Str("optimize_profile", profileName).Interface("profile", profile).
+			Msg("optimizing was requested, perform selected operation")
+		tmpOutCompressedPdf := fmt.Sprintf("%s%s", inputFilename, "_compr.pdf")
+		tmpFiles = append(tmpFiles, tmpOutCompressedPdf)
+		optimizeTmpFiles, err := optimizePdf(ctx, tmpOutCombinedPdf, tmpOutCompressedPdf, *profile, engineArgs.jbig2Command)
+		tmpFiles = append(tmpFiles, optimizeTmpFiles...)
+		if err != nil {
+			return "", tmpFiles, err
+		}
+		return tmpOutCompressedPdf, tmpFiles, nil
+	case OutputOcrLayerOnly:
+		return layer.text, nil, nil
+	case OutputTxt:
+		logger.Info().Msg("extracting text from ocr")
+		// pdftotext will create %filename%.txt
+		textFile := fmt.Sprintf("%s%s", strings.TrimSuffix(layer.text, filepath.Ext(layer.text)), ".txt")
+		tmpFiles = append(tmpFiles, textFile)
+		outputPdfToText, err := runCommand(ctx, exec.Command("pdftotext", layer.text))
+		if err != nil {
+			return "", tmpFiles, fmt.Errorf("pdftotext failed: %v: %s", err, string(outputPdfToText))
+		}
+		return textFile, tmpFiles, nil
+	case OutputHocr:
+		logger.Info().Msg("extracting the word boxes from ocr")
+		baseName := strings.TrimSuffix(layer.text, filepath.Ext(layer.text))
+		bboxFile := baseName + "_bbox.html"
+		hocrFile := baseName + ".hocr"
+		tmpFiles = append(tmpFiles, bboxFile, hocrFile)
+		outputPdfToText, err := runCommand(ctx, exec.Command("pdftotext", "-bbox-layout", layer.text, bboxFile))
+		if err != nil {
+			return "", tmpFiles, fmt.Errorf("pdftotext failed: %v: %s", err, string(outputPdfToText))
+		}
+		bboxLayout, err := ioutil.ReadFile(bboxFile)
+		if err != nil {
+			return "", tmpFiles, err
+		}
+		hocr, err := bboxLayoutToHocr(bboxLayout)
+		if err != nil {
+			return "", tmpFiles, err
+		}
+		return hocrFile, tmpFiles, ioutil.WriteFile(hocrFile, hocr, 0600)
+	case OutputPdfa:
+		combinedPdf, err := source(OutputCombinedPdf)
+		if err != nil {
+			return "", nil, err
+		}
+		logger.Info().Str("pdfa_level", engineArgs.pdfaLevel).Msg("converting the combined pdf into PDF/A")
+		pdfaFile := inputFilename + "_pdfa.pdf"
+		tmpFiles = append(tmpFiles, pdfaFile)
+		err = convertToPdfa(ctx, combinedPdf, pdfaFile, engineArgs.pdfaLevel, engineArgs.pdfaMetadata, engineArgs.pdfa.iccProfile)
+		return pdfaFile, tmpFiles, err
+	case OutputPdfaSigned:
+		pdfaFile, err := source(OutputPdfa)
+		if err != nil {
+			return "", nil, err
+		}
+		logger.Info().Msg("signing the PDF/A file")
+		signedFile := inputFilename + "_pdfa_signed.pdf"
+		tmpFiles = append(tmpFiles, signedFile)
+		return signedFile, tmpFiles, signPdf(ctx, pdfaFile, signedFile, engineArgs.pdfa)
+	default:
+		return "", nil, fmt.Errorf("requested output format is not supported")
+	}
+}
+
+func (t SandwichEngine) processImageFile(ctx context.Context, inputFilename, uplFileType string, engineArgs *SandwichEngineArgs, configTimeOut uint) (OcrResult, error) {
 	// if error flag is true, input files won't be deleted
 	errorFlag := false
 
@@ -413,12 +646,18 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 
 	logger.Info().Str("file_name", inputFilename).Msg("input file name")
 
+	// the size of the document as it was sent, the optimisation is reported against it
+	var inputSize int64
+	if info, err := os.Stat(inputFilename); err == nil {
+		inputSize = info.Size()
+	}
+
 	if uplFileType == "TIFF" {
 		switch engineArgs.t2pConverter {
 		case "convert":
-			inputFilename = convertImageToPdf(inputFilename)
+			inputFilename = convertImageToPdf(ctx, inputFilename)
 		case "tiff2pdf":
-			inputFilename = tiff2Pdf(inputFilename)
+			inputFilename = tiff2Pdf(ctx, inputFilename)
 		}
 		if inputFilename == "" {
 			err := fmt.Errorf("can not convert input image to intermediate pdf")
@@ -427,136 +666,185 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 		}
 	}
 
-	ocrType := strings.ToUpper(engineArgs.ocrType)
-
-	extCommandTimeout := time.Duration(configTimeOut) * time.Second
-
-	cmdArgs, ocrLayerFile = t.buildCmdLineArgs(inputFilename, engineArgs)
-	logger.Info().Str("command", "pdfsandwich").Interface("cmdArgs", cmdArgs).
-		Uint("command_timeout", configTimeOut).
-		Msg("running external pdfsandwich command")
-	output, err := t.runExternalCmd("pdfsandwich", cmdArgs, extCommandTimeout)
-	if err != nil {
-		errMsg := output
-		if errMsg != "" {
-			errMsg = fmt.Sprintf(output, err)
-			err := fmt.Errorf(errMsg)
-			logger.Error().Err(err).Caller().Msg("Error exec external command")
-			errorFlag = true
+	// rotate the pages upright, the rotated copy replaces the input file from here on
+	var orientation []PageOrientation
+	if engineArgs.autoOrient {
+		rotatedFilename, pageOrientations, err := autoOrientPdf(ctx, inputFilename)
+		if err != nil {
+			logger.Error().Err(err).Caller().Msg("orientation detection failed")
 			return OcrResult{Status: "error"}, err
 		}
-		logger.Error().Err(err).Caller().Msg("Error exec external command")
-		errorFlag = true
-		return OcrResult{Status: "error"}, err
+		logger.Info().Interface("orientation", pageOrientations).Msg("detected page orientation")
+		if rotatedFilename != inputFilename && !engineArgs.saveFiles {
+			originalFilename := inputFilename
+			defer func() {
+				if err := os.Remove(originalFilename); err != nil {
+					logger.Warn().Err(err)
+				}
+			}()
+		}
+		inputFilename = rotatedFilename
+		orientation = pageOrientations
 	}
 
-	switch ocrType {
-	case "COMBINEDPDF":
+	ocrType := strings.ToUpper(engineArgs.ocrType)
 
-		tmpOutCombinedPdf := fmt.Sprintf("%s%s", inputFilename, "_comb.pdf")
+	extCommandTimeout := time.Duration(configTimeOut) * time.Second
 
-		defer func() {
-			logger.Info().Str("file_name", tmpOutCombinedPdf).
-				Msg("step 2: deleting file (pdftk run)")
-			if err := os.Remove(tmpOutCombinedPdf); err != nil {
+	// every artifact is derived from the text layer of the single pdfsandwich run
+	var outputFiles []string
+	defer func() {
+		for _, file := range outputFiles {
+			logger.Info().Str("file_name", file).Msg("step 2: deleting output file")
+			if err := os.Remove(file); err != nil {
 				logger.Warn().Err(err)
 			}
-		}()
+		}
+	}()
+
+	// the pages with a text layer are not recognized unless the ocr_mode asks for it, their text is returned
+	var pageSources []PageSource
+	var err error
+	if uplFileType != "TIFF" && engineArgs.ocrMode != OcrModeForceOcr {
+		pageSources, err = planPageSources(ctx, inputFilename, engineArgs.ocrMode)
+		if err != nil {
+			logger.Warn().Err(err).Msg("unable to detect the text layer, every page is recognized")
+			pageSources = nil
+		}
+	}
+	ocrPages := pagesBySource(pageSources, PageSourceOcr)
+	textPages := pagesBySource(pageSources, PageSourceTextLayer)
+	ocrInput := inputFilename
+	if len(textPages) > 0 {
+		logger.Info().Ints("text_layer_pages", textPages).Ints("ocr_pages", ocrPages).
+			Msg("the pages with a text layer are not recognized")
+		ocrInput = ""
+		if len(ocrPages) > 0 {
+			ocrInput = inputFilename + "_ocr_pages.pdf"
+			outputFiles = append(outputFiles, ocrInput)
+			if err := selectPdfPages(ctx, inputFilename, ocrInput, ocrPages); err != nil {
+				logger.Error().Err(err).Caller().Msg("Error selecting the pages to recognize")
+				errorFlag = true
+				return OcrResult{Status: "error"}, err
+			}
+		}
+	}
 
-		var combinedArgs []string
-		// pdftk FILE_only_TEXT-LAYER.pdf multistamp FILE_ORIGINAL_IMAGE.pdf output FILE_OUTPUT_IMAGE_AND_TEXT_LAYER.pdf
-		combinedArgs = append(combinedArgs, ocrLayerFile, "multistamp", inputFilename, "output", tmpOutCombinedPdf)
-		logger.Info().Interface("combinedArgs", combinedArgs).
-			Msg("Arguments for pdftk to combine pdf files")
-
-		outPdftk, errPdftk := exec.Command("pdftk", combinedArgs...).CombinedOutput()
-		if errPdftk != nil {
-			logger.Error().Err(errPdftk).Caller().
-				Str("file_name", string(outPdftk)).
-				Msg("Error running command")
+	// pdfsandwich keeps its temporary files in here, among them the tsv files of the pages
+	sandwichTmpDir := ""
+	if ocrInput != "" {
+		sandwichTmpDir = ocrInput + "_pdfsandwich"
+		if err := os.MkdirAll(sandwichTmpDir, 0700); err != nil {
 			errorFlag = true
 			return OcrResult{Status: "error"}, err
 		}
-
-		if engineArgs.ocrOptimize {
-			logger.Info().Msg("optimizing was requested, perform selected operation")
-			var compressedArgs []string
-			tmpOutCompressedPdf := inputFilename
-			tmpOutCompressedPdf = fmt.Sprintf("%s%s", tmpOutCompressedPdf, "_compr.pdf")
-			defer func() {
-				logger.Info().Str("file_name", tmpOutCompressedPdf).
-					Msg("step 3: deleting compressed result file (gs run)")
-				if err := os.Remove(tmpOutCompressedPdf); err != nil {
-					logger.Warn().Err(err)
-				}
-			}()
-
-			compressedArgs = append(
-				compressedArgs,
-				"-sDEVICE=pdfwrite",
-				"-dCompatibilityLevel=1.5",
-				"-dPDFSETTINGS=/screen",
-				"-dNOPAUSE",
-				"-dBATCH",
-				"-dQUIET",
-				"-sOutputFile="+tmpOutCompressedPdf,
-				tmpOutCombinedPdf,
-			)
-			logger.Info().Str("file_name", tmpOutCompressedPdf).
-				Str("file_name", tmpOutCombinedPdf).
-				Interface("compressedArgs", compressedArgs).
-				Msg("tmpOutCompressedPdf, tmpOutCombinedPdf, combinedArgs ")
-
-			outQpdf, errQpdf := exec.Command("gs", compressedArgs...).CombinedOutput()
-			if errQpdf != nil {
-				logger.Error().Err(errQpdf).
-					Str("outQpdf", string(outQpdf)).
-					Msg("Error running command")
+		defer os.RemoveAll(sandwichTmpDir)
+		cmdArgs, ocrLayerFile = t.buildCmdLineArgs(ocrInput, engineArgs)
+		logger.Info().Str("command", "pdfsandwich").Interface("cmdArgs", cmdArgs).
+			Uint("command_timeout", configTimeOut).
+			Msg("running external pdfsandwich command")
+		// the clients following the job get every page as soon as it is recognized
+		pageWatcher := watchSandwichPages(ctx, sandwichTmpDir, ocrPages)
+		output, err := t.runExternalCmd(withPageProgress(ctx, ocrInput), "pdfsandwich", cmdArgs, sandwichTmpDir, extCommandTimeout)
+		pageWatcher.finish(err == nil)
+		if err != nil {
+			errMsg := output
+			if errMsg != "" {
+				errMsg = fmt.Sprintf(output, err)
+				err := fmt.Errorf(errMsg)
+				logger.Error().Err(err).Caller().Msg("Error exec external command")
 				errorFlag = true
 				return OcrResult{Status: "error"}, err
 			}
-
-			fileToDeliver = tmpOutCompressedPdf
-		} else {
-			fileToDeliver = tmpOutCombinedPdf
+			logger.Error().Err(err).Caller().Msg("Error exec external command")
+			errorFlag = true
+			return OcrResult{Status: "error"}, err
 		}
-	case "OCRLAYERONLY":
-		fileToDeliver = ocrLayerFile
-	case "TXT":
-		logger.Info().Msg("extracting text from ocr")
-		textFile := fmt.Sprintf("%s%s", strings.TrimSuffix(ocrLayerFile, filepath.Ext(ocrLayerFile)), ".txt")
-		cmdArgsPdfToText := exec.Command("pdftotext", ocrLayerFile)
-		outputPdfToText, err := cmdArgsPdfToText.CombinedOutput()
+	}
+	layer := sandwichLayer{text: ocrLayerFile, stamp: ocrLayerFile, base: inputFilename}
+	if len(textPages) == 0 && uplFileType != "TIFF" && engineArgs.ocrMode != OcrModeSkipText {
+		// every page was recognized, the old text layers of redo_ocr and force_ocr would show next to the new one
+		layer.base = inputFilename + "_no_text.pdf"
+		outputFiles = append(outputFiles, layer.base)
+		if err := filterPdf(ctx, inputFilename, layer.base, "TEXT"); err != nil {
+			logger.Error().Err(err).Caller().Msg("Error removing the old text layer")
+			errorFlag = true
+			return OcrResult{Status: "error"}, err
+		}
+	} else if len(textPages) > 0 {
+		var tmpFiles []string
+		layer, tmpFiles, err = mergeTextLayer(ctx, inputFilename, ocrLayerFile, pageSources)
+		outputFiles = append(outputFiles, tmpFiles...)
 		if err != nil {
-			errMsg := fmt.Sprintf(string(outputPdfToText), err)
-			err := fmt.Errorf(errMsg)
-			logger.Error().Caller().Err(err).Msg("error exec pdftotext")
+			logger.Error().Err(err).Caller().Msg("Error merging the text layer")
 			errorFlag = true
+			return OcrResult{Status: "error"}, err
 		}
-		// pdftotext will create %filename%.txt
-		defer func() {
-			logger.Info().Str("file_name", textFile).
-				Msg("step 2: deleting file (pdftotext run)")
-			if err := os.Remove(textFile); err != nil {
-				logger.Warn().Err(err)
+	}
+	produced := make(map[string]string)
+	var produce func(format string) (string, error)
+	produce = func(format string) (string, error) {
+		if file, ok := produced[format]; ok {
+			return file, nil
+		}
+		file, tmpFiles, err := t.produceOutput(ctx, &logger, format, inputFilename, layer, engineArgs, produce)
+		outputFiles = append(outputFiles, tmpFiles...)
+		if err != nil {
+			logger.Error().Err(err).Caller().Str("output", format).Msg("Error producing the output")
+			errorFlag = true
+			return "", err
+		}
+		produced[format] = file
+		return file, nil
+	}
+	if ocrType != "" {
+		fileToDeliver, err = produce(strings.ToLower(ocrType))
+		if err != nil {
+			return OcrResult{Status: "error"}, err
+		}
+	}
+	var outputs map[string]OcrOutput
+	for _, format := range engineArgs.outputs {
+		file, err := produce(format)
+		if err != nil {
+			return OcrResult{Status: "error"}, err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			logger.Error().Caller().Err(err).Str("output", format).Msg("Error getting data from output file")
+			return OcrResult{Status: "error"}, err
+		}
+		if outputs == nil {
+			outputs = make(map[string]OcrOutput)
+		}
+		outputs[format] = newOcrOutput(format, content)
+	}
+	var optimizeReport *OptimizeReport
+	if profileName, profile := engineArgs.optimization(); profile != nil {
+		if combinedPdf, ok := produced[OutputCombinedPdf]; ok {
+			optimizeReport, err = newOptimizeReport(profileName, inputSize, combinedPdf)
+			if err != nil {
+				logger.Warn().Err(err).Msg("unable to report the optimization")
 			}
-		}()
-
-		fileToDeliver = textFile
-
-	default:
-		err := fmt.Errorf("requested output format is not supported")
-		logger.Error().Err(err).Caller()
-		errorFlag = true
-		return OcrResult{Status: "error"}, err
+		}
+	}
+	// the signature is an incremental update of the PDF/A file, the unsigned file is validated
+	var pdfaValidation *PdfaValidation
+	if pdfaFile, ok := produced[OutputPdfa]; ok && engineArgs.pdfa.validator != "" {
+		pdfaValidation = validatePdfa(ctx, pdfaFile, engineArgs.pdfaLevel, engineArgs.pdfa.validator)
+		if !pdfaValidation.Compliant {
+			logger.Warn().Interface("pdfa_validation", pdfaValidation).Msg("the PDF/A file is not compliant")
+		}
 	}
 	// if command line argument save_files is set or any internal processing is failed the input file won't be deleted
 	if !engineArgs.saveFiles || errorFlag == true {
 		defer func() {
-			logger.Info().Str("file_name", ocrLayerFile).
-				Msg("step 1: deleting file (pdfsandwich run)")
-			if err := os.Remove(ocrLayerFile); err != nil {
-				logger.Warn().Err(err)
+			if ocrLayerFile != "" {
+				logger.Info().Str("file_name", ocrLayerFile).
+					Msg("step 1: deleting file (pdfsandwich run)")
+				if err := os.Remove(ocrLayerFile); err != nil {
+					logger.Warn().Err(err)
+				}
 			}
 			logger.Info().Str("file_name", inputFilename).
 				Msg("step 1: deleting file (pdfsandwich run)")
@@ -572,14 +860,43 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 			Msg("Input file and ocrLayer file were not removed for debugging purposes")
 	}
 
-	logger.Info().Str("file_name", fileToDeliver).Msg("resulting file")
-	outBytes, err := ioutil.ReadFile(fileToDeliver)
+	// the outputs replace the ocr_type if it is not set
+	var outBytes []byte
+	if ocrType != "" {
+		logger.Info().Str("file_name", fileToDeliver).Msg("resulting file")
+		outBytes, err = ioutil.ReadFile(fileToDeliver)
+		if err != nil {
+			logger.Error().Caller().Err(err).Msg("Error getting data from result file")
+			return OcrResult{Status: "error"}, err
+		}
+	}
+	pages, err := countPdfPages(ctx, inputFilename)
 	if err != nil {
-		logger.Error().Caller().Err(err).Msg("Error getting data from result file")
-		return OcrResult{Status: "error"}, err
+		// the number of pages is only needed for the metrics, the result can be delivered anyway
+		logger.Warn().Err(err).Msg("unable to count pages")
+	}
+	ocrResult := OcrResult{
+		Text:           base64.StdEncoding.EncodeToString(outBytes),
+		Status:         "done",
+		Orientation:    orientation,
+		Outputs:        outputs,
+		PdfaValidation: pdfaValidation,
+		Optimization:   optimizeReport,
+		PageSources:    pageSources,
+		pages:          pages,
+	}
+	if pageSources == nil {
+		for page := 1; page <= pages; page++ {
+			ocrResult.PageSources = append(ocrResult.PageSources, PageSource{Page: page, Source: PageSourceOcr})
+		}
+	}
+	// the pages with a text layer have no confidence
+	if sandwichTmpDir != "" {
+		ocrResult.PageConfidence, ocrResult.Confidence, err = sandwichConfidence(sandwichTmpDir, ocrPages)
+		if err != nil {
+			// like the number of pages the confidence is not worth failing the request
+			logger.Warn().Err(err).Msg("unable to compute the confidence")
+		}
 	}
-	return OcrResult{
-		Text:   base64.StdEncoding.EncodeToString(outBytes),
-		Status: "done",
-	}, nil
+	return ocrResult, nil
 }
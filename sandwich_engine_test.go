@@ -1,6 +1,7 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"testing"
@@ -103,7 +104,7 @@ func TestSandwichEngineWithFile(t *testing.T) {
 	engineArgs.ocrOptimize = true
 	engineArgs.lang = "deu"
 	engineArgs.saveFiles = true
-	result, err := engine.processImageFile("docs/testimage.pdf", "PDF", &engineArgs, 20)
+	result, err := engine.processImageFile(context.Background(), "docs/testimage.pdf", "PDF", &engineArgs, 20)
 	log.Warn().Err(err).Str("component", "TEST")
 	assert.True(t, err == nil)
 
@@ -0,0 +1,112 @@
+package ocrworker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sandwichPagePollInterval is the interval in which the temporary directory of pdfsandwich is checked
+// for the tsv files of finished pages
+var sandwichPagePollInterval = 500 * time.Millisecond
+
+// sandwichPageWatcher reports the result of every page of a pdfsandwich run as soon as tesseract wrote its tsv,
+// so the clients following the job get the pages while the others are still recognized
+type sandwichPageWatcher struct {
+	ctx      context.Context
+	dir      string
+	ocrPages []int
+	// sizes are the sizes of the tsv files at the last check, a file is complete once it stopped growing
+	sizes    map[string]int64
+	reported map[int]bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// watchSandwichPages follows the tsv files in dir if the job reports its progress, the watcher is nil otherwise
+func watchSandwichPages(ctx context.Context, dir string, ocrPages []int) *sandwichPageWatcher {
+	if !hasProgressReporter(ctx) {
+		return nil
+	}
+	w := &sandwichPageWatcher{
+		ctx:      ctx,
+		dir:      dir,
+		ocrPages: ocrPages,
+		sizes:    make(map[string]int64),
+		reported: make(map[int]bool),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go func() {
+		defer close(w.stopped)
+		ticker := time.NewTicker(sandwichPagePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.scan(false)
+			}
+		}
+	}()
+	return w
+}
+
+// finish stops the watcher, if pdfsandwich succeeded the pages which were not reported yet are reported now
+func (w *sandwichPageWatcher) finish(succeeded bool) {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.stopped
+	if succeeded {
+		w.scan(true)
+	}
+}
+
+// scan reports the pages whose tsv is complete, after pdfsandwich exited every tsv is
+func (w *sandwichPageWatcher) scan(exited bool) {
+	files, err := sandwichTSVFiles(w.dir)
+	if err != nil {
+		log.Warn().Err(err).Str("component", "OCR_SANDWICH").Msg("unable to look for the recognized pages")
+		return
+	}
+	pages := make([]int, 0, len(files))
+	for page := range files {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+	for _, page := range pages {
+		file := files[page]
+		if w.reported[page] {
+			continue
+		}
+		if !exited {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			lastSize := w.sizes[file]
+			w.sizes[file] = info.Size()
+			if info.Size() == 0 || info.Size() != lastSize {
+				continue
+			}
+		}
+		tsv, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		pageResult := PageResult{Page: documentPage(page, w.ocrPages), Text: tsvText(tsv)}
+		if pageConfidence, _, err := parseTesseractTSV(tsv); err == nil && len(pageConfidence) > 0 {
+			pageResult.Confidence = pageConfidence[0].Confidence
+			pageResult.Words = pageConfidence[0].Words
+		}
+		w.reported[page] = true
+		reportProgress(w.ctx, JobProgress{State: JobRecognizing, Page: &pageResult})
+	}
+}
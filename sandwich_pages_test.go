@@ -0,0 +1,56 @@
+package ocrworker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSandwichPageWatcher(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sandwich-pages")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) { sandwichPagePollInterval = interval }(sandwichPagePollInterval)
+	sandwichPagePollInterval = 10 * time.Millisecond
+
+	// without a progress reporter there is nothing to watch
+	assert.True(t, watchSandwichPages(context.Background(), dir, nil) == nil)
+	var nilWatcher *sandwichPageWatcher
+	nilWatcher.finish(true)
+
+	reported := make(chan PageResult, 10)
+	ctx := withProgressReporter(context.Background(), func(progress JobProgress) {
+		if progress.Page != nil {
+			reported <- *progress.Page
+		}
+	})
+	tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+		"5\t1\t1\t1\t1\t1\t100\t100\t200\t40\t90\tpage\n" +
+		"5\t1\t1\t1\t1\t2\t320\t100\t120\t40\t80\tone\n"
+	// the pages 3 and 5 of the document are recognized
+	watcher := watchSandwichPages(ctx, dir, []int{3, 5})
+	assert.True(t, ioutil.WriteFile(filepath.Join(dir, "pdfsandwich_inputfile1.tsv"), []byte(tsv), 0600) == nil)
+	select {
+	case page := <-reported:
+		assert.Equals(t, page, PageResult{Page: 3, Text: "page one\n", Confidence: 85, Words: 2})
+	case <-time.After(5 * time.Second):
+		t.Fatal("the finished page was not reported while pdfsandwich runs")
+	}
+
+	// the last pages are reported once pdfsandwich exited
+	assert.True(t, ioutil.WriteFile(filepath.Join(dir, "pdfsandwich_inputfile2.tsv"), []byte(tsv), 0600) == nil)
+	watcher.finish(true)
+	close(reported)
+	var pages []int
+	for page := range reported {
+		pages = append(pages, page.Page)
+	}
+	assert.DeepEquals(t, pages, []int{5})
+
+}
@@ -16,18 +16,18 @@ func (s StrokeWidthTransformer) preprocess(ocrRequest *OcrRequest) error {
 
 	// write bytes to a temp file
 
-	tmpFileNameInput, err := createTempFileName("")
-	tmpFileNameInput = fmt.Sprintf("%s.png", tmpFileNameInput)
+	tmpFileNameInput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
+	tmpFileNameInput = fmt.Sprintf("%s.png", tmpFileNameInput)
 	defer os.Remove(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
-	tmpFileNameOutput = fmt.Sprintf("%s.png", tmpFileNameOutput)
+	tmpFileNameOutput, err := createTempFileName(ocrRequest.workDir, "")
 	if err != nil {
 		return err
 	}
+	tmpFileNameOutput = fmt.Sprintf("%s.png", tmpFileNameOutput)
 	defer os.Remove(tmpFileNameOutput)
 
 	err = saveBytesToFileName(ocrRequest.ImgBytes, tmpFileNameInput)
@@ -41,12 +41,12 @@ func (s StrokeWidthTransformer) preprocess(ocrRequest *OcrRequest) error {
 		Str("tmpFileNameInput", tmpFileNameInput).Str("tmpFileNameOutput", tmpFileNameOutput).
 		Str("darkOnLightSetting", darkOnLightSetting).Msg("DetectText")
 
-	out, err := exec.Command(
+	out, err := runCommand(ocrRequest.traceContext(), exec.Command(
 		"DetectText",
 		tmpFileNameInput,
 		tmpFileNameOutput,
 		darkOnLightSetting,
-	).CombinedOutput()
+	))
 	if err != nil {
 		log.Error().Err(err).Msg(string(out))
 	}
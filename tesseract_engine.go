@@ -1,11 +1,13 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -15,15 +17,25 @@ type TesseractEngine struct {
 }
 
 type TesseractEngineArgs struct {
-	configVars  map[string]string `json:"config_vars"`
-	pageSegMode string            `json:"psm"`
-	lang        string            `json:"lang"`
+	configVars  map[string]string
+	pageSegMode string
+	lang        string
+	autoOrient  bool
 	saveFiles   bool
+	outputs     []string
+}
+
+// tesseractOutputConfigs are the config files which make tesseract write the outputs next to the text
+var tesseractOutputConfigs = map[string]string{
+	OutputTxt:         "txt",
+	OutputHocr:        "hocr",
+	OutputCombinedPdf: "pdf",
 }
 
 func NewTesseractEngineArgs(ocrRequest *OcrRequest) (*TesseractEngineArgs, error) {
 
 	engineArgs := &TesseractEngineArgs{}
+	engineArgs.outputs = requestedOutputs(ocrRequest)
 
 	if ocrRequest.EngineArgs == nil {
 		return engineArgs, nil
@@ -38,7 +50,10 @@ func NewTesseractEngineArgs(ocrRequest *OcrRequest) (*TesseractEngineArgs, error
 			Interface("configVarsMapInterfaceOrig", configVarsMapInterfaceOrig).
 			Interface("configVarsMapInterfaceOrig", configVarsMapInterfaceOrig).Msg("got configVarsMap")
 
-		configVarsMapInterface := configVarsMapInterfaceOrig.(map[string]interface{})
+		configVarsMapInterface, ok := configVarsMapInterfaceOrig.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("could not convert config_vars into map: %v", configVarsMapInterfaceOrig)
+		}
 
 		configVarsMap := make(map[string]string)
 		for k, v := range configVarsMapInterface {
@@ -73,6 +88,16 @@ func NewTesseractEngineArgs(ocrRequest *OcrRequest) (*TesseractEngineArgs, error
 		engineArgs.lang = langStr
 	}
 
+	// detect and correct the orientation before recognition
+	autoOrient := ocrRequest.EngineArgs["auto_orient"]
+	if autoOrient != nil {
+		autoOrientFlag, ok := autoOrient.(bool)
+		if !ok {
+			return nil, fmt.Errorf("could not convert auto_orient into boolean: %v", autoOrient)
+		}
+		engineArgs.autoOrient = autoOrientFlag
+	}
+
 	return engineArgs, nil
 
 }
@@ -96,17 +121,27 @@ func (t TesseractEngineArgs) Export() []string {
 	return result
 }
 
+// selectsOutput is true if the config vars choose the output format of tesseract, e.g. tessedit_create_hocr
+func (t TesseractEngineArgs) selectsOutput() bool {
+	for k := range t.configVars {
+		if strings.HasPrefix(k, "tessedit_create_") {
+			return true
+		}
+	}
+	return false
+}
+
 // ProcessRequest will process incoming OCR request by routing it through the whole process chain
 func (t TesseractEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
 
 	tmpFileName, err := func() (string, error) {
 		switch {
 		case ocrRequest.ImgBase64 != "":
-			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64)
+			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64, ocrRequest.workDir)
 		case ocrRequest.ImgUrl != "":
-			return t.tmpFileFromImageUrl(ocrRequest.ImgUrl)
+			return t.tmpFileFromImageUrl(ocrRequest.ImgUrl, ocrRequest.workDir)
 		default:
-			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes)
+			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes, ocrRequest.workDir)
 		}
 	}()
 
@@ -121,21 +156,21 @@ func (t TesseractEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wo
 		return OcrResult{}, err
 	}
 
-	if engineArgs.saveFiles {
+	if !engineArgs.saveFiles {
 		defer os.Remove(tmpFileName)
 	}
 
-	ocrResult, err := t.processImageFile(tmpFileName, *engineArgs)
+	ocrResult, err := t.processImageFile(ocrRequest.traceContext(), tmpFileName, *engineArgs)
 
 	return ocrResult, err
 
 }
 
-func (t TesseractEngine) tmpFileFromImageBytes(imgBytes []byte) (string, error) {
+func (t TesseractEngine) tmpFileFromImageBytes(imgBytes []byte, workDir string) (string, error) {
 
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with bytes image")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(workDir, "")
 	if err != nil {
 		return "", err
 	}
@@ -151,11 +186,11 @@ func (t TesseractEngine) tmpFileFromImageBytes(imgBytes []byte) (string, error)
 
 }
 
-func (t TesseractEngine) tmpFileFromImageBase64(base64Image string) (string, error) {
+func (t TesseractEngine) tmpFileFromImageBase64(base64Image, workDir string) (string, error) {
 
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with base 64")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(workDir, "")
 	if err != nil {
 		return "", err
 	}
@@ -176,11 +211,11 @@ func (t TesseractEngine) tmpFileFromImageBase64(base64Image string) (string, err
 
 }
 
-func (t TesseractEngine) tmpFileFromImageUrl(imgUrl string) (string, error) {
+func (t TesseractEngine) tmpFileFromImageUrl(imgUrl, workDir string) (string, error) {
 
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with url")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(workDir, "")
 	if err != nil {
 		return "", err
 	}
@@ -195,7 +230,7 @@ func (t TesseractEngine) tmpFileFromImageUrl(imgUrl string) (string, error) {
 
 }
 
-func (t TesseractEngine) processImageFile(inputFilename string, engineArgs TesseractEngineArgs) (OcrResult, error) {
+func (t TesseractEngine) processImageFile(ctx context.Context, inputFilename string, engineArgs TesseractEngineArgs) (OcrResult, error) {
 
 	// if the input filename is /tmp/ocrimage, set the output file basename
 	// to /tmp/ocrimage as well, which will produce /tmp/ocrimage.txt output
@@ -204,15 +239,62 @@ func (t TesseractEngine) processImageFile(inputFilename string, engineArgs Tesse
 	// possible file extensions
 	fileExtensions := []string{"txt", "hocr", "json"}
 
+	// auto orient: rotate the image upright before recognition
+	var orientation []PageOrientation
+	var osd *OsdResult
+	if engineArgs.autoOrient {
+		rotatedFilename, pageOrientation, err := autoOrientImage(ctx, inputFilename)
+		if err != nil {
+			log.Error().Err(err).Str("component", "OCR_TESSERACT").Msg("orientation detection failed")
+			return OcrResult{Status: "error"}, err
+		}
+		if rotatedFilename != inputFilename {
+			if !engineArgs.saveFiles {
+				defer os.Remove(rotatedFilename)
+			}
+			inputFilename = rotatedFilename
+		}
+		orientation = []PageOrientation{pageOrientation}
+		osd = &pageOrientation.OsdResult
+	}
+
+	// lang auto: detect the script first and select the matching language pack
+	if engineArgs.lang == "auto" {
+		if osd == nil {
+			detected, err := detectOrientationAndScript(ctx, inputFilename)
+			if err != nil {
+				log.Error().Err(err).Str("component", "OCR_TESSERACT").Msg("language auto detection failed")
+				return OcrResult{Status: "error"}, err
+			}
+			osd = &detected
+		}
+		languages, scripts := InstalledTesseractLanguages()
+		engineArgs.lang = selectLanguageForScript(osd.Script, languages, scripts)
+		log.Info().Str("component", "OCR_TESSERACT").Str("script", osd.Script).
+			Float64("script_confidence", osd.ScriptConfidence).Str("lang", engineArgs.lang).
+			Msg("selected language by script detection")
+	}
+
 	// build args array
 	cflags := engineArgs.Export()
 	cmdArgs := []string{inputFilename, tmpOutFileBaseName}
 	cmdArgs = append(cmdArgs, cflags...)
+	// the tsv output holds the confidence of every word, requests choosing their output themselves go without
+	withConfidence := !engineArgs.selectsOutput()
+	if withConfidence {
+		cmdArgs = append(cmdArgs, "txt", "tsv")
+	}
+	// the outputs are written by the same run
+	for _, output := range engineArgs.outputs {
+		if !withConfidence || output != OutputTxt {
+			cmdArgs = append(cmdArgs, tesseractOutputConfigs[output])
+		}
+	}
 	log.Info().Str("component", "OCR_TESSERACT").Interface("cmdArgs", cmdArgs)
 
 	// exec tesseract
 	cmd := exec.Command("tesseract", cmdArgs...)
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
 		log.Error().Err(err).Str("component", "OCR_TESSERACT").Str("component", "OCR_TESSERACT").
 			Msg(string(output))
@@ -222,7 +304,7 @@ func (t TesseractEngine) processImageFile(inputFilename string, engineArgs Tesse
 	outBytes, outFile, err := findAndReadOutfile(tmpOutFileBaseName, fileExtensions)
 
 	// delete output file when we are done
-	if engineArgs.saveFiles {
+	if !engineArgs.saveFiles && outFile != "" {
 		defer os.Remove(outFile)
 	}
 	if err != nil {
@@ -231,10 +313,44 @@ func (t TesseractEngine) processImageFile(inputFilename string, engineArgs Tesse
 		return OcrResult{Status: "error"}, err
 	}
 
-	return OcrResult{
-		Text:   string(outBytes),
-		Status: "done",
-	}, nil
+	ocrResult := OcrResult{
+		Text:        string(outBytes),
+		Status:      "done",
+		Orientation: orientation,
+		pages:       1,
+	}
+	for _, output := range engineArgs.outputs {
+		outputFile := tmpOutFileBaseName + "." + tesseractOutputConfigs[output]
+		if !engineArgs.saveFiles && outputFile != outFile {
+			defer os.Remove(outputFile)
+		}
+		content, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			log.Error().Err(err).Str("component", "OCR_TESSERACT").Str("output", output).
+				Msg("Error getting data from output file")
+			return OcrResult{Status: "error"}, err
+		}
+		if ocrResult.Outputs == nil {
+			ocrResult.Outputs = make(map[string]OcrOutput)
+		}
+		ocrResult.Outputs[output] = newOcrOutput(output, content)
+	}
+	if withConfidence {
+		tsvFile := tmpOutFileBaseName + ".tsv"
+		if !engineArgs.saveFiles {
+			defer os.Remove(tsvFile)
+		}
+		// the text is delivered without the confidence if it can not be computed
+		tsv, err := ioutil.ReadFile(tsvFile)
+		if err == nil {
+			ocrResult.PageConfidence, ocrResult.Confidence, err = parseTesseractTSV(tsv)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("component", "OCR_TESSERACT").Msg("could not compute the confidence")
+		}
+	}
+
+	return ocrResult, nil
 
 }
 
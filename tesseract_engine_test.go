@@ -1,6 +1,7 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"testing"
@@ -90,7 +91,7 @@ func TestTesseractEngineWithFile(t *testing.T) {
 
 	engine := TesseractEngine{}
 	engineArgs := TesseractEngineArgs{}
-	result, err := engine.processImageFile("docs/testimage.png", engineArgs)
+	result, err := engine.processImageFile(context.Background(), "docs/testimage.png", engineArgs)
 	assert.True(t, err == nil)
 	log.Info().Str("component", "TEST").Interface("result", result)
 
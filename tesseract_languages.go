@@ -0,0 +1,144 @@
+package ocrworker
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// scriptPrefix marks script based traineddata in the output of tesseract --list-langs, e.g. script/Latin
+const scriptPrefix = "script/"
+
+var (
+	installedLanguagesOnce sync.Once
+	installedLanguages     []string
+	installedScripts       []string
+)
+
+// InstalledTesseractLanguages returns the languages and scripts installed on this machine.
+// The discovery runs only once, at the first call.
+func InstalledTesseractLanguages() ([]string, []string) {
+	installedLanguagesOnce.Do(func() {
+		output, err := exec.Command("tesseract", "--list-langs").CombinedOutput()
+		if err != nil {
+			log.Warn().Str("component", "OCR_WORKER").Err(err).
+				Msg("unable to discover installed tesseract languages")
+			return
+		}
+		installedLanguages, installedScripts = parseTesseractLanguages(string(output))
+		log.Info().Str("component", "OCR_WORKER").
+			Strs("languages", installedLanguages).
+			Strs("scripts", installedScripts).
+			Msg("discovered installed tesseract languages")
+	})
+	return installedLanguages, installedScripts
+}
+
+// parseTesseractLanguages splits the output of tesseract --list-langs into languages and scripts
+func parseTesseractLanguages(output string) ([]string, []string) {
+	languages := make([]string, 0)
+	scripts := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "List of available languages") {
+			continue
+		}
+		if strings.HasPrefix(line, scriptPrefix) {
+			scripts = append(scripts, strings.TrimPrefix(line, scriptPrefix))
+			continue
+		}
+		languages = append(languages, line)
+	}
+	sort.Strings(languages)
+	sort.Strings(scripts)
+	return languages, scripts
+}
+
+// OsdResult holds the result of tesseract's orientation and script detection (--psm 0)
+type OsdResult struct {
+	Orientation           int     `json:"orientation"`
+	Rotate                int     `json:"rotate"`
+	OrientationConfidence float64 `json:"orientation_confidence"`
+	Script                string  `json:"script"`
+	ScriptConfidence      float64 `json:"script_confidence"`
+}
+
+// parseOsd parses the output of "tesseract <image> stdout --psm 0"
+func parseOsd(output string) (OsdResult, error) {
+	osd := OsdResult{}
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		keyValue := strings.SplitN(line, ":", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(keyValue[0]), strings.TrimSpace(keyValue[1])
+		var err error
+		switch key {
+		case "Orientation in degrees":
+			osd.Orientation, err = strconv.Atoi(value)
+		case "Rotate":
+			osd.Rotate, err = strconv.Atoi(value)
+		case "Orientation confidence":
+			osd.OrientationConfidence, err = strconv.ParseFloat(value, 64)
+		case "Script":
+			osd.Script = value
+			found = true
+		case "Script confidence":
+			osd.ScriptConfidence, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return osd, fmt.Errorf("unable to parse osd output %q: %v", line, err)
+		}
+	}
+	if !found {
+		return osd, fmt.Errorf("no script detected in osd output")
+	}
+	return osd, nil
+}
+
+// detectOrientationAndScript runs tesseract orientation and script detection on an image file
+func detectOrientationAndScript(ctx context.Context, inputFilename string) (OsdResult, error) {
+	output, err := runCommand(ctx, exec.Command("tesseract", inputFilename, "stdout", "--psm", "0"))
+	if err != nil {
+		return OsdResult{}, fmt.Errorf("osd failed: %v: %s", err, string(output))
+	}
+	return parseOsd(string(output))
+}
+
+// scriptLanguages maps a script detected by osd to the language pack used if no script pack is installed
+var scriptLanguages = map[string]string{
+	"Latin":      "eng",
+	"Cyrillic":   "rus",
+	"Greek":      "ell",
+	"Arabic":     "ara",
+	"Hebrew":     "heb",
+	"Han":        "chi_sim",
+	"Japanese":   "jpn",
+	"Hangul":     "kor",
+	"Devanagari": "hin",
+	"Thai":       "tha",
+}
+
+// selectLanguageForScript picks the installed language pack which fits the detected script best
+func selectLanguageForScript(script string, languages, scripts []string) string {
+	for _, installed := range scripts {
+		if installed == script {
+			return scriptPrefix + script
+		}
+	}
+	if language, ok := scriptLanguages[script]; ok {
+		for _, installed := range languages {
+			if installed == language {
+				return language
+			}
+		}
+	}
+	return "eng"
+}
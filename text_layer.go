@@ -0,0 +1,241 @@
+package ocrworker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// the modes of the ocr_mode engine arg, they tell what happens to the pages of a pdf which already have text
+const (
+	// OcrModeSkipText returns the text of the pages which have some, only the others are recognized
+	OcrModeSkipText = "skip_text"
+	// OcrModeRedoOcr recognizes the pages which have text and images again, they are most likely scans
+	// with the text layer of an older recognition. The pages with text only are skipped.
+	OcrModeRedoOcr = "redo_ocr"
+	// OcrModeForceOcr recognizes every page
+	OcrModeForceOcr = "force_ocr"
+)
+
+// the paths a page of a result takes
+const (
+	PageSourceTextLayer = "text_layer"
+	PageSourceOcr       = "ocr"
+)
+
+// minTextLayerChars is the number of letters and digits a page needs to count as having a text layer,
+// scanners add a few stray characters to their pdfs
+const minTextLayerChars = 10
+
+// PageSource tells if the text of a page was extracted from its text layer or recognized
+type PageSource struct {
+	Page   int    `json:"page"`
+	Source string `json:"source"`
+}
+
+// planPageSources decides for every page of a pdf if it is recognized or its text is extracted
+func planPageSources(ctx context.Context, pdfFile, mode string) ([]PageSource, error) {
+	textFile := pdfFile + "_layer.txt"
+	defer os.Remove(textFile)
+	// stdout would mix the text with the warnings of pdftotext
+	if output, err := runCommand(ctx, exec.Command("pdftotext", "-enc", "UTF-8", pdfFile, textFile)); err != nil {
+		return nil, fmt.Errorf("pdftotext failed: %v: %s", err, string(output))
+	}
+	text, err := ioutil.ReadFile(textFile)
+	if err != nil {
+		return nil, err
+	}
+	var images map[int]bool
+	if mode == OcrModeRedoOcr {
+		// the warnings of pdfimages don't parse as images
+		output, err := runCommand(ctx, exec.Command("pdfimages", "-list", pdfFile))
+		if err != nil {
+			return nil, fmt.Errorf("pdfimages failed: %v: %s", err, string(output))
+		}
+		images = parsePdfImagesList(output)
+	}
+	return pageSources(mode, splitPages(string(text)), images), nil
+}
+
+// splitPages splits the output of pdftotext into pages, every page ends with a form feed
+func splitPages(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\f"), "\f")
+}
+
+func hasTextLayer(pageText string) bool {
+	chars := 0
+	for _, r := range pageText {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			chars++
+		}
+	}
+	return chars >= minTextLayerChars
+}
+
+// parsePdfImagesList returns the pages with images from the output of pdfimages -list
+func parsePdfImagesList(output []byte) map[int]bool {
+	images := make(map[int]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the masks of the images don't count, the header and the separator line don't parse
+		if len(fields) < 3 || fields[2] != "image" {
+			continue
+		}
+		if page, err := strconv.Atoi(fields[0]); err == nil {
+			images[page] = true
+		}
+	}
+	return images
+}
+
+func pageSources(mode string, pageTexts []string, images map[int]bool) []PageSource {
+	sources := make([]PageSource, len(pageTexts))
+	for i, pageText := range pageTexts {
+		page := i + 1
+		source := PageSourceOcr
+		if mode != OcrModeForceOcr && hasTextLayer(pageText) && !(mode == OcrModeRedoOcr && images[page]) {
+			source = PageSourceTextLayer
+		}
+		sources[i] = PageSource{Page: page, Source: source}
+	}
+	return sources
+}
+
+// pagesBySource returns the numbers of the pages which take the path source
+func pagesBySource(sources []PageSource, source string) []int {
+	var pages []int
+	for _, pageSource := range sources {
+		if pageSource.Source == source {
+			pages = append(pages, pageSource.Page)
+		}
+	}
+	return pages
+}
+
+// selectPdfPages writes the given pages of a pdf into a new one
+func selectPdfPages(ctx context.Context, inputPdf, outputPdf string, pages []int) error {
+	args := []string{inputPdf, "cat"}
+	for _, page := range pages {
+		args = append(args, strconv.Itoa(page))
+	}
+	args = append(args, "output", outputPdf)
+	if output, err := runCommand(ctx, exec.Command("pdftk", args...)); err != nil {
+		return fmt.Errorf("pdftk failed: %v: %s", err, string(output))
+	}
+	return nil
+}
+
+// filterPdf removes the text, the images or the vector graphics of a pdf with the FILTER* options of ghostscript,
+// e.g. TEXT, the pages keep their size
+func filterPdf(ctx context.Context, inputPdf, outputPdf string, filters ...string) error {
+	args := []string{"-sDEVICE=pdfwrite", "-dNOPAUSE", "-dBATCH", "-dQUIET"}
+	for _, filter := range filters {
+		args = append(args, "-dFILTER"+filter)
+	}
+	args = append(args, "-sOutputFile="+outputPdf, inputPdf)
+	if output, err := runCommand(ctx, exec.Command("gs", args...)); err != nil {
+		return fmt.Errorf("gs failed: %v: %s", err, string(output))
+	}
+	return nil
+}
+
+// mergePageSources puts a pdf together in the order of the pages, the recognized pages are taken one after
+// the other from ocrPdf and the others from the page with the same number of textLayerPdf
+func mergePageSources(ctx context.Context, outputPdf string, sources []PageSource, ocrPdf, textLayerPdf string) error {
+	args := []string{"A=" + ocrPdf, "B=" + textLayerPdf, "cat"}
+	args = append(args, mergePageRanges(sources)...)
+	args = append(args, "output", outputPdf)
+	if output, err := runCommand(ctx, exec.Command("pdftk", args...)); err != nil {
+		return fmt.Errorf("pdftk failed: %v: %s", err, string(output))
+	}
+	return nil
+}
+
+func mergePageRanges(sources []PageSource) []string {
+	var ranges []string
+	ocrPage := 0
+	for _, pageSource := range sources {
+		if pageSource.Source == PageSourceOcr {
+			ocrPage++
+			ranges = append(ranges, fmt.Sprintf("A%d", ocrPage))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("B%d", pageSource.Page))
+		}
+	}
+	return ranges
+}
+
+// basePageRanges takes the recognized pages from the pdf without text, A, and the others from the input, B,
+// a recognized page would show the text of its old text layer next to the new one
+func basePageRanges(sources []PageSource) []string {
+	var ranges []string
+	for _, pageSource := range sources {
+		if pageSource.Source == PageSourceOcr {
+			ranges = append(ranges, fmt.Sprintf("A%d", pageSource.Page))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("B%d", pageSource.Page))
+		}
+	}
+	return ranges
+}
+
+// sandwichLayer are the files the outputs of the sandwich engine are derived from
+type sandwichLayer struct {
+	// text is a pdf with nothing but the text of every page, recognized or taken from its text layer
+	text string
+	// stamp is stamped onto base for the combined pdf, empty if no page was recognized. The recognized
+	// pages of base have no text.
+	stamp string
+	base  string
+}
+
+// mergeTextLayer builds the layer of a pdf whose pages with a text layer were not recognized, the text of these
+// pages is the pdf without images and vector graphics and their stamp is blank. The old text of the recognized
+// pages is removed from the base. ocrLayerPdf is empty if no page was recognized.
+func mergeTextLayer(ctx context.Context, inputPdf, ocrLayerPdf string, sources []PageSource) (layer sandwichLayer, tmpFiles []string, err error) {
+	textOnly := inputPdf + "_text_only.pdf"
+	tmpFiles = append(tmpFiles, textOnly)
+	if err := filterPdf(ctx, inputPdf, textOnly, "IMAGE", "VECTOR"); err != nil {
+		return layer, tmpFiles, err
+	}
+	if ocrLayerPdf == "" {
+		// the document is returned as it is
+		return sandwichLayer{text: textOnly, base: inputPdf}, tmpFiles, nil
+	}
+	blank := inputPdf + "_blank.pdf"
+	noText := inputPdf + "_no_text.pdf"
+	text := inputPdf + "_text_layer.pdf"
+	stamp := inputPdf + "_stamp.pdf"
+	base := inputPdf + "_base.pdf"
+	tmpFiles = append(tmpFiles, blank, noText, text, stamp, base)
+	if err := filterPdf(ctx, inputPdf, blank, "TEXT", "IMAGE", "VECTOR"); err != nil {
+		return layer, tmpFiles, err
+	}
+	if err := filterPdf(ctx, inputPdf, noText, "TEXT"); err != nil {
+		return layer, tmpFiles, err
+	}
+	if err := mergePageSources(ctx, text, sources, ocrLayerPdf, textOnly); err != nil {
+		return layer, tmpFiles, err
+	}
+	if err := mergePageSources(ctx, stamp, sources, ocrLayerPdf, blank); err != nil {
+		return layer, tmpFiles, err
+	}
+	args := []string{"A=" + noText, "B=" + inputPdf, "cat"}
+	args = append(args, basePageRanges(sources)...)
+	args = append(args, "output", base)
+	if output, err := runCommand(ctx, exec.Command("pdftk", args...)); err != nil {
+		return layer, tmpFiles, fmt.Errorf("pdftk failed: %v: %s", err, string(output))
+	}
+	return sandwichLayer{text: text, stamp: stamp, base: base}, tmpFiles, nil
+}
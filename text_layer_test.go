@@ -0,0 +1,64 @@
+package ocrworker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const testPdfImagesList = `page   num  type   width height color comp bpc  enc interp  object ID x-ppi y-ppi size ratio
+--------------------------------------------------------------------------------------------
+   1     0 smask     120    80  gray    1   8  image  no        14  0    72    72  2B  0.0%
+   3     1 image    2480  3508  gray    1   8  jpeg   no        10  0   300   300  463K 5.4%
+`
+
+func TestPageSources(t *testing.T) {
+
+	pageTexts := splitPages("Invoice number 4711\f\fScanned page with an old text layer\fx 1\f")
+	assert.Equals(t, len(pageTexts), 4)
+	images := parsePdfImagesList([]byte(testPdfImagesList))
+	assert.True(t, images[3])
+	// masks are no images
+	assert.False(t, images[1])
+
+	sourcesOf := func(mode string) string {
+		var sources []string
+		for _, pageSource := range pageSources(mode, pageTexts, images) {
+			sources = append(sources, pageSource.Source)
+		}
+		return strings.Join(sources, ",")
+	}
+	// a few stray characters are no text layer
+	assert.Equals(t, sourcesOf(OcrModeSkipText), "text_layer,ocr,text_layer,ocr")
+	assert.Equals(t, sourcesOf(OcrModeRedoOcr), "text_layer,ocr,ocr,ocr")
+	assert.Equals(t, sourcesOf(OcrModeForceOcr), "ocr,ocr,ocr,ocr")
+	assert.Equals(t, len(splitPages("")), 0)
+
+	sources := pageSources(OcrModeSkipText, pageTexts, images)
+	assert.Equals(t, fmt.Sprint(pagesBySource(sources, PageSourceOcr)), "[2 4]")
+	// the recognized pages are taken one after the other from the ocr layer
+	assert.Equals(t, strings.Join(mergePageRanges(sources), " "), "B1 A1 B3 A2")
+	// with redo_ocr the scanned page 3 is recognized again, its old text is taken out of the base
+	sources = pageSources(OcrModeRedoOcr, pageTexts, images)
+	assert.Equals(t, strings.Join(basePageRanges(sources), " "), "B1 A2 A3 A4")
+	assert.Equals(t, strings.Join(mergePageRanges(sources), " "), "B1 A1 A2 A3")
+
+	ocrRequest := OcrRequest{ImgUrl: "http://localhost/img", EngineType: EngineSandwichTesseract,
+		EngineArgs: map[string]interface{}{"ocr_type": "txt", "ocr_mode": "redo_ocr"}}
+	workerConfig := workerConfigForTests()
+	engineArgs, err := NewSandwichEngineArgs(&ocrRequest, &workerConfig)
+	assert.True(t, err == nil)
+	assert.Equals(t, engineArgs.ocrMode, OcrModeRedoOcr)
+	engineArgs, err = NewSandwichEngineArgs(&OcrRequest{EngineType: EngineSandwichTesseract}, &workerConfig)
+	assert.True(t, err == nil)
+	assert.Equals(t, engineArgs.ocrMode, OcrModeSkipText)
+
+	rabbitConfig := rabbitConfigForTests()
+	ocrRequest.EngineArgs["ocr_mode"] = "always"
+	err = ValidateOcrRequest(&ocrRequest, &rabbitConfig)
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*OcrRequestValidationError).InvalidParams[0].Name, "engine_args.ocr_mode")
+
+}
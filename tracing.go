@@ -0,0 +1,179 @@
+package ocrworker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// publishTimeHeader carries the time a message was published in unix nanoseconds, the amqp
+// timestamp property has only a resolution of seconds which is too coarse for the queue wait span
+const publishTimeHeader = "x-publish-time"
+
+// tracer creates all spans of open-ocr, it delegates to the provider installed by InitTracing
+var tracer = otel.Tracer("github.com/ublast/open-ocr")
+
+// InitTracing installs the global tracer provider and the W3C trace context propagator.
+// exporter is either empty (tracing is disabled), "stdout" or the url of an OTLP/HTTP collector,
+// e.g. http://otel-collector:4318. The returned function flushes the pending spans and stops the exporter.
+func InitTracing(serviceName, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var spanProcessor sdktrace.SpanProcessor
+	if exporter == "stdout" {
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		spanProcessor = sdktrace.NewSimpleSpanProcessor(stdoutExporter)
+	} else {
+		endpoint, err := url.Parse(exporter)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("trace exporter must be \"stdout\" or the url of an OTLP collector, got %q", exporter)
+		}
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+		}
+		otlpExporter, err := otlptracehttp.New(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+		spanProcessor = sdktrace.NewBatchSpanProcessor(otlpExporter)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(spanProcessor),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	log.Info().Str("component", "OCR_TRACING").Str("service", serviceName).Str("exporter", exporter).
+		Msg("tracing enabled")
+	return tracerProvider.Shutdown, nil
+}
+
+// amqpHeadersCarrier adapts the headers of an amqp message to the propagation.TextMapCarrier interface
+type amqpHeadersCarrier amqp.Table
+
+func (c amqpHeadersCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeadersCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpHeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// traceHeaders returns the headers for a message published within ctx
+func traceHeaders(ctx context.Context) amqp.Table {
+	headers := amqp.Table{publishTimeHeader: time.Now().UnixNano()}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeadersCarrier(headers))
+	return headers
+}
+
+// startDeliverySpan continues the trace of the publisher of a delivery. The time the message
+// spent in the queue is recorded as a span of its own before the consumer span is started.
+func startDeliverySpan(d *amqp.Delivery, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), amqpHeadersCarrier(d.Headers))
+	queueAttributes := trace.WithAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination", d.RoutingKey),
+		attribute.String("messaging.conversation_id", d.CorrelationId),
+	)
+	if publishTime, ok := d.Headers[publishTimeHeader].(int64); ok {
+		_, queueWait := tracer.Start(ctx, "queue wait "+d.RoutingKey, queueAttributes,
+			trace.WithTimestamp(time.Unix(0, publishTime)))
+		queueWait.End()
+	}
+	return tracer.Start(ctx, name, queueAttributes, trace.WithSpanKind(trace.SpanKindConsumer))
+}
+
+// detachedTraceContext keeps the span of ctx but not its deadline or cancellation,
+// e.g. for work which outlives the http request it was started by
+func detachedTraceContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+// recordSpanError marks the span as failed if err is set
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endSpan marks the span as failed if err is set and ends it
+func endSpan(span trace.Span, err error) {
+	recordSpanError(span, err)
+	span.End()
+}
+
+// runCommand runs an external command in a span of its own and returns its combined output.
+// The command is killed if ctx is cancelled, e.g. when a job is aborted on shutdown.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	_, span := tracer.Start(ctx, "exec "+cmd.Args[0], trace.WithAttributes(
+		attribute.String("process.command_line", strings.Join(cmd.Args, " ")),
+	))
+	start := time.Now()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if watch, ok := ctx.Value(outputWatcherKey{}).(func(string)); ok {
+		writer := io.MultiWriter(&output, &lineWriter{watch: watch})
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+	}
+	startInProcessGroup(cmd)
+	err := cmd.Start()
+	if err == nil {
+		waitDone := make(chan error, 1)
+		go func() { waitDone <- cmd.Wait() }()
+		select {
+		case err = <-waitDone:
+		case <-ctx.Done():
+			_ = killProcessGroup(cmd)
+			err = <-waitDone
+		}
+	}
+	observeExternalCommand(cmd, start, err)
+	recordCommand(ctx, cmd, output.Bytes(), start, err)
+	endSpan(span, err)
+	return output.Bytes(), err
+}
@@ -0,0 +1,97 @@
+package ocrworker
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	testSpanRecorderOnce sync.Once
+	testSpanRecorder     *tracetest.SpanRecorder
+)
+
+// recordedSpans installs a tracer provider which records all spans, the package tracer
+// is bound to the first provider which is installed, so it has to be shared by all tests
+func recordedSpans() *tracetest.SpanRecorder {
+	testSpanRecorderOnce.Do(func() {
+		testSpanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpanRecorder)))
+	})
+	return testSpanRecorder
+}
+
+func endedSpansOfTrace(recorder *tracetest.SpanRecorder, traceID trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func TestTraceContextThroughAmqpHeaders(t *testing.T) {
+
+	recorder := recordedSpans()
+	_, err := InitTracing("open-ocr-test", "")
+	assert.True(t, err == nil)
+
+	ctx, publishSpan := tracer.Start(context.Background(), "publish")
+	headers := traceHeaders(ctx)
+	publishSpan.End()
+	_, ok := headers["traceparent"].(string)
+	assert.True(t, ok)
+	_, ok = headers[publishTimeHeader].(int64)
+	assert.True(t, ok)
+
+	delivery := amqp.Delivery{Headers: headers, RoutingKey: "decode-ocr", CorrelationId: "abc"}
+	ctx, consumeSpan := startDeliverySpan(&delivery, "process ocr request")
+	_, err = runCommand(ctx, exec.Command("false"))
+	assert.True(t, err != nil)
+	consumeSpan.End()
+
+	traceID := publishSpan.SpanContext().TraceID()
+	spans := endedSpansOfTrace(recorder, traceID)
+	assert.Equals(t, len(spans), 4)
+	assert.Equals(t, spans["queue wait decode-ocr"].Parent().SpanID(), publishSpan.SpanContext().SpanID())
+	assert.Equals(t, spans["process ocr request"].Parent().SpanID(), publishSpan.SpanContext().SpanID())
+	assert.Equals(t, spans["process ocr request"].SpanKind(), trace.SpanKindConsumer)
+	assert.Equals(t, spans["exec false"].Parent().SpanID(), consumeSpan.SpanContext().SpanID())
+	assert.Equals(t, spans["exec false"].Status().Code, codes.Error)
+
+	// a delivery without trace context starts a new trace
+	_, orphanSpan := startDeliverySpan(&amqp.Delivery{}, "process ocr request")
+	orphanSpan.End()
+	assert.True(t, orphanSpan.SpanContext().TraceID() != traceID)
+
+}
+
+func TestInitTracingRejectsInvalidExporter(t *testing.T) {
+
+	_, err := InitTracing("open-ocr-test", "not a collector")
+	assert.True(t, err != nil)
+
+}
+
+func TestRunCommandKillsChildren(t *testing.T) {
+
+	// the background sleep keeps the output pipe open after the shell is gone, like the tesseract of pdfsandwich
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runCommand(ctx, exec.Command("sh", "-c", "sleep 30 & sleep 30"))
+	assert.True(t, err != nil)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+}
@@ -0,0 +1,601 @@
+package ocrworker
+
+import (
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The messages of wire_protocol.proto are encoded field by field, the field numbers are the ones of the proto file.
+// Like the generated code, zero values are left out and unknown fields are skipped.
+
+// wireEncoder appends the fields of a message
+type wireEncoder struct {
+	b []byte
+}
+
+func (e *wireEncoder) string(num protowire.Number, s string) {
+	if s != "" {
+		e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+		e.b = protowire.AppendString(e.b, s)
+	}
+}
+
+func (e *wireEncoder) strings(num protowire.Number, values []string) {
+	for _, s := range values {
+		e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+		e.b = protowire.AppendString(e.b, s)
+	}
+}
+
+func (e *wireEncoder) bytes(num protowire.Number, b []byte) {
+	if len(b) > 0 {
+		e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+		e.b = protowire.AppendBytes(e.b, b)
+	}
+}
+
+func (e *wireEncoder) uint(num protowire.Number, v uint64) {
+	if v != 0 {
+		e.b = protowire.AppendTag(e.b, num, protowire.VarintType)
+		e.b = protowire.AppendVarint(e.b, v)
+	}
+}
+
+func (e *wireEncoder) int(num protowire.Number, v int64) {
+	e.uint(num, uint64(v))
+}
+
+func (e *wireEncoder) bool(num protowire.Number, v bool) {
+	if v {
+		e.uint(num, 1)
+	}
+}
+
+// double leaves out 0 unless present is set, which is the presence of an optional field
+func (e *wireEncoder) double(num protowire.Number, v float64, present bool) {
+	if v != 0 || present {
+		e.b = protowire.AppendTag(e.b, num, protowire.Fixed64Type)
+		e.b = protowire.AppendFixed64(e.b, math.Float64bits(v))
+	}
+}
+
+func (e *wireEncoder) message(num protowire.Number, encode func(e *wireEncoder)) {
+	inner := wireEncoder{}
+	encode(&inner)
+	e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+	e.b = protowire.AppendBytes(e.b, inner.b)
+}
+
+// known encodes a message of the well known types, e.g. a google.protobuf.Struct
+func (e *wireEncoder) known(num protowire.Number, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+	e.b = protowire.AppendBytes(e.b, b)
+	return nil
+}
+
+func (e *wireEncoder) args(num protowire.Number, args map[string]interface{}) error {
+	if args == nil {
+		return nil
+	}
+	s, err := structpb.NewStruct(args)
+	if err != nil {
+		return err
+	}
+	return e.known(num, s)
+}
+
+func (e *wireEncoder) time(num protowire.Number, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	return e.known(num, timestamppb.New(t))
+}
+
+// wireField is a field of a message, value holds the varint or fixed number and b the bytes of the field
+type wireField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	value uint64
+	b     []byte
+}
+
+func (f wireField) string() string  { return string(f.b) }
+func (f wireField) int() int        { return int(int64(f.value)) }
+func (f wireField) bool() bool      { return f.value != 0 }
+func (f wireField) double() float64 { return math.Float64frombits(f.value) }
+func (f wireField) bytes() []byte   { return append([]byte{}, f.b...) }
+
+func (f wireField) args() (map[string]interface{}, error) {
+	s := structpb.Struct{}
+	if err := proto.Unmarshal(f.b, &s); err != nil {
+		return nil, err
+	}
+	return s.AsMap(), nil
+}
+
+func (f wireField) time() (time.Time, error) {
+	t := timestamppb.Timestamp{}
+	if err := proto.Unmarshal(f.b, &t); err != nil {
+		return time.Time{}, err
+	}
+	return t.AsTime(), nil
+}
+
+// rangeWireFields calls field for every field of the message b. The messages only have varint, fixed64
+// and length delimited fields, fields of the other types are skipped.
+func rangeWireFields(b []byte, field func(f wireField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := wireField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			f.num = 0
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if f.num == 0 {
+			continue
+		}
+		if err := field(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field numbers of OcrRequest in wire_protocol.proto
+const (
+	requestFieldImgURL protowire.Number = iota + 1
+	requestFieldImgBase64
+	requestFieldEngine
+	requestFieldImgBytes
+	requestFieldPreprocessors
+	requestFieldPreprocessorArgs
+	requestFieldEngineArgs
+	requestFieldOutputs
+	requestFieldDeferred
+	requestFieldReplyTo
+	requestFieldDocType
+	requestFieldRequestID
+	requestFieldPageNumber
+	requestFieldUserAgent
+	requestFieldTimeOut
+	requestFieldReferenceID
+	requestFieldTitle
+	requestFieldInplaceDecode
+	requestFieldDebug
+	requestFieldReportProgress
+	requestFieldImgBlob
+	requestFieldCache
+	requestFieldDebugArtifacts
+)
+
+func marshalWireRequest(e *wireEncoder, ocrRequest *OcrRequest) error {
+	e.string(requestFieldImgURL, ocrRequest.ImgUrl)
+	e.string(requestFieldImgBase64, ocrRequest.ImgBase64)
+	e.uint(requestFieldEngine, uint64(ocrRequest.EngineType))
+	e.bytes(requestFieldImgBytes, ocrRequest.ImgBytes)
+	e.strings(requestFieldPreprocessors, ocrRequest.PreprocessorChain)
+	if err := e.args(requestFieldPreprocessorArgs, ocrRequest.PreprocessorArgs); err != nil {
+		return err
+	}
+	if err := e.args(requestFieldEngineArgs, ocrRequest.EngineArgs); err != nil {
+		return err
+	}
+	e.strings(requestFieldOutputs, ocrRequest.Outputs)
+	e.bool(requestFieldDeferred, ocrRequest.Deferred)
+	e.string(requestFieldReplyTo, ocrRequest.ReplyTo)
+	e.string(requestFieldDocType, ocrRequest.DocType)
+	e.string(requestFieldRequestID, ocrRequest.RequestID)
+	e.uint(requestFieldPageNumber, uint64(ocrRequest.PageNumber))
+	e.string(requestFieldUserAgent, ocrRequest.UserAgent)
+	e.uint(requestFieldTimeOut, uint64(ocrRequest.TimeOut))
+	e.string(requestFieldReferenceID, ocrRequest.ReferenceID)
+	e.string(requestFieldTitle, ocrRequest.Title)
+	e.bool(requestFieldInplaceDecode, ocrRequest.InplaceDecode)
+	e.bool(requestFieldDebug, ocrRequest.Debug)
+	e.bool(requestFieldReportProgress, ocrRequest.ReportProgress)
+	if blob := ocrRequest.ImgBlob; blob != nil {
+		e.message(requestFieldImgBlob, func(e *wireEncoder) {
+			e.string(1, blob.URI)
+			e.string(2, blob.SHA256)
+			e.int(3, int64(blob.Size))
+		})
+	}
+	e.string(requestFieldCache, ocrRequest.Cache)
+	for _, artifact := range ocrRequest.DebugArtifacts {
+		var err error
+		e.message(requestFieldDebugArtifacts, func(e *wireEncoder) {
+			err = marshalWireDebugArtifact(e, &artifact)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalWireRequest(b []byte, ocrRequest *OcrRequest) error {
+	return rangeWireFields(b, func(f wireField) (err error) {
+		switch f.num {
+		case requestFieldImgURL:
+			ocrRequest.ImgUrl = f.string()
+		case requestFieldImgBase64:
+			ocrRequest.ImgBase64 = f.string()
+		case requestFieldEngine:
+			ocrRequest.EngineType = OcrEngineType(f.int())
+		case requestFieldImgBytes:
+			ocrRequest.ImgBytes = f.bytes()
+		case requestFieldPreprocessors:
+			ocrRequest.PreprocessorChain = append(ocrRequest.PreprocessorChain, f.string())
+		case requestFieldPreprocessorArgs:
+			ocrRequest.PreprocessorArgs, err = f.args()
+		case requestFieldEngineArgs:
+			ocrRequest.EngineArgs, err = f.args()
+		case requestFieldOutputs:
+			ocrRequest.Outputs = append(ocrRequest.Outputs, f.string())
+		case requestFieldDeferred:
+			ocrRequest.Deferred = f.bool()
+		case requestFieldReplyTo:
+			ocrRequest.ReplyTo = f.string()
+		case requestFieldDocType:
+			ocrRequest.DocType = f.string()
+		case requestFieldRequestID:
+			ocrRequest.RequestID = f.string()
+		case requestFieldPageNumber:
+			ocrRequest.PageNumber = uint16(f.value)
+		case requestFieldUserAgent:
+			ocrRequest.UserAgent = f.string()
+		case requestFieldTimeOut:
+			ocrRequest.TimeOut = uint(f.value)
+		case requestFieldReferenceID:
+			ocrRequest.ReferenceID = f.string()
+		case requestFieldTitle:
+			ocrRequest.Title = f.string()
+		case requestFieldInplaceDecode:
+			ocrRequest.InplaceDecode = f.bool()
+		case requestFieldDebug:
+			ocrRequest.Debug = f.bool()
+		case requestFieldReportProgress:
+			ocrRequest.ReportProgress = f.bool()
+		case requestFieldImgBlob:
+			blob := BlobRef{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					blob.URI = f.string()
+				case 2:
+					blob.SHA256 = f.string()
+				case 3:
+					blob.Size = f.int()
+				}
+				return nil
+			})
+			ocrRequest.ImgBlob = &blob
+		case requestFieldCache:
+			ocrRequest.Cache = f.string()
+		case requestFieldDebugArtifacts:
+			artifact := DebugArtifact{}
+			err = unmarshalWireDebugArtifact(f.b, &artifact)
+			ocrRequest.DebugArtifacts = append(ocrRequest.DebugArtifacts, artifact)
+		}
+		return err
+	})
+}
+
+func marshalWireDebugArtifact(e *wireEncoder, artifact *DebugArtifact) error {
+	e.string(1, artifact.Preprocessor)
+	e.bytes(2, artifact.Input)
+	for _, command := range artifact.Commands {
+		var err error
+		e.message(3, func(e *wireEncoder) {
+			e.strings(1, command.Args)
+			e.string(2, command.Output)
+			e.int(3, int64(command.ExitCode))
+			e.string(4, command.Error)
+			err = e.time(5, command.Started)
+			e.double(6, command.Duration, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for tool, version := range artifact.ToolVersions {
+		e.message(4, func(e *wireEncoder) {
+			e.string(1, tool)
+			e.string(2, version)
+		})
+	}
+	if err := e.time(5, artifact.Started); err != nil {
+		return err
+	}
+	e.double(6, artifact.Duration, false)
+	return nil
+}
+
+func unmarshalWireDebugArtifact(b []byte, artifact *DebugArtifact) error {
+	return rangeWireFields(b, func(f wireField) (err error) {
+		switch f.num {
+		case 1:
+			artifact.Preprocessor = f.string()
+		case 2:
+			artifact.Input = f.bytes()
+		case 3:
+			command := CommandRecord{}
+			err = rangeWireFields(f.b, func(f wireField) (err error) {
+				switch f.num {
+				case 1:
+					command.Args = append(command.Args, f.string())
+				case 2:
+					command.Output = f.string()
+				case 3:
+					command.ExitCode = f.int()
+				case 4:
+					command.Error = f.string()
+				case 5:
+					command.Started, err = f.time()
+				case 6:
+					command.Duration = f.double()
+				}
+				return err
+			})
+			artifact.Commands = append(artifact.Commands, command)
+		case 4:
+			var tool, version string
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					tool = f.string()
+				case 2:
+					version = f.string()
+				}
+				return nil
+			})
+			if artifact.ToolVersions == nil {
+				artifact.ToolVersions = make(map[string]string)
+			}
+			artifact.ToolVersions[tool] = version
+		case 5:
+			artifact.Started, err = f.time()
+		case 6:
+			artifact.Duration = f.double()
+		}
+		return err
+	})
+}
+
+// field numbers of OcrResult in wire_protocol.proto
+const (
+	resultFieldText protowire.Number = iota + 1
+	resultFieldStatus
+	resultFieldID
+	resultFieldOrientation
+	resultFieldConfidence
+	resultFieldPageConfidence
+	resultFieldOutputs
+	resultFieldPdfaValidation
+	resultFieldPageSources
+	resultFieldOptimization
+	resultFieldDebugBundle
+	resultFieldDebugURL
+	resultFieldCached
+)
+
+func marshalWireResult(e *wireEncoder, ocrResult *OcrResult) {
+	e.string(resultFieldText, ocrResult.Text)
+	e.string(resultFieldStatus, ocrResult.Status)
+	e.string(resultFieldID, ocrResult.ID)
+	for _, orientation := range ocrResult.Orientation {
+		e.message(resultFieldOrientation, func(e *wireEncoder) {
+			e.int(1, int64(orientation.Page))
+			e.int(2, int64(orientation.Orientation))
+			e.int(3, int64(orientation.Rotate))
+			e.double(4, orientation.OrientationConfidence, false)
+			e.string(5, orientation.Script)
+			e.double(6, orientation.ScriptConfidence, false)
+			e.bool(7, orientation.Applied)
+		})
+	}
+	if ocrResult.Confidence != nil {
+		e.double(resultFieldConfidence, *ocrResult.Confidence, true)
+	}
+	for _, page := range ocrResult.PageConfidence {
+		e.message(resultFieldPageConfidence, func(e *wireEncoder) {
+			e.int(1, int64(page.Page))
+			e.double(2, page.Confidence, false)
+			e.int(3, int64(page.Words))
+			e.bool(4, page.LowConfidence)
+		})
+	}
+	for format, output := range ocrResult.Outputs {
+		e.message(resultFieldOutputs, func(e *wireEncoder) {
+			e.string(1, format)
+			e.message(2, func(e *wireEncoder) {
+				e.string(1, output.ContentType)
+				e.string(2, output.Encoding)
+				e.string(3, output.Content)
+			})
+		})
+	}
+	if validation := ocrResult.PdfaValidation; validation != nil {
+		e.message(resultFieldPdfaValidation, func(e *wireEncoder) {
+			e.string(1, validation.Level)
+			e.string(2, validation.Validator)
+			e.bool(3, validation.Compliant)
+			e.string(4, validation.Statement)
+			e.strings(5, validation.Failures)
+		})
+	}
+	for _, source := range ocrResult.PageSources {
+		e.message(resultFieldPageSources, func(e *wireEncoder) {
+			e.int(1, int64(source.Page))
+			e.string(2, source.Source)
+		})
+	}
+	if report := ocrResult.Optimization; report != nil {
+		e.message(resultFieldOptimization, func(e *wireEncoder) {
+			e.string(1, report.Profile)
+			e.int(2, report.InputSize)
+			e.int(3, report.OutputSize)
+			e.double(4, report.CompressionRatio, false)
+		})
+	}
+	e.bytes(resultFieldDebugBundle, ocrResult.DebugBundle)
+	e.string(resultFieldDebugURL, ocrResult.DebugURL)
+	e.bool(resultFieldCached, ocrResult.Cached)
+}
+
+func unmarshalWireResult(b []byte, ocrResult *OcrResult) error {
+	return rangeWireFields(b, func(f wireField) (err error) {
+		switch f.num {
+		case resultFieldText:
+			ocrResult.Text = f.string()
+		case resultFieldStatus:
+			ocrResult.Status = f.string()
+		case resultFieldID:
+			ocrResult.ID = f.string()
+		case resultFieldOrientation:
+			orientation := PageOrientation{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					orientation.Page = f.int()
+				case 2:
+					orientation.Orientation = f.int()
+				case 3:
+					orientation.Rotate = f.int()
+				case 4:
+					orientation.OrientationConfidence = f.double()
+				case 5:
+					orientation.Script = f.string()
+				case 6:
+					orientation.ScriptConfidence = f.double()
+				case 7:
+					orientation.Applied = f.bool()
+				}
+				return nil
+			})
+			ocrResult.Orientation = append(ocrResult.Orientation, orientation)
+		case resultFieldConfidence:
+			confidence := f.double()
+			ocrResult.Confidence = &confidence
+		case resultFieldPageConfidence:
+			page := PageConfidence{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					page.Page = f.int()
+				case 2:
+					page.Confidence = f.double()
+				case 3:
+					page.Words = f.int()
+				case 4:
+					page.LowConfidence = f.bool()
+				}
+				return nil
+			})
+			ocrResult.PageConfidence = append(ocrResult.PageConfidence, page)
+		case resultFieldOutputs:
+			var format string
+			output := OcrOutput{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					format = f.string()
+				case 2:
+					return rangeWireFields(f.b, func(f wireField) error {
+						switch f.num {
+						case 1:
+							output.ContentType = f.string()
+						case 2:
+							output.Encoding = f.string()
+						case 3:
+							output.Content = f.string()
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if ocrResult.Outputs == nil {
+				ocrResult.Outputs = make(map[string]OcrOutput)
+			}
+			ocrResult.Outputs[format] = output
+		case resultFieldPdfaValidation:
+			validation := PdfaValidation{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					validation.Level = f.string()
+				case 2:
+					validation.Validator = f.string()
+				case 3:
+					validation.Compliant = f.bool()
+				case 4:
+					validation.Statement = f.string()
+				case 5:
+					validation.Failures = append(validation.Failures, f.string())
+				}
+				return nil
+			})
+			ocrResult.PdfaValidation = &validation
+		case resultFieldPageSources:
+			source := PageSource{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					source.Page = f.int()
+				case 2:
+					source.Source = f.string()
+				}
+				return nil
+			})
+			ocrResult.PageSources = append(ocrResult.PageSources, source)
+		case resultFieldOptimization:
+			report := OptimizeReport{}
+			err = rangeWireFields(f.b, func(f wireField) error {
+				switch f.num {
+				case 1:
+					report.Profile = f.string()
+				case 2:
+					report.InputSize = int64(f.value)
+				case 3:
+					report.OutputSize = int64(f.value)
+				case 4:
+					report.CompressionRatio = f.double()
+				}
+				return nil
+			})
+			ocrResult.Optimization = &report
+		case resultFieldDebugBundle:
+			ocrResult.DebugBundle = f.bytes()
+		case resultFieldDebugURL:
+			ocrResult.DebugURL = f.string()
+		case resultFieldCached:
+			ocrResult.Cached = f.bool()
+		}
+		return err
+	})
+}
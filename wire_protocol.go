@@ -0,0 +1,213 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// names of the message encodings which can be chosen with the -wire_encoding flag
+const (
+	WireEncodingJSON     = "json"
+	WireEncodingProtobuf = "protobuf"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+	// schemaVersionHeader carries the schema version of the message body in every message
+	schemaVersionHeader = "x-schema-version"
+	// wireSchemaVersion is the newest schema this build understands, see wire_protocol.proto
+	wireSchemaVersion = 2
+	// jsonSchemaVersion is the schema of the JSON messages, they did not change with the protobuf messages of
+	// schema 2, so older services still take them
+	jsonSchemaVersion = 1
+)
+
+// errUnsupportedSchema is returned for messages of a newer schema, they are rejected instead of misparsed
+var errUnsupportedSchema = errors.New("the message has a newer schema version than this service understands")
+
+// field numbers of the WireMessage in wire_protocol.proto, header, payload and attachments are the fields of schema 1
+const (
+	wireFieldSchemaVersion protowire.Number = 1
+	wireFieldHeader        protowire.Number = 2
+	wireFieldPayload       protowire.Number = 3
+	wireFieldAttachments   protowire.Number = 4
+	wireFieldRequest       protowire.Number = 5
+	wireFieldResult        protowire.Number = 6
+)
+
+// wireMessage is the protobuf body of a message, body is the OcrRequest or OcrResult message.
+// A message of schema 1 has the request or result as JSON in header instead, the document or the debug bundle
+// in payload and the inputs of the debug artifacts in attachments.
+type wireMessage struct {
+	schemaVersion uint64
+	body          []byte
+	header        []byte
+	payload       []byte
+	attachments   [][]byte
+}
+
+// unmarshalWireMessage parses a protobuf body, unknown fields are skipped
+func unmarshalWireMessage(b []byte) (wireMessage, error) {
+	m := wireMessage{}
+	err := rangeWireFields(b, func(f wireField) error {
+		switch f.num {
+		case wireFieldSchemaVersion:
+			m.schemaVersion = f.value
+		case wireFieldRequest, wireFieldResult:
+			m.body = f.b
+		case wireFieldHeader:
+			m.header = f.b
+		case wireFieldPayload:
+			m.payload = f.b
+		case wireFieldAttachments:
+			m.attachments = append(m.attachments, f.b)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if m.schemaVersion > wireSchemaVersion {
+		return m, errUnsupportedSchema
+	}
+	return m, nil
+}
+
+// marshalWireMessage wraps the request or result message into the WireMessage of this schema
+func marshalWireMessage(field protowire.Number, marshal func(e *wireEncoder) error) ([]byte, error) {
+	e := wireEncoder{}
+	e.uint(wireFieldSchemaVersion, wireSchemaVersion)
+	var err error
+	e.message(field, func(e *wireEncoder) {
+		err = marshal(e)
+	})
+	return e.b, err
+}
+
+// checkSchemaVersion returns errUnsupportedSchema if the delivery was published with a newer schema.
+// Messages of older services don't have the header, they are of the first schema.
+func checkSchemaVersion(d *amqp.Delivery) error {
+	var version int64
+	switch value := d.Headers[schemaVersionHeader].(type) {
+	case int32:
+		version = int64(value)
+	case int64:
+		version = value
+	case int16:
+		version = int64(value)
+	case uint8:
+		version = int64(value)
+	}
+	if version > wireSchemaVersion {
+		return errUnsupportedSchema
+	}
+	return nil
+}
+
+// wireEncodingOf is the encoding of a delivery, replies and the next hop use the same one
+func wireEncodingOf(d *amqp.Delivery) string {
+	if d.ContentType == contentTypeProtobuf {
+		return WireEncodingProtobuf
+	}
+	return WireEncodingJSON
+}
+
+// contentTypeFor is the content type of messages in the given encoding
+func contentTypeFor(encoding string) string {
+	if encoding == WireEncodingProtobuf {
+		return contentTypeProtobuf
+	}
+	return contentTypeJSON
+}
+
+// withSchemaVersion adds the schema version of a message in the given encoding to its headers
+func withSchemaVersion(headers amqp.Table, encoding string) amqp.Table {
+	headers[schemaVersionHeader] = int32(jsonSchemaVersion)
+	if encoding == WireEncodingProtobuf {
+		headers[schemaVersionHeader] = int32(wireSchemaVersion)
+	}
+	return headers
+}
+
+// encodeOcrRequest marshals the request, with protobuf the document is not base64 encoded
+func encodeOcrRequest(ocrRequest *OcrRequest, encoding string) ([]byte, error) {
+	if encoding != WireEncodingProtobuf {
+		return json.Marshal(ocrRequest)
+	}
+	return marshalWireMessage(wireFieldRequest, func(e *wireEncoder) error {
+		return marshalWireRequest(e, ocrRequest)
+	})
+}
+
+// decodeOcrRequest unmarshals the request of a delivery in either encoding
+func decodeOcrRequest(d *amqp.Delivery) (OcrRequest, error) {
+	ocrRequest := OcrRequest{}
+	if err := checkSchemaVersion(d); err != nil {
+		return ocrRequest, err
+	}
+	if d.ContentType != contentTypeProtobuf {
+		return ocrRequest, json.Unmarshal(d.Body, &ocrRequest)
+	}
+	m, err := unmarshalWireMessage(d.Body)
+	if err != nil {
+		return ocrRequest, err
+	}
+	if m.header == nil {
+		return ocrRequest, unmarshalWireRequest(m.body, &ocrRequest)
+	}
+	if err := json.Unmarshal(m.header, &ocrRequest); err != nil {
+		return ocrRequest, err
+	}
+	if len(m.payload) > 0 {
+		ocrRequest.ImgBytes = m.payload
+	}
+	if len(m.attachments) > len(ocrRequest.DebugArtifacts) {
+		return ocrRequest, fmt.Errorf("the message has %d attachments for %d debug artifacts",
+			len(m.attachments), len(ocrRequest.DebugArtifacts))
+	}
+	for i, attachment := range m.attachments {
+		ocrRequest.DebugArtifacts[i].Input = attachment
+	}
+	return ocrRequest, nil
+}
+
+// encodeOcrResult marshals the result, with protobuf the debug bundle is not base64 encoded
+func encodeOcrResult(ocrResult *OcrResult, encoding string) ([]byte, error) {
+	if encoding != WireEncodingProtobuf {
+		return json.Marshal(ocrResult)
+	}
+	return marshalWireMessage(wireFieldResult, func(e *wireEncoder) error {
+		marshalWireResult(e, ocrResult)
+		return nil
+	})
+}
+
+// decodeOcrResult unmarshals the result of a delivery in either encoding
+func decodeOcrResult(d *amqp.Delivery) (OcrResult, error) {
+	ocrResult := OcrResult{}
+	if err := checkSchemaVersion(d); err != nil {
+		return ocrResult, err
+	}
+	if d.ContentType != contentTypeProtobuf {
+		return ocrResult, json.Unmarshal(d.Body, &ocrResult)
+	}
+	m, err := unmarshalWireMessage(d.Body)
+	if err != nil {
+		return ocrResult, err
+	}
+	if m.header == nil {
+		return ocrResult, unmarshalWireResult(m.body, &ocrResult)
+	}
+	if err := json.Unmarshal(m.header, &ocrResult); err != nil {
+		return ocrResult, err
+	}
+	if len(m.payload) > 0 {
+		ocrResult.DebugBundle = m.payload
+	}
+	return ocrResult, nil
+}
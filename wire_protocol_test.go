@@ -0,0 +1,239 @@
+package ocrworker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/streadway/amqp"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testWireRequest is a request with the fields of all the messages of the wire protocol
+func testWireRequest() OcrRequest {
+	started := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	return OcrRequest{
+		RequestID:         "req1",
+		ImgUrl:            "http://localhost/img",
+		ImgBase64:         "JVBERg==",
+		EngineType:        EngineSandwichTesseract,
+		EngineArgs:        map[string]interface{}{"ocr_type": "txt", "psm": 3.0, "auto_orient": true},
+		PreprocessorChain: []string{"stroke-width-transform", "convert-pdf"},
+		PreprocessorArgs:  map[string]interface{}{"stroke-width-transform": "1"},
+		Outputs:           []string{"txt", "hocr"},
+		ImgBytes:          []byte{0x25, 0x50, 0x44, 0x46, 0x00, 0xff},
+		Deferred:          true,
+		ReplyTo:           "http://localhost/reply",
+		DocType:           "invoice",
+		PageNumber:        2,
+		UserAgent:         "client/1.0",
+		TimeOut:           60,
+		ReferenceID:       "ref1",
+		Title:             "Invoice",
+		InplaceDecode:     true,
+		Debug:             true,
+		ReportProgress:    true,
+		Cache:             "bypass",
+		ImgBlob:           &BlobRef{URI: "file:///tmp/blob", SHA256: "abc", Size: 6},
+		DebugArtifacts: []DebugArtifact{{
+			Preprocessor: "convert-pdf",
+			Input:        []byte("original"),
+			Commands:     []CommandRecord{{Args: []string{"convert", "in"}, ExitCode: -1, Started: started, Duration: 0.5}},
+			ToolVersions: map[string]string{"convert": "6.9"},
+			Started:      started,
+		}},
+	}
+}
+
+func TestWireProtocolRequest(t *testing.T) {
+	ocrRequest := testWireRequest()
+	for _, encoding := range []string{WireEncodingJSON, WireEncodingProtobuf} {
+		body, err := encodeOcrRequest(&ocrRequest, encoding)
+		assert.True(t, err == nil)
+		d := amqp.Delivery{
+			Body:        body,
+			ContentType: contentTypeFor(encoding),
+			Headers:     withSchemaVersion(amqp.Table{}, encoding),
+		}
+		assert.Equals(t, wireEncodingOf(&d), encoding)
+		decoded, err := decodeOcrRequest(&d)
+		assert.True(t, err == nil)
+		assert.DeepEquals(t, decoded, ocrRequest)
+	}
+	// protobuf carries the document as raw bytes
+	body, err := encodeOcrRequest(&ocrRequest, WireEncodingProtobuf)
+	assert.True(t, err == nil)
+	assert.True(t, bytes.Contains(body, ocrRequest.ImgBytes))
+
+	// messages of services without the schema header are json
+	legacy := amqp.Delivery{Body: []byte(`{"req_id":"req2","img_bytes":"JVBERg=="}`), ContentType: "text/plain"}
+	decoded, err := decodeOcrRequest(&legacy)
+	assert.True(t, err == nil)
+	assert.Equals(t, string(decoded.ImgBytes), "%PDF")
+}
+
+// testWireResult is a result with the fields of all the messages of the wire protocol
+func testWireResult() OcrResult {
+	confidence := 0.0
+	return OcrResult{
+		Text:           "text",
+		Status:         "done",
+		ID:             "req1",
+		Orientation:    []PageOrientation{{Page: 1, OsdResult: OsdResult{Orientation: 90, Rotate: 270, OrientationConfidence: 4.5, Script: "Latin", ScriptConfidence: 2.5}, Applied: true}},
+		Confidence:     &confidence,
+		PageConfidence: []PageConfidence{{Page: 1, Confidence: 91.5, Words: 12, LowConfidence: true}},
+		Outputs:        map[string]OcrOutput{"txt": {ContentType: "text/plain", Encoding: "utf-8", Content: "text"}},
+		PdfaValidation: &PdfaValidation{Level: "2b", Validator: "verapdf", Compliant: false, Statement: "not compliant", Failures: []string{"6.1-1: failure"}},
+		PageSources:    []PageSource{{Page: 1, Source: "ocr"}},
+		Optimization:   &OptimizeReport{Profile: "web", InputSize: 100, OutputSize: 50, CompressionRatio: 2},
+		DebugBundle:    []byte("bundle"),
+		DebugURL:       "http://localhost/debug/req1",
+		Cached:         true,
+	}
+}
+
+func TestWireProtocolResult(t *testing.T) {
+	ocrResult := testWireResult()
+	body, err := encodeOcrResult(&ocrResult, WireEncodingProtobuf)
+	assert.True(t, err == nil)
+	d := amqp.Delivery{Body: body, ContentType: contentTypeProtobuf}
+	decoded, err := decodeOcrResult(&d)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, decoded, ocrResult)
+	// a confidence of 0 is still there, no confidence stays unset
+	assert.True(t, decoded.Confidence != nil)
+	body, err = encodeOcrResult(&OcrResult{Text: "text"}, WireEncodingProtobuf)
+	assert.True(t, err == nil)
+	decoded, err = decodeOcrResult(&amqp.Delivery{Body: body, ContentType: contentTypeProtobuf})
+	assert.True(t, err == nil)
+	assert.True(t, decoded.Confidence == nil)
+}
+
+// schema1Message is the envelope of schema 1 with the request or result as JSON
+func schema1Message(header string, payload []byte, attachments ...[]byte) []byte {
+	b := protowire.AppendTag(nil, wireFieldSchemaVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, wireFieldHeader, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte(header))
+	b = protowire.AppendTag(b, wireFieldPayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	for _, attachment := range attachments {
+		b = protowire.AppendTag(b, wireFieldAttachments, protowire.BytesType)
+		b = protowire.AppendBytes(b, attachment)
+	}
+	return b
+}
+
+func TestWireProtocolSchemaVersion(t *testing.T) {
+	// messages of schema 1 are still understood during an upgrade
+	decodedRequest, err := decodeOcrRequest(&amqp.Delivery{ContentType: contentTypeProtobuf,
+		Body: schema1Message(`{"req_id":"req1","debug_artifacts":[{"preprocessor":"convert-pdf"}]}`,
+			[]byte("%PDF"), []byte("original"))})
+	assert.True(t, err == nil)
+	assert.Equals(t, decodedRequest.RequestID, "req1")
+	assert.Equals(t, string(decodedRequest.ImgBytes), "%PDF")
+	assert.Equals(t, string(decodedRequest.DebugArtifacts[0].Input), "original")
+	decoded, err := decodeOcrResult(&amqp.Delivery{Body: schema1Message(`{"text":"text"}`, []byte("bundle")),
+		ContentType: contentTypeProtobuf})
+	assert.True(t, err == nil)
+	assert.Equals(t, decoded.Text, "text")
+	assert.Equals(t, string(decoded.DebugBundle), "bundle")
+
+	// unknown fields of the same schema are skipped
+	body, err := encodeOcrResult(&OcrResult{Text: "text"}, WireEncodingProtobuf)
+	assert.True(t, err == nil)
+	body = protowire.AppendTag(body, 15, protowire.BytesType)
+	body = protowire.AppendBytes(body, []byte("future"))
+	decoded, err = decodeOcrResult(&amqp.Delivery{Body: body, ContentType: contentTypeProtobuf})
+	assert.True(t, err == nil)
+	assert.Equals(t, decoded.Text, "text")
+
+	// json messages announce schema 1, older services take them
+	assert.Equals(t, withSchemaVersion(amqp.Table{}, WireEncodingJSON)[schemaVersionHeader], int32(1))
+
+	// newer schemas are rejected, by the header and by the body
+	newer := amqp.Delivery{Body: []byte(`{}`), ContentType: contentTypeJSON,
+		Headers: amqp.Table{schemaVersionHeader: int32(wireSchemaVersion + 1)}}
+	_, err = decodeOcrRequest(&newer)
+	assert.Equals(t, err, errUnsupportedSchema)
+	body = protowire.AppendTag(nil, wireFieldSchemaVersion, protowire.VarintType)
+	body = protowire.AppendVarint(body, wireSchemaVersion+1)
+	_, err = decodeOcrRequest(&amqp.Delivery{Body: body, ContentType: contentTypeProtobuf})
+	assert.Equals(t, err, errUnsupportedSchema)
+
+	_, err = decodeOcrRequest(&amqp.Delivery{Body: []byte{0xff}, ContentType: contentTypeProtobuf})
+	assert.True(t, err != nil)
+}
+
+// unknownWireFields lists the fields of a message which are not in its descriptor
+func unknownWireFields(m protoreflect.Message) []string {
+	var unknown []string
+	if len(m.GetUnknown()) > 0 {
+		unknown = append(unknown, string(m.Descriptor().FullName()))
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				unknown = append(unknown, unknownWireFields(v.Message())...)
+				return true
+			})
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len(); i++ {
+				unknown = append(unknown, unknownWireFields(v.List().Get(i).Message())...)
+			}
+		case !fd.IsMap() && !fd.IsList() && fd.Message() != nil:
+			unknown = append(unknown, unknownWireFields(v.Message())...)
+		}
+		return true
+	})
+	return unknown
+}
+
+func TestWireProtocolFile(t *testing.T) {
+
+	// the messages are encoded by hand, they have to be the ones of wire_protocol.proto
+	parsed, err := parseProtoFile("wire_protocol.proto")
+	assert.True(t, err == nil)
+	file, err := protodesc.NewFile(parsed, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("wire_protocol.proto: %v", err)
+	}
+	wireMessage := file.Messages().ByName("WireMessage")
+
+	ocrRequest := testWireRequest()
+	ocrResult := testWireResult()
+	for name, encode := range map[string]func() ([]byte, error){
+		"request": func() ([]byte, error) { return encodeOcrRequest(&ocrRequest, WireEncodingProtobuf) },
+		"result":  func() ([]byte, error) { return encodeOcrResult(&ocrResult, WireEncodingProtobuf) },
+	} {
+		body, err := encode()
+		assert.True(t, err == nil)
+		m := dynamicpb.NewMessage(wireMessage)
+		assert.True(t, proto.Unmarshal(body, m) == nil)
+		assert.Equals(t, m.Get(wireMessage.Fields().ByName("schema_version")).Uint(), uint64(wireSchemaVersion))
+		assert.True(t, m.Has(wireMessage.Fields().ByName(protoreflect.Name(name))))
+		assert.DeepEquals(t, unknownWireFields(m), []string(nil))
+
+		// messages written by code generated from the file are read the same way
+		body, err = proto.Marshal(m)
+		assert.True(t, err == nil)
+		d := amqp.Delivery{Body: body, ContentType: contentTypeProtobuf}
+		if name == "request" {
+			decoded, err := decodeOcrRequest(&d)
+			assert.True(t, err == nil)
+			assert.DeepEquals(t, decoded, ocrRequest)
+		} else {
+			decoded, err := decodeOcrResult(&d)
+			assert.True(t, err == nil)
+			assert.DeepEquals(t, decoded, ocrResult)
+		}
+	}
+
+}
@@ -14,19 +14,54 @@ var (
 
 // WorkerConfig will be passed to ocr engines and is used to establish connection to a message  broker
 type WorkerConfig struct {
-	AmqpURI           string
-	Exchange          string
-	ExchangeType      string
-	RoutingKey        string
-	Reliable          bool
-	AmqpAPIURI        string
-	APIPathQueue      string
-	APIQueueName      string
-	APIPathStats      string
-	SaveFiles         bool
-	Debug             bool
-	Tiff2pdfConverter string
-	NumParallelJobs   uint
+	AmqpURI           string `yaml:"amqp_uri" toml:"amqp_uri" config:"secret"`
+	Exchange          string `yaml:"exchange" toml:"exchange"`
+	ExchangeType      string `yaml:"exchange_type" toml:"exchange_type"`
+	RoutingKey        string `yaml:"routing_key" toml:"routing_key"`
+	Reliable          bool   `yaml:"reliable" toml:"reliable"`
+	AmqpAPIURI        string `yaml:"amqpapi_uri" toml:"amqpapi_uri" config:"secret"`
+	APIPathQueue      string `yaml:"api_path_queue" toml:"api_path_queue"`
+	APIQueueName      string `yaml:"api_queue_name" toml:"api_queue_name"`
+	APIPathStats      string `yaml:"api_path_stats" toml:"api_path_stats"`
+	SaveFiles         bool   `yaml:"save_files" toml:"save_files"`
+	Debug             bool   `yaml:"debug" toml:"debug"`
+	Tiff2pdfConverter string `yaml:"image_converter" toml:"image_converter"`
+	NumParallelJobs   uint   `yaml:"num_parallel_jobs" toml:"num_parallel_jobs"`
+	// AnnounceExchange is the fanout exchange on which the worker announces its capabilities
+	AnnounceExchange string `yaml:"announce_exchange" toml:"announce_exchange"`
+	// TraceExporter is empty if tracing is disabled, "stdout" or the url of an OTLP collector
+	TraceExporter string `yaml:"trace_exporter" toml:"trace_exporter"`
+	// HttpPort is the port of the listener serving /metrics, /healthz and /readyz, 0 disables it
+	HttpPort uint `yaml:"http_port" toml:"http_port"`
+	// ShutdownGrace is the number of seconds running jobs may take to finish after SIGTERM
+	// before they are aborted and requeued
+	ShutdownGrace uint `yaml:"shutdown_grace" toml:"shutdown_grace"`
+	// WorkDir is the root of the job directories, os.TempDir()/open-ocr if empty
+	WorkDir string `yaml:"work_dir" toml:"work_dir"`
+	// WorkDirMaxAge is the number of seconds after which the janitor removes a kept job directory, 0 keeps them
+	WorkDirMaxAge uint `yaml:"work_dir_max_age" toml:"work_dir_max_age"`
+	// WorkDirQuotaMB limits the megabytes used by the kept job directories, 0 means no limit
+	WorkDirQuotaMB uint `yaml:"work_dir_quota_mb" toml:"work_dir_quota_mb"`
+	// DebugOnFailure sends a debug bundle for every failed job, not only for debug requests
+	DebugOnFailure bool `yaml:"debug_on_failure" toml:"debug_on_failure"`
+	// DebugBundleMaxMB limits the size of a debug bundle, the files which don't fit are left out
+	DebugBundleMaxMB uint `yaml:"debug_bundle_max_mb" toml:"debug_bundle_max_mb"`
+	// BlobStore is the uri of the store the documents of big requests are fetched from, see NewBlobStore
+	BlobStore string `yaml:"blob_store" toml:"blob_store" config:"secret"`
+	// PdfaIccProfile is the ICC profile of the output intent of PDF/A files, the sRGB profile of ghostscript if empty
+	PdfaIccProfile string `yaml:"pdfa_icc_profile" toml:"pdfa_icc_profile"`
+	// PdfaValidator is the veraPDF command the PDF/A files are validated with, empty disables the validation
+	PdfaValidator string `yaml:"pdfa_validator" toml:"pdfa_validator"`
+	// SignCert and SignKey are the PEM files of the certificate pdfa_signed files are signed with
+	SignCert string `yaml:"sign_cert" toml:"sign_cert"`
+	SignKey  string `yaml:"sign_key" toml:"sign_key"`
+	// SignKeyPass is the passphrase of SignKey, empty if the key is not encrypted
+	SignKeyPass string `yaml:"sign_key_pass" toml:"sign_key_pass" config:"secret"`
+	// OptimizeProfiles are the optimize profiles of the requests by name, they add to the built in ones or replace them
+	OptimizeProfiles map[string]OptimizeProfile `yaml:"optimize_profiles" toml:"optimize_profiles"`
+	// Jbig2Command recompresses the bitonal images of a pdf as JBIG2, it is called with the input and the output pdf.
+	// Requests asking for jbig2 fail if it is empty.
+	Jbig2Command string `yaml:"jbig2_command" toml:"jbig2_command"`
 }
 
 // DefaultWorkerConfig will set the default set of worker parameters which are needed for testing and connecting to a broker
@@ -50,6 +85,12 @@ func DefaultWorkerConfig() WorkerConfig {
 		Debug:             false,
 		Tiff2pdfConverter: "convert",
 		NumParallelJobs:   1,
+		AnnounceExchange:  "open-ocr-workers",
+		HttpPort:          8090,
+		ShutdownGrace:     25,
+		WorkDirMaxAge:     86400,
+		DebugBundleMaxMB:  20,
+		PdfaValidator:     "verapdf",
 	}
 	return workerConfig
 
@@ -68,6 +109,7 @@ func DefaultConfigFlagsWorkerOverride(flagFunction FlagFunctionWorker) (WorkerCo
 	workerConfig := DefaultWorkerConfig()
 
 	flagFunction()
+	configFlags := registerConfigFlags()
 	var (
 		amqpURI           string
 		saveFiles         bool
@@ -75,6 +117,20 @@ func DefaultConfigFlagsWorkerOverride(flagFunction FlagFunctionWorker) (WorkerCo
 		tiff2pdfConverter string
 		flgVersion        bool
 		numParJobs        uint
+		traceExporter     string
+		httpPort          uint
+		shutdownGrace     uint
+		workDir           string
+		workDirMaxAge     uint
+		workDirQuotaMB    uint
+		debugOnFailure    bool
+		debugBundleMaxMB  uint
+		blobStore         string
+		pdfaIccProfile    string
+		pdfaValidator     string
+		signCert          string
+		signKey           string
+		jbig2Command      string
 	)
 	flag.StringVar(
 		&amqpURI,
@@ -108,6 +164,93 @@ func DefaultConfigFlagsWorkerOverride(flagFunction FlagFunctionWorker) (WorkerCo
 		"how many messages will be preloaded from a message broker. Can be used to saturate the load"+
 			" Set the value to 1 for round robbin distribution of messages across workers.",
 	)
+	flag.StringVar(
+		&traceExporter,
+		"trace_exporter",
+		"",
+		"where to export traces to: the url of an OTLP/HTTP collector, e.g. http://localhost:4318, "+
+			"or stdout. Tracing is disabled if empty.",
+	)
+	flag.UintVar(
+		&httpPort,
+		"http_port",
+		8090,
+		"port of the http listener serving /metrics, /healthz and /readyz, 0 disables the listener",
+	)
+	flag.UintVar(
+		&shutdownGrace,
+		"shutdown_grace",
+		25,
+		"seconds the running jobs may take to finish after SIGTERM, afterwards they are aborted and requeued",
+	)
+	flag.StringVar(
+		&workDir,
+		"work_dir",
+		"",
+		"root of the per job working directories, defaults to open-ocr in the temp directory",
+	)
+	flag.UintVar(
+		&workDirMaxAge,
+		"work_dir_max_age",
+		86400,
+		"seconds after which job directories kept by save_files or debug are purged, 0 keeps them",
+	)
+	flag.UintVar(
+		&workDirQuotaMB,
+		"work_dir_quota_mb",
+		0,
+		"megabytes the kept job directories may use, the oldest are purged first. 0 means no limit",
+	)
+	flag.BoolVar(
+		&debugOnFailure,
+		"debug_on_failure",
+		false,
+		"send a debug bundle for every failed job, not only for requests with debug: true",
+	)
+	flag.UintVar(
+		&debugBundleMaxMB,
+		"debug_bundle_max_mb",
+		20,
+		"maximal size of a debug bundle in megabytes, files which don't fit are left out",
+	)
+	flag.StringVar(
+		&blobStore,
+		"blob_store",
+		"",
+		"store the documents of big requests are fetched from, the same as blob_store of cli-httpd",
+	)
+	flag.StringVar(
+		&pdfaIccProfile,
+		"pdfa_icc_profile",
+		"",
+		"ICC profile of the output intent of PDF/A files, defaults to the sRGB profile of ghostscript",
+	)
+	flag.StringVar(
+		&pdfaValidator,
+		"pdfa_validator",
+		"verapdf",
+		"veraPDF command the PDF/A outputs are validated with, empty disables the validation",
+	)
+	flag.StringVar(
+		&signCert,
+		"sign_cert",
+		"",
+		"PEM certificate the pdfa_signed outputs are signed with",
+	)
+	// the passphrase of the key is not a flag, it would show up in the process list
+	flag.StringVar(
+		&signKey,
+		"sign_key",
+		"",
+		"PEM private key of sign_cert, its passphrase is set by sign_key_pass in the config file or the environment",
+	)
+	flag.StringVar(
+		&jbig2Command,
+		"jbig2_command",
+		"",
+		"command which recompresses the bitonal images of a pdf as JBIG2, called with the input and the output pdf. "+
+			"The optimize profiles are set in the config file",
+	)
 
 	flag.BoolVar(
 		&flgVersion,
@@ -121,17 +264,87 @@ func DefaultConfigFlagsWorkerOverride(flagFunction FlagFunctionWorker) (WorkerCo
 		fmt.Printf("version %s. Build on %s from git commit hash %s\n", version, buildTime, sha1ver)
 		os.Exit(0)
 	}
-	if len(amqpURI) > 0 {
+	if err := configFlags.load(&workerConfig); err != nil {
+		return workerConfig, err
+	}
+
+	// only the flags which are set explicitly override the config file and the environment
+	explicit := explicitFlags()
+	if explicit["amqp_uri"] {
 		workerConfig.AmqpURI = amqpURI
 	}
-	if len(tiff2pdfConverter) > 0 {
+	if explicit["image_converter"] {
 		workerConfig.Tiff2pdfConverter = tiff2pdfConverter
-		if tiff2pdfConverter != "convert" && tiff2pdfConverter != "tiff2pdf" {
-			return workerConfig, fmt.Errorf("please choose convert of tiff2pdf as image converter")
+	}
+	if explicit["save_files"] {
+		workerConfig.SaveFiles = saveFiles
+	}
+	if explicit["debug"] {
+		workerConfig.Debug = debug
+	}
+	if explicit["num_parallel_jobs"] {
+		workerConfig.NumParallelJobs = numParJobs
+	}
+	if explicit["trace_exporter"] {
+		workerConfig.TraceExporter = traceExporter
+	}
+	if explicit["http_port"] {
+		workerConfig.HttpPort = httpPort
+	}
+	if explicit["shutdown_grace"] {
+		workerConfig.ShutdownGrace = shutdownGrace
+	}
+	if explicit["work_dir"] {
+		workerConfig.WorkDir = workDir
+	}
+	if explicit["work_dir_max_age"] {
+		workerConfig.WorkDirMaxAge = workDirMaxAge
+	}
+	if explicit["work_dir_quota_mb"] {
+		workerConfig.WorkDirQuotaMB = workDirQuotaMB
+	}
+	if explicit["debug_on_failure"] {
+		workerConfig.DebugOnFailure = debugOnFailure
+	}
+	if explicit["debug_bundle_max_mb"] {
+		workerConfig.DebugBundleMaxMB = debugBundleMaxMB
+	}
+	if explicit["blob_store"] {
+		workerConfig.BlobStore = blobStore
+	}
+	if explicit["pdfa_icc_profile"] {
+		workerConfig.PdfaIccProfile = pdfaIccProfile
+	}
+	if explicit["pdfa_validator"] {
+		workerConfig.PdfaValidator = pdfaValidator
+	}
+	if explicit["sign_cert"] {
+		workerConfig.SignCert = signCert
+	}
+	if explicit["sign_key"] {
+		workerConfig.SignKey = signKey
+	}
+	if explicit["jbig2_command"] {
+		workerConfig.Jbig2Command = jbig2Command
+	}
+
+	if workerConfig.Tiff2pdfConverter != "convert" && workerConfig.Tiff2pdfConverter != "tiff2pdf" {
+		return workerConfig, fmt.Errorf("please choose convert of tiff2pdf as image converter")
+	}
+	if _, err := NewBlobStore(workerConfig.BlobStore); err != nil {
+		return workerConfig, err
+	}
+	if (workerConfig.SignCert == "") != (workerConfig.SignKey == "") {
+		return workerConfig, fmt.Errorf("sign_cert and sign_key must be set together")
+	}
+	if err := validateOptimizeProfiles(workerConfig.OptimizeProfiles, workerConfig.Jbig2Command); err != nil {
+		return workerConfig, err
+	}
+	if configFlags.printConfig {
+		if err := printConfig(os.Stdout, &workerConfig); err != nil {
+			return workerConfig, err
 		}
+		os.Exit(0)
 	}
-	workerConfig.SaveFiles = saveFiles
-	workerConfig.Debug = debug
-	workerConfig.NumParallelJobs = numParJobs
 	return workerConfig, nil
 }
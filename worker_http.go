@@ -0,0 +1,67 @@
+package ocrworker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// workerNotReady is nil as long as the worker of this process is consuming from its queue,
+	// otherwise it holds the reason why it is not
+	workerNotReady   = errors.New("not connected to the message broker yet")
+	workerNotReadyMu sync.Mutex
+)
+
+// setWorkerReady marks the worker as ready if notReady is nil
+func setWorkerReady(notReady error) {
+	workerNotReadyMu.Lock()
+	workerNotReady = notReady
+	workerNotReadyMu.Unlock()
+}
+
+func workerReadiness() error {
+	workerNotReadyMu.Lock()
+	defer workerNotReadyMu.Unlock()
+	return workerNotReady
+}
+
+// NewWorkerHttpServer creates the http listener of cli-worker and cli-preprocessor which serves
+// /metrics for prometheus, /healthz (the process is alive) and /readyz (the worker is consuming)
+func NewWorkerHttpServer(port uint) *http.Server {
+	mux := &http.ServeMux{}
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := workerReadiness(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		Handler:           mux,
+	}
+}
+
+// ServeWorkerHttp runs the http listener of a worker, nothing is served if port is 0
+func ServeWorkerHttp(port uint) {
+	if port == 0 {
+		return
+	}
+	log.Info().Str("component", "WORKER_HTTP").Uint("port", port).Msg("serving /metrics, /healthz and /readyz")
+	if err := NewWorkerHttpServer(port).ListenAndServe(); err != nil {
+		log.Fatal().Err(err).Str("component", "WORKER_HTTP").Msg("worker http listener has failed to start")
+	}
+}
@@ -0,0 +1,416 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// WorkerAnnouncement is the heartbeat which is published periodically by every ocr worker
+// to advertise its capabilities and what it is processing right now
+type WorkerAnnouncement struct {
+	Tag       string    `json:"tag"`
+	Hostname  string    `json:"hostname"`
+	Version   string    `json:"version"`
+	Engines   []string  `json:"engines"`
+	Languages []string  `json:"languages"`
+	Scripts   []string  `json:"scripts"`
+	Started   time.Time `json:"started"`
+	Time      time.Time `json:"time"`
+	// RequestIDs are the requests the worker is processing at the time of the heartbeat
+	RequestIDs      []string `json:"request_ids"`
+	NumParallelJobs uint     `json:"num_parallel_jobs"`
+	// LoadAverage is the 1 minute load average of the host, 0 if unknown
+	LoadAverage float64 `json:"load_average"`
+	// LastSeen is set by the registry of the http daemon when the heartbeat arrives
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ReplicaAnnouncement is the heartbeat which is published periodically by every http daemon, the replicas
+// add up the jobs they are waiting for to decide on admission by the outstanding work of all of them
+type ReplicaAnnouncement struct {
+	Tag             string    `json:"tag"`
+	Hostname        string    `json:"hostname"`
+	Time            time.Time `json:"time"`
+	AwaitingResults int64     `json:"awaiting_results"`
+}
+
+// replicaAnnouncementType is the type of the messages of the http daemons on the announce exchange,
+// the messages of the workers have no type
+const replicaAnnouncementType = "replica"
+
+var (
+	// announceInterval is the interval in which workers publish their heartbeat,
+	// a worker is considered to be gone after three missed heartbeats
+	announceInterval = 10 * time.Second
+
+	workerRegistryMu sync.RWMutex
+	workerRegistry   = make(map[string]workerRegistryEntry)
+	// replicaRegistry holds the last heartbeat of every http daemon by tag
+	replicaRegistry = make(map[string]ReplicaAnnouncement)
+
+	runningRequestsMu sync.Mutex
+	// runningRequests are the requests which are processed by the worker of this process
+	runningRequests = make(map[string]time.Time)
+
+	// engineCommands are the external commands every engine needs
+	engineCommands = map[OcrEngineType][]string{
+		EngineMock:              {},
+		EngineTesseract:         {"tesseract"},
+		EngineSandwichTesseract: {"tesseract", "gs", "pdftk", "pdftotext"},
+	}
+)
+
+type workerRegistryEntry struct {
+	announcement WorkerAnnouncement
+	lastSeen     time.Time
+}
+
+func declareAnnounceExchange(channel *amqp.Channel, exchange string) error {
+	return channel.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // noWait
+		nil,      // arguments
+	)
+}
+
+// trackRunningRequest adds the request to the heartbeat of this worker until the returned function is called
+func trackRunningRequest(requestID string) func() {
+	runningRequestsMu.Lock()
+	runningRequests[requestID] = time.Now()
+	runningRequestsMu.Unlock()
+	return func() {
+		runningRequestsMu.Lock()
+		delete(runningRequests, requestID)
+		runningRequestsMu.Unlock()
+	}
+}
+
+func runningRequestIDs() []string {
+	runningRequestsMu.Lock()
+	defer runningRequestsMu.Unlock()
+	requestIDs := make([]string, 0, len(runningRequests))
+	for requestID := range runningRequests {
+		requestIDs = append(requestIDs, requestID)
+	}
+	sort.Strings(requestIDs)
+	return requestIDs
+}
+
+// availableEngines returns the engines whose external commands are installed
+func availableEngines() []string {
+	engines := make([]string, 0, len(engineCommands))
+	for engineType, commands := range engineCommands {
+		available := true
+		for _, command := range commands {
+			if _, err := exec.LookPath(command); err != nil {
+				available = false
+				break
+			}
+		}
+		if available {
+			engines = append(engines, engineType.String())
+		}
+	}
+	sort.Strings(engines)
+	return engines
+}
+
+// loadAverage returns the 1 minute load average of the host or 0 if it is unknown
+func loadAverage() float64 {
+	content, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// announce publishes the heartbeat of this worker until the connection to the broker is closed
+func (w *OcrRpcWorker) announce() {
+	channel, err := w.conn.Channel()
+	if err != nil {
+		log.Warn().Str("component", "OCR_WORKER").Err(err).Str("tag", tag).
+			Msg("unable to open channel for announcements")
+		return
+	}
+	defer channel.Close()
+
+	if err := declareAnnounceExchange(channel, w.workerConfig.AnnounceExchange); err != nil {
+		log.Warn().Str("component", "OCR_WORKER").Err(err).Str("tag", tag).
+			Msg("unable to declare announce exchange")
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	languages, scripts := InstalledTesseractLanguages()
+	engines := availableEngines()
+	started := time.Now()
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		body, err := json.Marshal(WorkerAnnouncement{
+			Tag:             tag,
+			Hostname:        hostname,
+			Version:         version,
+			Engines:         engines,
+			Languages:       languages,
+			Scripts:         scripts,
+			Started:         started,
+			Time:            time.Now(),
+			RequestIDs:      runningRequestIDs(),
+			NumParallelJobs: w.workerConfig.NumParallelJobs,
+			LoadAverage:     loadAverage(),
+		})
+		if err != nil {
+			log.Error().Str("component", "OCR_WORKER").Err(err).Msg("unable to marshal announcement")
+			return
+		}
+		if err := channel.Publish(
+			w.workerConfig.AnnounceExchange, // publish to an exchange
+			"",                              // fanout, no routing key
+			false,                           // mandatory
+			false,                           // immediate
+			amqp.Publishing{
+				Headers:      amqp.Table{},
+				ContentType:  "application/json",
+				Body:         body,
+				DeliveryMode: amqp.Transient,
+				Expiration:   fmt.Sprintf("%d", announceInterval.Milliseconds()),
+			},
+		); err != nil {
+			log.Info().Str("component", "OCR_WORKER").Err(err).Str("tag", tag).
+				Msg("stopped announcing, connection is gone")
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// announceReplica publishes the heartbeat of this http daemon until the connection to the broker is closed
+func announceReplica(conn *amqp.Connection, exchange string) {
+	channel, err := conn.Channel()
+	if err != nil {
+		log.Warn().Str("component", "OCR_REGISTRY").Err(err).Msg("unable to open channel for announcements")
+		return
+	}
+	defer channel.Close()
+
+	hostname, _ := os.Hostname()
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		body, err := json.Marshal(ReplicaAnnouncement{
+			Tag:             tag,
+			Hostname:        hostname,
+			Time:            time.Now(),
+			AwaitingResults: atomic.LoadInt64(&awaitingResults),
+		})
+		if err != nil {
+			log.Error().Str("component", "OCR_REGISTRY").Err(err).Msg("unable to marshal announcement")
+			return
+		}
+		if err := channel.Publish(
+			exchange, // publish to an exchange
+			"",       // fanout, no routing key
+			false,    // mandatory
+			false,    // immediate
+			amqp.Publishing{
+				Headers:      amqp.Table{},
+				ContentType:  "application/json",
+				Type:         replicaAnnouncementType,
+				Body:         body,
+				DeliveryMode: amqp.Transient,
+				Expiration:   fmt.Sprintf("%d", announceInterval.Milliseconds()),
+			},
+		); err != nil {
+			log.Info().Str("component", "OCR_REGISTRY").Err(err).Msg("stopped announcing, connection is gone")
+			return
+		}
+		<-ticker.C
+	}
+}
+
+func registerReplicaAnnouncement(announcement ReplicaAnnouncement) {
+	workerRegistryMu.Lock()
+	defer workerRegistryMu.Unlock()
+	// like the workers, replicas are timed out by the arrival of their heartbeats
+	announcement.Time = time.Now()
+	replicaRegistry[announcement.Tag] = announcement
+}
+
+// otherReplicasAwaitingResults adds up the jobs the other live http daemons are waiting for
+// and forgets about the ones which have missed too many announcements
+func otherReplicasAwaitingResults() int64 {
+	workerRegistryMu.Lock()
+	defer workerRegistryMu.Unlock()
+	var awaiting int64
+	for replicaTag, announcement := range replicaRegistry {
+		if time.Since(announcement.Time) > 3*announceInterval {
+			delete(replicaRegistry, replicaTag)
+			continue
+		}
+		if replicaTag != tag {
+			awaiting += announcement.AwaitingResults
+		}
+	}
+	return awaiting
+}
+
+// workersRunningJobs adds up the jobs the live workers are processing, their messages are unacknowledged
+func workersRunningJobs() int {
+	running := 0
+	for _, announcement := range liveWorkerAnnouncements() {
+		running += len(announcement.RequestIDs)
+	}
+	return running
+}
+
+func registerWorkerAnnouncement(announcement WorkerAnnouncement) {
+	announcement.LastSeen = time.Now()
+	workerRegistryMu.Lock()
+	workerRegistry[announcement.Tag] = workerRegistryEntry{announcement: announcement, lastSeen: announcement.LastSeen}
+	workerRegistryMu.Unlock()
+}
+
+// liveWorkerAnnouncements returns the last announcement of every worker which is still alive
+// and forgets about the workers which have missed too many announcements
+func liveWorkerAnnouncements() []WorkerAnnouncement {
+	workerRegistryMu.Lock()
+	defer workerRegistryMu.Unlock()
+	announcements := make([]WorkerAnnouncement, 0, len(workerRegistry))
+	for workerTag, entry := range workerRegistry {
+		if time.Since(entry.lastSeen) > 3*announceInterval {
+			delete(workerRegistry, workerTag)
+			continue
+		}
+		announcements = append(announcements, entry.announcement)
+	}
+	sort.Slice(announcements, func(i, j int) bool { return announcements[i].Tag < announcements[j].Tag })
+	return announcements
+}
+
+// LiveWorkers returns the last heartbeat of every worker which is still alive, ordered by tag
+func LiveWorkers() []WorkerAnnouncement {
+	return liveWorkerAnnouncements()
+}
+
+// AvailableLanguages returns the union of the languages and scripts of all live workers
+func AvailableLanguages() (languages []string, scripts []string, numWorkers int) {
+	languageSet := make(map[string]bool)
+	scriptSet := make(map[string]bool)
+	announcements := liveWorkerAnnouncements()
+	for _, announcement := range announcements {
+		for _, language := range announcement.Languages {
+			languageSet[language] = true
+		}
+		for _, script := range announcement.Scripts {
+			scriptSet[script] = true
+		}
+	}
+	languages = make([]string, 0, len(languageSet))
+	for language := range languageSet {
+		languages = append(languages, language)
+	}
+	scripts = make([]string, 0, len(scriptSet))
+	for script := range scriptSet {
+		scripts = append(scripts, script)
+	}
+	sort.Strings(languages)
+	sort.Strings(scripts)
+	return languages, scripts, len(announcements)
+}
+
+// RunWorkerRegistry will run forever, collect the announcements of the workers and the other http daemons
+// and announce this one
+func RunWorkerRegistry(rabbitConfig *RabbitConfig) {
+	for {
+		err := consumeWorkerAnnouncements(rabbitConfig)
+		log.Warn().Str("component", "OCR_REGISTRY").Err(err).
+			Msg("consuming worker announcements stopped, reconnecting")
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func consumeWorkerAnnouncements(rabbitConfig *RabbitConfig) error {
+	conn, err := amqp.Dial(rabbitConfig.AmqpURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := declareAnnounceExchange(channel, rabbitConfig.AnnounceExchange); err != nil {
+		return err
+	}
+	queue, err := channel.QueueDeclare(
+		"",    // let rabbit generate a name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		return err
+	}
+	if err := channel.QueueBind(queue.Name, "", rabbitConfig.AnnounceExchange, false, nil); err != nil {
+		return err
+	}
+	go announceReplica(conn, rabbitConfig.AnnounceExchange)
+	deliveries, err := channel.Consume(
+		queue.Name, // name
+		"",         // consumerTag
+		true,       // noAck
+		true,       // exclusive
+		false,      // noLocal
+		false,      // noWait
+		nil,        // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("component", "OCR_REGISTRY").Str("exchange", rabbitConfig.AnnounceExchange).
+		Msg("listening for worker announcements")
+	for d := range deliveries {
+		if d.Type == replicaAnnouncementType {
+			replica := ReplicaAnnouncement{}
+			if err := json.Unmarshal(d.Body, &replica); err != nil || replica.Tag == "" {
+				log.Warn().Str("component", "OCR_REGISTRY").Err(err).Msg("ignoring invalid replica announcement")
+				continue
+			}
+			registerReplicaAnnouncement(replica)
+			continue
+		}
+		announcement := WorkerAnnouncement{}
+		if err := json.Unmarshal(d.Body, &announcement); err != nil || announcement.Tag == "" {
+			log.Warn().Str("component", "OCR_REGISTRY").Err(err).Msg("ignoring invalid worker announcement")
+			continue
+		}
+		registerWorkerAnnouncement(announcement)
+	}
+	return fmt.Errorf("deliveries channel closed")
+}
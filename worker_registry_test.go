@@ -0,0 +1,147 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func resetWorkerRegistry() {
+	workerRegistryMu.Lock()
+	workerRegistry = make(map[string]workerRegistryEntry)
+	replicaRegistry = make(map[string]ReplicaAnnouncement)
+	workerRegistryMu.Unlock()
+}
+
+func TestParseTesseractLanguages(t *testing.T) {
+
+	output := "List of available languages in \"/usr/share/tesseract-ocr/4.00/tessdata/\" (5):\n" +
+		"eng\nosd\ndeu\nscript/Latin\nscript/Cyrillic\n"
+	languages, scripts := parseTesseractLanguages(output)
+	assert.Equals(t, len(languages), 3)
+	assert.Equals(t, languages[0], "deu")
+	assert.Equals(t, len(scripts), 2)
+	assert.Equals(t, scripts[0], "Cyrillic")
+
+}
+
+func TestParseOsd(t *testing.T) {
+
+	output := "Page number: 0\nOrientation in degrees: 270\nRotate: 90\n" +
+		"Orientation confidence: 21.27\nScript: Cyrillic\nScript confidence: 4.14\n"
+	osd, err := parseOsd(output)
+	assert.True(t, err == nil)
+	assert.Equals(t, osd.Orientation, 270)
+	assert.Equals(t, osd.Rotate, 90)
+	assert.Equals(t, osd.Script, "Cyrillic")
+
+	_, err = parseOsd("Too few characters. Skipping this page")
+	assert.True(t, err != nil)
+
+	assert.Equals(t, selectLanguageForScript("Cyrillic", []string{"eng", "rus"}, []string{"Latin"}), "rus")
+	assert.Equals(t, selectLanguageForScript("Latin", []string{"eng"}, []string{"Latin"}), "script/Latin")
+	assert.Equals(t, selectLanguageForScript("Thai", []string{"eng"}, nil), "eng")
+
+}
+
+func TestAvailableLanguages(t *testing.T) {
+
+	resetWorkerRegistry()
+	defer resetWorkerRegistry()
+
+	registerWorkerAnnouncement(WorkerAnnouncement{Tag: "a", Languages: []string{"eng", "deu"}, Scripts: []string{"Latin"}})
+	registerWorkerAnnouncement(WorkerAnnouncement{Tag: "b", Languages: []string{"eng", "rus"}})
+	workerRegistryMu.Lock()
+	workerRegistry["gone"] = workerRegistryEntry{
+		announcement: WorkerAnnouncement{Tag: "gone", Languages: []string{"jpn"}},
+		lastSeen:     time.Now().Add(-4 * announceInterval),
+	}
+	workerRegistryMu.Unlock()
+
+	languages, scripts, numWorkers := AvailableLanguages()
+	assert.Equals(t, numWorkers, 2)
+	assert.Equals(t, len(languages), 3)
+	assert.Equals(t, len(scripts), 1)
+
+	rec := httptest.NewRecorder()
+	NewOcrHttpLanguagesHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/languages", nil))
+	assert.Equals(t, rec.Code, 200)
+	response := languagesResponse{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &response) == nil)
+	assert.Equals(t, response.Workers, 2)
+	assert.Equals(t, response.Languages[0], "deu")
+
+	rabbitConfig := rabbitConfigForTests()
+	ocrRequest := OcrRequest{
+		ImgUrl:     "http://localhost/img",
+		EngineType: EngineTesseract,
+		EngineArgs: map[string]interface{}{"lang": "deu+script/Latin"},
+	}
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	ocrRequest.EngineArgs["lang"] = "deu+jpn"
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) != nil)
+	ocrRequest.EngineArgs["lang"] = "auto"
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) == nil)
+	ocrRequest.EngineType = EngineSandwichTesseract
+	ocrRequest.EngineArgs["ocr_type"] = "txt"
+	assert.True(t, ValidateOcrRequest(&ocrRequest, &rabbitConfig) != nil)
+
+}
+
+func TestWorkerHeartbeats(t *testing.T) {
+
+	resetWorkerRegistry()
+	defer resetWorkerRegistry()
+
+	untrack := trackRunningRequest("request-b")
+	trackRunningRequest("request-a")()
+	assert.Equals(t, strings.Join(runningRequestIDs(), ","), "request-b")
+	untrack()
+	assert.Equals(t, len(runningRequestIDs()), 0)
+	assert.True(t, len(availableEngines()) > 0)
+
+	registerWorkerAnnouncement(WorkerAnnouncement{
+		Tag:             "a",
+		Hostname:        "<ocr-1>",
+		Version:         "1.2.3",
+		Engines:         []string{"ENGINE_MOCK"},
+		RequestIDs:      []string{"request-a", "request-b"},
+		NumParallelJobs: 2,
+	})
+	registerWorkerAnnouncement(WorkerAnnouncement{Tag: "b", Hostname: "ocr-2", NumParallelJobs: 1})
+
+	// the hosts and requests of the workers are shown to admins only
+	rabbitConfig := rabbitConfigForTests()
+	rec := httptest.NewRecorder()
+	NewOcrHttpWorkersHandler(&rabbitConfig).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/workers", nil))
+	assert.Equals(t, rec.Code, http.StatusForbidden)
+	rabbitConfig.AdminToken = "secret"
+	req := httptest.NewRequest("GET", "/admin/workers", nil)
+	req.Header.Set(AdminTokenHeader, "wrong")
+	rec = httptest.NewRecorder()
+	NewOcrHttpWorkersHandler(&rabbitConfig).ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, http.StatusForbidden)
+	req.Header.Set(AdminTokenHeader, "secret")
+	rec = httptest.NewRecorder()
+	NewOcrHttpWorkersHandler(&rabbitConfig).ServeHTTP(rec, req)
+	assert.Equals(t, rec.Code, 200)
+	response := workersResponse{}
+	assert.True(t, json.Unmarshal(rec.Body.Bytes(), &response) == nil)
+	assert.Equals(t, len(response.Workers), 2)
+	assert.Equals(t, response.RunningJobs, 2)
+	assert.Equals(t, response.Workers[0].Hostname, "<ocr-1>")
+	assert.False(t, response.Workers[0].LastSeen.IsZero())
+
+	// the public landing page only shows the numbers
+	landingPage := GenerateLandingPage(false, false, LiveWorkers())
+	assert.True(t, strings.Contains(landingPage, "2 workers are connected, 2 of 3 jobs are running."))
+	assert.False(t, strings.Contains(landingPage, "ocr-1"))
+	assert.False(t, strings.Contains(landingPage, "request-a"))
+	assert.True(t, strings.Contains(GenerateLandingPage(false, false, nil), "No workers are connected."))
+
+}
@@ -0,0 +1,107 @@
+package ocrworker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// exit statuses of cli-worker and cli-preprocessor after SIGTERM, they tell the supervisor what happened
+const (
+	// ExitShutdownClean means that every running job has finished within the grace period
+	ExitShutdownClean = 0
+	// ExitShutdownFailed means that the worker could not be stopped properly
+	ExitShutdownFailed = 1
+	// ExitShutdownRequeued means that running jobs were aborted after the grace period and requeued
+	ExitShutdownRequeued = 3
+)
+
+// ErrJobsRequeued is returned by Shutdown if jobs were still running after the grace period
+var ErrJobsRequeued = errors.New("jobs were aborted after the grace period and requeued")
+
+// ShutdownExitCode maps the result of Shutdown to the exit status of the process
+func ShutdownExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitShutdownClean
+	case errors.Is(err, ErrJobsRequeued):
+		return ExitShutdownRequeued
+	}
+	return ExitShutdownFailed
+}
+
+// jobControl lets a worker abort its running job and reject new deliveries while it is shutting down
+type jobControl struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	stopping bool
+}
+
+// startJob returns the context of a new job, it is cancelled by abort. done must be called when the job has ended.
+func (c *jobControl) startJob(ctx context.Context) (jobCtx context.Context, done func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	return jobCtx, func() {
+		c.mu.Lock()
+		c.cancel = nil
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// stop marks the worker as shutting down, deliveries which arrive from now on are requeued
+func (c *jobControl) stop() {
+	c.mu.Lock()
+	c.stopping = true
+	c.mu.Unlock()
+}
+
+func (c *jobControl) isStopping() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopping
+}
+
+// abort cancels the running job, its external commands are killed
+func (c *jobControl) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// awaitJobs waits up to grace for handleDone, the running job is aborted after grace.
+// It returns ErrJobsRequeued if a job had to be aborted.
+func (c *jobControl) awaitJobs(handleDone <-chan error, grace time.Duration) error {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-handleDone:
+		return nil
+	case <-timer.C:
+	}
+	c.abort()
+	<-handleDone
+	return ErrJobsRequeued
+}
+
+// requeueDelivery gives a message back to the broker, another consumer will process it
+func requeueDelivery(d *amqp.Delivery, component string) {
+	if err := d.Nack(false, true); err != nil {
+		log.Warn().Err(err).Str("component", component).
+			Str("RequestID", d.CorrelationId).
+			Msg("Nack() was not successful, the message is requeued when the connection closes")
+		return
+	}
+	log.Info().Str("component", component).
+		Str("RequestID", d.CorrelationId).
+		Uint64("DeliveryTag", d.DeliveryTag).
+		Msg("message requeued")
+}
@@ -0,0 +1,59 @@
+package ocrworker
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestShutdownExitCode(t *testing.T) {
+	assert.Equals(t, ShutdownExitCode(nil), ExitShutdownClean)
+	assert.Equals(t, ShutdownExitCode(fmt.Errorf("shutdown: %w", ErrJobsRequeued)), ExitShutdownRequeued)
+	assert.Equals(t, ShutdownExitCode(fmt.Errorf("cancel failed")), ExitShutdownFailed)
+}
+
+func TestAwaitJobs(t *testing.T) {
+	// the job finishes within the grace period
+	jobs := jobControl{}
+	handleDone := make(chan error, 1)
+	jobCtx, jobDone := jobs.startJob(context.Background())
+	go func() {
+		jobDone()
+		handleDone <- nil
+	}()
+	assert.Equals(t, jobs.awaitJobs(handleDone, time.Minute), nil)
+
+	// the job is aborted after the grace period
+	jobs = jobControl{}
+	jobs.stop()
+	assert.True(t, jobs.isStopping())
+	handleDone = make(chan error)
+	jobCtx, jobDone = jobs.startJob(context.Background())
+	go func() {
+		<-jobCtx.Done()
+		jobDone()
+		handleDone <- nil
+	}()
+	assert.Equals(t, jobs.awaitJobs(handleDone, 10*time.Millisecond), ErrJobsRequeued)
+	assert.Equals(t, jobCtx.Err(), context.Canceled)
+}
+
+func TestRunCommandKilledOnCancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not installed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := runCommand(ctx, exec.Command("sleep", "10"))
+	assert.True(t, err != nil)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	output, err := runCommand(context.Background(), exec.Command("echo", "ok"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(output), "ok\n")
+}